@@ -12,16 +12,23 @@ log "Building EC2 macOS Init..."
 
 # Get commit date and version tag
 COMMITDATE="$(git show -s --format=%ci HEAD)"
+COMMITSHA="$(git rev-parse HEAD)"
 VERSION="$(git describe --always --tags)"
 
 log "Commit date: ${COMMITDATE}"
+log "Commit: ${COMMITSHA}"
 log "Version: ${VERSION}"
 
+# cgo is required for logging to the unified logging system
 for arch in amd64 arm64; do
     log "Building for darwin/$arch"
-    GOOS=darwin GOARCH="$arch" CGO_ENABLED=0 \
+    case "$arch" in
+        amd64) clang_arch=x86_64 ;;
+        *) clang_arch="$arch" ;;
+    esac
+    GOOS=darwin GOARCH="$arch" CGO_ENABLED=1 CC="clang -arch $clang_arch" \
         go build -trimpath \
-        -ldflags="-s -w -X 'main.CommitDate=${COMMITDATE}' -X 'main.Version=${VERSION}'" \
+        -ldflags="-s -w -X 'main.CommitDate=${COMMITDATE}' -X 'main.CommitSHA=${COMMITSHA}' -X 'main.Version=${VERSION}'" \
         -o "ec2-macos-init_$arch"
 done
 
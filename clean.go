@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/aws/ec2-macos-init/internal/paths"
 	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
@@ -12,15 +14,33 @@ import (
 // clean removes old instance history. It has two options:
 // current - This is the option when -all isn't provided. It only removes the current instance's history.
 // all - When -all is provided, all instance history is removed.
+// In both cases, files left behind by runs are removed too: temporary files, the fatal count file, and the user data
+// scripts and logs kept in the history of other instances. With -dry-run, what would be removed is logged instead.
 func clean(baseDir string, c *ec2macosinit.InitConfig) {
 	// Define flags
 	cleanFlags := flag.NewFlagSet("clean", flag.ExitOnError)
 	cleanAll := cleanFlags.Bool("all", false, "Optional; Remove all instance history.  Default is false.")
+	dryRun := cleanFlags.Bool("dry-run", false, "Optional; Log what would be removed without removing anything.")
+	imdsMock := cleanFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
 
 	// Parse flags
 	err := cleanFlags.Parse(os.Args[2:])
 	if err != nil {
-		c.Log.Fatalf(64, "Unable to parse arguments: %s", err)
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	c.IMDS.MockPath = *imdsMock
+
+	var removed []string
+	remove := func(path string) {
+		removed = append(removed, path)
+		if *dryRun {
+			c.Log.Infof("Would remove %s", path)
+			return
+		}
+		err := os.RemoveAll(path)
+		if err != nil {
+			c.Log.Fatalf(1, "Unable to remove %s: %s", path, err)
+		}
 	}
 
 	// Clean all or clean the current instance
@@ -34,25 +54,37 @@ func clean(baseDir string, c *ec2macosinit.InitConfig) {
 		}
 		for _, d := range dir {
 			// Remove everything
-			err := os.RemoveAll(filepath.Join(historyPath, d.Name()))
-			if err != nil {
-				c.Log.Fatalf(1, "Unable to remove instance history: %s", err)
-			}
+			remove(filepath.Join(historyPath, d.Name()))
 		}
 	} else {
 		c.Log.Infof("Getting current instance ID from IMDS")
 		// Instance ID is needed, run setup
-		err = SetupInstanceID(c)
+		err = SetupInstanceID(context.Background(), c)
 		if err != nil {
-			c.Log.Fatalf(75, "Unable to get instance ID: %s", err)
+			c.Log.Fatalf(exitIMDSUnavailable, "Unable to get instance ID: %s", err)
 		}
 		c.Log.Infof("Removing history for the current instance [%s]", c.IMDS.InstanceID)
 
 		// Remove current instance history
-		err := os.RemoveAll(paths.InstanceHistory(baseDir, c.IMDS.InstanceID))
-		if err != nil {
-			c.Log.Fatalf(1, "Unable to remove instance history: %s", err)
+		remove(paths.InstanceHistory(baseDir, c.IMDS.InstanceID))
+	}
+
+	// Remove anything else left behind by runs, skipping anything in history which has already been removed
+	c.Log.Info("Removing temporary files and user data artifacts")
+	for _, artifact := range ec2macosinit.Artifacts(baseDir) {
+		var inRemoved bool
+		for _, r := range removed {
+			if strings.HasPrefix(artifact, r+string(filepath.Separator)) {
+				inRemoved = true
+			}
+		}
+		if !inRemoved {
+			remove(artifact)
 		}
 	}
+	if *dryRun {
+		c.Log.Info("Dry run complete, nothing was removed")
+		return
+	}
 	c.Log.Info("Clean complete")
 }
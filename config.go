@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// configCommand reads and changes individual values in init.toml. It has two subcommands:
+// get <key> - Print the value of the key, formatted as TOML.
+// set <key> <value> - Set the key to the value, keeping the rest of the file as it is. The change is only written if the
+// updated config is valid.
+func configCommand(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	configFlags := flag.NewFlagSet("config", flag.ExitOnError)
+	configFlags.Usage = func() {
+		fmt.Fprintln(configFlags.Output(), "Usage: ec2-macos-init config get <key>")
+		fmt.Fprintln(configFlags.Output(), "       ec2-macos-init config set <key> <value>")
+		fmt.Fprintln(configFlags.Output(), "Keys are dotted paths with modules addressed by name, such as Module.<name>.SystemConfig.secureSSHDConfig")
+		configFlags.PrintDefaults()
+	}
+
+	// Parse flags
+	err := configFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	args := configFlags.Args()
+	if len(args) < 2 || (args[0] == "get" && len(args) != 2) || (args[0] == "set" && len(args) != 3) ||
+		(args[0] != "get" && args[0] != "set") {
+		configFlags.Usage()
+		os.Exit(2)
+	}
+
+	path := filepath.Join(baseDir, paths.InitTOML)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.Log.Fatalf(exitConfigUnreadable, "Unable to read config file: %s", err)
+	}
+
+	if args[0] == "get" {
+		value, err := ec2macosinit.GetConfigValue(data, args[1])
+		if err != nil {
+			c.Log.Fatalf(exitConfigInvalid, "Unable to get %s: %s", args[1], err)
+		}
+		fmt.Println(value)
+		return
+	}
+
+	updated, err := ec2macosinit.SetConfigValue(data, args[1], args[2])
+	if err != nil {
+		c.Log.Fatalf(exitConfigInvalid, "Unable to set %s: %s", args[1], err)
+	}
+	err = ec2macosinit.ValidateConfigData(updated)
+	if err != nil {
+		c.Log.Fatalf(exitConfigInvalid, "Not setting %s, the config wouldn't be valid: %s", args[1], err)
+	}
+	err = ec2macosinit.WriteConfigData(path, updated)
+	if err != nil {
+		c.Log.Fatalf(exitCommandFailed, "Unable to set %s: %s", args[1], err)
+	}
+	c.Log.Infof("Set %s in %s", args[1], path)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// daemon keeps running and periodically runs the modules with RunEvery set again, for work which needs to be kept up to
+// date after boot such as refreshing SSH keys. When enabled, it also serves the status of the current or last run.
+// Each module first runs RunEvery after the daemon starts, since run has already run it during boot. Modules which are
+// due at the same time are run together in priority order, while holding the run lock so that they don't interleave
+// with a run. Results are logged but aren't written to instance history, so they don't affect the Run type settings of
+// later runs. The daemon exits when it receives SIGTERM or SIGINT.
+func daemon(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	lockTimeout := daemonFlags.Duration("lock-timeout", defaultLockTimeout, "Optional; How long to wait for a run to finish before skipping due modules.")
+	logFormat := daemonFlags.String("log-format", "text", "Optional; Format of log output to stdout, either text or json.")
+	imdsMock := daemonFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
+
+	// Parse flags
+	err := daemonFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		c.Log.JSON = true
+	default:
+		c.Log.Fatalf(exitUsage, "Unknown log format %q, must be text or json", *logFormat)
+	}
+	c.IMDS.MockPath = *imdsMock
+
+	// Read and validate init config
+	err = c.ReadConfig(filepath.Join(baseDir, paths.InitTOML))
+	if err != nil {
+		c.Log.Fatalf(exitConfigUnreadable, "Error while reading init config file: %s", err)
+	}
+	err = c.ValidateAndIdentify()
+	if err != nil {
+		c.Log.Fatalf(exitConfigInvalid, "Error found during init config validation: %s", err)
+	}
+	err = c.PrioritizeModules()
+	if err != nil {
+		c.Log.Fatalf(exitInternal, "Error preparing and identifying modules: %s", err)
+	}
+
+	// Exiting successfully keeps launchd from restarting the daemon when there's nothing for it to do
+	modules := c.ScheduledModules()
+	if len(modules) == 0 && !c.Status.Enabled {
+		c.Log.Info("No modules have RunEvery set and the status server isn't enabled, exiting")
+		return
+	}
+
+	if c.Status.Enabled {
+		stop, err := c.ServeStatus()
+		if err != nil {
+			c.Log.Fatalf(exitInternal, "Unable to start status server: %s", err)
+		}
+		defer stop()
+		c.Log.Info("Serving run status")
+	}
+
+	// Stop waiting for IMDS if the daemon is stopped before it's available
+	setupCtx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	c.Log.Info("Fetching instance ID from IMDS...")
+	err = SetupInstanceID(setupCtx, c)
+	cancel()
+	if err != nil {
+		c.Log.Fatalf(exitIMDSUnavailable, "Unable to get instance ID: %s", err)
+	}
+	c.Log.Fields.InstanceID = c.IMDS.InstanceID
+
+	// Schedule the first run of each module
+	next := make(map[*ec2macosinit.Module]time.Time, len(modules))
+	for _, m := range modules {
+		next[m] = time.Now().Add(m.RunEvery)
+		c.Log.Infof("Running module [%s] (type: %s) every %s", m.Name, m.Type, m.RunEvery)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		// Wait until the next module is due, or only for a signal when just serving status
+		var timer *time.Timer
+		var due <-chan time.Time
+		if len(modules) > 0 {
+			timer = time.NewTimer(time.Until(nextDue(modules, next)))
+			due = timer.C
+		}
+		select {
+		case s := <-signals:
+			if timer != nil {
+				timer.Stop()
+			}
+			c.Log.Infof("Received %s, exiting", s)
+			return
+		case <-due:
+		}
+
+		runScheduledModules(baseDir, c, modules, next, *lockTimeout)
+	}
+}
+
+// nextDue returns the time at which the next module is due.
+func nextDue(modules []*ec2macosinit.Module, next map[*ec2macosinit.Module]time.Time) (due time.Time) {
+	due = next[modules[0]]
+	for _, m := range modules[1:] {
+		if next[m].Before(due) {
+			due = next[m]
+		}
+	}
+	return due
+}
+
+// runScheduledModules runs each module which is due and schedules its next run. A module which can't be run because a
+// run is in progress is tried again at its next interval.
+func runScheduledModules(baseDir string, c *ec2macosinit.InitConfig, modules []*ec2macosinit.Module, next map[*ec2macosinit.Module]time.Time, lockTimeout time.Duration) {
+	c.Log.Fields.RunID = ec2macosinit.NewRunID()
+	lock, err := ec2macosinit.AcquireRunLock(filepath.Join(baseDir, paths.RunLock), lockTimeout, func(holder string) {
+		c.Log.Infof("Waiting for run of ec2-macos-init (PID %s) to finish...", holder)
+	})
+	if err != nil {
+		c.Log.Warnf("Skipping due modules: %s", err)
+	} else {
+		defer lock.Release()
+	}
+
+	// Properties such as the public keys may have changed since they were last fetched, and users since they were
+	// last looked up
+	c.IMDS.ClearCache()
+	c.StartUserIDCache()
+
+	now := time.Now()
+	for _, m := range modules {
+		if next[m].After(now) {
+			continue
+		}
+		next[m] = now.Add(m.RunEvery)
+		if lock == nil {
+			continue
+		}
+
+		moduleLog := c.Log.WithModule(m.Name, m.PriorityGroup)
+		moduleLog.Infof("Running module [%s] (type: %s, group: %d)", m.Name, m.Type, m.PriorityGroup)
+		ctx := c.NewModuleContext(moduleLog, baseDir)
+		message, err := runModule(ctx, m)
+		if err != nil {
+			moduleLog.Errorf("Error while running module [%s] (type: %s, group: %d) with message: %s and err: %s", m.Name, m.Type, m.PriorityGroup, message, err)
+			continue
+		}
+		moduleLog.Infof("Successfully completed module [%s] (type: %s, group: %d) with message: %s", m.Name, m.Type, m.PriorityGroup, message)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+	"howett.net/plist"
+)
+
+// doctorCheck is the result of a single installation health check, with a hint on how to fix it when it failed.
+type doctorCheck struct {
+	name   string
+	err    error
+	detail string
+	hint   string
+}
+
+// doctor checks the installation for the most common reasons that ec2-macos-init doesn't run on boot and prints the
+// result of each check, along with how to fix anything which failed. It exits with exitCommandFailed if any check
+// failed.
+func doctor(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	doctorFlags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	imdsMock := doctorFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
+
+	// Parse flags
+	err := doctorFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	c.IMDS.MockPath = *imdsMock
+
+	checks := []doctorCheck{
+		checkLaunchDaemon(),
+		checkBaseDirectory(baseDir),
+		checkConfig(baseDir, c),
+		checkIMDS(c),
+		checkHistory(c),
+	}
+
+	var failed int
+	for _, check := range checks {
+		if check.err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n", check.name, check.err)
+			fmt.Printf("       Fix: %s\n", check.hint)
+			continue
+		}
+		fmt.Printf("[ OK ] %s: %s\n", check.name, check.detail)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		os.Exit(exitCommandFailed)
+	}
+	fmt.Printf("All %d checks passed\n", len(checks))
+}
+
+// checkLaunchDaemon checks that the launchd plist which runs ec2-macos-init on boot is installed, runs a binary which
+// exists, and is loaded.
+func checkLaunchDaemon() (check doctorCheck) {
+	check.name = "launchd job"
+	path := ec2macosinit.LaunchDaemonPlist(ec2macosinit.RunJobLabel)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		check.err = fmt.Errorf("unable to read %s: %s", path, err)
+		check.hint = "Reinstall ec2-macos-init, which installs " + path
+		return check
+	}
+	var v interface{}
+	_, err = plist.Unmarshal(data, &v)
+	job, ok := v.(map[string]interface{})
+	if err != nil || !ok {
+		check.err = fmt.Errorf("%s isn't a valid plist", path)
+		check.hint = "Check it with 'plutil -lint " + path + "' or reinstall ec2-macos-init"
+		return check
+	}
+	args, _ := job["ProgramArguments"].([]interface{})
+	if len(args) == 0 {
+		check.err = fmt.Errorf("%s has no ProgramArguments", path)
+		check.hint = "Reinstall ec2-macos-init to restore " + path
+		return check
+	}
+	program, _ := args[0].(string)
+	info, err := os.Stat(program)
+	if err != nil || info.Mode().Perm()&0111 == 0 {
+		check.err = fmt.Errorf("the program %q in %s isn't an executable file", program, path)
+		check.hint = "Install the ec2-macos-init binary at " + program + " or correct ProgramArguments in " + path
+		return check
+	}
+	if !ec2macosinit.LaunchdJobLoaded(ec2macosinit.RunJobLabel) {
+		check.err = fmt.Errorf("%s isn't loaded", ec2macosinit.RunJobLabel)
+		check.hint = "Run 'sudo launchctl bootstrap system " + path + "' so that it runs on boot"
+		return check
+	}
+	check.detail = fmt.Sprintf("%s is loaded and runs %s", ec2macosinit.RunJobLabel, program)
+	return check
+}
+
+// checkBaseDirectory checks that the base directory is owned by root and can't be written by anyone else, since
+// modules run the commands and scripts configured in it as root.
+func checkBaseDirectory(baseDir string) (check doctorCheck) {
+	check.name = "base directory"
+	info, err := os.Stat(baseDir)
+	if err != nil {
+		check.err = fmt.Errorf("unable to read %s: %s", baseDir, err)
+		check.hint = "Reinstall ec2-macos-init, which creates " + baseDir
+		return check
+	}
+	if !info.IsDir() {
+		check.err = fmt.Errorf("%s isn't a directory", baseDir)
+		check.hint = "Move " + baseDir + " out of the way and reinstall ec2-macos-init"
+		return check
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		check.err = fmt.Errorf("%s is owned by UID %d rather than root", baseDir, stat.Uid)
+		check.hint = "Run 'sudo chown -R root:wheel " + baseDir + "'"
+		return check
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		check.err = fmt.Errorf("%s can be written by users other than root (mode %s)", baseDir, info.Mode().Perm())
+		check.hint = "Run 'sudo chmod go-w " + baseDir + "'"
+		return check
+	}
+	check.detail = fmt.Sprintf("%s is owned by root with mode %s", baseDir, info.Mode().Perm())
+	return check
+}
+
+// checkConfig checks that init.toml can be read and is valid.
+func checkConfig(baseDir string, c *ec2macosinit.InitConfig) (check doctorCheck) {
+	check.name = "init config"
+	path := filepath.Join(baseDir, paths.InitTOML)
+	err := c.ReadConfig(path)
+	if err != nil {
+		check.err = err
+		check.hint = "Correct the TOML syntax in " + path + ", or restore it from the ec2-macos-init package"
+		return check
+	}
+	err = c.ValidateAndIdentify()
+	if err != nil {
+		check.err = err
+		check.hint = "Correct the module named in the error in " + path + ", see the README for the options of each module"
+		return check
+	}
+	check.detail = fmt.Sprintf("%s is valid with %d module(s)", path, len(c.Modules))
+	return check
+}
+
+// checkIMDS checks that the instance ID can be read from IMDS.
+func checkIMDS(c *ec2macosinit.InitConfig) (check doctorCheck) {
+	check.name = "IMDS"
+	err := c.IMDS.UpdateInstanceID()
+	if err != nil {
+		check.err = err
+		check.hint = "Check that this is an EC2 instance with the metadata service enabled (HttpEndpoint) and a hop limit " +
+			"of at least 1, and that no firewall or proxy blocks 169.254.169.254"
+		return check
+	}
+	check.detail = "reachable on instance " + c.IMDS.InstanceID
+	return check
+}
+
+// checkHistory checks that the instance history can be read.
+func checkHistory(c *ec2macosinit.InitConfig) (check doctorCheck) {
+	check.name = "instance history"
+	_, err := os.Stat(c.HistoryPath)
+	if os.IsNotExist(err) {
+		check.detail = c.HistoryPath + " doesn't exist yet, so ec2-macos-init hasn't run on this image"
+		return check
+	}
+	err = c.GetInstanceHistory()
+	if err != nil {
+		check.err = err
+		check.hint = "Run 'sudo ec2-macos-init history migrate' to repair invalid history files, or " +
+			"'sudo ec2-macos-init clean -all' to remove them"
+		return check
+	}
+	check.detail = fmt.Sprintf("read history of %d instance(s)", len(c.InstanceHistory))
+	return check
+}
@@ -0,0 +1,16 @@
+package main
+
+// Exit codes for each class of failure, following sysexits(3) where one fits. Any non-zero exit of run causes launchd
+// to start it again, until the per-boot fatal limit is reached.
+const (
+	exitModuleFatal      = 1  // exitModuleFatal is a failure of a module with FatalOnError set
+	exitUsage            = 64 // exitUsage is invalid command line arguments
+	exitConfigInvalid    = 65 // exitConfigInvalid is an init config which failed validation
+	exitConfigUnreadable = 66 // exitConfigUnreadable is an init config which is missing or can't be decoded
+	exitIMDSUnavailable  = 69 // exitIMDSUnavailable is IMDS not providing an instance ID
+	exitInternal         = 70 // exitInternal is an unexpected internal error
+	exitCommandFailed    = 70 // exitCommandFailed is a command other than run which couldn't do what was asked
+	exitHistoryWrite     = 73 // exitHistoryWrite is instance history which couldn't be written
+	exitHistoryRead      = 74 // exitHistoryRead is instance history which couldn't be read
+	exitLocked           = 75 // exitLocked is another run still in progress after the lock timeout
+)
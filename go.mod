@@ -7,6 +7,9 @@ require (
 	github.com/digineo/go-ping v1.0.1
 	github.com/google/go-cmp v0.5.9
 	github.com/stretchr/testify v1.7.2
+	golang.org/x/sys v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+	howett.net/plist v1.0.0
 )
 
 require (
@@ -14,6 +17,4 @@ require (
 	github.com/digineo/go-logwrap v0.0.0-20181106161722-a178c58ea3f0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// history manages the instance history kept on disk. It has one subcommand:
+// migrate - Upgrade all history files to the current version, repairing any which are empty or invalid.
+func history(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+	historyFlags.Usage = func() {
+		fmt.Fprintln(historyFlags.Output(), "Usage: ec2-macos-init history migrate")
+		historyFlags.PrintDefaults()
+	}
+
+	// Parse flags
+	err := historyFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	if historyFlags.NArg() != 1 || historyFlags.Arg(0) != "migrate" {
+		historyFlags.Usage()
+		os.Exit(2)
+	}
+
+	c.Log.Infof("Migrating instance history in %s", c.HistoryPath)
+	migrations, err := c.MigrateHistory()
+	changed := 0
+	for _, m := range migrations {
+		if m.Skipped != "" {
+			c.Log.Warnf("Skipped history for instance %s: %s", m.InstanceID, m.Skipped)
+			continue
+		}
+		changed++
+		if m.Repaired {
+			c.Log.Warnf("Repaired invalid history for instance %s, recovered %d module histories", m.InstanceID, m.Recovered)
+		} else {
+			c.Log.Infof("Migrated history for instance %s from version %d", m.InstanceID, m.FromVersion)
+		}
+	}
+	if err != nil {
+		c.Log.Fatalf(1, "Unable to migrate instance history: %s", err)
+	}
+	c.Log.Infof("Migration complete, %d history file(s) changed", changed)
+}
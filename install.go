@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// install writes the launchd plist which runs ec2-macos-init on boot, and optionally the plist which keeps the daemon
+// running, pointing at the running binary. Each job is then loaded, replacing it if it's already loaded, unless
+// -no-load is given, such as when preparing an image to be captured.
+func install(c *ec2macosinit.InitConfig) {
+	// Define flags
+	installFlags := flag.NewFlagSet("install", flag.ExitOnError)
+	withDaemon := installFlags.Bool("daemon", false, "Optional; Also install the job which keeps the daemon running.")
+	noLoad := installFlags.Bool("no-load", false, "Optional; Write the plists without loading them, which would start a run now.")
+
+	// Parse flags
+	err := installFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+
+	// The jobs run the binary itself rather than a symlink to it
+	program, err := os.Executable()
+	if err == nil {
+		program, err = filepath.EvalSymlinks(program)
+	}
+	if err != nil {
+		c.Log.Fatalf(exitInternal, "Unable to find the installed binary: %s", err)
+	}
+
+	labels := []string{ec2macosinit.RunJobLabel}
+	if *withDaemon {
+		labels = append(labels, ec2macosinit.DaemonJobLabel)
+	}
+	for _, label := range labels {
+		path := ec2macosinit.LaunchDaemonPlist(label)
+		job, err := ec2macosinit.LaunchDaemonJob(label, program)
+		if err != nil {
+			c.Log.Fatalf(exitInternal, "Unable to install %s: %s", label, err)
+		}
+		err = ec2macosinit.WriteLaunchDaemon(path, job)
+		if err != nil {
+			c.Log.Fatalf(exitCommandFailed, "Unable to install %s: %s", label, err)
+		}
+		c.Log.Infof("Wrote %s to run %s", path, program)
+		if *noLoad {
+			continue
+		}
+
+		// Unload any earlier version of the job so that the new plist is used
+		if ec2macosinit.LaunchdJobLoaded(label) {
+			err = ec2macosinit.BootoutLaunchdJob(label)
+			if err != nil {
+				c.Log.Fatalf(exitCommandFailed, "Unable to replace %s: %s", label, err)
+			}
+		}
+		err = ec2macosinit.BootstrapLaunchdJob(path)
+		if err != nil {
+			c.Log.Fatalf(exitCommandFailed, "Unable to load %s: %s", label, err)
+		}
+		c.Log.Infof("Loaded %s", label)
+	}
+}
+
+// uninstall unloads the launchd jobs installed with ec2-macos-init and removes their plists. The binary, configuration,
+// and instance history are left in place.
+func uninstall(c *ec2macosinit.InitConfig) {
+	// Define flags
+	uninstallFlags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+
+	// Parse flags
+	err := uninstallFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+
+	for _, label := range []string{ec2macosinit.DaemonJobLabel, ec2macosinit.RunJobLabel} {
+		if ec2macosinit.LaunchdJobLoaded(label) {
+			err = ec2macosinit.BootoutLaunchdJob(label)
+			if err != nil {
+				c.Log.Fatalf(exitCommandFailed, "Unable to uninstall %s: %s", label, err)
+			}
+			c.Log.Infof("Unloaded %s", label)
+		}
+
+		path := ec2macosinit.LaunchDaemonPlist(label)
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			c.Log.Fatalf(exitCommandFailed, "Unable to uninstall %s: %s", label, err)
+		}
+		c.Log.Infof("Removed %s", path)
+	}
+}
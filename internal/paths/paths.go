@@ -13,12 +13,26 @@ const (
 	// HistoryJSON is the filename of the per-instance persisted history state,
 	// used to store on disk.
 	HistoryJSON = "history.json"
+	// RunLock is the filename of the lock held while a run is in progress.
+	RunLock = "run.lock"
+	// FatalCounts is the filename of the count of fatal exits during the
+	// current boot.
+	FatalCounts = "fatal-counts.json"
+	// StatusJSON is the filename of the status of the current or last run,
+	// served by the status server.
+	StatusJSON = "status.json"
+	// Snapshots is the filename of the record of snapshots created by
+	// Snapshot modules.
+	Snapshots = "snapshots.json"
 )
 
 const (
 	// instancesHistoryDirname is the name of the directory under which history
 	// files are stored. See path builders below for usages.
 	instancesHistoryDirname = "instances"
+	// backupsDirname is the name of the directory under which backups of
+	// modified system files are stored.
+	backupsDirname = "backups"
 )
 
 // AllInstancesHistory returns the path where all instances' history is,
@@ -32,3 +46,15 @@ func AllInstancesHistory(base string) string {
 func InstanceHistory(base string, instanceID string) string {
 	return filepath.Join(base, instancesHistoryDirname, instanceID)
 }
+
+// Backups returns the path where backups of files modified by modules are
+// kept, relative to given base directory.
+func Backups(base string) string {
+	return filepath.Join(base, backupsDirname)
+}
+
+// ModuleBackups returns the path where backups made by the *specified* module
+// type are kept.
+func ModuleBackups(base string, moduleType string) string {
+	return filepath.Join(base, backupsDirname, moduleType)
+}
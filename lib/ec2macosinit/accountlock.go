@@ -0,0 +1,181 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// pwpolicyPath is the path to the pwpolicy utility
+	pwpolicyPath = "/usr/bin/pwpolicy"
+	// sysadminctlPath is the path to the sysadminctl utility
+	sysadminctlPath = "/usr/sbin/sysadminctl"
+	// lockedShell is the login shell given to locked accounts so that no interactive session can be started
+	lockedShell = "/usr/bin/false"
+	// accountActionDisable prevents the account from authenticating
+	accountActionDisable = "disable"
+	// accountActionLock disables the account and also sets its shell so that key based SSH logins are refused
+	accountActionLock = "lock"
+)
+
+// AccountLock contains the configuration for a single account handled by the AccountLock module.
+type AccountLock struct {
+	User   string `toml:"User"`   // User is the account to disable or lock
+	Action string `toml:"Action"` // Action is either "disable" (default) or "lock"
+}
+
+// AccountLockModule contains all necessary configuration fields for running an AccountLock module.
+type AccountLockModule struct {
+	Accounts     []AccountLock `toml:"Account"`
+	DisableGuest bool          `toml:"DisableGuest"` // DisableGuest turns off the guest account
+}
+
+// Do for the AccountLockModule disables or locks each configured account, and the guest account if requested. Accounts
+// which are already in the desired state, or which don't exist, are left untouched.
+func (c *AccountLockModule) Do(ctx *ModuleContext) (message string, err error) {
+	if len(c.Accounts) == 0 && !c.DisableGuest {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	for _, a := range c.Accounts {
+		accountChanged, err := a.apply(ctx)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to %s account %s: %s", a.action(), a.User, err)
+		}
+		if accountChanged {
+			changed++
+			ctx.Logger.Infof("Applied [%s] to account [%s]", a.action(), a.User)
+		} else {
+			unchanged++
+			ctx.Logger.Infof("Account [%s] already in desired state", a.User)
+		}
+	}
+
+	if c.DisableGuest {
+		guestChanged, err := disableGuestAccount(ctx)
+		if err != nil {
+			return "", err
+		}
+		if guestChanged {
+			changed++
+			ctx.Logger.Info("Disabled the guest account")
+		} else {
+			unchanged++
+			ctx.Logger.Info("Guest account already disabled")
+		}
+	}
+
+	return fmt.Sprintf("successfully processed accounts [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// action returns the configured action, defaulting to disable.
+func (a AccountLock) action() string {
+	if a.Action == "" {
+		return accountActionDisable
+	}
+	return strings.ToLower(a.Action)
+}
+
+// apply disables, and for the lock action also locks, a single account.
+func (a AccountLock) apply(ctx *ModuleContext) (changed bool, err error) {
+	action := a.action()
+	if action != accountActionDisable && action != accountActionLock {
+		return false, fmt.Errorf("unknown action %q, must be %q or %q", a.Action, accountActionDisable, accountActionLock)
+	}
+	if a.User == "" {
+		return false, fmt.Errorf("User must be provided")
+	}
+
+	exists, err := userExists(a.User)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		// Nothing can log in as an account which doesn't exist
+		return false, nil
+	}
+
+	allowed, err := authenticationAllowed(ctx, a.User)
+	if err != nil {
+		return false, err
+	}
+	if allowed {
+		_, err = ctx.executeCommand([]string{pwpolicyPath, "-u", a.User, "-disableuser"}, "", []string{})
+		if err != nil {
+			return false, fmt.Errorf("unable to disable authentication: %s", err)
+		}
+		// Validate new state
+		allowed, err = authenticationAllowed(ctx, a.User)
+		if err != nil {
+			return false, err
+		}
+		if allowed {
+			return false, fmt.Errorf("verification failed, authentication is still allowed")
+		}
+		changed = true
+	}
+
+	if action == accountActionLock {
+		shellChanged, err := setUserAttributes(ctx, a.User, []userAttribute{{"UserShell", lockedShell}})
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || shellChanged > 0
+	}
+
+	return changed, nil
+}
+
+// authenticationAllowed checks if the user may authenticate. pwpolicy prints one of:
+//
+//	User <name> is allowed to authenticate: ...
+//	User <name> is not allowed to authenticate: ...
+func authenticationAllowed(ctx *ModuleContext, username string) (allowed bool, err error) {
+	out, err := ctx.executeCommand([]string{pwpolicyPath, "-u", username, "-authentication-allowed"}, "", []string{})
+	// pwpolicy exits non-zero when authentication isn't allowed, so rely on the output instead
+	output := out.stdout + out.stderr
+	switch {
+	case strings.Contains(output, "is not allowed to authenticate"):
+		return false, nil
+	case strings.Contains(output, "is allowed to authenticate"):
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to check if authentication is allowed: %s", err)
+	}
+	return false, fmt.Errorf("unable to check if authentication is allowed, unexpected output: %s", strings.TrimSpace(output))
+}
+
+// disableGuestAccount turns off the guest account, if enabled. sysadminctl prints its status to stderr, e.g.
+//
+//	2023-01-01 00:00:00.000 sysadminctl[123:456] Guest account disabled.
+func disableGuestAccount(ctx *ModuleContext) (changed bool, err error) {
+	enabled := func() (bool, error) {
+		out, err := ctx.executeCommand([]string{sysadminctlPath, "-guestAccount", "status"}, "", []string{})
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to get guest account status: %s", err)
+		}
+		return strings.Contains(out.stdout+out.stderr, "Guest account enabled"), nil
+	}
+
+	isEnabled, err := enabled()
+	if err != nil || !isEnabled {
+		return false, err
+	}
+	_, err = ctx.executeCommand([]string{sysadminctlPath, "-guestAccount", "off"}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to disable the guest account: %s", err)
+	}
+
+	// Validate new state
+	isEnabled, err = enabled()
+	if err != nil {
+		return false, err
+	}
+	if isEnabled {
+		return false, fmt.Errorf("ec2macosinit: verification failed, guest account is still enabled")
+	}
+
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountLock_apply(t *testing.T) {
+	_, err := AccountLock{User: "build", Action: "delete"}.apply(&ModuleContext{})
+	assert.Error(t, err, "unknown actions must be rejected")
+
+	_, err = AccountLock{Action: accountActionLock}.apply(&ModuleContext{})
+	assert.Error(t, err, "a user must be provided")
+
+	assert.Equal(t, accountActionDisable, AccountLock{User: "build"}.action())
+	assert.Equal(t, accountActionLock, AccountLock{User: "build", Action: "Lock"}.action())
+}
+
+func Test_disableGuestAccount(t *testing.T) {
+	enabled := true
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		if c[len(c)-1] == "off" {
+			enabled = false
+			return commandOutput{}, nil
+		}
+		if enabled {
+			return commandOutput{stderr: "sysadminctl[123:456] Guest account enabled."}, nil
+		}
+		return commandOutput{stderr: "sysadminctl[123:456] Guest account disabled."}, nil
+	}}
+	ctx := &ModuleContext{executor: fake}
+
+	changed, err := disableGuestAccount(ctx)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{
+		sysadminctlPath + " -guestAccount status",
+		sysadminctlPath + " -guestAccount off",
+		sysadminctlPath + " -guestAccount status",
+	}, fake.commands)
+
+	// Already disabled
+	changed, err = disableGuestAccount(ctx)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+}
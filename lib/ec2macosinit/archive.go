@@ -0,0 +1,168 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// archiveMarkerFile records the archive extracted to a destination, so that it isn't extracted again
+	archiveMarkerFile = ".ec2-macos-init-archive.json"
+	// tarPath is the path to bsdtar, which detects the format of tar and zip archives and their compression
+	tarPath = "/usr/bin/tar"
+	// chownPath is the path to chown, used to give extracted files to their owner
+	chownPath = "/usr/sbin/chown"
+)
+
+// archiveMarker is the content of the marker file in a destination.
+type archiveMarker struct {
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveModule contains all necessary configuration fields for running an Archive module.
+type ArchiveModule struct {
+	Source          string `toml:"Source"`          // Source is an absolute path, http(s):// URL, or s3:// URI of the archive
+	Destination     string `toml:"Destination"`     // Destination is the absolute path of the directory to extract to
+	SHA256          string `toml:"SHA256"`          // SHA256 is the expected hex encoded SHA-256 checksum of the archive
+	StripComponents int    `toml:"StripComponents"` // StripComponents removes leading directories from extracted paths
+	Owner           string `toml:"Owner"`           // Owner of the extracted files, default is root
+	Group           string `toml:"Group"`           // Group of the extracted files, default is the owner's primary group
+}
+
+// Do for the ArchiveModule fetches a tar or zip archive and extracts it to the destination, for toolchains which are
+// too large to deliver as packages. The checksum of the archive is recorded in a marker file in the destination once
+// extraction is complete, and an archive which has already been extracted isn't extracted again. With a SHA256, it
+// isn't fetched again either. Files in the destination which aren't in the archive are left alone.
+func (c *ArchiveModule) Do(ctx *ModuleContext) (message string, err error) {
+	if c.Source == "" {
+		return "", fmt.Errorf("ec2macosinit: a Source is required for the archive")
+	}
+	if !filepath.IsAbs(c.Destination) {
+		return "", fmt.Errorf("ec2macosinit: the destination of the archive must be absolute, not %q", c.Destination)
+	}
+	if c.StripComponents < 0 {
+		return "", fmt.Errorf("ec2macosinit: StripComponents must not be negative")
+	}
+	var expected []byte
+	if c.SHA256 != "" {
+		expected, err = hex.DecodeString(c.SHA256)
+		if err != nil || len(expected) != sha256.Size {
+			return "", fmt.Errorf("ec2macosinit: invalid SHA256 %q, expected 64 hex digits", c.SHA256)
+		}
+	}
+	// Ownership is resolved before anything is fetched, so a missing user fails fast
+	var uid, gid int
+	if c.Owner != "" || c.Group != "" {
+		uid, gid, err = (&WriteFile{Owner: c.Owner, Group: c.Group}).ownership(ctx)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: %s", err)
+		}
+	}
+
+	marker := c.readMarker()
+	if expected != nil && marker.SHA256 == hex.EncodeToString(expected) {
+		ctx.Logger.Infof("Archive [%s] already extracted to [%s]", c.Source, c.Destination)
+		return fmt.Sprintf("archive %s already extracted to %s", c.Source, c.Destination), nil
+	}
+
+	archive, sum, cleanup, err := c.fetch(ctx, expected)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to fetch archive %s: %s", c.Source, err)
+	}
+	defer cleanup()
+	if marker.SHA256 == hex.EncodeToString(sum) {
+		ctx.Logger.Infof("Archive [%s] already extracted to [%s]", c.Source, c.Destination)
+		return fmt.Sprintf("archive %s already extracted to %s", c.Source, c.Destination), nil
+	}
+
+	err = os.MkdirAll(c.Destination, 0755)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to create %s: %s", c.Destination, err)
+	}
+	// Files are owned by root, rather than whoever owned them when the archive was made, until they're given to Owner
+	extract := []string{tarPath, "-x", "--no-same-owner", "-f", archive, "-C", c.Destination}
+	if c.StripComponents > 0 {
+		extract = append(extract, "--strip-components", strconv.Itoa(c.StripComponents))
+	}
+	out, err := ctx.executeCommand(extract, "", []string{})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to extract %s to %s: %s %s", c.Source, c.Destination, err, strings.TrimSpace(out.stderr))
+	}
+	if c.Owner != "" || c.Group != "" {
+		out, err = ctx.executeCommand([]string{chownPath, "-R", fmt.Sprintf("%d:%d", uid, gid), c.Destination}, "", []string{})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to change the owner of %s: %s %s", c.Destination, err, strings.TrimSpace(out.stderr))
+		}
+	}
+
+	// The marker is only written once everything else succeeded, so that a failed extraction is tried again
+	data, err := json.Marshal(archiveMarker{Source: c.Source, SHA256: hex.EncodeToString(sum)})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to encode archive marker: %s", err)
+	}
+	err = safeWriteFile(filepath.Join(c.Destination, archiveMarkerFile), data, 0644, -1, -1)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to write archive marker: %s", err)
+	}
+	ctx.Logger.Infof("Extracted archive [%s] to [%s]", c.Source, c.Destination)
+
+	return fmt.Sprintf("successfully extracted archive %s to %s", c.Source, c.Destination), nil
+}
+
+// readMarker reads the marker in the destination, which is empty when there's no valid marker.
+func (c *ArchiveModule) readMarker() (marker archiveMarker) {
+	data, err := os.ReadFile(filepath.Join(c.Destination, archiveMarkerFile))
+	if err != nil {
+		return archiveMarker{}
+	}
+	if json.Unmarshal(data, &marker) != nil {
+		return archiveMarker{}
+	}
+	return marker
+}
+
+// fetch returns the path of the archive and its SHA-256, after checking it against the expected checksum. A local
+// archive is used where it is, while others are downloaded to a temporary directory which cleanup removes.
+func (c *ArchiveModule) fetch(ctx *ModuleContext, expected []byte) (archive string, sum []byte, cleanup func(), err error) {
+	cleanup = func() {}
+	if filepath.IsAbs(c.Source) {
+		sum, err = fileSHA256(c.Source)
+		if err != nil {
+			return "", nil, cleanup, err
+		}
+		if sum == nil {
+			return "", nil, cleanup, fmt.Errorf("%s doesn't exist", c.Source)
+		}
+		if expected != nil && !bytes.Equal(sum, expected) {
+			return "", nil, cleanup, fmt.Errorf("checksum mismatch, expected SHA256 %x but got %x", expected, sum)
+		}
+		return c.Source, sum, cleanup, nil
+	}
+
+	newRequest, err := sourceRequest(ctx, c.Source)
+	if err != nil {
+		return "", nil, cleanup, err
+	}
+	dir, err := os.MkdirTemp("", "ec2-macos-init-archive-")
+	if err != nil {
+		return "", nil, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	tmp, sum, err := downloadFile(newRequest, filepath.Join(dir, "archive"), func(header http.Header, sum []byte) error {
+		return verifyS3Checksum(header, sum, expected)
+	})
+	if err != nil {
+		cleanup()
+		return "", nil, func() {}, err
+	}
+	return tmp, sum, cleanup, nil
+}
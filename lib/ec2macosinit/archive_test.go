@@ -0,0 +1,68 @@
+package ec2macosinit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveModule_Do(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "toolchain.tar.gz")
+	require.NoError(t, os.WriteFile(source, []byte("archive"), 0644))
+	sum := sha256.Sum256([]byte("archive"))
+	destination := filepath.Join(dir, "toolchain")
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	c := &ArchiveModule{Source: source, Destination: destination, StripComponents: 1}
+
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "successfully extracted")
+	assert.Equal(t, []string{tarPath + " -x --no-same-owner -f " + source + " -C " + destination + " --strip-components 1"}, fake.commands)
+	assert.Equal(t, archiveMarker{Source: source, SHA256: hex.EncodeToString(sum[:])}, c.readMarker())
+
+	// The same archive isn't extracted again
+	fake.commands = nil
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "already extracted")
+	assert.Empty(t, fake.commands)
+
+	// A changed archive is extracted again
+	require.NoError(t, os.WriteFile(source, []byte("archive v2"), 0644))
+	_, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Len(t, fake.commands, 1)
+
+	// An archive which doesn't match the SHA256 isn't extracted
+	fake.commands = nil
+	c.SHA256 = hex.EncodeToString(sum[:])
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+	assert.Empty(t, fake.commands)
+}
+
+func TestArchiveModule_Do_failedExtraction(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "toolchain.zip")
+	require.NoError(t, os.WriteFile(source, []byte("archive"), 0644))
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stderr: "tar: Error opening archive"}, assert.AnError
+	}}
+	c := &ArchiveModule{Source: source, Destination: filepath.Join(dir, "toolchain")}
+	_, err := c.Do(&ModuleContext{Logger: &Logger{}, executor: fake})
+	assert.ErrorContains(t, err, "Error opening archive")
+
+	// Without a marker, the archive is extracted on the next run
+	assert.Equal(t, archiveMarker{}, c.readMarker())
+}
@@ -0,0 +1,80 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+)
+
+// tempArtifactPatterns match the files which runs create in the temporary directory, and which are left behind if a
+// run is stopped while using them. sshd_config_fixed.* files were created by earlier versions.
+var tempArtifactPatterns = []string{
+	"sshd_config_fixed.*",
+	"sshd_config_candidate.*",
+	"ssh_config_candidate.*",
+	"ec2-macos-ssh.*.conf",
+	"ec2-macos-init-script-*",
+	"ec2-macos-init-archive-*",
+}
+
+// instanceArtifactPatterns match the user data scripts and their logs kept in the history directory of each instance.
+var instanceArtifactPatterns = []string{
+	"userdata",
+	"userdata.log",
+	"userdata-part-*",
+	userDataOutputFile,
+	userDataCompleteFile,
+	"." + paths.HistoryJSON + ".*",
+}
+
+// Artifacts returns the files left on disk by runs, other than instance history itself: temporary files, the fatal
+// count and run status files, user data scripts and logs in the history of every instance, and any temporary files
+// left by interrupted writes. Removing them, along with instance history, returns the instance to the state it was in
+// before ec2-macos-init first ran.
+func Artifacts(baseDir string) (artifacts []string) {
+	tempDirs := []string{os.TempDir(), "/tmp"}
+	// Root's per-user temporary directory, which is used when TMPDIR is set by launchd
+	out, err := executeCommand([]string{"/usr/bin/getconf", "DARWIN_USER_TEMP_DIR"}, "", []string{})
+	if err == nil && strings.TrimSpace(out.stdout) != "" {
+		tempDirs = append(tempDirs, strings.TrimSpace(out.stdout))
+	}
+	return findArtifacts(baseDir, tempDirs)
+}
+
+// findArtifacts returns the artifacts under the base directory and in the given temporary directories, sorted and
+// without duplicates.
+func findArtifacts(baseDir string, tempDirs []string) (artifacts []string) {
+	found := map[string]struct{}{}
+	add := func(dir string, patterns ...string) {
+		for _, pattern := range patterns {
+			matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+			for _, m := range matches {
+				// Temporary directories may be reached through symlinks, such as /tmp to /private/tmp
+				if resolved, err := filepath.EvalSymlinks(m); err == nil {
+					m = resolved
+				}
+				found[m] = struct{}{}
+			}
+		}
+	}
+
+	for _, dir := range tempDirs {
+		add(dir, tempArtifactPatterns...)
+	}
+	add(baseDir, paths.FatalCounts, "."+paths.FatalCounts+".*", paths.StatusJSON, "."+paths.StatusJSON+".*")
+	instances, _ := os.ReadDir(paths.AllInstancesHistory(baseDir))
+	for _, instance := range instances {
+		if instance.IsDir() {
+			add(paths.InstanceHistory(baseDir, instance.Name()), instanceArtifactPatterns...)
+		}
+	}
+
+	for a := range found {
+		artifacts = append(artifacts, a)
+	}
+	sort.Strings(artifacts)
+	return artifacts
+}
@@ -0,0 +1,50 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_findArtifacts(t *testing.T) {
+	baseDir, tempDir := t.TempDir(), t.TempDir()
+	instance := filepath.Join(baseDir, "instances", "i-0123456789abcdef0")
+	require.NoError(t, os.MkdirAll(instance, 0755))
+	for _, f := range []string{
+		filepath.Join(tempDir, "sshd_config_fixed.123456"),
+		filepath.Join(tempDir, "ec2-macos-init-script-123456"),
+		filepath.Join(tempDir, "unrelated"),
+		filepath.Join(baseDir, "fatal-counts.json"),
+		filepath.Join(baseDir, "init.toml"),
+		filepath.Join(instance, "history.json"),
+		filepath.Join(instance, ".history.json.123456"),
+		filepath.Join(instance, "userdata"),
+		filepath.Join(instance, "userdata.log"),
+		filepath.Join(instance, "userdata-part-001"),
+		filepath.Join(instance, "userdata-part-001.log"),
+		filepath.Join(instance, "userdata-output.log"),
+	} {
+		require.NoError(t, os.WriteFile(f, []byte{}, 0600))
+	}
+
+	// Instance history and configuration aren't artifacts
+	resolved := func(path string) string {
+		p, err := filepath.EvalSymlinks(path)
+		require.NoError(t, err)
+		return p
+	}
+	assert.Equal(t, []string{
+		resolved(filepath.Join(baseDir, "fatal-counts.json")),
+		resolved(filepath.Join(instance, ".history.json.123456")),
+		resolved(filepath.Join(instance, "userdata")),
+		resolved(filepath.Join(instance, "userdata-output.log")),
+		resolved(filepath.Join(instance, "userdata-part-001")),
+		resolved(filepath.Join(instance, "userdata-part-001.log")),
+		resolved(filepath.Join(instance, "userdata.log")),
+		resolved(filepath.Join(tempDir, "ec2-macos-init-script-123456")),
+		resolved(filepath.Join(tempDir, "sshd_config_fixed.123456")),
+	}, findArtifacts(baseDir, []string{tempDir, tempDir}))
+}
@@ -0,0 +1,222 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// awsAPITimeout bounds each AWS API request.
+	awsAPITimeout = 30 * time.Second
+	// awsJSONContentType is the content type used by AWS JSON 1.1 protocol services such as Secrets Manager and SSM.
+	awsJSONContentType = "application/x-amz-json-1.1"
+)
+
+// awsAPIError is an error response returned by an AWS JSON protocol service.
+type awsAPIError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+// Error returns the error type and message.
+func (e *awsAPIError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+// awsDomain returns the DNS suffix for AWS service endpoints in the partition of the given region.
+func awsDomain(region string) string {
+	if strings.HasPrefix(region, "cn-") {
+		return "amazonaws.com.cn"
+	}
+	return "amazonaws.com"
+}
+
+// awsServiceEndpoint returns the regional HTTPS endpoint for an AWS service.
+func awsServiceEndpoint(service, region string) string {
+	return fmt.Sprintf("https://%s.%s.%s/", service, region, awsDomain(region))
+}
+
+// callAWSJSON calls an action on an AWS JSON 1.1 protocol service using the instance profile role credentials. The
+// request body is marshalled from input and, if out is not nil, the response is unmarshalled into out. Server errors
+// and throttling are retried; any other error response is returned as an *awsAPIError.
+func callAWSJSON(ctx *ModuleContext, service, target string, input, out interface{}) (err error) {
+	region, err := ctx.IMDS.getRegion()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to encode %s request: %s", target, err)
+	}
+
+	var body []byte
+	var apiErr *awsAPIError
+	err = Retry(context.Background(), fetchBackoff, func() (err error) {
+		// Credentials are fetched for each attempt so that retries never use expired credentials
+		creds, err := ctx.IMDS.getRoleCredentials()
+		if err != nil {
+			return err
+		}
+		body, apiErr, err = doAWSJSONRequest(awsServiceEndpoint(service, region), service, region, target, payload, creds)
+		if err != nil {
+			return err
+		}
+		if apiErr != nil && (apiErr.StatusCode >= 500 || strings.Contains(apiErr.Type, "Throttling")) {
+			return apiErr
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: %s request failed: %s", target, err)
+	}
+	if apiErr != nil {
+		return apiErr
+	}
+
+	if out != nil {
+		err = json.Unmarshal(body, out)
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to decode %s response: %s", target, err)
+		}
+	}
+
+	return nil
+}
+
+// doAWSJSONRequest signs and sends a single JSON protocol request. Error responses are returned as apiErr, while err
+// is only set for transport failures.
+func doAWSJSONRequest(endpoint, service, region, target string, payload []byte, creds awsCredentials) (body []byte, apiErr *awsAPIError, err error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", awsJSONContentType)
+	req.Header.Set("X-Amz-Target", target)
+	signRequestV4(req, payload, creds, region, service, time.Now())
+
+	client := &http.Client{Timeout: awsAPITimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(io.LimitReader(resp.Body, maxFetchSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return body, nil, nil
+	}
+
+	// Error responses look like {"__type": "ResourceExistsException", "message": "..."}, where the type may be
+	// prefixed with a namespace followed by '#'
+	var e struct {
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+		MessageUpper string `json:"Message"`
+	}
+	_ = json.Unmarshal(body, &e)
+	apiErr = &awsAPIError{StatusCode: resp.StatusCode, Type: e.Type, Message: e.Message}
+	if i := strings.LastIndex(apiErr.Type, "#"); i != -1 {
+		apiErr.Type = apiErr.Type[i+1:]
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = e.MessageUpper
+	}
+	if apiErr.Type == "" {
+		apiErr.Type = resp.Status
+	}
+
+	return nil, apiErr, nil
+}
+
+// awsQueryContentType is the content type used by AWS Query protocol services such as CloudWatch.
+const awsQueryContentType = "application/x-www-form-urlencoded; charset=utf-8"
+
+// callAWSQuery calls an action on an AWS Query protocol service using the instance profile role credentials. Server
+// errors and throttling are retried; any other error response is returned as an *awsAPIError.
+func callAWSQuery(ctx *ModuleContext, service, action, version string, params url.Values) (err error) {
+	region, err := ctx.IMDS.getRegion()
+	if err != nil {
+		return err
+	}
+	form := url.Values{"Action": {action}, "Version": {version}}
+	for k, v := range params {
+		form[k] = v
+	}
+	payload := []byte(form.Encode())
+
+	var apiErr *awsAPIError
+	err = Retry(context.Background(), fetchBackoff, func() (err error) {
+		// Credentials are fetched for each attempt so that retries never use expired credentials
+		creds, err := ctx.IMDS.getRoleCredentials()
+		if err != nil {
+			return err
+		}
+		apiErr, err = doAWSQueryRequest(awsServiceEndpoint(service, region), service, region, payload, creds)
+		if err != nil {
+			return err
+		}
+		if apiErr != nil && (apiErr.StatusCode >= 500 || strings.Contains(apiErr.Type, "Throttling")) {
+			return apiErr
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: %s request failed: %s", action, err)
+	}
+	if apiErr != nil {
+		return apiErr
+	}
+
+	return nil
+}
+
+// doAWSQueryRequest signs and sends a single Query protocol request. Error responses are returned as apiErr, while err
+// is only set for transport failures.
+func doAWSQueryRequest(endpoint, service, region string, payload []byte, creds awsCredentials) (apiErr *awsAPIError, err error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", awsQueryContentType)
+	signRequestV4(req, payload, creds, region, service, time.Now())
+
+	client := &http.Client{Timeout: awsAPITimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+
+	// Error responses look like <ErrorResponse><Error><Code>Throttling</Code><Message>...</Message></Error></ErrorResponse>
+	var e struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+	_ = xml.Unmarshal(body, &e)
+	apiErr = &awsAPIError{StatusCode: resp.StatusCode, Type: e.Code, Message: e.Message}
+	if apiErr.Type == "" {
+		apiErr.Type = resp.Status
+	}
+
+	return apiErr, nil
+}
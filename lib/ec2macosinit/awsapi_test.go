@@ -0,0 +1,70 @@
+package ec2macosinit
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_doAWSJSONRequest(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", Token: "token"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, awsJSONContentType, r.Header.Get("Content-Type"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" Credential=AKIDEXAMPLE/"))
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+		body, _ := io.ReadAll(r.Body)
+		switch r.Header.Get("X-Amz-Target") {
+		case "secretsmanager.CreateSecret":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.secretsmanager#ResourceExistsException","message":"exists"}`))
+		default:
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	body, apiErr, err := doAWSJSONRequest(server.URL, "secretsmanager", "us-east-1", "secretsmanager.PutSecretValue", []byte(`{"a":"b"}`), creds)
+	require.NoError(t, err)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, `{"a":"b"}`, string(body))
+
+	_, apiErr, err = doAWSJSONRequest(server.URL, "secretsmanager", "us-east-1", "secretsmanager.CreateSecret", []byte(`{}`), creds)
+	require.NoError(t, err)
+	require.NotNil(t, apiErr)
+	assert.Equal(t, "ResourceExistsException", apiErr.Type)
+	assert.Equal(t, "exists", apiErr.Message)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func Test_awsServiceEndpoint(t *testing.T) {
+	assert.Equal(t, "https://ssm.us-west-2.amazonaws.com/", awsServiceEndpoint("ssm", "us-west-2"))
+	assert.Equal(t, "https://ssm.cn-north-1.amazonaws.com.cn/", awsServiceEndpoint("ssm", "cn-north-1"))
+}
+
+func Test_doAWSQueryRequest(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, awsQueryContentType, r.Header.Get("Content-Type"))
+		assert.NoError(t, r.ParseForm())
+		if r.PostForm.Get("Namespace") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>MissingParameter</Code><Message>missing</Message></Error></ErrorResponse>`))
+		}
+	}))
+	defer server.Close()
+
+	apiErr, err := doAWSQueryRequest(server.URL, "monitoring", "us-east-1", []byte("Action=PutMetricData&Namespace=Test"), creds)
+	require.NoError(t, err)
+	assert.Nil(t, apiErr)
+
+	apiErr, err = doAWSQueryRequest(server.URL, "monitoring", "us-east-1", []byte("Action=PutMetricData"), creds)
+	require.NoError(t, err)
+	require.NotNil(t, apiErr)
+	assert.Equal(t, "MissingParameter", apiErr.Type)
+	assert.Equal(t, "missing", apiErr.Message)
+}
@@ -0,0 +1,218 @@
+package ec2macosinit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// sigV4Algorithm is the signing algorithm identifier for AWS Signature Version 4.
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// sigV4TimeFormat is the format of the X-Amz-Date header.
+	sigV4TimeFormat = "20060102T150405Z"
+	// sigV4DateFormat is the format of the date in the credential scope.
+	sigV4DateFormat = "20060102"
+	// iamCredentialsEndpoint is the IMDS path listing the instance profile role.
+	iamCredentialsEndpoint = "meta-data/iam/security-credentials/"
+	// credentialsRefreshWindow is how long before they expire that cached role credentials are replaced.
+	credentialsRefreshWindow = 5 * time.Minute
+)
+
+// awsCredentials contains temporary credentials for the instance profile role.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// getRoleCredentials gets temporary credentials for the instance profile role. Credentials are cached and shared by
+// all modules until shortly before they expire, when new credentials are fetched from IMDS.
+func (i *IMDSConfig) getRoleCredentials() (creds awsCredentials, err error) {
+	i.credsMu.Lock()
+	defer i.credsMu.Unlock()
+	if i.creds.AccessKeyID != "" && time.Now().Add(credentialsRefreshWindow).Before(i.creds.Expiration) {
+		return i.creds, nil
+	}
+	creds, err = i.fetchRoleCredentials()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	i.creds = creds
+	return creds, nil
+}
+
+// fetchRoleCredentials fetches temporary credentials for the instance profile role from IMDS.
+func (i *IMDSConfig) fetchRoleCredentials() (creds awsCredentials, err error) {
+	// The listing contains the name of the single role attached to the instance profile
+	role, respCode, err := i.getIMDSProperty(iamCredentialsEndpoint)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: error getting instance profile role from IMDS: %s", err)
+	}
+	if respCode == 404 {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: no instance profile is attached to this instance")
+	}
+	if respCode != 200 {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+
+	body, respCode, err := i.getIMDSProperty(iamCredentialsEndpoint + role)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: error getting credentials for role %s from IMDS: %s", role, err)
+	}
+	if respCode != 200 {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+
+	err = json.Unmarshal([]byte(body), &creds)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: error parsing credentials for role %s: %s", role, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("ec2macosinit: incomplete credentials returned for role %s", role)
+	}
+
+	return creds, nil
+}
+
+// getRegion gets the region the instance is running in from IMDS.
+func (i *IMDSConfig) getRegion() (region string, err error) {
+	region, respCode, err := i.getIMDSProperty("meta-data/placement/region")
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error getting region from IMDS: %s", err)
+	}
+	if respCode != 200 {
+		return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+
+	return strings.TrimSpace(region), nil
+}
+
+// SignAWSRequest signs a request to an AWS service in the instance's region with the instance profile role
+// credentials. The payload must be the exact request body.
+func (m ModuleContext) SignAWSRequest(req *http.Request, payload []byte, service string) (err error) {
+	region, err := m.IMDS.getRegion()
+	if err != nil {
+		return err
+	}
+	creds, err := m.IMDS.getRoleCredentials()
+	if err != nil {
+		return err
+	}
+	signRequestV4(req, payload, creds, region, service, time.Now())
+	return nil
+}
+
+// signRequestV4 signs an HTTP request using AWS Signature Version 4. The payload must be the exact request body.
+// S3 additionally requires the payload hash to be sent in the X-Amz-Content-Sha256 header.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signRequestV4(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(sigV4TimeFormat)
+	scope := strings.Join([]string{now.Format(sigV4DateFormat), region, service, "aws4_request"}, "/")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	// Canonical headers always include the host, followed by every header set on the request
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQueryString(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	// Derive the signing key for this date, region, and service
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(sigV4DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQueryString encodes query parameters sorted by name using RFC 3986 encoding.
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except the RFC 3986 unreserved characters.
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// sha256Hex returns the hex encoded SHA-256 digest of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data using key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package ec2macosinit
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_signRequestV4(t *testing.T) {
+	// The get-vanilla case from the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	assert.NoError(t, err)
+	creds := awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	signRequestV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, "+
+			"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func Test_signRequestV4_S3(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://bucket.s3.us-east-1.amazonaws.com/key", nil)
+	assert.NoError(t, err)
+	signRequestV4(req, nil, awsCredentials{AccessKeyID: "id", SecretAccessKey: "secret", Token: "token"}, "us-east-1", "s3", time.Now())
+
+	assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", req.Header.Get("X-Amz-Content-Sha256"))
+	assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token,")
+}
+
+func Test_canonicalQueryString(t *testing.T) {
+	query := url.Values{"b": {"2", "1"}, "a": {"x y"}, "c~": {"*"}}
+	assert.Equal(t, "a=x%20y&b=1&b=2&c~=%2A", canonicalQueryString(query))
+}
+
+func TestIMDSConfig_getRoleCredentials(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	i, requests := newTestIMDS(t, map[string]string{
+		"meta-data/iam/security-credentials/":     "role\n",
+		"meta-data/iam/security-credentials/role": `{"AccessKeyId": "id", "SecretAccessKey": "secret", "Token": "token", "Expiration": "` + expiration + `"}`,
+	})
+
+	// Credentials are cached until shortly before they expire
+	for n := 0; n < 3; n++ {
+		creds, err := i.getRoleCredentials()
+		assert.NoError(t, err)
+		assert.Equal(t, "id", creds.AccessKeyID)
+	}
+	assert.Equal(t, 1, requests["/meta-data/iam/security-credentials/role"])
+	i.creds.Expiration = time.Now().Add(time.Minute)
+	_, err := i.getRoleCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests["/meta-data/iam/security-credentials/role"])
+
+	// Without an instance profile there are no credentials
+	i, _ = newTestIMDS(t, map[string]string{})
+	_, err = i.getRoleCredentials()
+	assert.EqualError(t, err, "ec2macosinit: no instance profile is attached to this instance")
+}
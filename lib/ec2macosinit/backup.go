@@ -0,0 +1,219 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+)
+
+const (
+	// backupManifestFile is the name of the manifest describing the files in a backup set.
+	backupManifestFile = "manifest.json"
+	// backupSetTimeFormat names backup sets so that they sort chronologically.
+	backupSetTimeFormat = "20060102T150405.000000000Z"
+	// backupSetsRetained is the number of backup sets kept for each module type.
+	backupSetsRetained = 10
+)
+
+// backupEntry records the state of a single file before it was modified.
+type backupEntry struct {
+	Path    string      `json:"path"`
+	Existed bool        `json:"existed"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	Data    string      `json:"data,omitempty"` // Data is the name of the copy within the backup set
+}
+
+// backupManifest lists the files saved in a backup set, in the order they were saved.
+type backupManifest struct {
+	Module  string        `json:"module"`
+	Created time.Time     `json:"created"`
+	Files   []backupEntry `json:"files"`
+}
+
+// fileBackups saves the original state of files before a module modifies them. All files saved during a single module
+// run are kept together in one backup set under the base directory so that they can be rolled back as a unit. The set
+// is only created once the first file is saved. A nil *fileBackups saves nothing.
+type fileBackups struct {
+	sync.Mutex
+	dir      string
+	manifest backupManifest
+	saved    map[string]bool
+}
+
+// newFileBackups creates a backup set for the given module type under baseDir.
+func newFileBackups(baseDir, moduleType string) *fileBackups {
+	now := time.Now().UTC()
+	return &fileBackups{
+		dir:      filepath.Join(paths.ModuleBackups(baseDir, moduleType), now.Format(backupSetTimeFormat)),
+		manifest: backupManifest{Module: moduleType, Created: now},
+		saved:    map[string]bool{},
+	}
+}
+
+// save records the current state of the file at path. Only the first save for each path is kept so that the set always
+// holds the state from before the module ran.
+func (b *fileBackups) save(path string) (err error) {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.saved[path] {
+		return nil
+	}
+
+	entry := backupEntry{Path: path, UID: -1, GID: -1}
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ec2macosinit: unable to back up %s: %s", path, err)
+	}
+
+	err = os.MkdirAll(b.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to create backup directory %s: %s", b.dir, err)
+	}
+
+	if info != nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to back up %s: %s", path, err)
+		}
+		entry.Existed = true
+		entry.Mode = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.UID, entry.GID = int(st.Uid), int(st.Gid)
+		}
+		entry.Data = strconv.Itoa(len(b.manifest.Files))
+		err = safeWrite(filepath.Join(b.dir, entry.Data), data)
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to back up %s: %s", path, err)
+		}
+	}
+
+	b.manifest.Files = append(b.manifest.Files, entry)
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to encode backup manifest: %s", err)
+	}
+	err = safeWrite(filepath.Join(b.dir, backupManifestFile), manifest)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write backup manifest: %s", err)
+	}
+	b.saved[path] = true
+
+	// Only prune once, when the set is first created
+	if len(b.manifest.Files) == 1 {
+		err = pruneBackupSets(filepath.Dir(b.dir), backupSetsRetained)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listBackupSets returns the backup set directories in moduleDir, oldest first.
+func listBackupSets(moduleDir string) (sets []string, err error) {
+	dir, err := os.ReadDir(moduleDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read backups in %s: %s", moduleDir, err)
+	}
+	for _, d := range dir {
+		if d.IsDir() {
+			sets = append(sets, filepath.Join(moduleDir, d.Name()))
+		}
+	}
+	sort.Strings(sets)
+	return sets, nil
+}
+
+// pruneBackupSets removes the oldest backup sets in moduleDir so that at most retain sets remain.
+func pruneBackupSets(moduleDir string, retain int) (err error) {
+	sets, err := listBackupSets(moduleDir)
+	if err != nil {
+		return err
+	}
+	for len(sets) > retain {
+		err = os.RemoveAll(sets[0])
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to remove old backup %s: %s", sets[0], err)
+		}
+		sets = sets[1:]
+	}
+	return nil
+}
+
+// Rollback restores the files saved in the most recent backup set for the given module type and then removes that set,
+// so that repeated rollbacks step further back in time. It returns the paths which were restored.
+func Rollback(baseDir, moduleType string) (restored []string, err error) {
+	// The module type names a directory of the backups, so it mustn't be able to name anything outside of it
+	if moduleType != filepath.Base(moduleType) || moduleType == "." || moduleType == ".." {
+		return nil, fmt.Errorf("ec2macosinit: invalid module type %q", moduleType)
+	}
+	sets, err := listBackupSets(paths.ModuleBackups(baseDir, moduleType))
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("ec2macosinit: no backups found for module type %s", moduleType)
+	}
+	latest := sets[len(sets)-1]
+
+	data, err := os.ReadFile(filepath.Join(latest, backupManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read backup manifest in %s: %s", latest, err)
+	}
+	var manifest backupManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to decode backup manifest in %s: %s", latest, err)
+	}
+
+	for _, entry := range manifest.Files {
+		if !entry.Existed {
+			// The module created this file, so rolling back removes it
+			err = os.Remove(entry.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return restored, fmt.Errorf("ec2macosinit: unable to remove %s: %s", entry.Path, err)
+			}
+			restored = append(restored, entry.Path)
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(latest, entry.Data))
+		if err != nil {
+			return restored, fmt.Errorf("ec2macosinit: unable to read backup of %s: %s", entry.Path, err)
+		}
+		err = os.MkdirAll(filepath.Dir(entry.Path), 0755)
+		if err != nil {
+			return restored, fmt.Errorf("ec2macosinit: unable to create directory for %s: %s", entry.Path, err)
+		}
+		err = safeWriteFile(entry.Path, content, entry.Mode, entry.UID, entry.GID)
+		if err != nil {
+			return restored, fmt.Errorf("ec2macosinit: unable to restore %s: %s", entry.Path, err)
+		}
+		restored = append(restored, entry.Path)
+	}
+
+	err = os.RemoveAll(latest)
+	if err != nil {
+		return restored, fmt.Errorf("ec2macosinit: unable to remove backup %s after restoring it: %s", latest, err)
+	}
+
+	return restored, nil
+}
@@ -0,0 +1,60 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollback(t *testing.T) {
+	baseDir := t.TempDir()
+	filesDir := t.TempDir()
+	existing := filepath.Join(filesDir, "sshd_config")
+	created := filepath.Join(filesDir, "new.conf")
+	require.NoError(t, os.WriteFile(existing, []byte("original\n"), 0640))
+
+	backups := newFileBackups(baseDir, "systemconfig")
+	require.NoError(t, backups.save(existing))
+	require.NoError(t, backups.save(created))
+	require.NoError(t, os.WriteFile(existing, []byte("modified\n"), 0640))
+	// Saving again must keep the original content
+	require.NoError(t, backups.save(existing))
+	require.NoError(t, os.WriteFile(created, []byte("created\n"), 0644))
+
+	restored, err := Rollback(baseDir, "systemconfig")
+	require.NoError(t, err)
+	assert.Equal(t, []string{existing, created}, restored)
+
+	data, err := os.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "original\n", string(data))
+	info, err := os.Stat(existing)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.NoFileExists(t, created)
+
+	// The backup set is consumed by the rollback
+	_, err = Rollback(baseDir, "systemconfig")
+	assert.Error(t, err)
+	// Module types can't reach outside of the backups
+	for _, moduleType := range []string{"", "..", "../../etc", "systemconfig/.."} {
+		_, err = Rollback(baseDir, moduleType)
+		assert.ErrorContains(t, err, "invalid module type", moduleType)
+	}
+}
+
+func Test_pruneBackupSets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20230101T000000.000000000Z", "20230102T000000.000000000Z", "20230103T000000.000000000Z"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0700))
+	}
+
+	require.NoError(t, pruneBackupSets(dir, 2))
+
+	sets, err := listBackupSets(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "20230102T000000.000000000Z"), filepath.Join(dir, "20230103T000000.000000000Z")}, sets)
+}
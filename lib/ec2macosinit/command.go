@@ -2,23 +2,180 @@ package ec2macosinit
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// commandShell is the shell used to run commands when Shell is set.
+const commandShell = "/bin/zsh"
+
+// defaultCommandRetryDelay is the time between attempts of a command when RetryDelaySeconds is unset.
+const defaultCommandRetryDelay = 5 * time.Second
+
 // CommandModule contains contains all necessary configuration fields for running a Command module.
 type CommandModule struct {
-	Cmd             []string `toml:"Cmd"`
-	RunAsUser       string   `toml:"RunAsUser"`
-	EnvironmentVars []string `toml:"EnvironmentVars"`
+	Cmd                 []string `toml:"Cmd"`
+	RunAsUser           string   `toml:"RunAsUser"`
+	EnvironmentVars     []string `toml:"EnvironmentVars"`
+	SensitiveOutput     bool     `toml:"SensitiveOutput"`     // SensitiveOutput redacts stdout and stderr from the module message
+	TimeoutSeconds      int      `toml:"TimeoutSeconds"`      // TimeoutSeconds stops each attempt after this many seconds
+	Retries             int      `toml:"Retries"`             // Retries is the number of times a failed command is run again
+	RetryDelaySeconds   int      `toml:"RetryDelaySeconds"`   // RetryDelaySeconds is the time between attempts
+	SuccessExitCodes    []int    `toml:"SuccessExitCodes"`    // SuccessExitCodes are exit codes treated as success in addition to 0
+	WorkingDirectory    string   `toml:"WorkingDirectory"`    // WorkingDirectory is the directory the command is run from
+	Shell               bool     `toml:"Shell"`               // Shell runs Cmd, a single command line, using zsh -c
+	Stdin               string   `toml:"Stdin"`               // Stdin is passed to the command on standard input
+	StdinFile           string   `toml:"StdinFile"`           // StdinFile is a file whose contents are passed on standard input
+	OutputFile          string   `toml:"OutputFile"`          // OutputFile receives stdout and stderr as the command runs
+	InstanceEnvironment bool     `toml:"InstanceEnvironment"` // InstanceEnvironment adds EC2_* variables describing the instance
+	LogOutput           bool     `toml:"LogOutput"`           // LogOutput logs each line of stdout and stderr as it's written
+
+	InstanceEnvironmentNetwork bool `toml:"InstanceEnvironmentNetwork"` // InstanceEnvironmentNetwork adds the primary interface
+	InstanceEnvironmentTags    bool `toml:"InstanceEnvironmentTags"`    // InstanceEnvironmentTags adds EC2_TAG_<key> variables
 }
 
 // Do for CommandModule runs a command with the values set in the config file.
 func (c *CommandModule) Do(ctx *ModuleContext) (message string, err error) {
-	out, err := executeCommand(c.Cmd, c.RunAsUser, c.EnvironmentVars)
+	opts := commandOptions{
+		RunAsUser: c.RunAsUser,
+		EnvVars:   c.EnvironmentVars,
+		Timeout:   time.Duration(c.TimeoutSeconds) * time.Second,
+		Dir:       c.WorkingDirectory,
+	}
+	opts.Stdin, err = c.stdin()
+	if err != nil {
+		return "", err
+	}
+	if c.LogOutput {
+		if c.SensitiveOutput {
+			return "", fmt.Errorf("ec2macosinit: LogOutput can't be used with SensitiveOutput")
+		}
+		opts.Log = ctx.Logger
+	}
+	if c.InstanceEnvironment {
+		env, err := ctx.IMDS.InstanceEnvironment(c.InstanceEnvironmentNetwork, c.InstanceEnvironmentTags)
+		if err != nil {
+			return "", err
+		}
+		opts.EnvVars = append(env, c.EnvironmentVars...)
+	}
+	if c.OutputFile != "" {
+		f, err := c.openOutputFile(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		opts.Output = f
+	}
+	delay := defaultCommandRetryDelay
+	if c.RetryDelaySeconds > 0 {
+		delay = time.Duration(c.RetryDelaySeconds) * time.Second
+	}
+
+	var out commandOutput
+	var code int
+	for attempt := 1; ; attempt++ {
+		out, err = ctx.runCommand(c.command(), opts)
+		code = exitCode(err)
+		if err != nil && code > 0 && c.successExitCode(code) {
+			err = nil
+		}
+		if err == nil || attempt > c.Retries {
+			break
+		}
+		ctx.Logger.Warnf("Command [%s] failed on attempt %d of %d, retrying in %s: %s", c.Cmd, attempt, c.Retries+1, delay, err)
+		time.Sleep(delay)
+	}
+	if c.SensitiveOutput {
+		out = redactedOutput(out)
+	}
+	if c.OutputFile != "" {
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error executing command [%s] with output written to %s: %s", c.Cmd, c.OutputFile, err)
+		}
+		return fmt.Sprintf("successfully ran command [%s] with exit code %d and output written to %s", c.Cmd, code, c.OutputFile), nil
+	}
 	if err != nil {
 		return "", fmt.Errorf("ec2macosinit: error executing command [%s] with stdout [%s] and stderr [%s]: %s",
 			c.Cmd, strings.TrimSuffix(out.stdout, "\n"), strings.TrimSuffix(out.stderr, "\n"), err)
 	}
+	if code != 0 {
+		return fmt.Sprintf("successfully ran command [%s] with accepted exit code %d, stdout [%s] and stderr [%s]",
+			c.Cmd, code, strings.TrimSuffix(out.stdout, "\n"), strings.TrimSuffix(out.stderr, "\n")), nil
+	}
 	return fmt.Sprintf("successfully ran command [%s] with stdout [%s] and stderr [%s]",
 		c.Cmd, strings.TrimSuffix(out.stdout, "\n"), strings.TrimSuffix(out.stderr, "\n")), nil
 }
+
+// command returns the command to run. With Shell set, Cmd is a single command line run by the shell.
+func (c *CommandModule) command() []string {
+	if !c.Shell || len(c.Cmd) != 1 {
+		return c.Cmd
+	}
+	return []string{commandShell, "-c", c.Cmd[0]}
+}
+
+// stdin returns the input for the command, nil when there is none. The input is read once so that every attempt gets
+// the same input.
+func (c *CommandModule) stdin() (input []byte, err error) {
+	switch {
+	case c.Stdin != "" && c.StdinFile != "":
+		return nil, fmt.Errorf("ec2macosinit: only one of Stdin and StdinFile may be set")
+	case c.StdinFile != "":
+		input, err = os.ReadFile(c.StdinFile)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: unable to read stdin file: %s", err)
+		}
+		return input, nil
+	case c.Stdin != "":
+		return []byte(c.Stdin), nil
+	}
+	return nil, nil
+}
+
+// openOutputFile opens the output file for appending, creating it if needed. When the command runs as another user,
+// that user owns the file.
+func (c *CommandModule) openOutputFile(ctx *ModuleContext) (f *os.File, err error) {
+	err = os.MkdirAll(filepath.Dir(c.OutputFile), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to create directory for output file: %s", err)
+	}
+	f, err = os.OpenFile(c.OutputFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to open output file: %s", err)
+	}
+	if c.RunAsUser != "" {
+		uid, gid, err := ctx.getUIDandGID(c.RunAsUser)
+		if err == nil {
+			err = f.Chown(uid, gid)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("ec2macosinit: unable to set owner of output file: %s", err)
+		}
+	}
+	return f, nil
+}
+
+// successExitCode checks whether a non-zero exit code is treated as success.
+func (c *CommandModule) successExitCode(code int) bool {
+	for _, accepted := range c.SuccessExitCodes {
+		if code == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedOutput replaces any non-empty stdout and stderr of a command.
+func redactedOutput(out commandOutput) commandOutput {
+	if out.stdout != "" {
+		out.stdout = redactedText
+	}
+	if out.stderr != "" {
+		out.stderr = redactedText
+	}
+	return out
+}
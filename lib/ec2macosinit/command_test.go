@@ -0,0 +1,89 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandModule_Do(t *testing.T) {
+	ctx := &ModuleContext{Logger: &Logger{}}
+
+	// Exit codes other than 0 fail unless accepted
+	c := &CommandModule{Cmd: []string{"/bin/sh", "-c", "echo installed; exit 2"}}
+	_, err := c.Do(ctx)
+	assert.Error(t, err)
+
+	c.SuccessExitCodes = []int{2}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully ran command [[/bin/sh -c echo installed; exit 2]] with accepted exit code 2, stdout [installed] and stderr []", message)
+
+	// Commands which run too long are stopped
+	c = &CommandModule{Cmd: []string{"/bin/sh", "-c", "sleep 10"}, TimeoutSeconds: 1}
+	start := time.Now()
+	_, err = c.Do(ctx)
+	assert.ErrorContains(t, err, "timed out after 1s")
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Failed commands are run again, here the command succeeds on its second attempt
+	marker := filepath.Join(t.TempDir(), "marker")
+	c = &CommandModule{Cmd: []string{"/bin/sh", "-c", "test -e " + marker + " || { touch " + marker + "; exit 1; }"}, Retries: 2, RetryDelaySeconds: 1}
+	_, err = c.Do(ctx)
+	assert.NoError(t, err)
+}
+
+func TestCommandModule_command(t *testing.T) {
+	c := &CommandModule{Cmd: []string{"/bin/echo", "a b"}}
+	assert.Equal(t, []string{"/bin/echo", "a b"}, c.command())
+
+	c = &CommandModule{Cmd: []string{`echo "$HOME" | tee /tmp/home`}, Shell: true}
+	assert.Equal(t, []string{"/bin/zsh", "-c", `echo "$HOME" | tee /tmp/home`}, c.command())
+}
+
+func TestCommandModule_Do_workingDirectory(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	c := &CommandModule{Cmd: []string{"/bin/pwd"}, WorkingDirectory: dir}
+	message, err := c.Do(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.Contains(t, message, "stdout ["+dir+"]")
+}
+
+func TestCommandModule_Do_stdin(t *testing.T) {
+	ctx := &ModuleContext{Logger: &Logger{}}
+	c := &CommandModule{Cmd: []string{"/bin/cat"}, Stdin: "accept"}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "stdout [accept]")
+
+	input := filepath.Join(t.TempDir(), "input")
+	require.NoError(t, os.WriteFile(input, []byte("from file\n"), 0600))
+	c = &CommandModule{Cmd: []string{"/bin/cat"}, StdinFile: input}
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "stdout [from file]")
+
+	c.Stdin = "both"
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+}
+
+func TestCommandModule_Do_outputFile(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "logs", "install.log")
+	c := &CommandModule{Cmd: []string{"/bin/sh", "-c", "echo out; echo err >&2"}, OutputFile: output}
+	message, err := c.Do(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.Equal(t, "successfully ran command [[/bin/sh -c echo out; echo err >&2]] with exit code 0 and output written to "+output, message)
+
+	// Output of later runs is appended
+	_, err = c.Do(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "out\nerr\nout\nerr\n", string(data))
+}
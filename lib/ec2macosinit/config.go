@@ -3,6 +3,7 @@ package ec2macosinit
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -18,8 +19,28 @@ type InitConfig struct {
 	Modules           []Module `toml:"Module"`
 	ModulesByPriority [][]Module
 	FatalCounts       FatalCount
+	HistoryRetention  HistoryRetention `toml:"HistoryRetention"`
+	Metrics           MetricsConfig    `toml:"Metrics"`
+	Readiness         ReadinessConfig  `toml:"Readiness"`
+	Update            UpdateConfig     `toml:"Update"`
+	Status            StatusConfig     `toml:"Status"`
+	StatusFile        string
+	runStatus         *runStatus
+	userIDs           *userIDCache
+	executor          commandExecutor
 }
 
+// HistoryRetention limits how much history of previous instances is kept. The current instance's history is always
+// kept. A zero value disables the corresponding limit.
+type HistoryRetention struct {
+	MaxAge       time.Duration `toml:"MaxAge"`       // MaxAge removes history of instances last run longer ago than this
+	MaxInstances int           `toml:"MaxInstances"` // MaxInstances is the number of instances to keep history for
+}
+
+// ConfigSchemaVersion is the version of the init.toml format reported by the version command. It isn't increased as
+// options are added, so the version of ec2-macos-init is what tells which options an installed build supports.
+const ConfigSchemaVersion = 1
+
 // Number of runs resulting in fatal exits in a single boot before giving up
 const PerBootFatalLimit = 100
 
@@ -40,8 +61,60 @@ func (c *InitConfig) ReadConfig(fileLocation string) (err error) {
 	return nil
 }
 
+// ReadModuleFile reads a single module from a TOML file, either as a [[Module]] table copied from init.toml or with
+// the module's options at the top level. The module is identified and validated as it would be in init.toml, except
+// that the Run type and priority group are optional since they don't apply to a module run on its own.
+func ReadModuleFile(fileLocation string) (m Module, err error) {
+	rawModule, err := os.ReadFile(fileLocation)
+	if err != nil {
+		return Module{}, fmt.Errorf("ec2macosinit: error reading module file located at %s: %s", fileLocation, err)
+	}
+
+	var config struct {
+		Modules []Module `toml:"Module"`
+	}
+	_, err = toml.Decode(string(rawModule), &config)
+	if err != nil {
+		return Module{}, fmt.Errorf("ec2macosinit: error decoding module: %s", err)
+	}
+	switch len(config.Modules) {
+	case 0:
+		_, err = toml.Decode(string(rawModule), &m)
+		if err != nil {
+			return Module{}, fmt.Errorf("ec2macosinit: error decoding module: %s", err)
+		}
+	case 1:
+		m = config.Modules[0]
+	default:
+		return Module{}, fmt.Errorf("ec2macosinit: module file must contain a single module, found %d", len(config.Modules))
+	}
+
+	if !m.RunOnce && !m.RunPerBoot && !m.RunPerInstance {
+		m.RunPerBoot = true
+	}
+	if m.PriorityGroup == 0 {
+		m.PriorityGroup = 1
+	}
+	err = m.identifyModule()
+	if err != nil {
+		return Module{}, fmt.Errorf("ec2macosinit: error while identifying module: %s", err)
+	}
+	err = m.validateModule()
+	if err != nil {
+		return Module{}, fmt.Errorf("ec2macosinit: error found in module (type: %s): %s", m.Type, err)
+	}
+
+	return m, nil
+}
+
 // ValidateConfig validates all modules and identifies type.
 func (c *InitConfig) ValidateAndIdentify() (err error) {
+	// Check the IMDS settings
+	err = c.IMDS.validate()
+	if err != nil {
+		return err
+	}
+
 	// Create keySet to store used keys
 	keySet := map[string]struct{}{}
 
@@ -89,6 +162,29 @@ func (c *InitConfig) PrioritizeModules() (err error) {
 	return nil
 }
 
+// HasPreNetworkModules returns whether any module runs in the pre-network phase.
+func (c *InitConfig) HasPreNetworkModules() bool {
+	for _, m := range c.Modules {
+		if m.PreNetwork() {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledModules returns the modules which the daemon runs again on an interval, in priority order. It must be called
+// after PrioritizeModules.
+func (c *InitConfig) ScheduledModules() (modules []*Module) {
+	for i := range c.ModulesByPriority {
+		for j := range c.ModulesByPriority[i] {
+			if c.ModulesByPriority[i][j].RunEvery > 0 {
+				modules = append(modules, &c.ModulesByPriority[i][j])
+			}
+		}
+	}
+	return modules
+}
+
 // RetriesExceeded checks if the number of previous fatal exits exceeds the limit.
 func (c *InitConfig) RetriesExceeded() (exceeded bool, err error) {
 	// Check for the existence of the temporary file and get the current fatal count
@@ -0,0 +1,41 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadModuleFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	// A module copied from init.toml
+	m, err := ReadModuleFile(write("copied.toml", "[[Module]]\n  Name = \"Hello\"\n  PriorityGroup = 3\n  RunOnce = true\n  [Module.Command]\n    Cmd = [\"/bin/echo\", \"hello\"]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "command", m.Type)
+	assert.Equal(t, 3, m.PriorityGroup)
+	assert.True(t, m.RunOnce)
+	assert.Equal(t, []string{"/bin/echo", "hello"}, m.CommandModule.Cmd)
+
+	// A module at the top level, with the Run type and priority group defaulted
+	m, err = ReadModuleFile(write("toplevel.toml", "Name = \"Hello\"\n[Command]\n  Cmd = [\"/bin/echo\", \"hello\"]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "command", m.Type)
+	assert.Equal(t, 1, m.PriorityGroup)
+	assert.True(t, m.RunPerBoot)
+
+	_, err = ReadModuleFile(write("two.toml", "[[Module]]\n  Name = \"A\"\n[[Module]]\n  Name = \"B\"\n"))
+	assert.EqualError(t, err, "ec2macosinit: module file must contain a single module, found 2")
+	_, err = ReadModuleFile(write("untyped.toml", "Name = \"Hello\"\n"))
+	assert.Error(t, err)
+	_, err = ReadModuleFile(filepath.Join(dir, "missing.toml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,272 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config keys address a value in init.toml with a dotted path, such as Metrics.Enabled. Modules are addressed by their
+// name, so the secureSSHDConfig option of the SystemConfig module named Security is Module.Security.SystemConfig.
+// secureSSHDConfig. Values inside arrays of tables, such as SystemConfig.Sysctl, can be read with their array but not
+// set individually.
+
+// tomlHeader matches a table or array of tables header line.
+var tomlHeader = regexp.MustCompile(`^\s*(\[\[?)\s*([^\]]+?)\s*\]\]?\s*(#.*)?$`)
+
+// configKey is a config key split into the table containing the value and the name of the value in that table.
+type configKey struct {
+	module int    // module is the index of the addressed module, -1 outside of modules
+	table  string // table is the table header containing the value, empty for the top level
+	name   string // name is the key of the value within the table
+}
+
+// parseConfigKey splits a config key into the table and name of the value, finding the addressed module in the config.
+func parseConfigKey(config map[string]interface{}, key string) (k configKey, err error) {
+	parts := strings.Split(key, ".")
+	for _, p := range parts {
+		if p == "" {
+			return configKey{}, fmt.Errorf("ec2macosinit: invalid config key %q", key)
+		}
+	}
+	k.module = -1
+	if parts[0] == "Module" {
+		if len(parts) < 3 {
+			return configKey{}, fmt.Errorf("ec2macosinit: config key %q must be Module.<module name>.<option>", key)
+		}
+		modules, _ := config["Module"].([]map[string]interface{})
+		for i, m := range modules {
+			if m["Name"] == parts[1] {
+				k.module = i
+			}
+		}
+		if k.module == -1 {
+			return configKey{}, fmt.Errorf("ec2macosinit: no module named %s in config", parts[1])
+		}
+		parts = append([]string{"Module"}, parts[2:]...)
+	}
+	k.table = strings.Join(parts[:len(parts)-1], ".")
+	k.name = parts[len(parts)-1]
+	return k, nil
+}
+
+// GetConfigValue returns the value of the config key in TOML config data, formatted as TOML. Tables are returned as
+// TOML documents.
+func GetConfigValue(data []byte, key string) (value string, err error) {
+	var config map[string]interface{}
+	_, err = toml.Decode(string(data), &config)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error decoding config: %s", err)
+	}
+	k, err := parseConfigKey(config, key)
+	if err != nil {
+		return "", err
+	}
+
+	var v interface{} = config
+	if k.module != -1 {
+		v = config["Module"].([]map[string]interface{})[k.module]
+	}
+	path := strings.Split(k.table, ".")
+	if k.module != -1 || k.table == "" {
+		path = path[1:]
+	}
+	for _, p := range append(path, k.name) {
+		table, ok := v.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("ec2macosinit: %s is not set in config", key)
+		}
+		v, ok = table[p]
+		if !ok {
+			return "", fmt.Errorf("ec2macosinit: %s is not set in config", key)
+		}
+	}
+
+	if table, ok := v.(map[string]interface{}); ok {
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(table)
+		return strings.TrimRight(buf.String(), "\n"), err
+	}
+	return tomlValue(v)
+}
+
+// SetConfigValue sets the config key to value in TOML config data, editing only the line containing the value so that
+// the formatting and comments of the rest of the config are kept. The value is TOML, such as true, 3, or ["a", "b"],
+// and is treated as a string if it isn't valid TOML. Values which aren't set yet are added to their table, and tables
+// which don't exist yet are added to the end of their module or the config. The updated config isn't validated.
+func SetConfigValue(data []byte, key, value string) (updated []byte, err error) {
+	var config map[string]interface{}
+	_, err = toml.Decode(string(data), &config)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error decoding config: %s", err)
+	}
+	k, err := parseConfigKey(config, key)
+	if err != nil {
+		return nil, err
+	}
+	var parsed map[string]interface{}
+	if _, err := toml.Decode("v = "+value, &parsed); err != nil {
+		value, err = tomlValue(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lines := strings.Split(string(data), "\n")
+	sections := tomlSections(lines)
+	var table *tomlSection
+	moduleEnd := -1
+	for i := range sections {
+		sec := &sections[i]
+		if k.module != -1 && sec.module == k.module && strings.HasPrefix(sec.header, "Module") {
+			moduleEnd = sec.end
+		}
+		if table == nil && sec.header == k.table && (k.module == -1 || sec.module == k.module) {
+			table = sec
+		}
+	}
+
+	if table != nil {
+		if table.array && table.header != "Module" {
+			return nil, fmt.Errorf("ec2macosinit: %s is in an array of tables, which can't be set", key)
+		}
+
+		// Replace the value on an existing line, keeping any comment following it
+		keyLine := regexp.MustCompile(`^(\s*)("?` + regexp.QuoteMeta(k.name) + `"?\s*=\s*)(.*)$`)
+		last, indent := table.start-1, table.indent+"    "
+		if table.start == 0 {
+			indent = ""
+		}
+		for i := table.start; i < table.end; i++ {
+			trimmed := strings.TrimSpace(lines[i])
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if last < table.start {
+				indent = lines[i][:len(lines[i])-len(strings.TrimLeft(lines[i], " \t"))]
+			}
+			last = i
+			m := keyLine.FindStringSubmatch(lines[i])
+			if m == nil {
+				continue
+			}
+			comment, err := tomlComment(m[3])
+			if err != nil {
+				return nil, fmt.Errorf("ec2macosinit: unable to set %s: %s", key, err)
+			}
+			lines[i] = m[1] + m[2] + value + comment
+			return []byte(strings.Join(lines, "\n")), nil
+		}
+
+		// Add the value after the last value in the table
+		lines = insertLines(lines, last+1, indent+k.name+" = "+value)
+		return []byte(strings.Join(lines, "\n")), nil
+	}
+
+	// Add the table after the last value of the module for module tables, or at the end of the config
+	at, indent := len(lines), ""
+	if k.module != -1 {
+		at, indent = moduleEnd, "    "
+	}
+	for at > 0 && (strings.TrimSpace(lines[at-1]) == "" || (k.module != -1 && strings.HasPrefix(strings.TrimSpace(lines[at-1]), "#"))) {
+		at--
+	}
+	insert := []string{indent + "[" + k.table + "]", indent + "    " + k.name + " = " + value}
+	if k.module == -1 {
+		insert = append([]string{""}, insert...)
+	}
+	lines = insertLines(lines, at, insert...)
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// tomlSection is the lines of a table in TOML config.
+type tomlSection struct {
+	header string // header is the name of the table, empty for the top level
+	array  bool   // array is set for a table in an array of tables
+	module int    // module is the index of the last [[Module]] at or before the table, -1 if there isn't one
+	indent string // indent is the indentation of the header
+	start  int    // start is the first line after the header
+	end    int    // end is the line after the last line of the table
+}
+
+// tomlSections splits TOML config lines into the top level section and a section for each table.
+func tomlSections(lines []string) (sections []tomlSection) {
+	sections = []tomlSection{{module: -1, end: len(lines)}}
+	module := -1
+	for i, line := range lines {
+		m := tomlHeader.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		sec := tomlSection{header: m[2], array: m[1] == "[[", start: i + 1, end: len(lines)}
+		if sec.array && sec.header == "Module" {
+			module++
+		}
+		sec.module = module
+		sec.indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		sections[len(sections)-1].end = i
+		sections = append(sections, sec)
+	}
+	return sections
+}
+
+// ValidateConfigData checks that TOML config data is a valid config, with no options which aren't known.
+func ValidateConfigData(data []byte) (err error) {
+	c := &InitConfig{}
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: error decoding config: %s", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("ec2macosinit: unknown option %s in config", undecoded[0])
+	}
+	return c.ValidateAndIdentify()
+}
+
+// tomlValue formats a value as TOML.
+func tomlValue(v interface{}) (value string, err error) {
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).Encode(map[string]interface{}{"v": v})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to encode value: %s", err)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(buf.String(), "v = "), "\n"), nil
+}
+
+// tomlComment returns the comment following the value on a key's line, along with the whitespace before it. Values
+// continuing onto later lines aren't supported.
+func tomlComment(rest string) (comment string, err error) {
+	for i := 0; i <= len(rest); i++ {
+		if i < len(rest) && rest[i] != '#' {
+			continue
+		}
+		var v map[string]interface{}
+		if _, err := toml.Decode("v = "+rest[:i], &v); err == nil {
+			trimmed := strings.TrimRight(rest[:i], " \t")
+			return rest[len(trimmed):], nil
+		}
+	}
+	return "", fmt.Errorf("values over multiple lines can't be set")
+}
+
+// insertLines inserts lines at index i.
+func insertLines(lines []string, i int, insert ...string) []string {
+	return append(lines[:i], append(insert, lines[i:]...)...)
+}
+
+// WriteConfigData atomically replaces the config file at path, keeping its permissions.
+func WriteConfigData(path string, data []byte) (err error) {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	err = safeWriteFile(path, data, perm, -1, -1)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write config file %s: %s", path, err)
+	}
+	return nil
+}
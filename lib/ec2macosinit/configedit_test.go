@@ -0,0 +1,146 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEditConfig = `# Test config
+
+[[Module]]
+    Name = "Ethernet"
+    PriorityGroup = 1 # First group
+    RunPerBoot = true
+    [Module.Command]
+        Cmd = ["/usr/sbin/networksetup", "-setnetworkserviceenabled", "Ethernet", "off"] # Disable # Ethernet
+
+# Security settings
+[[Module]]
+    Name = "Security"
+    PriorityGroup = 3
+    RunPerBoot = true
+    [Module.SystemConfig]
+        secureSSHDConfig = true # Apply secure settings
+        [[Module.SystemConfig.Sysctl]]
+            value = "kern.aiomax=900"
+
+# Final group
+[[Module]]
+    Name = "MOTD"
+    PriorityGroup = 4
+    RunPerInstance = true
+    [Module.MOTD]
+        UpdateName = true
+`
+
+func TestGetConfigValue(t *testing.T) {
+	value, err := GetConfigValue([]byte(testEditConfig), "Module.Security.SystemConfig.secureSSHDConfig")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", value)
+
+	value, err = GetConfigValue([]byte(testEditConfig), "Module.Ethernet.Command.Cmd")
+	assert.NoError(t, err)
+	assert.Equal(t, `["/usr/sbin/networksetup", "-setnetworkserviceenabled", "Ethernet", "off"]`, value)
+
+	value, err = GetConfigValue([]byte(testEditConfig), "Module.MOTD.MOTD")
+	assert.NoError(t, err)
+	assert.Equal(t, "UpdateName = true", value)
+
+	_, err = GetConfigValue([]byte(testEditConfig), "Module.Security.SystemConfig.secureSSHDConfg")
+	assert.EqualError(t, err, "ec2macosinit: Module.Security.SystemConfig.secureSSHDConfg is not set in config")
+	_, err = GetConfigValue([]byte(testEditConfig), "Module.Missing.PriorityGroup")
+	assert.EqualError(t, err, "ec2macosinit: no module named Missing in config")
+}
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Existing value with a comment",
+			key:   "Module.Security.SystemConfig.secureSSHDConfig",
+			value: "false",
+			want:  "        secureSSHDConfig = false # Apply secure settings\n",
+		},
+		{
+			name:  "Existing value with a comment character in it",
+			key:   "Module.Ethernet.Command.Cmd",
+			value: `["/usr/bin/true"]`,
+			want:  "        Cmd = [\"/usr/bin/true\"] # Disable # Ethernet\n",
+		},
+		{
+			name:  "Module option",
+			key:   "Module.MOTD.PriorityGroup",
+			value: "5",
+			want:  "    PriorityGroup = 5\n",
+		},
+		{
+			name:  "New value in an existing table",
+			key:   "Module.Ethernet.Command.RunAsUser",
+			value: "ec2-user",
+			want:  "        Cmd = [\"/usr/sbin/networksetup\", \"-setnetworkserviceenabled\", \"Ethernet\", \"off\"] # Disable # Ethernet\n        RunAsUser = \"ec2-user\"\n\n# Security settings\n",
+		},
+		{
+			name:  "New table in a module",
+			key:   "Module.Ethernet.NetworkCheck.PingCount",
+			value: "3",
+			want:  "Ethernet\n    [Module.NetworkCheck]\n        PingCount = 3\n\n# Security settings\n",
+		},
+		{
+			name:  "New top level table",
+			key:   "Metrics.Enabled",
+			value: "true",
+			want:  "        UpdateName = true\n\n[Metrics]\n    Enabled = true\n",
+		},
+		{
+			name:    "Array of tables",
+			key:     "Module.Security.SystemConfig.Sysctl.value",
+			value:   "kern.aiomax=1000",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown module",
+			key:     "Module.Missing.RunOnce",
+			value:   "true",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated, err := SetConfigValue([]byte(testEditConfig), tt.key, tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, string(updated), tt.want)
+
+			// Values which aren't valid TOML are set as strings
+			value, err := GetConfigValue(updated, tt.key)
+			assert.NoError(t, err)
+			want := tt.value
+			if tt.value == "ec2-user" {
+				want = `"ec2-user"`
+			}
+			assert.Equal(t, want, value)
+		})
+	}
+}
+
+func TestValidateConfigData(t *testing.T) {
+	assert.NoError(t, ValidateConfigData([]byte(testEditConfig)))
+
+	updated, err := SetConfigValue([]byte(testEditConfig), "Module.Security.SystemConfig.secureSSHDConfg", "true")
+	require.NoError(t, err)
+	assert.EqualError(t, ValidateConfigData(updated), "ec2macosinit: unknown option Module.SystemConfig.secureSSHDConfg in config")
+
+	updated, err = SetConfigValue([]byte(testEditConfig), "Module.MOTD.PriorityGroup", "0")
+	require.NoError(t, err)
+	assert.Error(t, ValidateConfigData(updated))
+}
@@ -0,0 +1,110 @@
+package ec2macosinit
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	// ConsoleDevice is written to so that output shows up in the EC2 console output (GetConsoleOutput)
+	ConsoleDevice = "/dev/console"
+	// launchKeyEndpoint is the IMDS path of the public key of the key pair the instance was launched with
+	launchKeyEndpoint = "meta-data/public-keys/0/openssh-key"
+)
+
+// encryptPasswordForConsole encrypts the password with the RSA public key of the launch key pair, the same way EC2
+// Windows instances do for GetPasswordData. The result can be decrypted with the key pair's private key, e.g.
+//
+//	base64 -d | openssl pkeyutl -decrypt -inkey my-key.pem
+func encryptPasswordForConsole(ctx *ModuleContext, password string) (encrypted string, err error) {
+	authorizedKey, respCode, err := ctx.IMDS.getIMDSProperty(launchKeyEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error getting launch key from IMDS: %s", err)
+	}
+	if respCode == 404 {
+		return "", fmt.Errorf("ec2macosinit: instance was not launched with a key pair")
+	}
+	if respCode != 200 {
+		return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+
+	pub, err := parseSSHRSAPublicKey(authorizedKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte(password))
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to encrypt password: %s", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// parseSSHRSAPublicKey parses an RSA public key in authorized_keys format ("ssh-rsa AAAA... comment"). Other key
+// types, such as ed25519, can't be used for encryption and are rejected.
+func parseSSHRSAPublicKey(authorizedKey string) (pub *rsa.PublicKey, err error) {
+	fields := strings.Fields(authorizedKey)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("ec2macosinit: invalid public key")
+	}
+	if fields[0] != "ssh-rsa" {
+		return nil, fmt.Errorf("ec2macosinit: launch key type %s can't be used for encryption, an RSA key is required", fields[0])
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to decode public key: %s", err)
+	}
+
+	// The wire format (RFC 4253 section 6.6) is a sequence of length-prefixed strings: the key type, e, and n
+	var parts [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("ec2macosinit: truncated public key")
+		}
+		n := binary.BigEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, fmt.Errorf("ec2macosinit: truncated public key")
+		}
+		parts = append(parts, data[4:4+n])
+		data = data[4+n:]
+	}
+	if len(parts) != 3 || string(parts[0]) != "ssh-rsa" {
+		return nil, fmt.Errorf("ec2macosinit: malformed RSA public key")
+	}
+
+	e := new(big.Int).SetBytes(parts[1])
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("ec2macosinit: unsupported RSA public exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(parts[2]), E: int(e.Int64())}, nil
+}
+
+// writePasswordToConsole writes the encrypted password to the console using the same markers as EC2 Windows so that
+// it can be found in the console output.
+func writePasswordToConsole(user, encrypted string) (err error) {
+	return writeConsole(ConsoleDevice, fmt.Sprintf("\nec2-macos-init: encrypted password for %s\n<Password>\n%s\n</Password>\n", user, encrypted))
+}
+
+// writeConsole writes text to a console device.
+func writeConsole(device, text string) (err error) {
+	f, err := os.OpenFile(device, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to open %s: %s", device, err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(text)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write to %s: %s", device, err)
+	}
+
+	return nil
+}
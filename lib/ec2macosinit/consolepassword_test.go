@@ -0,0 +1,48 @@
+package ec2macosinit
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sshWireString encodes b as an SSH wire format string.
+func sshWireString(b []byte) []byte {
+	out := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+func Test_parseSSHRSAPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	var wire []byte
+	wire = append(wire, sshWireString([]byte("ssh-rsa"))...)
+	wire = append(wire, sshWireString(big.NewInt(int64(key.E)).Bytes())...)
+	wire = append(wire, sshWireString(append([]byte{0}, key.N.Bytes()...))...)
+	authorizedKey := "ssh-rsa " + base64.StdEncoding.EncodeToString(wire) + " my-key\n"
+
+	pub, err := parseSSHRSAPublicKey(authorizedKey)
+	require.NoError(t, err)
+	assert.Equal(t, key.E, pub.E)
+	assert.Equal(t, 0, key.N.Cmp(pub.N))
+
+	// Round trip the encryption used for the console password
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, []byte("password"))
+	require.NoError(t, err)
+	plaintext, err := rsa.DecryptPKCS1v15(rand.Reader, key, ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "password", string(plaintext))
+
+	_, err = parseSSHRSAPublicKey("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl key")
+	assert.Error(t, err, "ed25519 keys can't be used for encryption")
+	_, err = parseSSHRSAPublicKey("ssh-rsa AAAA")
+	assert.Error(t, err)
+}
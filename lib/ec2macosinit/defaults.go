@@ -0,0 +1,321 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"howett.net/plist"
+)
+
+const (
+	// defaultsKeySeparator separates the levels of a nested parameter, matching PlistBuddy's key path syntax.
+	defaultsKeySeparator = ":"
+	// preferencesDir is the location of preferences relative to a user's home directory.
+	preferencesDir = "Library/Preferences"
+	// byHostDir is the directory of -currentHost preferences within preferencesDir.
+	byHostDir = "ByHost"
+)
+
+// plistMutex serializes plist edits so that concurrent modifications to the same file don't race their
+// read-modify-write cycles.
+var plistMutex sync.Mutex
+
+// modifyDefaults modifies a default, if necessary. The plist is saved to backups before it is changed.
+func modifyDefaults(ctx *ModuleContext, modifyDefault ModifyDefaults, backups *fileBackups) (changed bool, err error) {
+	keyPath := modifyDefault.keyPath()
+	if len(keyPath) == 0 {
+		return false, fmt.Errorf("ec2macosinit: no parameter provided for plist %s", modifyDefault.Plist)
+	}
+
+	// Determine the desired value before touching the plist
+	var expected interface{}
+	if !modifyDefault.Delete {
+		expected, err = modifyDefault.expectedValue()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	path, err := modifyDefault.plistPath(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	plistMutex.Lock()
+	defer plistMutex.Unlock()
+
+	root, format, err := readPlistFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	// Check to see if current value already matches, otherwise update it
+	current, found := lookupPlistKey(root, keyPath)
+	if modifyDefault.Delete {
+		if !found {
+			return false, nil
+		}
+		deletePlistKey(root, keyPath)
+	} else {
+		if found && plistValuesEqual(expected, current) {
+			return false, nil
+		}
+		err = setPlistKey(root, keyPath, expected)
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to set parameter %s in plist %s: %s", modifyDefault.Parameter, path, err)
+		}
+	}
+
+	err = backups.save(path)
+	if err != nil {
+		return false, err
+	}
+	err = writePlistFile(ctx, path, root, format, modifyDefault.User)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to write plist %s: %s", path, err)
+	}
+
+	// Validate new value
+	verify, _, err := readPlistFile(path)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: verification failed for plist %s: %s", path, err)
+	}
+	current, found = lookupPlistKey(verify, keyPath)
+	if modifyDefault.Delete && found || !modifyDefault.Delete && !plistValuesEqual(expected, current) {
+		return false, fmt.Errorf("ec2macosinit: verification failed for updating value for plist %s, parameter %s", path, modifyDefault.Parameter)
+	}
+
+	return true, nil
+}
+
+// keyPath splits the parameter into the keys for each nesting level.
+func (m ModifyDefaults) keyPath() (keys []string) {
+	if m.Parameter == "" {
+		return nil
+	}
+	return strings.Split(m.Parameter, defaultsKeySeparator)
+}
+
+// expectedValue converts the configured value into the plist value for the configured type.
+func (m ModifyDefaults) expectedValue() (value interface{}, err error) {
+	switch m.Type {
+	case "bool", "boolean":
+		value, err = strconv.ParseBool(m.Value)
+	case "int", "integer":
+		value, err = strconv.ParseInt(m.Value, 10, 64)
+	case "float":
+		value, err = strconv.ParseFloat(m.Value, 64)
+	case "string":
+		value = m.Value
+	case "array":
+		a := make([]interface{}, len(m.Values))
+		for i := range m.Values {
+			a[i] = m.Values[i]
+		}
+		value = a
+	case "dict", "dictionary":
+		d := make(map[string]interface{}, len(m.Dict))
+		for k, v := range m.Dict {
+			d[k] = v
+		}
+		value = d
+	default:
+		return nil, fmt.Errorf("ec2macosinit: unsupported defaults type: %s", m.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: invalid %s value %q for parameter %s: %s", m.Type, m.Value, m.Parameter, err)
+	}
+
+	return value, nil
+}
+
+// plistPath resolves the file backing the configured plist. Like defaults, an absolute path is used as-is (with the
+// .plist extension added if missing) while a domain name is resolved in the preferences of the configured user, or
+// root when no user is given. The -currentHost domain lives in the ByHost directory, suffixed with the hardware UUID.
+func (m ModifyDefaults) plistPath(ctx *ModuleContext) (path string, err error) {
+	if filepath.IsAbs(m.Plist) {
+		if m.CurrentHost {
+			return "", fmt.Errorf("ec2macosinit: currentHost can't be used with a plist path: %s", m.Plist)
+		}
+		if !strings.HasSuffix(m.Plist, ".plist") {
+			return m.Plist + ".plist", nil
+		}
+		return m.Plist, nil
+	}
+
+	user := m.User
+	if user == "" {
+		user = "root"
+	}
+	home, err := getUserHomeDirectory(user)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to get home directory for user %s: %s", user, err)
+	}
+
+	if m.CurrentHost {
+		uuid, err := getHardwareUUID(ctx)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, preferencesDir, byHostDir, m.Plist+"."+uuid+".plist"), nil
+	}
+
+	return filepath.Join(home, preferencesDir, m.Plist+".plist"), nil
+}
+
+// getHardwareUUID returns the IOPlatformUUID used to name -currentHost preferences.
+func getHardwareUUID(ctx *ModuleContext) (uuid string, err error) {
+	out, err := ctx.executeCommand([]string{"/usr/sbin/ioreg", "-rd1", "-c", "IOPlatformExpertDevice"}, "", []string{})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to query hardware UUID: %s", err)
+	}
+
+	// The relevant line looks like:
+	//     "IOPlatformUUID" = "564D1A2B-0000-0000-0000-000000000000"
+	for _, line := range strings.Split(out.stdout, "\n") {
+		if !strings.Contains(line, `"IOPlatformUUID"`) {
+			continue
+		}
+		fields := strings.Split(line, `"`)
+		if len(fields) >= 4 && fields[3] != "" {
+			return fields[3], nil
+		}
+	}
+
+	return "", fmt.Errorf("ec2macosinit: hardware UUID not found in ioreg output")
+}
+
+// readPlistFile reads and decodes a plist file. A missing file is treated as an empty dictionary which will be written
+// in the binary format, as defaults would.
+func readPlistFile(path string) (root map[string]interface{}, format int, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]interface{}{}, plist.BinaryFormat, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("ec2macosinit: unable to read plist %s: %s", path, err)
+	}
+
+	var v interface{}
+	format, err = plist.Unmarshal(data, &v)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ec2macosinit: unable to decode plist %s: %s", path, err)
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("ec2macosinit: plist %s does not contain a dictionary at the top level", path)
+	}
+
+	return root, format, nil
+}
+
+// writePlistFile atomically replaces the plist at path. Existing ownership and permissions are preserved; new files
+// are owned by the given user (or root) and created along with any missing parent directories.
+func writePlistFile(ctx *ModuleContext, path string, root map[string]interface{}, format int, username string) (err error) {
+	data, err := plist.MarshalIndent(root, format, "\t")
+	if err != nil {
+		return err
+	}
+
+	perm := os.FileMode(0644)
+	uid, gid := -1, -1
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	} else if username != "" {
+		perm = 0600
+		uid, gid, err = ctx.getUIDandGID(username)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return safeWriteFile(path, data, perm, uid, gid)
+}
+
+// lookupPlistKey returns the value at the nested key path, if present.
+func lookupPlistKey(root map[string]interface{}, keyPath []string) (value interface{}, found bool) {
+	var current interface{} = root
+	for _, key := range keyPath {
+		dict, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = dict[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setPlistKey sets the value at the nested key path, creating intermediate dictionaries as needed.
+func setPlistKey(root map[string]interface{}, keyPath []string, value interface{}) (err error) {
+	dict := root
+	for i, key := range keyPath[:len(keyPath)-1] {
+		next, ok := dict[key]
+		if !ok {
+			child := map[string]interface{}{}
+			dict[key] = child
+			dict = child
+			continue
+		}
+		dict, ok = next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a dictionary", strings.Join(keyPath[:i+1], defaultsKeySeparator))
+		}
+	}
+	dict[keyPath[len(keyPath)-1]] = value
+	return nil
+}
+
+// deletePlistKey removes the value at the nested key path, if present.
+func deletePlistKey(root map[string]interface{}, keyPath []string) {
+	parent, found := lookupPlistKey(root, keyPath[:len(keyPath)-1])
+	if dict, ok := parent.(map[string]interface{}); found && ok {
+		delete(dict, keyPath[len(keyPath)-1])
+	}
+}
+
+// plistValuesEqual compares an expected value with one read from a plist. Integers are read as uint64 unless they're
+// negative, and reals as float32 when stored with single precision, so numbers with the same value are treated as
+// equal whatever their type.
+func plistValuesEqual(expected, actual interface{}) bool {
+	switch e := expected.(type) {
+	case int64:
+		switch a := actual.(type) {
+		case int64:
+			return e == a
+		case uint64:
+			return e >= 0 && uint64(e) == a
+		}
+		return false
+	case float64:
+		switch a := actual.(type) {
+		case float64:
+			return e == a
+		case float32:
+			return e == float64(a)
+		case int64:
+			return e == float64(a)
+		case uint64:
+			return e == float64(a)
+		}
+		return false
+	}
+	return reflect.DeepEqual(expected, actual)
+}
@@ -0,0 +1,126 @@
+package ec2macosinit
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func Test_modifyDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "com.amazon.ec2.test.plist")
+
+	// A missing plist is created in the binary format
+	changed, err := modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Enabled", Type: "bool", Value: "true"}, nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	root, format, err := readPlistFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, plist.BinaryFormat, format)
+	assert.Equal(t, true, root["Enabled"])
+
+	// Applying the same value again is a no-op
+	changed, err = modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Enabled", Type: "bool", Value: "true"}, nil)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Nested keys create intermediate dictionaries
+	changed, err = modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Outer:Inner", Type: "array", Values: []string{"a", "b"}}, nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	root, _, err = readPlistFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"Inner": []interface{}{"a", "b"}}, root["Outer"])
+
+	// A scalar can't be used as an intermediate dictionary
+	_, err = modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Enabled:Inner", Type: "int", Value: "1"}, nil)
+	assert.Error(t, err)
+
+	// Deleting removes the key, and deleting again is a no-op
+	changed, err = modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Outer:Inner", Delete: true}, nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Outer:Inner", Delete: true}, nil)
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func Test_modifyDefaults_PreservesXMLFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "com.amazon.ec2.xml.plist")
+	data, err := plist.MarshalIndent(map[string]interface{}{"Count": 1}, plist.XMLFormat, "	")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0640))
+
+	changed, err := modifyDefaults(&ModuleContext{}, ModifyDefaults{Plist: path, Parameter: "Count", Type: "int", Value: "2"}, nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	root, format, err := readPlistFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, plist.XMLFormat, format)
+	assert.Equal(t, uint64(2), root["Count"])
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), "should preserve permissions")
+}
+
+func TestModifyDefaults_expectedValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       ModifyDefaults
+		want    interface{}
+		wantErr bool
+	}{
+		{"Bool", ModifyDefaults{Type: "boolean", Value: "false"}, false, false},
+		{"Int", ModifyDefaults{Type: "int", Value: "42"}, int64(42), false},
+		{"Float", ModifyDefaults{Type: "float", Value: "1.5"}, 1.5, false},
+		{"String", ModifyDefaults{Type: "string", Value: "hello"}, "hello", false},
+		{"Array", ModifyDefaults{Type: "array", Values: []string{"a"}}, []interface{}{"a"}, false},
+		{"Dict", ModifyDefaults{Type: "dict", Dict: map[string]string{"k": "v"}}, map[string]interface{}{"k": "v"}, false},
+		{"BadInt", ModifyDefaults{Type: "int", Value: "many"}, nil, true},
+		{"UnknownType", ModifyDefaults{Type: "data", Value: "AA=="}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.m.expectedValue()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestModifyDefaults_plistPath(t *testing.T) {
+	path, err := ModifyDefaults{Plist: "/Library/Preferences/com.apple.SoftwareUpdate"}.plistPath(&ModuleContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, "/Library/Preferences/com.apple.SoftwareUpdate.plist", path)
+
+	_, err = ModifyDefaults{Plist: "/Library/Preferences/com.apple.SoftwareUpdate.plist", CurrentHost: true}.plistPath(&ModuleContext{})
+	assert.Error(t, err, "should reject currentHost with a path")
+
+	ctx := &ModuleContext{executor: &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stdout: `  "IOPlatformUUID" = "564D1A2B-0000-0000-0000-000000000000"` + "\n"}, nil
+	}}}
+	path, err = ModifyDefaults{Plist: "com.apple.screensaver", CurrentHost: true}.plistPath(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "com.apple.screensaver.564D1A2B-0000-0000-0000-000000000000.plist", filepath.Base(path))
+	assert.Equal(t, "ByHost", filepath.Base(filepath.Dir(path)))
+}
+
+func Test_plistValuesEqual(t *testing.T) {
+	assert.True(t, plistValuesEqual(int64(2), uint64(2)))
+	assert.True(t, plistValuesEqual(int64(-2), int64(-2)))
+	assert.False(t, plistValuesEqual(int64(-1), uint64(math.MaxUint64)))
+	assert.True(t, plistValuesEqual(1.5, float32(1.5)))
+	assert.True(t, plistValuesEqual(2.0, uint64(2)))
+	assert.False(t, plistValuesEqual(int64(1), true))
+	assert.True(t, plistValuesEqual([]interface{}{"a"}, []interface{}{"a"}))
+}
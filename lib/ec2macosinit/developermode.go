@@ -0,0 +1,86 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// devToolsSecurityPath is the path to the utility which turns developer mode on and off
+	devToolsSecurityPath = "/usr/sbin/DevToolsSecurity"
+	// developerGroup is the group whose members may use developer tools, such as debuggers, without authenticating
+	developerGroup = "_developer"
+)
+
+// DeveloperModeModule contains all necessary configuration fields for running a DeveloperMode module.
+type DeveloperModeModule struct {
+	Enable bool     `toml:"Enable"` // Enable turns on developer mode
+	Users  []string `toml:"Users"`  // Users are added to the _developer group
+}
+
+// Do for the DeveloperModeModule turns on developer mode with DevToolsSecurity and adds the users to the _developer
+// group, so debuggers can attach and UI tests can run without an authentication prompt in every session. Developer
+// mode is read back to verify it, and users which are already members are left alone.
+func (c *DeveloperModeModule) Do(ctx *ModuleContext) (message string, err error) {
+	if !c.Enable {
+		return "Not requested to enable developer mode", nil
+	}
+
+	var changed, unchanged int
+	enabled, err := developerModeEnabled(ctx)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		unchanged++
+	} else {
+		out, err := ctx.executeCommand([]string{devToolsSecurityPath, "-enable"}, "", []string{})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to enable developer mode: %s %s", err, strings.TrimSpace(out.stderr))
+		}
+
+		// Validate new value
+		enabled, err = developerModeEnabled(ctx)
+		if err != nil {
+			return "", err
+		}
+		if !enabled {
+			return "", fmt.Errorf("ec2macosinit: verification failed, developer mode is still disabled")
+		}
+		ctx.Logger.Info("Enabled developer mode")
+		changed++
+	}
+
+	for _, u := range c.Users {
+		added, err := addUserToGroup(ctx, u, developerGroup)
+		if err != nil {
+			return "", err
+		}
+		if added {
+			ctx.Logger.Infof("Added user %s to the %s group", u, developerGroup)
+			changed++
+		} else {
+			unchanged++
+		}
+	}
+
+	return fmt.Sprintf("successfully enabled developer mode [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// developerModeEnabled returns whether developer mode is on, as reported by DevToolsSecurity -status:
+// "Developer mode is currently enabled." or "Developer mode is currently disabled."
+func developerModeEnabled(ctx *ModuleContext) (enabled bool, err error) {
+	out, err := ctx.executeCommand([]string{devToolsSecurityPath, "-status"}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to get developer mode status: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+	status := strings.TrimSpace(out.stdout + out.stderr)
+	switch {
+	case strings.Contains(status, "currently enabled"):
+		return true, nil
+	case strings.Contains(status, "currently disabled"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("ec2macosinit: unexpected developer mode status: %q", status)
+	}
+}
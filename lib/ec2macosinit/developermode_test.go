@@ -0,0 +1,52 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeveloperModeModule_Do(t *testing.T) {
+	enabled := false
+	members := map[string]bool{"ci": true}
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch {
+		case c[0] == devToolsSecurityPath && c[1] == "-enable":
+			enabled = true
+		case c[0] == devToolsSecurityPath && enabled:
+			return commandOutput{stdout: "Developer mode is currently enabled.\n"}, nil
+		case c[0] == devToolsSecurityPath:
+			return commandOutput{stdout: "Developer mode is currently disabled.\n"}, nil
+		case c[2] == "checkmember" && !members[c[4]]:
+			return commandOutput{}, assert.AnError
+		case c[2] == "edit":
+			members[c[4]] = true
+		}
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	c := &DeveloperModeModule{Enable: true, Users: []string{"ec2-user", "ci"}}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully enabled developer mode [2 changed / 1 unchanged]", message)
+	assert.True(t, members["ec2-user"])
+	assert.Contains(t, fake.commands, "/usr/sbin/dseditgroup -o edit -a ec2-user -t user _developer")
+
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully enabled developer mode [0 changed / 3 unchanged]", message)
+
+	// Developer mode which doesn't turn on fails verification
+	enabled = false
+	fake.handle = func(c []string) (commandOutput, error) {
+		return commandOutput{stdout: "Developer mode is currently disabled.\n"}, nil
+	}
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+
+	message, err = (&DeveloperModeModule{}).Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Not requested to enable developer mode", message)
+}
@@ -0,0 +1,138 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// displayMode is a mode of a display. Width and Height are in points, while PixelWidth and PixelHeight are the size of
+// the framebuffer, which is twice as large for HiDPI modes. Depth is the number of bits per pixel.
+type displayMode struct {
+	Width       int
+	Height      int
+	PixelWidth  int
+	PixelHeight int
+	Depth       int
+	index       int // index identifies the mode to the system
+}
+
+// String returns the mode as it's logged, such as "1920x1080 32-bit" or "1280x720 HiDPI 32-bit".
+func (m displayMode) String() string {
+	s := fmt.Sprintf("%dx%d", m.Width, m.Height)
+	if m.hiDPI() {
+		s += " HiDPI"
+	}
+	return fmt.Sprintf("%s %d-bit", s, m.Depth)
+}
+
+// hiDPI returns whether the mode draws more than one pixel per point.
+func (m displayMode) hiDPI() bool {
+	return m.PixelWidth > m.Width
+}
+
+// displayConfigurator reads and changes the mode of the main display.
+type displayConfigurator interface {
+	currentMode() (mode displayMode, err error)
+	modes() (modes []displayMode, err error)
+	setMode(mode displayMode) (err error)
+}
+
+// mainDisplay configures the main display of the system.
+var mainDisplay displayConfigurator = systemDisplay{}
+
+// HeadlessDisplayModule contains all necessary configuration fields for running a HeadlessDisplay module.
+type HeadlessDisplayModule struct {
+	Width      int  `toml:"Width"`      // Width of the display in points
+	Height     int  `toml:"Height"`     // Height of the display in points
+	ColorDepth int  `toml:"ColorDepth"` // ColorDepth is the number of bits per pixel, defaults to the current depth
+	HiDPI      bool `toml:"HiDPI"`      // HiDPI selects a mode drawing two pixels per point
+}
+
+// Do for the HeadlessDisplayModule sets the mode of the main display, which is a virtual display on instances without
+// an attached display, so GUI tests get a known resolution. The current mode is read first and left alone when it
+// already matches, and the new mode is read back to verify it. The mode is saved so that it's kept after a reboot.
+func (c *HeadlessDisplayModule) Do(ctx *ModuleContext) (message string, err error) {
+	if c.Width <= 0 || c.Height <= 0 {
+		return "", fmt.Errorf("ec2macosinit: a positive Width and Height are required for the display")
+	}
+
+	current, err := mainDisplay.currentMode()
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to get the current display mode: %s", err)
+	}
+	if c.matches(current, current.Depth) {
+		ctx.Logger.Infof("Display mode already set to [%s]", current)
+		return fmt.Sprintf("display mode already set to %s", current), nil
+	}
+
+	modes, err := mainDisplay.modes()
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to list display modes: %s", err)
+	}
+	mode, found := c.selectMode(modes, current.Depth)
+	if !found {
+		return "", fmt.Errorf("ec2macosinit: the display doesn't support %s, available modes are %s", c.wanted(current.Depth), displayModeList(modes))
+	}
+
+	err = mainDisplay.setMode(mode)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to set display mode to %s: %s", mode, err)
+	}
+
+	// Validate new value
+	current, err = mainDisplay.currentMode()
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to get the current display mode: %s", err)
+	}
+	if !c.matches(current, current.Depth) {
+		return "", fmt.Errorf("ec2macosinit: verification failed, expected display mode %s but got %s", mode, current)
+	}
+	ctx.Logger.Infof("Set display mode to [%s]", current)
+
+	return fmt.Sprintf("successfully set display mode to %s", current), nil
+}
+
+// depth returns the color depth to use, which is the current depth when none is configured.
+func (c *HeadlessDisplayModule) depth(currentDepth int) int {
+	if c.ColorDepth != 0 {
+		return c.ColorDepth
+	}
+	return currentDepth
+}
+
+// matches returns whether the mode has the configured size, depth, and HiDPI setting.
+func (c *HeadlessDisplayModule) matches(m displayMode, currentDepth int) bool {
+	return m.Width == c.Width && m.Height == c.Height && m.Depth == c.depth(currentDepth) && m.hiDPI() == c.HiDPI
+}
+
+// wanted describes the configured mode for errors.
+func (c *HeadlessDisplayModule) wanted(currentDepth int) string {
+	m := displayMode{Width: c.Width, Height: c.Height, PixelWidth: c.Width, Depth: c.depth(currentDepth)}
+	if c.HiDPI {
+		m.PixelWidth *= 2
+	}
+	return m.String()
+}
+
+// selectMode returns the first of the modes which matches the configuration.
+func (c *HeadlessDisplayModule) selectMode(modes []displayMode, currentDepth int) (mode displayMode, found bool) {
+	for _, m := range modes {
+		if c.matches(m, currentDepth) {
+			return m, true
+		}
+	}
+	return displayMode{}, false
+}
+
+// displayModeList lists the modes for errors, without the duplicates which differ only in refresh rate.
+func displayModeList(modes []displayMode) string {
+	seen := map[string]bool{}
+	var list []string
+	for _, m := range modes {
+		if !seen[m.String()] {
+			seen[m.String()] = true
+			list = append(list, m.String())
+		}
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,148 @@
+//go:build cgo
+
+package ec2macosinit
+
+/*
+#cgo CFLAGS: -Wno-deprecated-declarations
+#cgo LDFLAGS: -framework CoreGraphics -framework CoreFoundation
+#include <CoreGraphics/CoreGraphics.h>
+#include <IOKit/graphics/IOGraphicsTypes.h>
+
+// ec2_mode_depth returns the bits per pixel of a mode. The pixel encoding is deprecated, but there's no replacement
+// for reading the depth of a mode.
+static int ec2_mode_depth(CGDisplayModeRef mode) {
+	CFStringRef encoding = CGDisplayModeCopyPixelEncoding(mode);
+	if (encoding == NULL) {
+		return 0;
+	}
+	int depth = 0;
+	if (CFStringCompare(encoding, CFSTR(IO32BitDirectPixels), 0) == kCFCompareEqualTo) {
+		depth = 32;
+	} else if (CFStringCompare(encoding, CFSTR(kIO30BitDirectPixels), 0) == kCFCompareEqualTo) {
+		depth = 30;
+	} else if (CFStringCompare(encoding, CFSTR(IO16BitDirectPixels), 0) == kCFCompareEqualTo) {
+		depth = 16;
+	} else if (CFStringCompare(encoding, CFSTR(IO8BitIndexedPixels), 0) == kCFCompareEqualTo) {
+		depth = 8;
+	}
+	CFRelease(encoding);
+	return depth;
+}
+
+// ec2_mode_info reads the size and depth of a mode.
+static void ec2_mode_info(CGDisplayModeRef mode, long *width, long *height, long *pixelWidth, long *pixelHeight, int *depth) {
+	*width = CGDisplayModeGetWidth(mode);
+	*height = CGDisplayModeGetHeight(mode);
+	*pixelWidth = CGDisplayModeGetPixelWidth(mode);
+	*pixelHeight = CGDisplayModeGetPixelHeight(mode);
+	*depth = ec2_mode_depth(mode);
+}
+
+// ec2_current_mode reads the current mode of the display, returning false if it has none.
+static int ec2_current_mode(CGDirectDisplayID display, long *width, long *height, long *pixelWidth, long *pixelHeight, int *depth) {
+	CGDisplayModeRef mode = CGDisplayCopyDisplayMode(display);
+	if (mode == NULL) {
+		return 0;
+	}
+	ec2_mode_info(mode, width, height, pixelWidth, pixelHeight, depth);
+	CGDisplayModeRelease(mode);
+	return 1;
+}
+
+// ec2_copy_modes returns every mode of the display, including the low resolution duplicates of HiDPI modes.
+static CFArrayRef ec2_copy_modes(CGDirectDisplayID display) {
+	const void *keys[] = {kCGDisplayShowDuplicateLowResolutionModes};
+	const void *values[] = {kCFBooleanTrue};
+	CFDictionaryRef options = CFDictionaryCreate(NULL, keys, values, 1, &kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFArrayRef modes = CGDisplayCopyAllDisplayModes(display, options);
+	CFRelease(options);
+	return modes;
+}
+
+// ec2_modes_info reads the size and depth of the mode at index.
+static void ec2_modes_info(CFArrayRef modes, CFIndex index, long *width, long *height, long *pixelWidth, long *pixelHeight, int *depth) {
+	ec2_mode_info((CGDisplayModeRef)CFArrayGetValueAtIndex(modes, index), width, height, pixelWidth, pixelHeight, depth);
+}
+
+// ec2_set_mode switches the display to the mode at index, saving it so that it's used after a reboot.
+static CGError ec2_set_mode(CGDirectDisplayID display, CFArrayRef modes, CFIndex index) {
+	CGDisplayConfigRef config;
+	CGError err = CGBeginDisplayConfiguration(&config);
+	if (err != kCGErrorSuccess) {
+		return err;
+	}
+	err = CGConfigureDisplayWithDisplayMode(config, display, (CGDisplayModeRef)CFArrayGetValueAtIndex(modes, index), NULL);
+	if (err != kCGErrorSuccess) {
+		CGCancelDisplayConfiguration(config);
+		return err;
+	}
+	return CGCompleteDisplayConfiguration(config, kCGConfigurePermanently);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+)
+
+// systemDisplay configures the main display through CoreGraphics, which needs the window server to be running.
+type systemDisplay struct{}
+
+// currentMode reads the current mode of the main display.
+func (systemDisplay) currentMode() (mode displayMode, err error) {
+	var width, height, pixelWidth, pixelHeight C.long
+	var depth C.int
+	if C.ec2_current_mode(C.CGMainDisplayID(), &width, &height, &pixelWidth, &pixelHeight, &depth) == 0 {
+		return displayMode{}, fmt.Errorf("no display is active, the window server may not be running")
+	}
+	return displayMode{
+		Width:       int(width),
+		Height:      int(height),
+		PixelWidth:  int(pixelWidth),
+		PixelHeight: int(pixelHeight),
+		Depth:       int(depth),
+	}, nil
+}
+
+// modes lists the modes of the main display.
+func (systemDisplay) modes() (modes []displayMode, err error) {
+	all := C.ec2_copy_modes(C.CGMainDisplayID())
+	if all == 0 {
+		return nil, fmt.Errorf("no display is active, the window server may not be running")
+	}
+	defer C.CFRelease(C.CFTypeRef(all))
+
+	for i := 0; i < int(C.CFArrayGetCount(all)); i++ {
+		var width, height, pixelWidth, pixelHeight C.long
+		var depth C.int
+		C.ec2_modes_info(all, C.CFIndex(i), &width, &height, &pixelWidth, &pixelHeight, &depth)
+		modes = append(modes, displayMode{
+			Width:       int(width),
+			Height:      int(height),
+			PixelWidth:  int(pixelWidth),
+			PixelHeight: int(pixelHeight),
+			Depth:       int(depth),
+			index:       i,
+		})
+	}
+	return modes, nil
+}
+
+// setMode switches the main display to the mode, which must have come from modes. The modes are listed again, since
+// the system's references to them don't outlive the listing.
+func (systemDisplay) setMode(mode displayMode) (err error) {
+	display := C.CGMainDisplayID()
+	all := C.ec2_copy_modes(display)
+	if all == 0 {
+		return fmt.Errorf("no display is active, the window server may not be running")
+	}
+	defer C.CFRelease(C.CFTypeRef(all))
+
+	if mode.index < 0 || mode.index >= int(C.CFArrayGetCount(all)) {
+		return fmt.Errorf("the display's modes changed")
+	}
+	if cgErr := C.ec2_set_mode(display, all, C.CFIndex(mode.index)); cgErr != C.kCGErrorSuccess {
+		return fmt.Errorf("CoreGraphics error %d", int(cgErr))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !darwin || !cgo
+
+package ec2macosinit
+
+import "fmt"
+
+// systemDisplay is only available on macOS in builds with cgo.
+type systemDisplay struct{}
+
+// currentMode is only available on macOS in builds with cgo.
+func (systemDisplay) currentMode() (mode displayMode, err error) {
+	return displayMode{}, fmt.Errorf("display configuration is not available on this platform")
+}
+
+// modes is only available on macOS in builds with cgo.
+func (systemDisplay) modes() (modes []displayMode, err error) {
+	return nil, fmt.Errorf("display configuration is not available on this platform")
+}
+
+// setMode is only available on macOS in builds with cgo.
+func (systemDisplay) setMode(mode displayMode) (err error) {
+	return fmt.Errorf("display configuration is not available on this platform")
+}
@@ -0,0 +1,60 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDisplay is a display with a fixed list of modes.
+type fakeDisplay struct {
+	current   displayMode
+	available []displayMode
+	sets      int
+}
+
+func (f *fakeDisplay) currentMode() (displayMode, error) { return f.current, nil }
+func (f *fakeDisplay) modes() ([]displayMode, error)     { return f.available, nil }
+func (f *fakeDisplay) setMode(m displayMode) error {
+	f.sets++
+	f.current = m
+	return nil
+}
+
+func TestHeadlessDisplayModule_Do(t *testing.T) {
+	defer func(d displayConfigurator) { mainDisplay = d }(mainDisplay)
+	display := &fakeDisplay{available: []displayMode{
+		{Width: 1024, Height: 768, PixelWidth: 1024, PixelHeight: 768, Depth: 32, index: 0},
+		{Width: 1920, Height: 1080, PixelWidth: 3840, PixelHeight: 2160, Depth: 32, index: 1},
+		{Width: 1920, Height: 1080, PixelWidth: 1920, PixelHeight: 1080, Depth: 16, index: 2},
+		{Width: 1920, Height: 1080, PixelWidth: 1920, PixelHeight: 1080, Depth: 32, index: 3},
+	}}
+	display.current = display.available[0]
+	mainDisplay = display
+	ctx := &ModuleContext{Logger: &Logger{}}
+
+	// The current depth is kept when none is configured
+	c := &HeadlessDisplayModule{Width: 1920, Height: 1080}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully set display mode to 1920x1080 32-bit", message)
+	assert.Equal(t, 3, display.current.index)
+
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "display mode already set to 1920x1080 32-bit", message)
+	assert.Equal(t, 1, display.sets)
+
+	c.HiDPI = true
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully set display mode to 1920x1080 HiDPI 32-bit", message)
+
+	_, err = (&HeadlessDisplayModule{Width: 1920, Height: 1080, ColorDepth: 30}).Do(ctx)
+	assert.EqualError(t, err, "ec2macosinit: the display doesn't support 1920x1080 30-bit, available modes are "+
+		"1024x768 32-bit, 1920x1080 HiDPI 32-bit, 1920x1080 16-bit, 1920x1080 32-bit")
+
+	_, err = (&HeadlessDisplayModule{}).Do(ctx)
+	assert.Error(t, err)
+}
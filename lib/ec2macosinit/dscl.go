@@ -0,0 +1,90 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dsclUserPath returns the directory services path of a local user.
+func dsclUserPath(username string) string {
+	return filepath.Join("/Users", username)
+}
+
+// dsclReadUserAttribute reads a single attribute of a local user. Multiple values are returned in order.
+func dsclReadUserAttribute(ctx *ModuleContext, username, attribute string) (values []string, err error) {
+	out, err := ctx.executeCommand([]string{DsclPath, ".", "-read", dsclUserPath(username), attribute}, "", []string{})
+	if err != nil {
+		// dscl exits non-zero when the attribute isn't set
+		if strings.Contains(out.stderr, "No such key") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ec2macosinit: unable to read %s for user %s: %s %s", attribute, username, err, strings.TrimSpace(out.stderr))
+	}
+	return parseDsclAttribute(out.stdout, attribute), nil
+}
+
+// parseDsclAttribute parses dscl -read output for an attribute. Short values are printed on the same line while long
+// values, or values containing spaces, are printed on the following lines:
+//
+//	UserShell: /bin/zsh
+//	RealName:
+//	 EC2 Default User
+func parseDsclAttribute(output, attribute string) (values []string) {
+	prefix := attribute + ":"
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, prefix):
+			values = append(values, strings.Fields(strings.TrimPrefix(line, prefix))...)
+		case strings.HasPrefix(line, " ") && len(values) == 0:
+			values = append(values, strings.TrimSpace(line))
+		}
+	}
+	return values
+}
+
+// dsclCreateUserAttribute sets an attribute of a local user, replacing any existing value.
+func dsclCreateUserAttribute(ctx *ModuleContext, username, attribute string, value string) (err error) {
+	out, err := ctx.executeCommand([]string{DsclPath, ".", "-create", dsclUserPath(username), attribute, value}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to set %s for user %s: %s %s", attribute, username, err, strings.TrimSpace(out.stderr))
+	}
+	if ctx != nil && (attribute == "UniqueID" || attribute == "PrimaryGroupID") {
+		ctx.userIDs.forget(username)
+	}
+	return nil
+}
+
+// listLocalUIDs returns all UIDs in use by local users.
+func listLocalUIDs(ctx *ModuleContext) (uids map[int]bool, err error) {
+	out, err := ctx.executeCommand([]string{DsclPath, ".", "-list", "/Users", "UniqueID"}, "", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to list local users: %s", err)
+	}
+	return parseDsclUIDList(out.stdout), nil
+}
+
+// parseDsclUIDList parses the output of dscl . -list /Users UniqueID, which contains one "name uid" pair per line.
+func parseDsclUIDList(output string) (uids map[int]bool) {
+	uids = map[int]bool{}
+	for _, uid := range parseDsclUserList(output) {
+		uids[uid] = true
+	}
+	return uids
+}
+
+// parseDsclUserList parses the output of dscl . -list /Users UniqueID into a map of user names to UIDs.
+func parseDsclUserList(output string) (users map[string]int) {
+	users = map[string]int{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if uid, err := strconv.Atoi(fields[1]); err == nil {
+			users[fields[0]] = uid
+		}
+	}
+	return users
+}
@@ -6,35 +6,61 @@ import (
 	"os"
 )
 
-// FatalCount contains a Count for tracking the number of Fatal exits for this boot
+// FatalCount contains a Count for tracking the number of Fatal exits for this boot. The count is stored along with the
+// boot time of the boot it belongs to, so a count left over from a previous boot is never used.
 type FatalCount struct {
-	Count int `json:"count"`
+	Count    int    `json:"count"`
+	BootTime int64  `json:"bootTime"` // BootTime is kern.boottime, in seconds since the epoch
+	Path     string `json:"-"`        // Path is the file the count is stored in
 }
 
-// fatalCountFile is the file that contains the fatal counter, this is cleared on reboot
-const fatalCountFile = "/tmp/.ec2-macos-init-fatal-counts.json"
-
 // readFatalCount reads the file contents into FatalCount or returns an initialized counter.
 func (r *FatalCount) readFatalCount() (err error) {
-	// Check if fatal count file exists, if not, create it but leave it empty, then return 0, otherwise read and return
-	_, err = os.Stat(fatalCountFile)
-	if !os.IsNotExist(err) {
-		err = r.readFatalFile()
+	bootTime, err := getBootTime()
+	if err != nil {
+		return err
+	}
+	return r.readFatalCountForBoot(bootTime)
+}
+
+// readFatalCountForBoot reads the count for the given boot. When there is no file, or the file was written during a
+// previous boot, the counter is initialized for this boot.
+func (r *FatalCount) readFatalCountForBoot(bootTime int64) (err error) {
+	// Take initial values for first run of this boot
+	stored := FatalCount{Count: 1, BootTime: bootTime}
+
+	countsBytes, err := os.ReadFile(r.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ec2macosinit: Failed to read %s: %s", r.Path, err)
+	}
+	if err == nil {
+		var fromFile FatalCount
+		err = json.Unmarshal(countsBytes, &fromFile)
 		if err != nil {
-			return fmt.Errorf("ec2macosinit: Failed to read %s: %s", fatalCountFile, err)
+			return fmt.Errorf("ec2macosinit: Failed to parse json: %s", err)
+		}
+		if fromFile.BootTime == bootTime {
+			stored = fromFile
 		}
-	} else {
-		// Take initial values for first run
-		*r = FatalCount{1}
 	}
 
+	r.Count, r.BootTime = stored.Count, stored.BootTime
 	return nil
 }
 
-// IncrementFatalCount takes the current count, increments it, and saves to the temporary file.
+// IncrementFatalCount takes the current count, increments it, and saves to the counter file.
 func (r *FatalCount) IncrementFatalCount() (err error) {
+	bootTime, err := getBootTime()
+	if err != nil {
+		return err
+	}
+	return r.incrementFatalCountForBoot(bootTime)
+}
+
+// incrementFatalCountForBoot increments the count for the given boot and saves it to the counter file.
+func (r *FatalCount) incrementFatalCountForBoot(bootTime int64) (err error) {
 	// Get the current count
-	err = r.readFatalCount()
+	err = r.readFatalCountForBoot(bootTime)
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: unable to read run count file: %s", err)
 	}
@@ -48,27 +74,10 @@ func (r *FatalCount) IncrementFatalCount() (err error) {
 	}
 
 	// Write the bytes to the counter file
-	err = os.WriteFile(fatalCountFile, rcBytes, 0644)
+	err = safeWrite(r.Path, rcBytes)
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: failed to save run counts: %s", err)
 	}
 
 	return nil
 }
-
-// readFatalFile reads the temporary file for count.
-func (r *FatalCount) readFatalFile() (err error) {
-	// Read the contents into bytes
-	countsBytes, err := os.ReadFile(fatalCountFile)
-	if err != nil {
-		return fmt.Errorf("ec2macosinit: Failed to read %s: %s", fatalCountFile, err)
-	}
-
-	// Unmarshal to the struct
-	err = json.Unmarshal(countsBytes, &r)
-	if err != nil {
-		return fmt.Errorf("ec2macosinit: Failed to parse json: %s", err)
-	}
-
-	return nil
-}
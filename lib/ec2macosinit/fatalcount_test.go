@@ -0,0 +1,37 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFatalCount_boots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fatal-counts.json")
+
+	// No file yet, start counting for this boot
+	r := &FatalCount{Path: path}
+	require.NoError(t, r.readFatalCountForBoot(100))
+	assert.Equal(t, 1, r.Count)
+
+	// Fatal exits during the same boot accumulate
+	require.NoError(t, r.incrementFatalCountForBoot(100))
+	require.NoError(t, r.incrementFatalCountForBoot(100))
+	r = &FatalCount{Path: path}
+	require.NoError(t, r.readFatalCountForBoot(100))
+	assert.Equal(t, 3, r.Count)
+
+	// A count from a previous boot is ignored
+	r = &FatalCount{Path: path}
+	require.NoError(t, r.readFatalCountForBoot(200))
+	assert.Equal(t, 1, r.Count)
+	require.NoError(t, r.incrementFatalCountForBoot(200))
+	assert.Equal(t, 2, r.Count)
+
+	// Corrupt files are reported
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	assert.Error(t, (&FatalCount{Path: path}).readFatalCountForBoot(200))
+}
@@ -0,0 +1,212 @@
+package ec2macosinit
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// maxFetchSize is the largest payload that will be downloaded into memory.
+	maxFetchSize = 64 << 20 // 64 MiB
+	// fetchTimeout bounds each download attempt.
+	fetchTimeout = 5 * time.Minute
+	// downloadTimeout bounds each attempt of a download to a file, which may be much larger than maxFetchSize.
+	downloadTimeout = 30 * time.Minute
+	// fetchAttempts is the number of attempts made for each download.
+	fetchAttempts = 3
+)
+
+// fetchBackoff is the backoff between attempts of downloads and AWS API requests.
+var fetchBackoff = Backoff{Initial: time.Second, Max: 10 * time.Second, Jitter: 0.2, Attempts: fetchAttempts}
+
+// fetchSource downloads the content at source, which may be an http(s):// URL or an s3:// URI. S3 objects are fetched
+// using the instance profile role credentials.
+func fetchSource(ctx *ModuleContext, source string) (data []byte, err error) {
+	newRequest, err := sourceRequest(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: fetchTimeout}
+	err = Retry(context.Background(), fetchBackoff, func() (err error) {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		data, err = doFetch(client, req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to fetch %s: %s", source, err)
+	}
+
+	return data, nil
+}
+
+// sourceRequest returns a function which creates a GET request for source, which may be an http(s):// URL or an s3://
+// URI. S3 requests are signed when they're created, so a new request is created for each attempt.
+func sourceRequest(ctx *ModuleContext, source string) (newRequest func() (*http.Request, error), err error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: invalid source %s: %s", source, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, u.String(), nil)
+		}, nil
+	case "s3":
+		bucket, key, err := parseS3URI(u)
+		if err != nil {
+			return nil, err
+		}
+		region, err := ctx.IMDS.getRegion()
+		if err != nil {
+			return nil, err
+		}
+		return s3Request(ctx, bucket, key, region, nil), nil
+	}
+	return nil, fmt.Errorf("ec2macosinit: unsupported source scheme %q in %s", u.Scheme, source)
+}
+
+// s3Request returns a function which creates a GET request for an S3 object in region, with any additional headers,
+// signed with the instance profile role credentials. Requests are signed for each attempt so that retries never use
+// expired credentials.
+func s3Request(ctx *ModuleContext, bucket, key, region string, header http.Header) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, s3ObjectURL(bucket, key, region), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		creds, err := ctx.IMDS.getRoleCredentials()
+		if err != nil {
+			return nil, err
+		}
+		signRequestV4(req, nil, creds, region, "s3", time.Now())
+		return req, nil
+	}
+}
+
+// downloadFile streams the response to a request from newRequest into a temporary file in the same directory as path,
+// so that it can be renamed over path once it's complete. There's no limit on the size of the download. Each attempt
+// starts over, and failed attempts are retried. check, if not nil, is given the response headers and the SHA-256 of
+// the content, and a download it returns an error for is retried. The caller removes or renames the temporary file.
+func downloadFile(newRequest func() (*http.Request, error), path string, check func(header http.Header, sum []byte) error) (tmp string, sum []byte, err error) {
+	client := &http.Client{Timeout: downloadTimeout}
+	err = Retry(context.Background(), fetchBackoff, func() (err error) {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		tmp, sum, err = downloadAttempt(client, req, path, check)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return tmp, sum, nil
+}
+
+// downloadAttempt makes a single attempt of downloadFile. The temporary file is removed if the attempt fails.
+func downloadAttempt(client *http.Client, req *http.Request, path string, check func(header http.Header, sum []byte) error) (tmp string, sum []byte, err error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("received an unexpected response: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*", filepath.Base(path)))
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return "", nil, err
+	}
+	sum = h.Sum(nil)
+	if check != nil {
+		err = check(resp.Header, sum)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return f.Name(), sum, nil
+}
+
+// doFetch performs a GET request and returns the body, enforcing maxFetchSize.
+func doFetch(client *http.Client, req *http.Request) (data []byte, err error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received an unexpected response: %s", resp.Status)
+	}
+	if resp.ContentLength > maxFetchSize {
+		return nil, fmt.Errorf("content length %d exceeds the maximum of %d bytes", resp.ContentLength, maxFetchSize)
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxFetchSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFetchSize {
+		return nil, fmt.Errorf("content exceeds the maximum of %d bytes", maxFetchSize)
+	}
+
+	return data, nil
+}
+
+// parseS3URI splits an s3://bucket/key URI into its bucket and key.
+func parseS3URI(u *url.URL) (bucket, key string, err error) {
+	bucket = u.Host
+	key = strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("ec2macosinit: invalid S3 URI %s, expected s3://bucket/key", u.String())
+	}
+	return bucket, key, nil
+}
+
+// s3ObjectURL returns the HTTPS URL for an object. Virtual-hosted style addressing is used unless the bucket name
+// contains dots, which would not match the wildcard TLS certificate.
+func s3ObjectURL(bucket, key, region string) string {
+	var segments []string
+	for _, s := range strings.Split(key, "/") {
+		segments = append(segments, uriEncode(s))
+	}
+	escapedKey := strings.Join(segments, "/")
+
+	if strings.Contains(bucket, ".") {
+		return fmt.Sprintf("https://s3.%s.%s/%s/%s", region, awsDomain(region), bucket, escapedKey)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.%s/%s", bucket, region, awsDomain(region), escapedKey)
+}
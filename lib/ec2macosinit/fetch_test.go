@@ -0,0 +1,27 @@
+package ec2macosinit
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseS3URI(t *testing.T) {
+	u, _ := url.Parse("s3://my-bucket/path/to/object.sh")
+	bucket, key, err := parseS3URI(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-bucket", bucket)
+	assert.Equal(t, "path/to/object.sh", key)
+
+	u, _ = url.Parse("s3://my-bucket/")
+	_, _, err = parseS3URI(u)
+	assert.Error(t, err, "should require a key")
+}
+
+func Test_s3ObjectURL(t *testing.T) {
+	assert.Equal(t, "https://my-bucket.s3.us-west-2.amazonaws.com/dir/a%20b%2Bc",
+		s3ObjectURL("my-bucket", "dir/a b+c", "us-west-2"))
+	assert.Equal(t, "https://s3.us-west-2.amazonaws.com/my.bucket/key",
+		s3ObjectURL("my.bucket", "key", "us-west-2"))
+}
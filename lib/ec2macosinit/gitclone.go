@@ -0,0 +1,192 @@
+package ec2macosinit
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// gitPath is the path to git, which is installed with the Command Line Tools
+	gitPath = "/usr/bin/git"
+	// gitTimeout bounds each git command, so that an unreachable remote can't hold up the run
+	gitTimeout = 30 * time.Minute
+	// defaultGitTokenUsername is the username sent with a token, which GitHub requires to be set but ignores
+	defaultGitTokenUsername = "x-access-token"
+)
+
+// GitCloneModule contains all necessary configuration fields for running a GitClone module.
+type GitCloneModule struct {
+	Repository    string `toml:"Repository"`    // Repository is the URL of the repository
+	Path          string `toml:"Path"`          // Path is the absolute path of the checkout
+	Ref           string `toml:"Ref"`           // Ref is the branch, tag, or commit to check out, default is the remote's HEAD
+	Depth         int    `toml:"Depth"`         // Depth limits the history fetched, default is the full history
+	RunAsUser     string `toml:"RunAsUser"`     // RunAsUser owns the checkout and runs git, default is root
+	TokenSecret   string `toml:"TokenSecret"`   // TokenSecret is the Secrets Manager secret holding a token for HTTPS
+	TokenUsername string `toml:"TokenUsername"` // TokenUsername is sent with the token, default is "x-access-token"
+}
+
+// Do for the GitCloneModule clones the repository to the path, or updates an existing checkout of it, and checks out
+// the configured ref as a detached HEAD. Local changes to tracked files in the checkout are discarded. A token for
+// HTTPS repositories is read from Secrets Manager and given to git in its environment, so it's never written to the
+// checkout's configuration or shown in the process list.
+func (c *GitCloneModule) Do(ctx *ModuleContext) (message string, err error) {
+	if c.Repository == "" {
+		return "", fmt.Errorf("ec2macosinit: a Repository is required for git clone")
+	}
+	if !filepath.IsAbs(c.Path) {
+		return "", fmt.Errorf("ec2macosinit: the path of the checkout must be absolute, not %q", c.Path)
+	}
+	ref := c.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	env, err := c.gitEnv(ctx)
+	if err != nil {
+		return "", err
+	}
+	git := func(args ...string) (out commandOutput, err error) {
+		out, err = ctx.runCommand(append([]string{gitPath, "-C", c.Path}, args...), commandOptions{
+			RunAsUser: c.RunAsUser,
+			EnvVars:   env,
+			Timeout:   gitTimeout,
+		})
+		if err != nil {
+			return out, fmt.Errorf("ec2macosinit: git %s failed: %s %s", args[0], err, strings.TrimSpace(out.stderr))
+		}
+		return out, nil
+	}
+
+	cloned, err := c.prepareCheckout(ctx, env)
+	if err != nil {
+		return "", err
+	}
+	var before string
+	if !cloned {
+		out, err := git("remote", "get-url", "origin")
+		if err != nil {
+			return "", err
+		}
+		if origin := strings.TrimSpace(out.stdout); origin != c.Repository {
+			return "", fmt.Errorf("ec2macosinit: %s is a checkout of %s, not %s", c.Path, origin, c.Repository)
+		}
+		// A checkout without any commits has no HEAD yet
+		if out, err := git("rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+			before = strings.TrimSpace(out.stdout)
+		}
+	}
+
+	fetch := []string{"fetch", "--quiet"}
+	if c.Depth > 0 {
+		fetch = append(fetch, fmt.Sprintf("--depth=%d", c.Depth))
+	}
+	_, err = git(append(fetch, "origin", ref)...)
+	if err != nil {
+		return "", err
+	}
+	_, err = git("checkout", "--quiet", "--force", "--detach", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+	out, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	after := strings.TrimSpace(out.stdout)
+
+	if after == before {
+		ctx.Logger.Infof("Checkout [%s] already at %s (%s)", c.Path, ref, after)
+		return fmt.Sprintf("checkout %s already at %s (%s)", c.Path, ref, after), nil
+	}
+	ctx.Logger.Infof("Checked out %s (%s) of %s in [%s]", ref, after, c.Repository, c.Path)
+	return fmt.Sprintf("successfully checked out %s (%s) in %s", ref, after, c.Path), nil
+}
+
+// prepareCheckout clones the repository, without checking anything out, when the path doesn't exist or is an empty
+// directory. A path which is neither, nor a git checkout, is refused rather than overwritten.
+func (c *GitCloneModule) prepareCheckout(ctx *ModuleContext, env []string) (cloned bool, err error) {
+	entries, err := os.ReadDir(c.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ec2macosinit: unable to read %s: %s", c.Path, err)
+	}
+	if len(entries) > 0 {
+		if _, err := os.Stat(filepath.Join(c.Path, ".git")); err != nil {
+			return false, fmt.Errorf("ec2macosinit: %s isn't empty or a git checkout, refusing to clone into it", c.Path)
+		}
+		return false, nil
+	}
+
+	// The checkout is created by root and handed to the user, who may not be able to write to its parent
+	err = os.MkdirAll(c.Path, 0755)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to create %s: %s", c.Path, err)
+	}
+	if c.RunAsUser != "" {
+		uid, gid, err := ctx.getUIDandGID(c.RunAsUser)
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: error looking up user %s: %s", c.RunAsUser, err)
+		}
+		err = os.Chown(c.Path, uid, gid)
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to give %s to %s: %s", c.Path, c.RunAsUser, err)
+		}
+	}
+
+	clone := []string{gitPath, "clone", "--quiet", "--no-checkout"}
+	if c.Depth > 0 {
+		clone = append(clone, fmt.Sprintf("--depth=%d", c.Depth))
+	}
+	out, err := ctx.runCommand(append(clone, "--", c.Repository, c.Path), commandOptions{
+		RunAsUser: c.RunAsUser,
+		EnvVars:   env,
+		Timeout:   gitTimeout,
+	})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: git clone of %s failed: %s %s", c.Repository, err, strings.TrimSpace(out.stderr))
+	}
+	return true, nil
+}
+
+// gitEnv returns the environment for git. Prompts are disabled so that git fails instead of waiting for credentials,
+// HOME is the user's so that their git configuration is used, and the token, if there is one, is sent in an
+// Authorization header for the repository's URL only.
+func (c *GitCloneModule) gitEnv(ctx *ModuleContext) (env []string, err error) {
+	env = []string{"GIT_TERMINAL_PROMPT=0"}
+	if c.RunAsUser != "" {
+		home, err := getUserHomeDirectory(c.RunAsUser)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: error getting home directory of %s: %s", c.RunAsUser, err)
+		}
+		env = append(env, "HOME="+home)
+	}
+	if c.TokenSecret == "" {
+		return env, nil
+	}
+
+	u, err := url.Parse(c.Repository)
+	if err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("ec2macosinit: a TokenSecret can only be used with an https:// Repository")
+	}
+	token, err := getSecretsManagerSecret(ctx, c.TokenSecret)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to get token for %s: %s", c.Repository, err)
+	}
+	username := c.TokenUsername
+	if username == "" {
+		username = defaultGitTokenUsername
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + strings.TrimSpace(token)))
+	ctx.Logger.AddSensitive(credentials)
+	// Configuration from the environment isn't saved to the checkout, unlike a token in the URL
+	return append(env,
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=http.%s.extraHeader", c.Repository),
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials,
+	), nil
+}
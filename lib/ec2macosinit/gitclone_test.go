@@ -0,0 +1,78 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitCloneModule_Do(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playbooks")
+	head := "1111111111111111111111111111111111111111"
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch {
+		case c[1] == "clone":
+			return commandOutput{}, os.MkdirAll(filepath.Join(path, ".git"), 0755)
+		case strings.HasSuffix(strings.Join(c, " "), "remote get-url origin"):
+			return commandOutput{stdout: "https://github.com/example/playbooks.git\n"}, nil
+		case c[len(c)-1] == "HEAD" && c[3] == "rev-parse":
+			return commandOutput{stdout: head + "\n"}, nil
+		}
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	c := &GitCloneModule{Repository: "https://github.com/example/playbooks.git", Path: path, Ref: "main", Depth: 1}
+
+	// A new checkout is cloned
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "successfully checked out main")
+	assert.Equal(t, []string{
+		"/usr/bin/git clone --quiet --no-checkout --depth=1 -- https://github.com/example/playbooks.git " + path,
+		"/usr/bin/git -C " + path + " fetch --quiet --depth=1 origin main",
+		"/usr/bin/git -C " + path + " checkout --quiet --force --detach FETCH_HEAD",
+		"/usr/bin/git -C " + path + " rev-parse HEAD",
+	}, fake.commands)
+
+	// An existing checkout is updated, and is unchanged when already at the ref
+	fake.commands = nil
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, message, "already at main")
+	assert.Equal(t, "/usr/bin/git -C "+path+" remote get-url origin", fake.commands[0])
+	assert.NotContains(t, strings.Join(fake.commands, "\n"), "clone")
+
+	// A checkout of a different repository isn't touched
+	c.Repository = "https://github.com/example/other.git"
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+}
+
+func TestGitCloneModule_prepareCheckout(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(path, "notes.txt"), []byte("keep"), 0644))
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{}, fmt.Errorf("unexpected command")
+	}}
+	c := &GitCloneModule{Repository: "https://github.com/example/playbooks.git", Path: path}
+
+	// A directory with other files isn't cloned into
+	_, err := c.prepareCheckout(&ModuleContext{Logger: &Logger{}, executor: fake}, nil)
+	assert.Error(t, err)
+	assert.Empty(t, fake.commands)
+}
+
+func TestGitCloneModule_gitEnv(t *testing.T) {
+	env, err := (&GitCloneModule{Repository: "git@github.com:example/playbooks.git"}).gitEnv(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GIT_TERMINAL_PROMPT=0"}, env)
+
+	// Tokens are only sent over HTTPS
+	_, err = (&GitCloneModule{Repository: "git@github.com:example/playbooks.git", TokenSecret: "token"}).gitEnv(&ModuleContext{Logger: &Logger{}})
+	assert.Error(t, err)
+}
@@ -1,75 +1,281 @@
 package ec2macosinit
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	imdsBase              = "http://169.254.169.254/latest/"
-	imdsTokenTTL          = 21600
+	imdsEndpoint          = "http://169.254.169.254"
+	imdsTokenTTL          = 21600 // imdsTokenTTL is the default and maximum token TTL in seconds
 	tokenEndpoint         = "api/token"
 	tokenRequestTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
 	tokenHeader           = "X-aws-ec2-metadata-token"
+
+	imdsRequestTimeout = 5 * time.Second        // imdsRequestTimeout bounds each request, so a hung connection can't stall boot
+	imdsAttempts       = 4                      // imdsAttempts is the number of attempts of each request
+	imdsBackoffBase    = 250 * time.Millisecond // imdsBackoffBase is the delay before the first retry, doubled for each retry
+	imdsBackoffMax     = 2 * time.Second        // imdsBackoffMax limits the delay between retries
+	imdsTokenRenewal   = 60 * time.Second       // imdsTokenRenewal is how long before expiry a token is renewed
+)
+
+// Environment variables overriding the IMDS settings in the configuration file. The endpoint variable is the one used
+// by the AWS SDKs and CLI.
+const (
+	imdsEndpointEnv = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+	imdsTokenTTLEnv = "EC2_MACOS_INIT_IMDS_TOKEN_TTL"
 )
 
+// imdsClient is shared by all IMDS requests.
+var imdsClient = &http.Client{Timeout: imdsRequestTimeout}
+
+// imdsCachedPaths are the IMDS properties which don't change while an instance is running. They are fetched at most
+// once per run and then served from the cache to every module, so that all modules see the same values. Properties
+// which do change, like role credentials, are always requested from IMDS.
+var imdsCachedPaths = []string{
+	"dynamic/instance-identity/document",
+	"meta-data/instance-id",
+	"meta-data/instance-type",
+	"meta-data/placement/availability-zone",
+	"meta-data/placement/region",
+	"meta-data/public-keys/",
+	"meta-data/public-keys/0/openssh-key",
+	"user-data",
+}
+
 // IMDS config contains the current instance ID and a place for the IMDSv2 token to be stored.
 // Using IMDSv2:
 // https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/configuring-instance-metadata-service.html#instance-metadata-v2-how-it-works
 type IMDSConfig struct {
-	token      string
-	InstanceID string
+	token       string
+	tokenExpiry time.Time // tokenExpiry is when the token should be renewed, shortly before it expires
+	InstanceID  string
+
+	Endpoint        string `toml:"Endpoint"`        // Endpoint is the IMDS URL, such as a proxy or mock, instead of imdsEndpoint
+	TokenTTLSeconds int    `toml:"TokenTTLSeconds"` // TokenTTLSeconds is the lifetime of requested tokens, up to imdsTokenTTL
+	MockPath        string `toml:"-"`               // MockPath serves IMDS from a directory or JSON file instead, for testing
+
+	tokenMu sync.Mutex              // tokenMu guards token, which is shared by modules running in parallel
+	cacheMu sync.Mutex              // cacheMu guards cache and is held while a cached property is fetched
+	cache   map[string]imdsProperty // cache holds the responses for imdsCachedPaths
+	credsMu sync.Mutex              // credsMu guards creds and is held while they're fetched
+	creds   awsCredentials          // creds are the cached instance profile role credentials
+}
+
+// imdsProperty is a response from IMDS.
+type imdsProperty struct {
+	value string
+	code  int
+}
+
+// isCachedPath returns whether the endpoint is one of imdsCachedPaths.
+func isCachedPath(endpoint string) bool {
+	for _, p := range imdsCachedPaths {
+		if endpoint == p {
+			return true
+		}
+	}
+	return false
 }
 
-// getIMDSProperty gets a given endpoint property from IMDS.
+// Prefetch fetches every cached IMDS property so that modules don't need to make their own requests. Properties which
+// can't be fetched are requested again when a module uses them.
+func (i *IMDSConfig) Prefetch() (err error) {
+	var failed []string
+	for _, endpoint := range imdsCachedPaths {
+		_, _, err := i.getIMDSProperty(endpoint)
+		if err != nil {
+			failed = append(failed, endpoint)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ec2macosinit: unable to prefetch IMDS properties: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// ClearCache drops every cached IMDS property so that they're fetched again, for long running processes where
+// properties such as the public keys may have changed since they were cached.
+func (i *IMDSConfig) ClearCache() {
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	i.cache = nil
+}
+
+// getIMDSProperty gets a given endpoint property from IMDS, or from the cache for properties which don't change.
 func (i *IMDSConfig) getIMDSProperty(endpoint string) (value string, httpResponseCode int, err error) {
-	// Check that an IMDSv2 token exists - get one if it doesn't
-	if i.token == "" {
+	if !isCachedPath(endpoint) {
+		return i.fetchIMDSProperty(endpoint)
+	}
+
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	if p, ok := i.cache[endpoint]; ok {
+		return p.value, p.code, nil
+	}
+	value, httpResponseCode, err = i.fetchIMDSProperty(endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	// Only cache definitive answers, anything else is retried on the next request
+	if (httpResponseCode == 200 && value != "") || httpResponseCode == 404 {
+		if i.cache == nil {
+			i.cache = map[string]imdsProperty{}
+		}
+		i.cache[endpoint] = imdsProperty{value: value, code: httpResponseCode}
+	}
+	return value, httpResponseCode, nil
+}
+
+// validate checks the IMDS settings from the configuration file and environment.
+func (i *IMDSConfig) validate() (err error) {
+	for _, endpoint := range []string{i.Endpoint, os.Getenv(imdsEndpointEnv)} {
+		if endpoint == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("ec2macosinit: invalid IMDS endpoint %q, must be an http:// or https:// URL\n", endpoint)
+		}
+	}
+	if i.TokenTTLSeconds < 0 || i.TokenTTLSeconds > imdsTokenTTL {
+		return fmt.Errorf("ec2macosinit: IMDS TokenTTLSeconds must be between 1 and %d\n", imdsTokenTTL)
+	}
+	if v := os.Getenv(imdsTokenTTLEnv); v != "" {
+		ttl, err := strconv.Atoi(v)
+		if err != nil || ttl < 1 || ttl > imdsTokenTTL {
+			return fmt.Errorf("ec2macosinit: %s must be between 1 and %d\n", imdsTokenTTLEnv, imdsTokenTTL)
+		}
+	}
+	return nil
+}
+
+// baseURL returns the base URL of IMDS, from the environment, the configuration file, or the default endpoint.
+func (i *IMDSConfig) baseURL() string {
+	endpoint := os.Getenv(imdsEndpointEnv)
+	if endpoint == "" {
+		endpoint = i.Endpoint
+	}
+	if endpoint == "" {
+		endpoint = imdsEndpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/latest/"
+}
+
+// tokenTTL returns the lifetime of requested tokens in seconds, from the environment, the configuration file, or the
+// default.
+func (i *IMDSConfig) tokenTTL() int {
+	if ttl, err := strconv.Atoi(os.Getenv(imdsTokenTTLEnv)); err == nil && ttl > 0 && ttl <= imdsTokenTTL {
+		return ttl
+	}
+	if i.TokenTTLSeconds > 0 {
+		return i.TokenTTLSeconds
+	}
+	return imdsTokenTTL
+}
+
+// fetchIMDSProperty requests a given endpoint property from IMDS. Connection errors and server errors are retried with
+// exponential backoff, while a 401 response, meaning the token has expired, gets a new token before retrying.
+func (i *IMDSConfig) fetchIMDSProperty(endpoint string) (value string, httpResponseCode int, err error) {
+	if mock := i.MockSource(); mock != "" {
+		return mockIMDSProperty(mock, endpoint)
+	}
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		value, httpResponseCode, retryable, err = i.fetchIMDSPropertyOnce(endpoint)
+		if !retryable || attempt >= imdsAttempts {
+			return value, httpResponseCode, err
+		}
+		if httpResponseCode != http.StatusUnauthorized {
+			time.Sleep(imdsBackoff(attempt))
+		}
+	}
+}
+
+// fetchIMDSPropertyOnce makes a single request for an IMDS property and returns whether a failure may be retried.
+func (i *IMDSConfig) fetchIMDSPropertyOnce(endpoint string) (value string, httpResponseCode int, retryable bool, err error) {
+	// Check that an unexpired IMDSv2 token exists - get one if it doesn't
+	i.tokenMu.Lock()
+	if i.token == "" || !time.Now().Before(i.tokenExpiry) {
 		err = i.getNewToken()
 		if err != nil {
-			return "", 0, fmt.Errorf("ec2macosinit: error while getting new IMDS token: %s\n", err)
+			i.tokenMu.Unlock()
+			return "", 0, true, fmt.Errorf("ec2macosinit: error while getting new IMDS token: %s\n", err)
 		}
 	}
+	token := i.token
+	i.tokenMu.Unlock()
 
 	// Create request
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, imdsBase+endpoint, nil)
+	req, err := http.NewRequest(http.MethodGet, i.baseURL()+endpoint, nil)
 	if err != nil {
-		return "", 0, fmt.Errorf("ec2macosinit: error while creating new HTTP request: %s\n", err)
+		return "", 0, false, fmt.Errorf("ec2macosinit: error while creating new HTTP request: %s\n", err)
 	}
-	req.Header.Set(tokenHeader, i.token) // set IMDSv2 token
+	req.Header.Set(tokenHeader, token) // set IMDSv2 token
 
 	// Make request
-	resp, err := client.Do(req)
+	resp, err := imdsClient.Do(req)
 	if err != nil {
-		return "", 0, fmt.Errorf("ec2macosinit: error while requesting IMDS property: %s\n", err)
+		return "", 0, true, fmt.Errorf("ec2macosinit: error while requesting IMDS property: %s\n", err)
 	}
+	defer resp.Body.Close()
 
 	// Convert returned io.ReadCloser to string
 	value, err = ioReadCloserToString(resp.Body)
 	if err != nil {
-		return "", 0, fmt.Errorf("ec2macosinit: error reading response body: %s\n", err)
+		return "", 0, true, fmt.Errorf("ec2macosinit: error reading response body: %s\n", err)
 	}
 
-	return value, resp.StatusCode, nil
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		// The token has expired, drop it unless another request already replaced it
+		i.tokenMu.Lock()
+		if i.token == token {
+			i.token = ""
+		}
+		i.tokenMu.Unlock()
+		return value, resp.StatusCode, true, nil
+	case resp.StatusCode >= 500:
+		return value, resp.StatusCode, true, nil
+	}
+	return value, resp.StatusCode, false, nil
 }
 
-// getNewToken gets a new IMDSv2 token from the IMDS API.
+// imdsBackoff returns the delay before retrying after the given attempt, doubling with each attempt up to
+// imdsBackoffMax. Half of the delay is random so that retries from parallel modules are spread out.
+func imdsBackoff(attempt int) time.Duration {
+	d := imdsBackoffBase << (attempt - 1)
+	if d > imdsBackoffMax || d <= 0 {
+		d = imdsBackoffMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// getNewToken gets a new IMDSv2 token from the IMDS API. The caller must hold tokenMu.
 func (i *IMDSConfig) getNewToken() (err error) {
 	// Create request
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPut, imdsBase+tokenEndpoint, nil)
+	req, err := http.NewRequest(http.MethodPut, i.baseURL()+tokenEndpoint, nil)
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: error while creating new HTTP request: %s\n", err)
 	}
-	req.Header.Set(tokenRequestTTLHeader, strconv.FormatInt(int64(imdsTokenTTL), 10))
+	ttl := time.Duration(i.tokenTTL()) * time.Second
+	req.Header.Set(tokenRequestTTLHeader, strconv.Itoa(i.tokenTTL()))
 
 	// Make request
-	resp, err := client.Do(req)
+	resp, err := imdsClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: error while requesting new token: %s\n", err)
 	}
+	defer resp.Body.Close()
 
 	// Validate response code
 	if resp.StatusCode != 200 {
@@ -79,15 +285,182 @@ func (i *IMDSConfig) getNewToken() (err error) {
 		)
 	}
 
-	// Set returned value
+	// Set returned value, and when it should be renewed
 	i.token, err = ioReadCloserToString(resp.Body)
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: error reading response body: %s\n", err)
 	}
+	i.tokenExpiry = time.Now().Add(tokenRenewalTime(ttl))
 
 	return nil
 }
 
+// tokenRenewalTime returns how long a token with the given TTL is used before it's renewed. Tokens are renewed
+// imdsTokenRenewal before they expire, or halfway through short TTLs, so that a request never uses an expired token.
+func tokenRenewalTime(ttl time.Duration) time.Duration {
+	if ttl <= 2*imdsTokenRenewal {
+		return ttl / 2
+	}
+	return ttl - imdsTokenRenewal
+}
+
+// InstanceIdentity is the instance identity document, which describes the instance and where it's running.
+type InstanceIdentity struct {
+	AccountID        string `json:"accountId"`
+	Architecture     string `json:"architecture"`
+	AvailabilityZone string `json:"availabilityZone"`
+	ImageID          string `json:"imageId"`
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	PrivateIP        string `json:"privateIp"`
+	Region           string `json:"region"`
+}
+
+// InstanceIdentity gets the instance identity document from IMDS. The document is cached, so modules can use it
+// without making their own requests.
+func (i *IMDSConfig) InstanceIdentity() (identity InstanceIdentity, err error) {
+	document, respCode, err := i.getIMDSProperty("dynamic/instance-identity/document")
+	if err != nil {
+		return InstanceIdentity{}, fmt.Errorf("ec2macosinit: error getting instance identity document from IMDS: %s", err)
+	}
+	if respCode != 200 {
+		return InstanceIdentity{}, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+	err = json.Unmarshal([]byte(document), &identity)
+	if err != nil {
+		return InstanceIdentity{}, fmt.Errorf("ec2macosinit: unable to parse instance identity document: %s", err)
+	}
+	return identity, nil
+}
+
+// instanceTagsEndpoint lists the instance's tag keys, when access to tags in instance metadata is enabled.
+const instanceTagsEndpoint = "meta-data/tags/instance"
+
+// InstanceTags gets the instance's tags from IMDS. Tags can change while the instance runs, so they aren't cached. When
+// access to tags in instance metadata isn't enabled for the instance, there are no tags rather than an error.
+func (i *IMDSConfig) InstanceTags() (tags map[string]string, err error) {
+	keys, respCode, err := i.getIMDSProperty(instanceTagsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error getting instance tags from IMDS: %s", err)
+	}
+	tags = map[string]string{}
+	if respCode == 404 { // 404 = tags aren't enabled in instance metadata
+		return tags, nil
+	}
+	if respCode != 200 {
+		return nil, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d", respCode)
+	}
+
+	for _, key := range strings.Split(keys, "\n") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		value, respCode, err := i.getIMDSProperty(instanceTagsEndpoint + "/" + url.PathEscape(key))
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: error getting instance tag %s from IMDS: %s", key, err)
+		}
+		if respCode != 200 {
+			return nil, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS for instance tag %s: %d", key, respCode)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// instanceEnvVars are the environment variables describing the instance and the IMDS properties they're set from.
+var instanceEnvVars = []struct{ name, endpoint string }{
+	{"EC2_INSTANCE_ID", "meta-data/instance-id"},
+	{"EC2_INSTANCE_TYPE", "meta-data/instance-type"},
+	{"EC2_REGION", "meta-data/placement/region"},
+	{"EC2_AVAILABILITY_ZONE", "meta-data/placement/availability-zone"},
+}
+
+// InstanceEnvironment returns environment variables describing the instance, in the form key=value, so that scripts
+// don't each need to query IMDS for them. With network, the primary network interface is described by EC2_MAC,
+// EC2_LOCAL_IPV4, EC2_SUBNET_ID, EC2_VPC_ID, and EC2_SECURITY_GROUP_IDS. With tags, each instance tag is included as
+// EC2_TAG_<key>. Tags can hold anything, so they're only included when asked for.
+func (i *IMDSConfig) InstanceEnvironment(network, tags bool) (env []string, err error) {
+	for _, v := range instanceEnvVars {
+		value, respCode, err := i.getIMDSProperty(v.endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: error getting %s from IMDS: %s", v.endpoint, err)
+		}
+		if respCode != 200 {
+			return nil, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS for %s: %d", v.endpoint, respCode)
+		}
+		env = append(env, v.name+"="+value)
+	}
+
+	if network {
+		vars, err := i.networkEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, vars...)
+	}
+	if tags {
+		vars, err := i.tagEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, vars...)
+	}
+	return env, nil
+}
+
+// networkEnvironment returns the environment variables describing the primary network interface, if there is one.
+func (i *IMDSConfig) networkEnvironment() (env []string, err error) {
+	interfaces, err := i.NetworkInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	// Interfaces are ordered by device number, so the first is the primary interface, eth0
+	if len(interfaces) > 0 && interfaces[0].DeviceNumber == 0 {
+		primary := interfaces[0]
+		var localIPv4 string
+		if len(primary.LocalIPv4s) > 0 {
+			localIPv4 = primary.LocalIPv4s[0]
+		}
+		env = append(env,
+			"EC2_MAC="+primary.MAC,
+			"EC2_LOCAL_IPV4="+localIPv4,
+			"EC2_SUBNET_ID="+primary.SubnetID,
+			"EC2_VPC_ID="+primary.VPCID,
+			"EC2_SECURITY_GROUP_IDS="+strings.Join(primary.SecurityGroupIDs, ","),
+		)
+	}
+	return env, nil
+}
+
+// tagEnvironment returns an EC2_TAG_<key> environment variable for each instance tag, ordered by key.
+func (i *IMDSConfig) tagEnvironment() (env []string, err error) {
+	tags, err := i.InstanceTags()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, "EC2_TAG_"+envVarName(key)+"="+tags[key])
+	}
+	return env, nil
+}
+
+// envVarName returns a tag key as an environment variable name, with each character other than letters, digits, and
+// underscores, such as the colons in aws: tags, replaced with an underscore.
+func envVarName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
 // UpdateInstanceID is a wrapper for getIMDSProperty that gets the current instance ID for the attached config.
 func (i *IMDSConfig) UpdateInstanceID() (err error) {
 	// If instance ID is already set, this doesn't need to be run
@@ -0,0 +1,270 @@
+package ec2macosinit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIMDS starts a fake IMDS serving the given properties, and returns a config using it along with the number
+// of requests made for each path.
+func newTestIMDS(t *testing.T, properties map[string]string) (*IMDSConfig, map[string]int) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/latest")
+		mu.Lock()
+		requests[path]++
+		mu.Unlock()
+		if path == "/"+tokenEndpoint {
+			_, _ = w.Write([]byte("token"))
+			return
+		}
+		value, ok := properties[path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(value))
+	}))
+	t.Cleanup(server.Close)
+	return &IMDSConfig{Endpoint: server.URL}, requests
+}
+
+func TestIMDSConfig_getIMDSProperty_cache(t *testing.T) {
+	i, requests := newTestIMDS(t, map[string]string{
+		"meta-data/instance-id":               "i-0123456789abcdef0",
+		"meta-data/placement/region":          "us-west-2",
+		"meta-data/iam/security-credentials/": "role",
+	})
+
+	require.NoError(t, i.Prefetch(), "missing properties are cached as 404s")
+	assert.Equal(t, 1, requests["/"+tokenEndpoint])
+
+	var wg sync.WaitGroup
+	for n := 0; n < 5; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			region, err := i.getRegion()
+			assert.NoError(t, err)
+			assert.Equal(t, "us-west-2", region)
+			_, code, err := i.getIMDSProperty("user-data")
+			assert.NoError(t, err)
+			assert.Equal(t, 404, code)
+			_, _, err = i.getIMDSProperty(iamCredentialsEndpoint)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, requests["/meta-data/placement/region"])
+	assert.Equal(t, 1, requests["/user-data"])
+	assert.Equal(t, 5, requests["/"+iamCredentialsEndpoint], "credentials aren't cached")
+
+	// Clearing the cache fetches properties again
+	i.ClearCache()
+	_, err := i.getRegion()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests["/meta-data/placement/region"])
+}
+
+func TestIMDSConfig_InstanceEnvironment(t *testing.T) {
+	properties := map[string]string{
+		"meta-data/instance-id":                 "i-0123456789abcdef0",
+		"meta-data/instance-type":               "mac2.metal",
+		"meta-data/placement/region":            "us-west-2",
+		"meta-data/placement/availability-zone": "us-west-2a",
+		"meta-data/network/interfaces/macs/":    "0a:00:00:00:00:01/",
+		"meta-data/tags/instance":               "Name\nci:pool",
+		"meta-data/tags/instance/Name":          "build-agent",
+		"meta-data/tags/instance/ci:pool":       "xcode-15",
+	}
+	const primary = "meta-data/network/interfaces/macs/0a:00:00:00:00:01/"
+	for name, value := range map[string]string{
+		"device-number":      "0",
+		"interface-id":       "eni-01",
+		"local-ipv4s":        "10.0.0.10\n10.0.0.11",
+		"subnet-id":          "subnet-01",
+		"security-group-ids": "sg-01\nsg-02",
+		"vpc-id":             "vpc-01",
+	} {
+		properties[primary+name] = value
+	}
+	i, _ := newTestIMDS(t, properties)
+	env, err := i.InstanceEnvironment(false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"EC2_INSTANCE_ID=i-0123456789abcdef0",
+		"EC2_INSTANCE_TYPE=mac2.metal",
+		"EC2_REGION=us-west-2",
+		"EC2_AVAILABILITY_ZONE=us-west-2a",
+	}, env)
+
+	// The network interface and tags are only included when asked for
+	env, err = i.InstanceEnvironment(true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"EC2_INSTANCE_ID=i-0123456789abcdef0",
+		"EC2_INSTANCE_TYPE=mac2.metal",
+		"EC2_REGION=us-west-2",
+		"EC2_AVAILABILITY_ZONE=us-west-2a",
+		"EC2_MAC=0a:00:00:00:00:01",
+		"EC2_LOCAL_IPV4=10.0.0.10",
+		"EC2_SUBNET_ID=subnet-01",
+		"EC2_VPC_ID=vpc-01",
+		"EC2_SECURITY_GROUP_IDS=sg-01,sg-02",
+		"EC2_TAG_Name=build-agent",
+		"EC2_TAG_ci_pool=xcode-15",
+	}, env)
+
+	i, _ = newTestIMDS(t, map[string]string{"meta-data/instance-id": "i-0123456789abcdef0"})
+	_, err = i.InstanceEnvironment(false, false)
+	assert.Error(t, err)
+}
+
+func TestIMDSConfig_fetchIMDSProperty_retries(t *testing.T) {
+	var mu sync.Mutex
+	tokens, failures := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.TrimPrefix(r.URL.Path, "/latest") {
+		case "/" + tokenEndpoint:
+			tokens++
+			_, _ = w.Write([]byte("token-" + strconv.Itoa(tokens)))
+		case "/meta-data/instance-type":
+			// The first token has expired, then IMDS fails once before succeeding
+			if r.Header.Get(tokenHeader) == "token-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if failures == 0 {
+				failures++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte("mac2.metal"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	i := &IMDSConfig{Endpoint: server.URL}
+	value, code, err := i.fetchIMDSProperty("meta-data/instance-type")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "mac2.metal", value)
+	assert.Equal(t, 2, tokens, "a new token is requested after a 401")
+
+	// Tokens are renewed before they expire
+	_, _, err = i.fetchIMDSProperty("meta-data/instance-type")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tokens)
+	i.tokenExpiry = time.Now().Add(-time.Second)
+	_, _, err = i.fetchIMDSProperty("meta-data/instance-type")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tokens)
+	assert.Equal(t, 21540*time.Second, tokenRenewalTime(21600*time.Second))
+	assert.Equal(t, 30*time.Second, tokenRenewalTime(60*time.Second))
+
+	// Server errors are returned once the attempts are used up
+	_, code, err = i.fetchIMDSProperty("meta-data/ami-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, code)
+}
+
+func Test_imdsBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := imdsBackoff(attempt)
+		assert.LessOrEqual(t, d, imdsBackoffMax)
+		assert.GreaterOrEqual(t, d, imdsBackoffBase/2)
+	}
+}
+
+func TestIMDSConfig_settings(t *testing.T) {
+	i := &IMDSConfig{}
+	assert.NoError(t, i.validate())
+	assert.Equal(t, "http://169.254.169.254/latest/", i.baseURL())
+	assert.Equal(t, 21600, i.tokenTTL())
+
+	i = &IMDSConfig{Endpoint: "http://localhost:1338/", TokenTTLSeconds: 300}
+	assert.NoError(t, i.validate())
+	assert.Equal(t, "http://localhost:1338/latest/", i.baseURL())
+	assert.Equal(t, 300, i.tokenTTL())
+
+	// The environment overrides the configuration file
+	t.Setenv(imdsEndpointEnv, "http://[fd00:ec2::254]")
+	t.Setenv(imdsTokenTTLEnv, "60")
+	assert.NoError(t, i.validate())
+	assert.Equal(t, "http://[fd00:ec2::254]/latest/", i.baseURL())
+	assert.Equal(t, 60, i.tokenTTL())
+
+	t.Setenv(imdsTokenTTLEnv, "21601")
+	assert.Error(t, i.validate())
+	t.Setenv(imdsTokenTTLEnv, "")
+	assert.Error(t, (&IMDSConfig{Endpoint: "169.254.169.254"}).validate())
+	assert.Error(t, (&IMDSConfig{TokenTTLSeconds: -1}).validate())
+}
+
+func TestIMDSConfig_InstanceIdentity(t *testing.T) {
+	i, requests := newTestIMDS(t, map[string]string{
+		"dynamic/instance-identity/document": `{
+  "accountId" : "123456789012",
+  "architecture" : "arm64",
+  "availabilityZone" : "us-west-2a",
+  "billingProducts" : null,
+  "imageId" : "ami-0123456789abcdef0",
+  "instanceId" : "i-0123456789abcdef0",
+  "instanceType" : "mac2.metal",
+  "pendingTime" : "2023-01-01T00:00:00Z",
+  "privateIp" : "10.0.0.10",
+  "region" : "us-west-2",
+  "version" : "2017-09-30"
+}`,
+	})
+	for n := 0; n < 2; n++ {
+		identity, err := i.InstanceIdentity()
+		assert.NoError(t, err)
+		assert.Equal(t, InstanceIdentity{
+			AccountID:        "123456789012",
+			Architecture:     "arm64",
+			AvailabilityZone: "us-west-2a",
+			ImageID:          "ami-0123456789abcdef0",
+			InstanceID:       "i-0123456789abcdef0",
+			InstanceType:     "mac2.metal",
+			PrivateIP:        "10.0.0.10",
+			Region:           "us-west-2",
+		}, identity)
+	}
+	assert.Equal(t, 1, requests["/dynamic/instance-identity/document"])
+
+	i, _ = newTestIMDS(t, map[string]string{})
+	_, err := i.InstanceIdentity()
+	assert.Error(t, err)
+}
+
+func TestIMDSConfig_InstanceTags(t *testing.T) {
+	i, _ := newTestIMDS(t, map[string]string{
+		"meta-data/tags/instance":         "Name\nci:pool\n",
+		"meta-data/tags/instance/Name":    "build-agent",
+		"meta-data/tags/instance/ci:pool": "xcode-15",
+	})
+	tags, err := i.InstanceTags()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Name": "build-agent", "ci:pool": "xcode-15"}, tags)
+
+	// Without tags in instance metadata there are no tags
+	i, _ = newTestIMDS(t, map[string]string{})
+	tags, err = i.InstanceTags()
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+}
@@ -0,0 +1,115 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// imdsMockEnv enables the IMDS mock when the mock isn't set with a flag.
+const imdsMockEnv = "EC2_MACOS_INIT_IMDS_MOCK"
+
+// MockSource returns the directory or JSON file IMDS is served from instead of the real IMDS, or empty when the real
+// IMDS is used. MockPath, which is set with a flag, takes precedence over the environment.
+func (i *IMDSConfig) MockSource() string {
+	if i.MockPath != "" {
+		return i.MockPath
+	}
+	return os.Getenv(imdsMockEnv)
+}
+
+// mockIMDSProperty serves an IMDS property from a mock, so that configurations can be run on Macs which aren't EC2
+// instances. The mock is either a directory laid out like IMDS, such as meta-data/instance-id and user-data files, or
+// a JSON file mapping paths to values:
+//
+//	{"meta-data/instance-id": "i-0123456789abcdef0", "user-data": "#!/bin/sh\necho hello"}
+//
+// Missing properties are 404s, and listings like meta-data/ are generated from the paths below them, as IMDS does.
+func mockIMDSProperty(mock, endpoint string) (value string, httpResponseCode int, err error) {
+	info, err := os.Stat(mock)
+	if err != nil {
+		return "", 0, fmt.Errorf("ec2macosinit: unable to read IMDS mock: %s", err)
+	}
+	var properties map[string]string
+	if info.IsDir() {
+		properties, err = readIMDSMockDirectory(mock)
+	} else {
+		properties, err = readIMDSMockFile(mock)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	endpoint = strings.TrimPrefix(endpoint, "/")
+	if value, ok := properties[endpoint]; ok && !strings.HasSuffix(endpoint, "/") {
+		return value, 200, nil
+	}
+
+	// List the entries below the endpoint, with a trailing slash for those which have entries of their own
+	prefix := strings.TrimSuffix(endpoint, "/") + "/"
+	entries := map[string]struct{}{}
+	for path := range properties {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		entry := strings.TrimPrefix(path, prefix)
+		if i := strings.Index(entry, "/"); i >= 0 {
+			entry = entry[:i+1]
+		}
+		entries[entry] = struct{}{}
+	}
+	if len(entries) == 0 {
+		return "", 404, nil
+	}
+	var listing []string
+	for entry := range entries {
+		listing = append(listing, entry)
+	}
+	sort.Strings(listing)
+	return strings.Join(listing, "\n"), 200, nil
+}
+
+// readIMDSMockDirectory reads every file below the directory as a property named by its relative path. A single
+// trailing newline is removed from metadata, which is easy to add when writing files by hand, but not from user data.
+func readIMDSMockDirectory(dir string) (properties map[string]string, err error) {
+	properties = map[string]string{}
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "user-data" {
+			data = []byte(strings.TrimSuffix(string(data), "\n"))
+		}
+		properties[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read IMDS mock directory: %s", err)
+	}
+	return properties, nil
+}
+
+// readIMDSMockFile reads a JSON file mapping property paths to their values.
+func readIMDSMockFile(path string) (properties map[string]string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read IMDS mock file: %s", err)
+	}
+	err = json.Unmarshal(data, &properties)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to parse IMDS mock file: %s", err)
+	}
+	return properties, nil
+}
@@ -0,0 +1,50 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIMDSConfig_mock(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "meta-data", "placement"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "meta-data", "instance-id"), []byte("i-0123456789abcdef0\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "meta-data", "placement", "region"), []byte("us-west-2\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user-data"), []byte("#!/bin/sh\necho hello\n"), 0644))
+
+	file := filepath.Join(t.TempDir(), "imds.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{
+  "meta-data/instance-id": "i-0123456789abcdef0",
+  "meta-data/placement/region": "us-west-2",
+  "user-data": "#!/bin/sh\necho hello\n"
+}`), 0644))
+
+	for _, mock := range []string{dir, file} {
+		i := &IMDSConfig{MockPath: mock}
+		require.NoError(t, i.UpdateInstanceID())
+		assert.Equal(t, "i-0123456789abcdef0", i.InstanceID)
+
+		userData, code, err := i.getIMDSProperty("user-data")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "#!/bin/sh\necho hello\n", userData)
+
+		listing, code, err := i.getIMDSProperty("meta-data/")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "instance-id\nplacement/", listing)
+
+		_, code, err = i.getIMDSProperty("meta-data/instance-type")
+		assert.NoError(t, err)
+		assert.Equal(t, 404, code)
+	}
+
+	// The mock can also be enabled from the environment
+	t.Setenv(imdsMockEnv, file)
+	assert.Equal(t, file, (&IMDSConfig{}).MockSource())
+	assert.Equal(t, dir, (&IMDSConfig{MockPath: dir}).MockSource())
+}
@@ -0,0 +1,227 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pmsetPath is the path to the power management utility
+	pmsetPath = "/usr/bin/pmset"
+	// softwareupdatePath is the path to the utility which installs Rosetta
+	softwareupdatePath = "/usr/sbin/softwareupdate"
+	// instanceTypeEndpoint is the IMDS path of the instance type, such as mac2.metal
+	instanceTypeEndpoint = "meta-data/instance-type"
+)
+
+// rosettaRuntimePath exists once Rosetta is installed.
+var rosettaRuntimePath = "/Library/Apple/usr/libexec/oah/libRosettaRuntime"
+
+// hardwareArch returns the architecture of the hardware, arm64 or x86_64. It's read from the hardware rather than the
+// binary, which may be running under Rosetta.
+var hardwareArch = func() string {
+	if raw, err := sysctlRead("hw.optional.arm64"); err == nil && len(raw) > 0 && raw[0] == 1 {
+		return "arm64"
+	}
+	return "x86_64"
+}
+
+// instancePreset is the built-in configuration for the instances of an architecture.
+type instancePreset struct {
+	sysctl  []string          // sysctl values, as "parameter=value"
+	pmset   map[string]string // pmset settings, applied only where the hardware supports them
+	rosetta bool              // rosetta installs Rosetta, so x86_64 tools run
+}
+
+// instancePresets maps an architecture to its preset. mac1 instances are x86_64, while every later family is arm64.
+var instancePresets = map[string]instancePreset{
+	"x86_64": {
+		sysctl: []string{"debug.lowpri_throttle_enabled=0"},
+		pmset: map[string]string{
+			"sleep": "0", "displaysleep": "0", "disksleep": "0", "powernap": "0", "autorestart": "1",
+			// Intel Macs hibernate from standby, which an instance never wakes from on its own
+			"standby": "0", "autopoweroff": "0", "hibernatemode": "0",
+		},
+	},
+	"arm64": {
+		sysctl: []string{"debug.lowpri_throttle_enabled=0"},
+		pmset: map[string]string{
+			"sleep": "0", "displaysleep": "0", "disksleep": "0", "powernap": "0", "autorestart": "1",
+			// Low Power Mode lowers clock speeds to reduce heat, which slows builds
+			"lowpowermode": "0",
+		},
+		rosetta: true,
+	},
+}
+
+// InstanceFamilyModule contains all necessary configuration fields for running an InstanceFamily module.
+type InstanceFamilyModule struct {
+	ApplyPresets bool     `toml:"ApplyPresets"` // ApplyPresets applies the preset for the instance's family
+	Skip         []string `toml:"Skip"`         // Skip lists settings to leave alone, such as "pmset:sleep" or "rosetta"
+}
+
+// Do for the InstanceFamilyModule detects whether the instance is an x86_64 mac1 instance or an Apple silicon instance
+// and applies the matching built-in sysctl, pmset, and Rosetta settings, so one init.toml works for both. Settings
+// which already have the desired value are left alone, and changed settings are read back to verify them.
+func (c *InstanceFamilyModule) Do(ctx *ModuleContext) (message string, err error) {
+	if !c.ApplyPresets {
+		return "Not requested to apply instance family presets", nil
+	}
+
+	family := instanceFamily(ctx)
+	arch := hardwareArch()
+	preset, ok := instancePresets[arch]
+	if !ok {
+		return "", fmt.Errorf("ec2macosinit: no instance family preset for architecture %s", arch)
+	}
+	ctx.Logger.Infof("Applying presets for %s instance (%s)", family, arch)
+
+	skip := map[string]bool{}
+	for _, s := range c.Skip {
+		skip[s] = true
+	}
+
+	var changed, unchanged int
+	count := func(settingChanged bool, name string) {
+		if settingChanged {
+			changed++
+			ctx.Logger.Infof("Applied instance family setting [%s]", name)
+		} else {
+			unchanged++
+		}
+	}
+
+	for _, v := range preset.sysctl {
+		name := "sysctl:" + strings.SplitN(v, "=", 2)[0]
+		if skip[name] {
+			continue
+		}
+		settingChanged, err := modifySysctl(v)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to set %s: %s", v, err)
+		}
+		count(settingChanged, name)
+	}
+
+	pmsetChanged, pmsetUnchanged, err := applyPmset(ctx, preset.pmset, skip)
+	if err != nil {
+		return "", err
+	}
+	changed += pmsetChanged
+	unchanged += pmsetUnchanged
+
+	if preset.rosetta && !skip["rosetta"] {
+		settingChanged, err := installRosetta(ctx)
+		if err != nil {
+			return "", err
+		}
+		count(settingChanged, "rosetta")
+	}
+
+	return fmt.Sprintf("successfully applied %s (%s) presets [%d changed / %d unchanged]", family, arch, changed, unchanged), nil
+}
+
+// instanceFamily returns the family of the instance type from IMDS, such as mac2-m2pro for mac2-m2pro.metal. The family
+// is only reported, so it's "unknown" when IMDS isn't available.
+func instanceFamily(ctx *ModuleContext) string {
+	if ctx.IMDS == nil {
+		return "unknown"
+	}
+	instanceType, respCode, err := ctx.IMDS.getIMDSProperty(instanceTypeEndpoint)
+	if err != nil || respCode != 200 || instanceType == "" {
+		ctx.Logger.Warnf("Unable to get instance type from IMDS, the preset is chosen from the hardware")
+		return "unknown"
+	}
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
+
+// applyPmset sets each pmset setting which differs, for all power sources, then reads them back to verify them.
+// Settings which pmset -g doesn't list aren't supported by the hardware, and are skipped.
+func applyPmset(ctx *ModuleContext, settings map[string]string, skip map[string]bool) (changed, unchanged int, err error) {
+	current, err := readPmset(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := settings[name]
+		have, supported := current[name]
+		if !supported || skip["pmset:"+name] {
+			continue
+		}
+		if have == value {
+			unchanged++
+			continue
+		}
+		out, err := ctx.executeCommand([]string{pmsetPath, "-a", name, value}, "", []string{})
+		if err != nil {
+			return changed, unchanged, fmt.Errorf("ec2macosinit: unable to set pmset %s to %s: %s %s", name, value, err, strings.TrimSpace(out.stderr))
+		}
+		changed++
+		ctx.Logger.Infof("Applied instance family setting [pmset:%s]", name)
+	}
+	if changed == 0 {
+		return changed, unchanged, nil
+	}
+
+	// Validate new values
+	current, err = readPmset(ctx)
+	if err != nil {
+		return changed, unchanged, err
+	}
+	for name, value := range settings {
+		if have, supported := current[name]; supported && !skip["pmset:"+name] && have != value {
+			return changed, unchanged, fmt.Errorf("ec2macosinit: verification failed for pmset %s, expected %s but got %s", name, value, have)
+		}
+	}
+	return changed, unchanged, nil
+}
+
+// readPmset reads the power management settings in use from pmset -g, which lists each setting and its value after a
+// header, for example " sleep                0 (sleep prevented by sharingd)".
+func readPmset(ctx *ModuleContext) (settings map[string]string, err error) {
+	out, err := ctx.executeCommand([]string{pmsetPath, "-g"}, "", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read power management settings: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+	settings = map[string]string{}
+	for _, line := range strings.Split(out.stdout, "\n") {
+		fields := strings.Fields(line)
+		// Names may have spaces, so the value is the first number after the name
+		for i := 1; i < len(fields); i++ {
+			if _, err := strconv.Atoi(fields[i]); err == nil {
+				settings[strings.Join(fields[:i], " ")] = fields[i]
+				break
+			}
+		}
+	}
+	return settings, nil
+}
+
+// installRosetta installs Rosetta, if it isn't already, and checks that it was installed.
+func installRosetta(ctx *ModuleContext) (changed bool, err error) {
+	if _, err := os.Stat(rosettaRuntimePath); err == nil {
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ec2macosinit: unable to check for Rosetta: %s", err)
+	}
+
+	out, err := ctx.executeCommand([]string{softwareupdatePath, "--install-rosetta", "--agree-to-license"}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to install Rosetta: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+
+	// Validate new value
+	if _, err := os.Stat(rosettaRuntimePath); err != nil {
+		return false, fmt.Errorf("ec2macosinit: verification failed, Rosetta isn't installed: %s", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePmset answers pmset commands from a map of settings.
+func fakePmset(settings map[string]string, rosetta string) *fakeExecutor {
+	return &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch {
+		case c[0] == pmsetPath && c[1] == "-g":
+			out := "System-wide power settings:\nCurrently in use:\n Sleep On Power Button 1\n"
+			for k, v := range settings {
+				out += " " + k + "                " + v + "\n"
+			}
+			return commandOutput{stdout: out}, nil
+		case c[0] == pmsetPath:
+			settings[c[2]] = c[3]
+		case c[0] == softwareupdatePath:
+			return commandOutput{}, os.WriteFile(rosetta, []byte{}, 0644)
+		}
+		return commandOutput{}, nil
+	}}
+}
+
+func TestInstanceFamilyModule_Do(t *testing.T) {
+	defer func(a func() string, r string) { hardwareArch, rosettaRuntimePath = a, r }(hardwareArch, rosettaRuntimePath)
+	rosettaRuntimePath = filepath.Join(t.TempDir(), "libRosettaRuntime")
+
+	// Only the settings the hardware supports are applied
+	settings := map[string]string{"sleep": "1", "displaysleep": "10", "powernap": "0", "autorestart": "0"}
+	fake := fakePmset(settings, rosettaRuntimePath)
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	hardwareArch = func() string { return "arm64" }
+
+	c := &InstanceFamilyModule{ApplyPresets: true, Skip: []string{"sysctl:debug.lowpri_throttle_enabled", "pmset:displaysleep"}}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied unknown (arm64) presets [3 changed / 1 unchanged]", message)
+	assert.Equal(t, map[string]string{"sleep": "0", "displaysleep": "10", "powernap": "0", "autorestart": "1"}, settings)
+	assert.FileExists(t, rosettaRuntimePath)
+
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied unknown (arm64) presets [0 changed / 4 unchanged]", message)
+
+	// Intel instances don't need Rosetta
+	require.NoError(t, os.Remove(rosettaRuntimePath))
+	hardwareArch = func() string { return "x86_64" }
+	settings["standby"] = "1"
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied unknown (x86_64) presets [1 changed / 3 unchanged]", message)
+	assert.NoFileExists(t, rosettaRuntimePath)
+
+	message, err = (&InstanceFamilyModule{}).Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Not requested to apply instance family presets", message)
+}
+
+func Test_readPmset(t *testing.T) {
+	ctx := &ModuleContext{executor: &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stdout: "System-wide power settings:\nCurrently in use:\n standby              0\n" +
+			" Sleep On Power Button 1\n sleep                0 (sleep prevented by sharingd, powerd)\n"}, nil
+	}}}
+	settings, err := readPmset(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"standby": "0", "Sleep On Power Button": "1", "sleep": "0"}, settings)
+}
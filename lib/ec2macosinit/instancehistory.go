@@ -1,15 +1,18 @@
 package ec2macosinit
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
-// This is unused for now but will allow us to modify the version of this history in the future.
-const historyVersion = 1
+// historyVersion is the version of the history written by this version of ec2-macos-init. Version 2 added the timing,
+// message, and error of each module. Version 1 files are still read, their additional fields are simply left empty.
+const historyVersion = 2
 
 // History contains an instance ID, run time and a slice of individual module histories.
 type History struct {
@@ -20,9 +23,19 @@ type History struct {
 }
 
 // ModuleHistory contains a key of the configuration struct for future comparison and whether that run was successful.
+// Modules skipped due to their Run type have no timing, message, or error. Modules which the run hadn't reached yet when
+// the history was written are Pending, and keep the result of the previous run so that Run types still apply if the
+// run never finishes.
 type ModuleHistory struct {
-	Key     string `json:"key"`
-	Success bool   `json:"success"`
+	Key        string     `json:"key"`
+	Success    bool       `json:"success"`
+	Skipped    bool       `json:"skipped,omitempty"`
+	Pending    bool       `json:"pending,omitempty"`
+	StartTime  *time.Time `json:"startTime,omitempty"`
+	EndTime    *time.Time `json:"endTime,omitempty"`
+	DurationMs int64      `json:"durationMs,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Error      string     `json:"error,omitempty"`
 }
 
 // HistoryError wraps a normal error and gives the caller insight into the type of error.
@@ -61,7 +74,7 @@ func (c *InitConfig) GetInstanceHistory() (err error) {
 				}
 				// If there is an error getting the history file or if the history file is empty do not append to Instance History
 				if info.Size() == 0 {
-					c.Log.Warnf("The history file exists at %s but is empty. Skipping this file...", historyFile)
+					c.Log.Warnf("The history file exists at %s but is empty. Skipping this file, run 'sudo ec2-macos-init history migrate' to repair it...", historyFile)
 					continue
 				}
 				history, err := readHistoryFile(historyFile)
@@ -94,23 +107,33 @@ func readHistoryFile(file string) (history History, err error) {
 	return history, nil
 }
 
-// WriteHistoryFile takes ModulesByPriority and writes it to a given history path and filename as JSON.
+// WriteHistoryFile takes ModulesByPriority and writes it to a given history path and filename as JSON. It's written
+// after each priority group as well as at the end of the run, so modules which haven't been reached yet are written as
+// pending with their result from the previous run on the instance.
 func (c *InitConfig) WriteHistoryFile() (err error) {
 	history := History{
 		InstanceID: c.IMDS.InstanceID,
 		RunTime:    time.Now(),
 		Version:    historyVersion,
 	}
+	// Results from the previous run on this instance, for modules which haven't been reached yet
+	previous := map[string]ModuleHistory{}
+	for _, instance := range c.InstanceHistory {
+		if instance.InstanceID == c.IMDS.InstanceID {
+			for _, h := range instance.ModuleHistories {
+				previous[h.Key] = h
+			}
+		}
+	}
 	// Copy relevant fields from InitConfig to History struct
 	for _, p := range c.ModulesByPriority {
 		for _, m := range p {
-			history.ModuleHistories = append(
-				history.ModuleHistories,
-				ModuleHistory{
-					Key:     m.generateHistoryKey(),
-					Success: m.Success,
-				},
-			)
+			h := m.moduleHistory()
+			if m.pending() {
+				h.Pending = true
+				h.Success = previous[h.Key].Success
+			}
+			history.ModuleHistories = append(history.ModuleHistories, h)
 		}
 	}
 
@@ -136,36 +159,258 @@ func (c *InitConfig) WriteHistoryFile() (err error) {
 	return nil
 }
 
+// FailedInLastRun returns the names of the configured modules which didn't succeed in the most recent run on the
+// current instance, either because they failed, weren't run after a fatal error, or weren't configured at the time.
+// It returns an error if there is no history for the current instance.
+func (c *InitConfig) FailedInLastRun() (names []string, err error) {
+	found := false
+	for _, instance := range c.InstanceHistory {
+		if instance.InstanceID == c.IMDS.InstanceID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("ec2macosinit: no history of a previous run on instance %s", c.IMDS.InstanceID)
+	}
+
+	for _, group := range c.ModulesByPriority {
+		for _, m := range group {
+			if !m.SucceededInLastRun(c.IMDS.InstanceID, c.InstanceHistory) {
+				names = append(names, m.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
 // safeWrite writes data to the desired file path or not at all. This function
 // protects against partially written or unflushed data intended for the file.
 func safeWrite(path string, data []byte) error {
-	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*", filepath.Base(path)))
+	return safeWriteFile(path, data, 0600, -1, -1)
+}
+
+// CreateDirectories creates the instance directory, if it doesn't exist and a directory for the running instance.
+func (c *InitConfig) CreateDirectories() (err error) {
+	if _, err := os.Stat(filepath.Join(c.HistoryPath, c.IMDS.InstanceID)); os.IsNotExist(err) {
+		err := os.MkdirAll(filepath.Join(c.HistoryPath, c.IMDS.InstanceID), 0755)
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to create directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// PruneHistory removes the history directories of previous instances which fall outside of the configured retention,
+// and returns the instance IDs which were removed. The current instance is never removed. Successful RunOnce modules
+// which are still configured are carried forward in the current instance's history, so pruning doesn't cause them to
+// run again.
+func (c *InitConfig) PruneHistory(now time.Time) (removed []string, err error) {
+	retention := c.HistoryRetention
+	if retention.MaxAge <= 0 && retention.MaxInstances <= 0 {
+		return nil, nil
+	}
+
+	dirs, err := os.ReadDir(c.HistoryPath)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("ec2macosinit: unable to read instance history directory: %w", err)
+	}
+
+	// Find when each previous instance last ran, falling back to the directory's modification time
+	type instanceRun struct {
+		id      string
+		runTime time.Time
+	}
+	var runs []instanceRun
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == c.IMDS.InstanceID {
+			continue
+		}
+		run := instanceRun{id: dir.Name()}
+		if history, err := readHistoryFile(filepath.Join(c.HistoryPath, dir.Name(), c.HistoryFilename)); err == nil {
+			run.runTime = history.RunTime
+		} else if info, err := dir.Info(); err == nil {
+			run.runTime = info.ModTime()
+		}
+		runs = append(runs, run)
 	}
-	defer os.Remove(f.Name())
-	defer f.Close()
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].runTime.After(runs[j].runTime)
+	})
 
-	_, err = f.Write(data)
+	for i, run := range runs {
+		// The current instance counts towards MaxInstances
+		tooMany := retention.MaxInstances > 0 && i+1 >= retention.MaxInstances
+		tooOld := retention.MaxAge > 0 && now.Sub(run.runTime) > retention.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(c.HistoryPath, run.id))
+		if err != nil {
+			return removed, fmt.Errorf("ec2macosinit: unable to remove history for instance %s: %w", run.id, err)
+		}
+		removed = append(removed, run.id)
+	}
+
+	return removed, nil
+}
+
+// moduleHistory returns the history entry for the module's result in this run.
+func (m *Module) moduleHistory() (h ModuleHistory) {
+	h = ModuleHistory{
+		Key:     m.generateHistoryKey(),
+		Success: m.Success,
+		Skipped: m.Skipped,
+		Message: m.Message,
+		Error:   m.Error,
+	}
+	if !m.StartTime.IsZero() {
+		start, end := m.StartTime, m.EndTime
+		h.StartTime, h.EndTime = &start, &end
+		h.DurationMs = end.Sub(start).Milliseconds()
+	}
+	return h
+}
+
+// pending returns whether the module hasn't been run or skipped in this run yet.
+func (m *Module) pending() bool {
+	return !m.Success && !m.Skipped && m.StartTime.IsZero()
+}
+
+// HistoryMigration describes the result of migrating a single instance's history file.
+type HistoryMigration struct {
+	InstanceID  string
+	FromVersion int
+	Repaired    bool   // Repaired is set when the file was empty or invalid and has been rewritten with what was readable
+	Recovered   int    // Recovered is the number of module histories recovered from a repaired file
+	Skipped     string // Skipped is the reason the file was left alone, if it was
+}
+
+// MigrateHistory upgrades every history file to the current history version. Empty, truncated, or otherwise invalid
+// files are repaired by keeping every complete module history that can be read, so that modules which already
+// succeeded aren't run again. The original contents of a repaired file are kept alongside it with a ".corrupt" suffix.
+// Files written by a newer version of ec2-macos-init are left untouched.
+func (c *InitConfig) MigrateHistory() (migrations []HistoryMigration, err error) {
+	dirs, err := os.ReadDir(c.HistoryPath)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("ec2macosinit: unable to read instance history directory: %w", err)
+	}
+
+	for _, dir := range dirs {
+		historyFile := filepath.Join(c.HistoryPath, dir.Name(), c.HistoryFilename)
+		if info, err := os.Stat(historyFile); !dir.IsDir() || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		migration, err := migrateHistoryFile(historyFile, dir.Name())
+		if err != nil {
+			return migrations, err
+		}
+		if migration != nil {
+			migrations = append(migrations, *migration)
+		}
+	}
+
+	return migrations, nil
+}
+
+// migrateHistoryFile migrates a single history file, returning nil when it is already current.
+func migrateHistoryFile(historyFile, instanceID string) (migration *HistoryMigration, err error) {
+	data, err := os.ReadFile(historyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read history file at %s: %w", historyFile, err)
+	}
+
+	migration = &HistoryMigration{InstanceID: instanceID}
+	var history History
+	if err := json.Unmarshal(data, &history); err != nil {
+		history = salvageHistory(data)
+		migration.Repaired = true
+		migration.Recovered = len(history.ModuleHistories)
+	}
+	// Version 1 files written before the version was recorded have no version
+	if history.Version == 0 {
+		history.Version = 1
+	}
+	migration.FromVersion = history.Version
+
+	switch {
+	case history.Version > historyVersion:
+		migration.Skipped = fmt.Sprintf("written by a newer version (history version %d)", history.Version)
+		return migration, nil
+	case history.Version == historyVersion && !migration.Repaired:
+		return nil, nil
+	}
+
+	// Fill in anything lost from a repaired file
+	if history.InstanceID == "" {
+		history.InstanceID = instanceID
 	}
+	if history.RunTime.IsZero() {
+		if info, err := os.Stat(historyFile); err == nil {
+			history.RunTime = info.ModTime()
+		}
+	}
+	history.Version = historyVersion
 
-	err = f.Sync()
+	if migration.Repaired {
+		err = safeWrite(historyFile+".corrupt", data)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: unable to keep a copy of history file at %s: %w", historyFile, err)
+		}
+	}
+	historyBytes, err := json.Marshal(history)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("ec2macosinit: unable to encode history file: %w", err)
+	}
+	err = safeWrite(historyFile, historyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to write history file at %s: %w", historyFile, err)
 	}
 
-	return os.Rename(f.Name(), path)
+	return migration, nil
 }
 
-// CreateDirectories creates the instance directory, if it doesn't exist and a directory for the running instance.
-func (c *InitConfig) CreateDirectories() (err error) {
-	if _, err := os.Stat(filepath.Join(c.HistoryPath, c.IMDS.InstanceID)); os.IsNotExist(err) {
-		err := os.MkdirAll(filepath.Join(c.HistoryPath, c.IMDS.InstanceID), 0755)
+// salvageHistory reads as much as it can from an invalid history file, stopping at the first error. Only module
+// histories which were completely written are kept.
+func salvageHistory(data []byte) (history History) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return history
+	}
+	fields := map[string]interface{}{
+		"instanceID": &history.InstanceID,
+		"runTime":    &history.RunTime,
+		"version":    &history.Version,
+	}
+	for dec.More() {
+		t, err := dec.Token()
 		if err != nil {
-			return fmt.Errorf("ec2macosinit: unable to create directory: %w", err)
+			return history
+		}
+		key, _ := t.(string)
+		if key != "moduleHistory" {
+			var value interface{} = &json.RawMessage{}
+			if field, ok := fields[key]; ok {
+				value = field
+			}
+			if err := dec.Decode(value); err != nil {
+				return history
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return history
+		}
+		for dec.More() {
+			var m ModuleHistory
+			if err := dec.Decode(&m); err != nil {
+				return history
+			}
+			history.ModuleHistories = append(history.ModuleHistories, m)
+		}
+		if _, err := dec.Token(); err != nil {
+			return history
 		}
 	}
-	return nil
+	return history
 }
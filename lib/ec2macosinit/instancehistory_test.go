@@ -0,0 +1,199 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitConfig_PruneHistory(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	historyPath := t.TempDir()
+	writeHistory := func(id string, runTime time.Time) {
+		require.NoError(t, os.MkdirAll(filepath.Join(historyPath, id), 0755))
+		data, err := json.Marshal(History{InstanceID: id, RunTime: runTime, Version: historyVersion})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(historyPath, id, "history.json"), data, 0600))
+	}
+	writeHistory("i-current", now.Add(-200*24*time.Hour))
+	writeHistory("i-new", now.Add(-1*time.Hour))
+	writeHistory("i-middle", now.Add(-48*time.Hour))
+	writeHistory("i-old", now.Add(-100*24*time.Hour))
+
+	c := &InitConfig{HistoryPath: historyPath, HistoryFilename: "history.json"}
+	c.IMDS.InstanceID = "i-current"
+
+	// No retention configured, nothing is removed
+	removed, err := c.PruneHistory(now)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	c.HistoryRetention = HistoryRetention{MaxAge: 90 * 24 * time.Hour}
+	removed, err = c.PruneHistory(now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-old"}, removed)
+
+	c.HistoryRetention = HistoryRetention{MaxInstances: 2}
+	removed, err = c.PruneHistory(now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-middle"}, removed)
+
+	assert.DirExists(t, filepath.Join(historyPath, "i-current"))
+	assert.DirExists(t, filepath.Join(historyPath, "i-new"))
+}
+
+func Test_readHistoryFile_v1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	v1 := `{"instanceID":"i-0123456789abcdef0","runTime":"2023-01-01T00:00:00Z","moduleHistory":[{"key":"1_RunOnce_command_Test","success":true}],"version":1}`
+	require.NoError(t, os.WriteFile(path, []byte(v1), 0600))
+
+	history, err := readHistoryFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, history.Version)
+	assert.Equal(t, []ModuleHistory{{Key: "1_RunOnce_command_Test", Success: true}}, history.ModuleHistories)
+}
+
+func TestModule_moduleHistory(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := Module{
+		Type:          "command",
+		Name:          "Test",
+		PriorityGroup: 1,
+		RunOnce:       true,
+		StartTime:     start,
+		EndTime:       start.Add(1500 * time.Millisecond),
+		Message:       "done",
+		Error:         "failed",
+	}
+	h := m.moduleHistory()
+	assert.Equal(t, "1_RunOnce_command_Test", h.Key)
+	assert.Equal(t, int64(1500), h.DurationMs)
+	assert.Equal(t, start, *h.StartTime)
+	assert.Equal(t, "done", h.Message)
+	assert.Equal(t, "failed", h.Error)
+
+	// Skipped modules have no timing
+	h = (&Module{Type: "command", Name: "Test", PriorityGroup: 1, RunOnce: true, Success: true, Skipped: true}).moduleHistory()
+	assert.Nil(t, h.StartTime)
+	assert.True(t, h.Skipped)
+}
+
+func TestInitConfig_MigrateHistory(t *testing.T) {
+	historyPath := t.TempDir()
+	writeFile := func(id, contents string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(historyPath, id), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(historyPath, id, "history.json"), []byte(contents), 0600))
+	}
+	writeFile("i-v1", `{"instanceID":"i-v1","runTime":"2023-01-01T00:00:00Z","moduleHistory":[{"key":"1_RunOnce_command_A","success":true}],"version":1}`)
+	writeFile("i-current", `{"instanceID":"i-current","runTime":"2023-01-01T00:00:00Z","moduleHistory":[],"version":2}`)
+	writeFile("i-newer", `{"instanceID":"i-newer","runTime":"2023-01-01T00:00:00Z","moduleHistory":[],"version":99}`)
+	writeFile("i-empty", ``)
+	writeFile("i-truncated", `{"instanceID":"i-truncated","runTime":"2023-01-01T00:00:00Z","moduleHistory":[{"key":"1_RunOnce_command_A","success":true},{"key":"1_RunOnce_comm`)
+
+	c := &InitConfig{HistoryPath: historyPath, HistoryFilename: "history.json"}
+	migrations, err := c.MigrateHistory()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []HistoryMigration{
+		{InstanceID: "i-v1", FromVersion: 1},
+		{InstanceID: "i-newer", FromVersion: 99, Skipped: "written by a newer version (history version 99)"},
+		{InstanceID: "i-empty", FromVersion: 1, Repaired: true},
+		{InstanceID: "i-truncated", FromVersion: 1, Repaired: true, Recovered: 1},
+	}, migrations)
+
+	// Every migrated file can now be read
+	require.NoError(t, c.GetInstanceHistory())
+	histories := map[string]History{}
+	for _, h := range c.InstanceHistory {
+		histories[h.InstanceID] = h
+	}
+	assert.Equal(t, historyVersion, histories["i-v1"].Version)
+	assert.Equal(t, historyVersion, histories["i-empty"].Version)
+	assert.Equal(t, []ModuleHistory{{Key: "1_RunOnce_command_A", Success: true}}, histories["i-truncated"].ModuleHistories)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), histories["i-truncated"].RunTime.UTC())
+	assert.FileExists(t, filepath.Join(historyPath, "i-truncated", "history.json.corrupt"))
+
+	// Migrating again changes nothing else
+	migrations, err = c.MigrateHistory()
+	require.NoError(t, err)
+	assert.Equal(t, []HistoryMigration{{InstanceID: "i-newer", FromVersion: 99, Skipped: "written by a newer version (history version 99)"}}, migrations)
+}
+
+func TestInitConfig_FailedInLastRun(t *testing.T) {
+	c := &InitConfig{
+		ModulesByPriority: [][]Module{
+			{
+				{Type: "command", Name: "install", PriorityGroup: 1, RunOnce: true},
+				{Type: "command", Name: "flaky", PriorityGroup: 1, RunPerBoot: true},
+			},
+			{
+				{Type: "command", Name: "new", PriorityGroup: 2, RunPerBoot: true},
+			},
+		},
+	}
+	c.IMDS.InstanceID = "i-current"
+
+	_, err := c.FailedInLastRun()
+	assert.Error(t, err, "no history for the current instance")
+
+	c.InstanceHistory = []History{
+		{InstanceID: "i-previous", ModuleHistories: []ModuleHistory{{Key: "1_RunPerBoot_command_flaky", Success: true}}},
+		{InstanceID: "i-current", ModuleHistories: []ModuleHistory{
+			{Key: "1_RunOnce_command_install", Success: true},
+			{Key: "1_RunPerBoot_command_flaky", Success: false},
+		}},
+	}
+	names, err := c.FailedInLastRun()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flaky", "new"}, names)
+}
+
+func TestInitConfig_WriteHistoryFile_pending(t *testing.T) {
+	historyPath := t.TempDir()
+	c := &InitConfig{
+		HistoryPath:     historyPath,
+		HistoryFilename: "history.json",
+		ModulesByPriority: [][]Module{
+			{
+				{Type: "command", Name: "setup", PriorityGroup: 1, RunPerBoot: true},
+			},
+			{
+				{Type: "command", Name: "install", PriorityGroup: 2, RunOnce: true},
+				{Type: "command", Name: "new", PriorityGroup: 2, RunPerBoot: true},
+			},
+		},
+		InstanceHistory: []History{
+			{InstanceID: "i-current", ModuleHistories: []ModuleHistory{
+				{Key: "1_RunPerBoot_command_setup", Success: false},
+				{Key: "2_RunOnce_command_install", Success: true},
+			}},
+		},
+	}
+	c.IMDS.InstanceID = "i-current"
+
+	// The run was interrupted after the first group
+	c.ModulesByPriority[0][0].StartTime = time.Now()
+	c.ModulesByPriority[0][0].EndTime = time.Now()
+	c.ModulesByPriority[0][0].Success = true
+	require.NoError(t, c.WriteHistoryFile())
+
+	history, err := readHistoryFile(filepath.Join(historyPath, "i-current", "history.json"))
+	require.NoError(t, err)
+	require.Len(t, history.ModuleHistories, 3)
+	assert.True(t, history.ModuleHistories[0].Success)
+	assert.False(t, history.ModuleHistories[0].Pending)
+	// The RunOnce module keeps its success, so it won't run again
+	assert.Equal(t, ModuleHistory{Key: "2_RunOnce_command_install", Success: true, Pending: true}, history.ModuleHistories[1])
+	assert.Equal(t, ModuleHistory{Key: "2_RunPerBoot_command_new", Pending: true}, history.ModuleHistories[2])
+	assert.False(t, c.ModulesByPriority[1][0].ShouldRun("i-current", []History{history}))
+
+	// Pending modules weren't reached, so they're rerun by rerun-failed
+	c.InstanceHistory = []History{history}
+	names, err := c.FailedInLastRun()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"install", "new"}, names)
+}
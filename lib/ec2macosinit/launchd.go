@@ -0,0 +1,111 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// LaunchDaemonsDirectory is where the plists of system domain launchd jobs are installed.
+const LaunchDaemonsDirectory = "/Library/LaunchDaemons"
+
+// launchd labels of the jobs installed with ec2-macos-init.
+const (
+	// RunJobLabel is the label of the job which runs ec2-macos-init on boot.
+	RunJobLabel = "com.amazon.ec2.macos-init"
+	// DaemonJobLabel is the label of the job which keeps the ec2-macos-init daemon running.
+	DaemonJobLabel = "com.amazon.ec2.macos-init.daemon"
+)
+
+// launchdJobPath is the PATH that jobs run with, which includes Homebrew so that commands installed with it can be run.
+const launchdJobPath = "/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin:/opt/homebrew/bin:/opt/homebrew/sbin"
+
+// launchdJobs are the command and log file of each job installed with ec2-macos-init.
+var launchdJobs = map[string]struct {
+	command string
+	logFile string
+}{
+	RunJobLabel:    {command: "run", logFile: "/var/log/amazon/ec2/ec2-macos-init.log"},
+	DaemonJobLabel: {command: "daemon", logFile: "/var/log/amazon/ec2/ec2-macos-init-daemon.log"},
+}
+
+// LaunchDaemonJob returns the definition of the job with the given label, running the ec2-macos-init binary at
+// program. Both jobs start at load and are restarted by launchd until they exit successfully.
+func LaunchDaemonJob(label, program string) (job map[string]interface{}, err error) {
+	j, ok := launchdJobs[label]
+	if !ok {
+		return nil, fmt.Errorf("ec2macosinit: unknown launchd job %s", label)
+	}
+	return map[string]interface{}{
+		"Debug":                true,
+		"EnvironmentVariables": map[string]interface{}{"PATH": launchdJobPath},
+		"KeepAlive":            map[string]interface{}{"SuccessfulExit": false},
+		"Label":                label,
+		"ProgramArguments":     []interface{}{program, j.command},
+		"RunAtLoad":            true,
+		"StandardErrorPath":    j.logFile,
+		"StandardOutPath":      j.logFile,
+		"UserName":             "root",
+	}, nil
+}
+
+// WriteLaunchDaemon writes the plist for a job to path, owned by root and readable by everyone as launchd requires.
+// The directory for the job's log file is created so that launchd can open it.
+func WriteLaunchDaemon(path string, job map[string]interface{}) (err error) {
+	data, err := plist.MarshalIndent(job, plist.XMLFormat, "	")
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to encode launchd plist: %s", err)
+	}
+	if logFile, ok := job["StandardOutPath"].(string); ok {
+		err = os.MkdirAll(filepath.Dir(logFile), 0755)
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to create log directory: %s", err)
+		}
+	}
+	err = safeWriteFile(path, data, 0644, 0, 0)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write launchd plist %s: %s", path, err)
+	}
+	return nil
+}
+
+// LaunchDaemonPlist returns the path of the plist for the system domain job with the given label.
+func LaunchDaemonPlist(label string) string {
+	return filepath.Join(LaunchDaemonsDirectory, label+".plist")
+}
+
+// LaunchdJobLoaded returns whether the system domain job with the given label is loaded.
+func LaunchdJobLoaded(label string) bool {
+	_, err := executeCommand([]string{"/bin/launchctl", "print", "system/" + label}, "", []string{})
+	return err == nil
+}
+
+// RestartLaunchdJob stops the system domain job with the given label, if it's running, and starts it again.
+func RestartLaunchdJob(label string) (err error) {
+	out, err := executeCommand([]string{"/bin/launchctl", "kickstart", "-k", "system/" + label}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to restart %s: %s: %s", label, err, strings.TrimSpace(out.stderr))
+	}
+	return nil
+}
+
+// BootstrapLaunchdJob loads the job in the plist at path into the system domain.
+func BootstrapLaunchdJob(path string) (err error) {
+	out, err := executeCommand([]string{"/bin/launchctl", "bootstrap", "system", path}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to load %s: %s: %s", path, err, strings.TrimSpace(out.stderr))
+	}
+	return nil
+}
+
+// BootoutLaunchdJob stops the system domain job with the given label and unloads it.
+func BootoutLaunchdJob(label string) (err error) {
+	out, err := executeCommand([]string{"/bin/launchctl", "bootout", "system/" + label}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to unload %s: %s: %s", label, err, strings.TrimSpace(out.stderr))
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package ec2macosinit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestLaunchDaemonJob(t *testing.T) {
+	// The jobs written by install match the plists shipped with ec2-macos-init
+	for _, label := range []string{RunJobLabel, DaemonJobLabel} {
+		data, err := os.ReadFile("../../Library/LaunchDaemons/" + label + ".plist")
+		require.NoError(t, err)
+		var shipped interface{}
+		_, err = plist.Unmarshal(data, &shipped)
+		require.NoError(t, err)
+
+		job, err := LaunchDaemonJob(label, "/usr/local/libexec/ec2-macos-init")
+		require.NoError(t, err)
+		data, err = plist.MarshalIndent(job, plist.XMLFormat, "	")
+		require.NoError(t, err)
+		var written interface{}
+		_, err = plist.Unmarshal(data, &written)
+		require.NoError(t, err)
+		assert.Equal(t, shipped, written, label)
+	}
+
+	_, err := LaunchDaemonJob("com.example.unknown", "/usr/local/libexec/ec2-macos-init")
+	assert.Error(t, err)
+}
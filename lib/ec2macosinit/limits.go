@@ -0,0 +1,138 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// limitJobLabelPrefix prefixes the labels of the launchd jobs which set resource limits on every boot.
+const limitJobLabelPrefix = "com.amazon.ec2.macos-init.limit."
+
+// unlimited is how launchctl reports and accepts a limit which isn't set.
+const unlimited = "unlimited"
+
+// Limit is a soft and hard resource limit.
+type Limit struct {
+	Soft int `toml:"Soft"` // Soft is the limit processes get by default, zero leaves the resource unmanaged
+	Hard int `toml:"Hard"` // Hard is the most processes may raise their soft limit to, zero for unlimited
+}
+
+// LimitsModule contains all necessary configuration fields for running a Limits module.
+type LimitsModule struct {
+	MaxFiles Limit `toml:"MaxFiles"` // MaxFiles limits the number of open files of each process
+	MaxProc  Limit `toml:"MaxProc"`  // MaxProc limits the number of processes of each user
+}
+
+// Do for the LimitsModule sets the launchd resource limits of processes, which are inherited by everything launchd
+// starts, and writes a LaunchDaemon for each limit which sets it again on every boot. Limits which already have the
+// desired values, and jobs which are already current, are left alone.
+func (c *LimitsModule) Do(ctx *ModuleContext) (message string, err error) {
+	limits := []struct {
+		name  string
+		limit Limit
+	}{{"maxfiles", c.MaxFiles}, {"maxproc", c.MaxProc}}
+
+	var changed, unchanged int
+	for _, l := range limits {
+		if l.limit.Soft == 0 {
+			continue
+		}
+		limitChanged, err := applyLimit(ctx, l.name, l.limit, LaunchDaemonPlist(limitJobLabelPrefix+l.name))
+		if err != nil {
+			return "", err
+		}
+		if limitChanged {
+			changed++
+		} else {
+			unchanged++
+		}
+	}
+	if changed+unchanged == 0 {
+		return "nothing to do", nil
+	}
+
+	return fmt.Sprintf("successfully applied resource limits [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// values returns the soft and hard limit as passed to launchctl.
+func (l Limit) values() (soft, hard string, err error) {
+	if l.Soft < 0 || l.Hard < 0 {
+		return "", "", fmt.Errorf("ec2macosinit: limits can't be negative")
+	}
+	if l.Hard == 0 {
+		return strconv.Itoa(l.Soft), unlimited, nil
+	}
+	if l.Soft > l.Hard {
+		return "", "", fmt.Errorf("ec2macosinit: soft limit %d is higher than hard limit %d", l.Soft, l.Hard)
+	}
+	return strconv.Itoa(l.Soft), strconv.Itoa(l.Hard), nil
+}
+
+// applyLimit sets a launchd resource limit if it differs, then reads it back to verify it, and makes sure the job in
+// the plist at path sets it on every boot.
+func applyLimit(ctx *ModuleContext, name string, l Limit, path string) (changed bool, err error) {
+	soft, hard, err := l.values()
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: invalid %s: %s", name, err)
+	}
+
+	currentSoft, currentHard, err := readLimit(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if currentSoft != soft || currentHard != hard {
+		out, err := ctx.executeCommand([]string{"/bin/launchctl", "limit", name, soft, hard}, "", []string{})
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to set %s to %s %s: %s %s", name, soft, hard, err, strings.TrimSpace(out.stderr))
+		}
+
+		// Validate new value
+		currentSoft, currentHard, err = readLimit(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if currentSoft != soft || currentHard != hard {
+			return false, fmt.Errorf("ec2macosinit: verification failed for %s, expected %s %s but got %s %s", name, soft, hard, currentSoft, currentHard)
+		}
+		ctx.Logger.Infof("Set %s limit to [%s %s]", name, soft, hard)
+		changed = true
+	}
+
+	// Persist the limit, launchd applies it when the job is loaded at boot
+	job, err := plist.MarshalIndent(map[string]interface{}{
+		"Label":            limitJobLabelPrefix + name,
+		"ProgramArguments": []interface{}{"/bin/launchctl", "limit", name, soft, hard},
+		"RunAtLoad":        true,
+	}, plist.XMLFormat, "	")
+	if err != nil {
+		return changed, fmt.Errorf("ec2macosinit: unable to encode launchd plist: %s", err)
+	}
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, job) {
+		return changed, nil
+	}
+	err = safeWriteFile(path, job, 0644, 0, 0)
+	if err != nil {
+		return changed, fmt.Errorf("ec2macosinit: unable to write launchd plist %s: %s", path, err)
+	}
+	ctx.Logger.Infof("Wrote %s to set the %s limit on every boot", path, name)
+	return true, nil
+}
+
+// readLimit reads the current soft and hard value of a launchd resource limit. launchctl prints them after the name,
+// such as "maxfiles    256            unlimited".
+func readLimit(ctx *ModuleContext, name string) (soft, hard string, err error) {
+	out, err := ctx.executeCommand([]string{"/bin/launchctl", "limit", name}, "", []string{})
+	if err != nil {
+		return "", "", fmt.Errorf("ec2macosinit: unable to get current value of %s: %s", name, err)
+	}
+	fields := strings.Fields(out.stdout)
+	if len(fields) != 3 || fields[0] != name {
+		return "", "", fmt.Errorf("ec2macosinit: unexpected launchctl output for %s: %s", name, strings.TrimSpace(out.stdout))
+	}
+	return fields[1], fields[2], nil
+}
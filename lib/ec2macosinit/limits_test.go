@@ -0,0 +1,51 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_applyLimit(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("launchd plists are owned by root")
+	}
+	soft, hard := "256", unlimited
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		if len(c) == 5 {
+			soft, hard = c[3], c[4]
+		}
+		return commandOutput{stdout: "\tmaxfiles    " + soft + "            " + hard + "      \n"}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	path := filepath.Join(t.TempDir(), limitJobLabelPrefix+"maxfiles.plist")
+
+	changed, err := applyLimit(ctx, "maxfiles", Limit{Soft: 65536, Hard: 200000}, path)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "65536", soft)
+	assert.Equal(t, "200000", hard)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "<string>200000</string>")
+
+	// Nothing changes on the next run
+	changed, err = applyLimit(ctx, "maxfiles", Limit{Soft: 65536, Hard: 200000}, path)
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestLimit_values(t *testing.T) {
+	soft, hard, err := Limit{Soft: 65536}.values()
+	assert.NoError(t, err)
+	assert.Equal(t, "65536", soft)
+	assert.Equal(t, "unlimited", hard)
+
+	_, _, err = Limit{Soft: 10, Hard: 5}.values()
+	assert.Error(t, err)
+	_, _, err = Limit{Soft: -1}.values()
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+const (
+	// lineInFileStatePresent ensures the line is in the file.
+	lineInFileStatePresent = "present"
+	// lineInFileStateAbsent ensures no matching line is in the file.
+	lineInFileStateAbsent = "absent"
+)
+
+// LineInFileModule contains all necessary configuration fields for running a LineInFile module.
+type LineInFileModule struct {
+	Path   string `toml:"Path"`   // Path is the file to edit
+	Regexp string `toml:"Regexp"` // Regexp matches the line(s) to replace or remove
+	Line   string `toml:"Line"`   // Line is the line to ensure is present
+	State  string `toml:"State"`  // State is either "present" (default) or "absent"
+	Backup bool   `toml:"Backup"` // Backup saves the file in the lineinfile backups before it is changed
+	Create bool   `toml:"Create"` // Create creates the file if it doesn't exist when State is "present"
+}
+
+// Do for the LineInFileModule ensures that a line is present in, or absent from, a file. When State is "present", the
+// last line matching Regexp is replaced with Line, or Line is appended if nothing matches. When State is "absent",
+// every line matching Regexp (or equal to Line, if no Regexp is given) is removed.
+func (c *LineInFileModule) Do(ctx *ModuleContext) (message string, err error) {
+	if c.Path == "" {
+		return "", fmt.Errorf("ec2macosinit: Path must be provided")
+	}
+
+	state := c.State
+	if state == "" {
+		state = lineInFileStatePresent
+	}
+	if state != lineInFileStatePresent && state != lineInFileStateAbsent {
+		return "", fmt.Errorf("ec2macosinit: unknown state %q, must be %q or %q", c.State, lineInFileStatePresent, lineInFileStateAbsent)
+	}
+	if state == lineInFileStatePresent && c.Line == "" {
+		return "", fmt.Errorf("ec2macosinit: Line must be provided when State is %q", lineInFileStatePresent)
+	}
+	// Without either, every blank line would match and be removed
+	if state == lineInFileStateAbsent && c.Regexp == "" && c.Line == "" {
+		return "", fmt.Errorf("ec2macosinit: Regexp or Line must be provided when State is %q", lineInFileStateAbsent)
+	}
+
+	var re *regexp.Regexp
+	if c.Regexp != "" {
+		re, err = regexp.Compile(c.Regexp)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error compiling regexp %q: %s", c.Regexp, err)
+		}
+	}
+
+	// Read the current contents, keeping existing permissions and ownership for the rewrite
+	perm, uid, gid := os.FileMode(0644), -1, -1
+	content, err := os.ReadFile(c.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		if state == lineInFileStateAbsent {
+			return fmt.Sprintf("file %s does not exist, nothing to remove", c.Path), nil
+		}
+		if !c.Create {
+			return "", fmt.Errorf("ec2macosinit: file %s does not exist and Create is not set", c.Path)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error reading %s: %s", c.Path, err)
+	} else if info, err := os.Stat(c.Path); err == nil {
+		perm = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+
+	updated, changed := editLines(string(content), re, c.Line, state == lineInFileStatePresent)
+	if !changed {
+		return fmt.Sprintf("file %s already in desired state", c.Path), nil
+	}
+
+	// Backups are kept under the base directory, since a copy next to the file may itself be read, as in /etc/pam.d
+	if c.Backup {
+		backups := newFileBackups(ctx.BaseDirectory, "lineinfile")
+		err = backups.save(c.Path)
+		if err != nil {
+			return "", err
+		}
+		ctx.Logger.Infof("Backed up %s to %s", c.Path, backups.dir)
+	}
+
+	err = safeWriteFile(c.Path, []byte(updated), perm, uid, gid)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error writing %s: %s", c.Path, err)
+	}
+
+	return fmt.Sprintf("successfully updated %s (state: %s)", c.Path, state), nil
+}
+
+// editLines applies the line edit to content and reports whether anything changed.
+func editLines(content string, re *regexp.Regexp, line string, present bool) (updated string, changed bool) {
+	var lines []string
+	if content != "" {
+		lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+	matches := func(l string) bool {
+		if re != nil {
+			return re.MatchString(l)
+		}
+		return l == line
+	}
+
+	if present {
+		// Replace the last matching line, or append when nothing matches
+		last := -1
+		for i, l := range lines {
+			if matches(l) {
+				last = i
+			}
+		}
+		// The line may already exist without matching the regexp
+		if last == -1 {
+			for _, l := range lines {
+				if l == line {
+					return content, false
+				}
+			}
+		}
+		switch {
+		case last == -1:
+			lines = append(lines, line)
+		case lines[last] == line:
+			return content, false
+		default:
+			lines[last] = line
+		}
+	} else {
+		kept := lines[:0]
+		for _, l := range lines {
+			if !matches(l) {
+				kept = append(kept, l)
+			}
+		}
+		if len(kept) == len(lines) {
+			return content, false
+		}
+		lines = kept
+	}
+
+	if len(lines) == 0 {
+		return "", true
+	}
+	return strings.Join(lines, "\n") + "\n", true
+}
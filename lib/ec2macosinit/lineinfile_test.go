@@ -0,0 +1,122 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_editLines(t *testing.T) {
+	const pam = "auth       optional       pam_krb5.so use_kcminit\nauth       required       pam_opendirectory.so\n"
+	tests := []struct {
+		name        string
+		content     string
+		regexp      string
+		line        string
+		present     bool
+		wantContent string
+		wantChanged bool
+	}{
+		{
+			name:        "Append when missing",
+			content:     pam,
+			line:        "auth       sufficient     pam_tid.so",
+			present:     true,
+			wantContent: pam + "auth       sufficient     pam_tid.so\n",
+			wantChanged: true,
+		},
+		{
+			name:        "Replace matching line",
+			content:     pam,
+			regexp:      `pam_krb5\.so`,
+			line:        "# krb5 disabled",
+			present:     true,
+			wantContent: "# krb5 disabled\nauth       required       pam_opendirectory.so\n",
+			wantChanged: true,
+		},
+		{
+			name:        "Already present",
+			content:     pam,
+			regexp:      `pam_opendirectory`,
+			line:        "auth       required       pam_opendirectory.so",
+			present:     true,
+			wantContent: pam,
+			wantChanged: false,
+		},
+		{
+			name:        "Create empty file",
+			content:     "",
+			line:        "first",
+			present:     true,
+			wantContent: "first\n",
+			wantChanged: true,
+		},
+		{
+			name:        "Remove matching lines",
+			content:     pam,
+			regexp:      `^auth`,
+			present:     false,
+			wantContent: "",
+			wantChanged: true,
+		},
+		{
+			name:        "Nothing to remove",
+			content:     pam,
+			line:        "missing",
+			present:     false,
+			wantContent: pam,
+			wantChanged: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var re *regexp.Regexp
+			if tt.regexp != "" {
+				re = regexp.MustCompile(tt.regexp)
+			}
+			gotContent, gotChanged := editLines(tt.content, re, tt.line, tt.present)
+			assert.Equal(t, tt.wantContent, gotContent)
+			assert.Equal(t, tt.wantChanged, gotChanged)
+		})
+	}
+}
+
+func TestLineInFileModule_Do_absentRequiresMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sudoers")
+	const content = "Defaults env_reset\n\nroot ALL = (ALL) ALL\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0440))
+
+	// Without a Regexp or Line, nothing is removed, rather than every blank line
+	_, err := (&LineInFileModule{Path: path, State: "absent"}).Do(&ModuleContext{Logger: &Logger{}})
+	assert.Error(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestLineInFileModule_Do_backup(t *testing.T) {
+	dir, baseDir := t.TempDir(), t.TempDir()
+	path := filepath.Join(dir, "sudo")
+	const content = "auth       required       pam_opendirectory.so\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0444))
+
+	c := &LineInFileModule{Path: path, Line: "auth       sufficient     pam_tid.so", Backup: true}
+	_, err := c.Do(&ModuleContext{Logger: &Logger{}, BaseDirectory: baseDir})
+	require.NoError(t, err)
+
+	// Nothing is left next to the file, which could be read as configuration
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	restored, err := Rollback(baseDir, "lineinfile")
+	require.NoError(t, err)
+	assert.Equal(t, []string{path}, restored)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
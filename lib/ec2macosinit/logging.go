@@ -1,28 +1,78 @@
 package ec2macosinit
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/syslog"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Logger contains booleans for where to log, a tag used in syslog and the syslog Writer itself.
+// osLogSubsystem is the subsystem used for messages written to the unified logging system.
+const osLogSubsystem = "com.amazon.ec2.macos-init"
+
+// Severities of log records.
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// SystemLogger writes messages to a system log, either the unified logging system or syslog.
+type SystemLogger interface {
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// Logger contains booleans for where to log, a tag used in the system log and the system log writer itself.
 type Logger struct {
 	LogToStdout    bool
 	LogToSystemLog bool
 	Tag            string
-	SystemLog      *syslog.Writer
+	SystemLog      SystemLogger
+	ConsolePath    string    // ConsolePath is the console device milestones are written to, empty disables the console
+	JSON           bool      // JSON writes each message to stdout as a JSON record instead of plain text
+	Fields         LogFields // Fields are included in every JSON record
+	sensitive      redactor
+	root           *Logger // root is the logger this one was derived from, which holds the sensitive values
+}
+
+// LogFields are the context included in JSON log records.
+type LogFields struct {
+	InstanceID string `json:"instanceID,omitempty"`
+	RunID      string `json:"runID,omitempty"`
+	Module     string `json:"module,omitempty"`
+	Group      int    `json:"group,omitempty"`
+}
+
+// logRecord is a single JSON log record.
+type logRecord struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	LogFields
 }
 
-// NewLogger creates a new logger. Logger writes using the LOG_LOCAL0 facility by default if system logging is enabled.
+// NewLogger creates a new logger. If system logging is enabled, Logger writes to the unified logging system using the
+// com.amazon.ec2.macos-init subsystem with the tag as the category. When unified logging isn't available, it falls
+// back to syslog using the LOG_LOCAL0 facility.
 func NewLogger(tag string, systemLog bool, stdout bool) (logger *Logger, err error) {
 	// Set up system logging, if enabled
-	syslogger := &syslog.Writer{}
+	var systemLogger SystemLogger
 	if systemLog {
-		syslogger, err = syslog.New(syslog.LOG_LOCAL0, tag)
+		systemLogger, err = newOSLogger(osLogSubsystem, tag)
 		if err != nil {
-			return &Logger{}, fmt.Errorf("ec2macosinit: unable to create new syslog logger: %s\n", err)
+			systemLogger, err = syslog.New(syslog.LOG_LOCAL0, tag)
+			if err != nil {
+				return &Logger{}, fmt.Errorf("ec2macosinit: unable to create new syslog logger: %s\n", err)
+			}
 		}
 	}
 	// Set log to use microseconds, if stdout is enabled
@@ -30,77 +80,178 @@ func NewLogger(tag string, systemLog bool, stdout bool) (logger *Logger, err err
 		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
 
-	return &Logger{LogToSystemLog: systemLog, LogToStdout: stdout, Tag: tag, SystemLog: syslogger}, nil
+	return &Logger{LogToSystemLog: systemLog, LogToStdout: stdout, Tag: tag, SystemLog: systemLogger}, nil
 }
 
 // Info writes info to stdout and/or the system log.
 func (l *Logger) Info(v ...interface{}) {
-	if l.LogToStdout {
-		log.Print(v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Info(fmt.Sprint(v...))
-	}
+	l.write(severityInfo, fmt.Sprint(v...))
 }
 
 // Infof writes formatted info to stdout and/or the system log.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.LogToStdout {
-		log.Printf(format, v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Info(fmt.Sprintf(format, v...))
-	}
+	l.write(severityInfo, fmt.Sprintf(format, v...))
 }
 
 // Warn writes a warning to stdout and/or the system log.
 func (l *Logger) Warn(v ...interface{}) {
-	if l.LogToStdout {
-		log.Print(v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Warning(fmt.Sprint(v...))
-	}
+	l.write(severityWarning, fmt.Sprint(v...))
 }
 
 // Warnf writes a formatted warning to stdout and/or the system log.
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.LogToStdout {
-		log.Printf(format, v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Warning(fmt.Sprintf(format, v...))
-	}
+	l.write(severityWarning, fmt.Sprintf(format, v...))
 }
 
 // Error writes an error to stdout and/or the system log.
 func (l *Logger) Error(v ...interface{}) {
-	if l.LogToStdout {
-		log.Print(v...)
-	}
-	if l.LogToSystemLog {
-		_ = l.SystemLog.Err(fmt.Sprint(v...))
-	}
+	l.write(severityError, fmt.Sprint(v...))
 }
 
 // Errorf writes a formatted error to stdout and/or the system log.
 func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.write(severityError, fmt.Sprintf(format, v...))
+}
+
+// WithModule returns a logger which includes the module and its priority group in JSON records. Sensitive values are
+// shared with the original logger.
+func (l *Logger) WithModule(name string, group int) *Logger {
+	fields := l.Fields
+	fields.Module, fields.Group = name, group
+	return &Logger{
+		LogToStdout:    l.LogToStdout,
+		LogToSystemLog: l.LogToSystemLog,
+		Tag:            l.Tag,
+		SystemLog:      l.SystemLog,
+		ConsolePath:    l.ConsolePath,
+		JSON:           l.JSON,
+		Fields:         fields,
+		root:           l.rootLogger(),
+	}
+}
+
+// rootLogger returns the logger holding the sensitive values.
+func (l *Logger) rootLogger() *Logger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// write writes a message with the given severity to stdout and/or the system log.
+func (l *Logger) write(severity string, m string) {
+	m = l.Redact(m)
 	if l.LogToStdout {
-		log.Printf(format, v...)
+		if l.JSON {
+			l.writeJSON(severity, m)
+		} else {
+			log.Print(m)
+		}
 	}
 	if l.LogToSystemLog {
-		_ = l.SystemLog.Err(fmt.Sprintf(format, v...))
+		switch severity {
+		case severityWarning:
+			_ = l.SystemLog.Warning(m)
+		case severityError:
+			_ = l.SystemLog.Err(m)
+		default:
+			_ = l.SystemLog.Info(m)
+		}
+	}
+}
+
+// writeJSON writes a message as a single line JSON record to the standard logger's output.
+func (l *Logger) writeJSON(severity string, m string) {
+	m = strings.TrimRight(m, "\n")
+	record, err := json.Marshal(logRecord{Time: time.Now().UTC(), Severity: severity, Message: m, LogFields: l.Fields})
+	if err != nil {
+		log.Print(m)
+		return
+	}
+	_, _ = fmt.Fprintln(log.Writer(), string(record))
+}
+
+// NewRunID returns a random identifier used to correlate the log records of a single run.
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Milestonef writes formatted info to stdout and/or the system log, and to the console so that progress can be
+// followed in the EC2 console output even when the instance can't be reached.
+func (l *Logger) Milestonef(format string, v ...interface{}) {
+	l.Infof(format, v...)
+	l.console(fmt.Sprintf(format, v...))
+}
+
+// console writes a message to the console, if enabled. Failures are ignored since the console is best effort.
+func (l *Logger) console(m string) {
+	if l.ConsolePath == "" {
+		return
+	}
+	_ = writeConsole(l.ConsolePath, fmt.Sprintf("%s %s: %s\n", time.Now().UTC().Format(time.RFC3339), l.Tag, l.Redact(m)))
+}
+
+// lineWriter logs each complete line written to it, so that the output of long running commands can be followed while
+// they run.
+type lineWriter struct {
+	logger  *Logger
+	prefix  string
+	console bool // console also writes lines to the console
+	mu      sync.Mutex
+	buf     []byte
+}
+
+// newLineWriter returns a lineWriter which logs lines with the prefix.
+func newLineWriter(l *Logger, prefix string) *lineWriter {
+	return &lineWriter{logger: l, prefix: prefix}
+}
+
+// Write logs each complete line and keeps any partial line until it's completed or flushed.
+func (w *lineWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any partial line left at the end of the output.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.log(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// log logs a single line.
+func (w *lineWriter) log(line string) {
+	w.logger.Infof("%s: %s", w.prefix, line)
+	if w.console {
+		w.logger.console(fmt.Sprintf("%s: %s", w.prefix, line))
 	}
 }
 
-// Fatal writes an error to stdout and/or the system log then exits with requested code.
+// Fatal writes an error to stdout, the system log, and/or the console then exits with requested code.
 func (l *Logger) Fatal(e int, v ...interface{}) {
 	l.Error(v...)
+	l.console(fmt.Sprint(v...))
 	os.Exit(e)
 }
 
-// Fatalf writes a formatted error to stdout and/or the system log then exits with requested code.
+// Fatalf writes a formatted error to stdout, the system log, and/or the console then exits with requested code.
 func (l *Logger) Fatalf(e int, format string, v ...interface{}) {
 	l.Errorf(format, v...)
+	l.console(fmt.Sprintf(format, v...))
 	os.Exit(e)
 }
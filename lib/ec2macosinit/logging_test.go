@@ -0,0 +1,71 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger_Milestonef(t *testing.T) {
+	console := filepath.Join(t.TempDir(), "console")
+	require.NoError(t, os.WriteFile(console, nil, 0600))
+
+	l := &Logger{Tag: "ec2-macOS-init", ConsolePath: console}
+	l.Milestonef("Completed processing of priority level %d of %d", 1, 2)
+	l.Milestonef("Run summary: result=%s", "success")
+
+	data, err := os.ReadFile(console)
+	require.NoError(t, err)
+	assert.Regexp(t, `^\S+Z ec2-macOS-init: Completed processing of priority level 1 of 2\n\S+Z ec2-macOS-init: Run summary: result=success\n$`, string(data))
+
+	// Without a console nothing is written, and an unavailable console is ignored
+	(&Logger{}).Milestonef("nothing")
+	(&Logger{ConsolePath: filepath.Join(t.TempDir(), "missing", "console")}).Milestonef("ignored")
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	l := &Logger{LogToStdout: true, JSON: true, Fields: LogFields{InstanceID: "i-0123456789abcdef0", RunID: "abc"}}
+	l.AddSensitive("hunter22")
+	l.WithModule("SetPassword", 2).Warnf("password hunter22 set\n")
+	l.Info("done")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var record logRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "warning", record.Severity)
+	assert.Equal(t, "password [REDACTED] set", record.Message)
+	assert.Equal(t, LogFields{InstanceID: "i-0123456789abcdef0", RunID: "abc", Module: "SetPassword", Group: 2}, record.LogFields)
+	assert.False(t, record.Time.IsZero())
+
+	record = logRecord{}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "info", record.Severity)
+	assert.Equal(t, LogFields{InstanceID: "i-0123456789abcdef0", RunID: "abc"}, record.LogFields)
+}
+
+func TestLineWriter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	w := newLineWriter(&Logger{LogToStdout: true}, "userdata")
+	_, _ = w.Write([]byte("first\nsec"))
+	assert.Equal(t, "userdata: first\n", buf.String())
+	_, _ = w.Write([]byte("ond\r\nlast"))
+	w.Flush()
+	assert.Equal(t, "userdata: first\nuserdata: second\nuserdata: last\n", buf.String())
+}
@@ -0,0 +1,93 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// loginwindowPlist holds the system wide login window settings
+	loginwindowPlist = "/Library/Preferences/com.apple.loginwindow"
+	// smbServerPlist holds the settings of the SMB file sharing server
+	smbServerPlist = "/Library/Preferences/SystemConfiguration/com.apple.smb.server"
+	// kcpasswordPath holds the obfuscated password used for automatic login
+	kcpasswordPath = "/etc/kcpassword"
+)
+
+// LoginHardeningModule contains all necessary configuration fields for running a LoginHardening module. Baseline turns
+// on every setting which isn't explicitly set, so a setting can still be turned off when it's wanted.
+type LoginHardeningModule struct {
+	Baseline            bool  `toml:"Baseline"`            // Baseline applies every setting which isn't set to false
+	DisableGuest        *bool `toml:"DisableGuest"`        // DisableGuest turns off the guest account and guest file sharing
+	DisableConsoleLogin *bool `toml:"DisableConsoleLogin"` // DisableConsoleLogin stops ">console" bypassing the login window
+	DisableAutoLogin    *bool `toml:"DisableAutoLogin"`    // DisableAutoLogin turns off automatic login and removes its password
+}
+
+// enabled returns whether a setting should be applied.
+func (c *LoginHardeningModule) enabled(setting *bool) bool {
+	if setting != nil {
+		return *setting
+	}
+	return c.Baseline
+}
+
+// Do for the LoginHardeningModule turns off the guest account, the console login bypass, and automatic login, as
+// configured. The login window settings are written directly to its plist and verified, and anything already in the
+// desired state is left alone.
+func (c *LoginHardeningModule) Do(ctx *ModuleContext) (message string, err error) {
+	var changes []ModifyDefaults
+	var guest, autoLogin bool
+	if c.enabled(c.DisableGuest) {
+		guest = true
+		changes = append(changes,
+			ModifyDefaults{Plist: loginwindowPlist, Parameter: "GuestEnabled", Type: "bool", Value: "false"},
+			ModifyDefaults{Plist: smbServerPlist, Parameter: "AllowGuestAccess", Type: "bool", Value: "false"},
+		)
+	}
+	if c.enabled(c.DisableConsoleLogin) {
+		changes = append(changes, ModifyDefaults{Plist: loginwindowPlist, Parameter: "DisableConsoleAccess", Type: "bool", Value: "true"})
+	}
+	if c.enabled(c.DisableAutoLogin) {
+		autoLogin = true
+		changes = append(changes, ModifyDefaults{Plist: loginwindowPlist, Parameter: "autoLoginUser", Delete: true})
+	}
+	if len(changes) == 0 {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	count := func(settingChanged bool, name string) {
+		if settingChanged {
+			changed++
+			ctx.Logger.Infof("Applied login hardening setting [%s]", name)
+		} else {
+			unchanged++
+		}
+	}
+
+	// The guest account is turned off with sysadminctl, which also removes its home directory and keychain
+	if guest {
+		guestChanged, err := disableGuestAccount(ctx)
+		if err != nil {
+			return "", err
+		}
+		count(guestChanged, "guest account")
+	}
+	for _, m := range changes {
+		settingChanged, err := modifyDefaults(ctx, m, nil)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to set %s: %s", m.Parameter, err)
+		}
+		count(settingChanged, m.Parameter)
+	}
+	if autoLogin {
+		err = os.Remove(kcpasswordPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("ec2macosinit: unable to remove the automatic login password: %s", err)
+		}
+		count(err == nil, kcpasswordPath)
+	}
+
+	return fmt.Sprintf("successfully applied login hardening [%d changed / %d unchanged]", changed, unchanged), nil
+}
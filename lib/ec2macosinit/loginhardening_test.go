@@ -0,0 +1,53 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestLoginHardeningModule_Do(t *testing.T) {
+	dir := t.TempDir()
+	defer func(l, s, k string) { loginwindowPlist, smbServerPlist, kcpasswordPath = l, s, k }(loginwindowPlist, smbServerPlist, kcpasswordPath)
+	loginwindowPlist = filepath.Join(dir, "com.apple.loginwindow")
+	smbServerPlist = filepath.Join(dir, "com.apple.smb.server")
+	kcpasswordPath = filepath.Join(dir, "kcpassword")
+	data, err := plist.MarshalIndent(map[string]interface{}{"autoLoginUser": "ec2-user", "GuestEnabled": true}, plist.XMLFormat, "	")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(loginwindowPlist+".plist", data, 0644))
+	require.NoError(t, os.WriteFile(kcpasswordPath, []byte("secret"), 0600))
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stderr: "Guest account disabled."}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	// Automatic login is kept when it's explicitly wanted
+	keep := false
+	c := &LoginHardeningModule{Baseline: true, DisableAutoLogin: &keep}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied login hardening [3 changed / 1 unchanged]", message)
+	assert.FileExists(t, kcpasswordPath)
+
+	data, err = os.ReadFile(loginwindowPlist + ".plist")
+	require.NoError(t, err)
+	var settings interface{}
+	_, err = plist.Unmarshal(data, &settings)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"autoLoginUser": "ec2-user", "GuestEnabled": false, "DisableConsoleAccess": true}, settings)
+
+	c.DisableAutoLogin = nil
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied login hardening [2 changed / 4 unchanged]", message)
+	assert.NoFileExists(t, kcpasswordPath)
+
+	message, err = (&LoginHardeningModule{}).Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "nothing to do", message)
+}
@@ -0,0 +1,104 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// defaultMetricsNamespace is the CloudWatch namespace used when none is configured.
+	defaultMetricsNamespace = "EC2MacOSInit"
+	// metricsBatchSize is the number of metrics sent in each PutMetricData request.
+	metricsBatchSize = 20
+)
+
+// MetricsConfig configures publishing run metrics to CloudWatch and writing them for Prometheus.
+type MetricsConfig struct {
+	Enabled   bool   `toml:"Enabled"`   // Enabled turns on publishing metrics to CloudWatch at the end of each run
+	Namespace string `toml:"Namespace"` // Namespace is the CloudWatch namespace, defaults to EC2MacOSInit
+	// TextfileDirectory is a node_exporter textfile collector directory to write Prometheus metrics to, empty disables it
+	TextfileDirectory string `toml:"TextfileDirectory"`
+}
+
+// metricDatum is a single CloudWatch metric value.
+type metricDatum struct {
+	Name       string
+	Unit       string
+	Value      float64
+	Dimensions [][2]string
+}
+
+// runMetrics returns the metrics for a run: the duration and result of the run as a whole, and of each module which
+// ran. Modules that were skipped or not run have no metrics.
+func (c *InitConfig) runMetrics(s RunSummary) (data []metricDatum) {
+	failure := func(failed bool) float64 {
+		if failed {
+			return 1
+		}
+		return 0
+	}
+
+	data = append(data,
+		metricDatum{Name: "RunDuration", Unit: "Seconds", Value: s.Duration.Seconds()},
+		metricDatum{Name: "RunFailure", Unit: "Count", Value: failure(s.Result() != "success")},
+		metricDatum{Name: "ModulesFailed", Unit: "Count", Value: float64(s.Failed)},
+	)
+	for _, group := range c.ModulesByPriority {
+		for _, m := range group {
+			if m.Skipped || m.StartTime.IsZero() {
+				continue
+			}
+			dimensions := [][2]string{{"Module", m.Name}}
+			data = append(data,
+				metricDatum{Name: "ModuleDuration", Unit: "Milliseconds", Value: float64(m.EndTime.Sub(m.StartTime).Milliseconds()), Dimensions: dimensions},
+				metricDatum{Name: "ModuleFailure", Unit: "Count", Value: failure(!m.Success), Dimensions: dimensions},
+			)
+		}
+	}
+	return data
+}
+
+// putMetricDataParams returns the PutMetricData request parameters for a batch of metrics.
+func putMetricDataParams(namespace string, data []metricDatum) (params url.Values) {
+	params = url.Values{"Namespace": {namespace}}
+	for i, d := range data {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		params.Set(prefix+"MetricName", d.Name)
+		params.Set(prefix+"Unit", d.Unit)
+		params.Set(prefix+"Value", strconv.FormatFloat(d.Value, 'f', -1, 64))
+		for j, dimension := range d.Dimensions {
+			dimensionPrefix := prefix + "Dimensions.member." + strconv.Itoa(j+1) + "."
+			params.Set(dimensionPrefix+"Name", dimension[0])
+			params.Set(dimensionPrefix+"Value", dimension[1])
+		}
+	}
+	return params
+}
+
+// PublishMetrics publishes the metrics of a run to CloudWatch using the instance profile role credentials, if enabled.
+// The role must allow cloudwatch:PutMetricData.
+func (c *InitConfig) PublishMetrics(s RunSummary) (err error) {
+	if !c.Metrics.Enabled {
+		return nil
+	}
+	namespace := c.Metrics.Namespace
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+
+	ctx := &ModuleContext{Logger: c.Log, IMDS: &c.IMDS}
+	data := c.runMetrics(s)
+	for start := 0; start < len(data); start += metricsBatchSize {
+		end := start + metricsBatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		err = callAWSQuery(ctx, "monitoring", "PutMetricData", "2010-08-01", putMetricDataParams(namespace, data[start:end]))
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to publish metrics: %s", err)
+		}
+	}
+
+	return nil
+}
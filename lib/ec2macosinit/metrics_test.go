@@ -0,0 +1,51 @@
+package ec2macosinit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitConfig_runMetrics(t *testing.T) {
+	started := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &InitConfig{
+		ModulesByPriority: [][]Module{
+			{
+				{Name: "ok", Success: true, StartTime: started, EndTime: started.Add(250 * time.Millisecond)},
+				{Name: "skipped", Success: true, Skipped: true},
+				{Name: "broken", StartTime: started, EndTime: started.Add(time.Second)},
+			},
+		},
+	}
+
+	data := c.runMetrics(c.Summarize(2*time.Second, ""))
+	assert.Equal(t, []metricDatum{
+		{Name: "RunDuration", Unit: "Seconds", Value: 2},
+		{Name: "RunFailure", Unit: "Count", Value: 1},
+		{Name: "ModulesFailed", Unit: "Count", Value: 1},
+		{Name: "ModuleDuration", Unit: "Milliseconds", Value: 250, Dimensions: [][2]string{{"Module", "ok"}}},
+		{Name: "ModuleFailure", Unit: "Count", Value: 0, Dimensions: [][2]string{{"Module", "ok"}}},
+		{Name: "ModuleDuration", Unit: "Milliseconds", Value: 1000, Dimensions: [][2]string{{"Module", "broken"}}},
+		{Name: "ModuleFailure", Unit: "Count", Value: 1, Dimensions: [][2]string{{"Module", "broken"}}},
+	}, data)
+}
+
+func Test_putMetricDataParams(t *testing.T) {
+	params := putMetricDataParams("EC2MacOSInit", []metricDatum{
+		{Name: "RunDuration", Unit: "Seconds", Value: 1.5},
+		{Name: "ModuleFailure", Unit: "Count", Value: 0, Dimensions: [][2]string{{"Module", "ok"}}},
+	})
+	assert.Equal(t, "EC2MacOSInit", params.Get("Namespace"))
+	assert.Equal(t, "RunDuration", params.Get("MetricData.member.1.MetricName"))
+	assert.Equal(t, "1.5", params.Get("MetricData.member.1.Value"))
+	assert.Equal(t, "Seconds", params.Get("MetricData.member.1.Unit"))
+	assert.Equal(t, "0", params.Get("MetricData.member.2.Value"))
+	assert.Equal(t, "Module", params.Get("MetricData.member.2.Dimensions.member.1.Name"))
+	assert.Equal(t, "ok", params.Get("MetricData.member.2.Dimensions.member.1.Value"))
+}
+
+func TestInitConfig_PublishMetrics_disabled(t *testing.T) {
+	c := &InitConfig{}
+	assert.NoError(t, c.PublishMetrics(RunSummary{}))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/ec2-macos-init/internal/paths"
 	"github.com/google/go-cmp/cmp"
@@ -12,28 +13,110 @@ import (
 // Module contains a few fields common to all Module types and containers for the configuration of any
 // potential module type.
 type Module struct {
-	Type                 string
-	Success              bool
-	Name                 string               `toml:"Name"`
-	PriorityGroup        int                  `toml:"PriorityGroup"`
-	FatalOnError         bool                 `toml:"FatalOnError"`
-	RunOnce              bool                 `toml:"RunOnce"`
-	RunPerBoot           bool                 `toml:"RunPerBoot"`
-	RunPerInstance       bool                 `toml:"RunPerInstance"`
-	CommandModule        CommandModule        `toml:"Command"`
-	MOTDModule           MOTDModule           `toml:"MOTD"`
-	SSHKeysModule        SSHKeysModule        `toml:"SSHKeys"`
-	UserDataModule       UserDataModule       `toml:"UserData"`
-	NetworkCheckModule   NetworkCheckModule   `toml:"NetworkCheck"`
-	SystemConfigModule   SystemConfigModule   `toml:"SystemConfig"`
-	UserManagementModule UserManagementModule `toml:"UserManagement"`
+	Type                  string
+	Success               bool
+	Skipped               bool                  `toml:"-"` // Skipped is set when the Run type setting skipped the module
+	StartTime             time.Time             `toml:"-"`
+	EndTime               time.Time             `toml:"-"`
+	Message               string                `toml:"-"` // Message is the message returned by the module
+	Error                 string                `toml:"-"` // Error is the error returned by the module, if any
+	Name                  string                `toml:"Name"`
+	PriorityGroup         int                   `toml:"PriorityGroup"`
+	FatalOnError          bool                  `toml:"FatalOnError"`
+	ContinueOnError       bool                  `toml:"ContinueOnError"` // ContinueOnError keeps a failure from failing the run
+	RunOnce               bool                  `toml:"RunOnce"`
+	RunPerBoot            bool                  `toml:"RunPerBoot"`
+	RunPerInstance        bool                  `toml:"RunPerInstance"`
+	Phase                 string                `toml:"Phase"`    // Phase is when the module runs, PreNetwork or PostNetwork (the default)
+	RunEvery              time.Duration         `toml:"RunEvery"` // RunEvery is how often the daemon runs the module again, zero for never
+	CommandModule         CommandModule         `toml:"Command"`
+	MOTDModule            MOTDModule            `toml:"MOTD"`
+	SSHKeysModule         SSHKeysModule         `toml:"SSHKeys"`
+	UserDataModule        UserDataModule        `toml:"UserData"`
+	NetworkCheckModule    NetworkCheckModule    `toml:"NetworkCheck"`
+	SystemConfigModule    SystemConfigModule    `toml:"SystemConfig"`
+	UserManagementModule  UserManagementModule  `toml:"UserManagement"`
+	WriteFilesModule      WriteFilesModule      `toml:"WriteFiles"`
+	LineInFileModule      LineInFileModule      `toml:"LineInFile"`
+	SystemSetupModule     SystemSetupModule     `toml:"SystemSetup"`
+	ServiceAccountModule  ServiceAccountModule  `toml:"ServiceAccount"`
+	AccountLockModule     AccountLockModule     `toml:"AccountLock"`
+	SecureTokenModule     SecureTokenModule     `toml:"SecureToken"`
+	ScriptModule          ScriptModule          `toml:"Script"`
+	NVRAMModule           NVRAMModule           `toml:"NVRAM"`
+	LimitsModule          LimitsModule          `toml:"Limits"`
+	LoginHardeningModule  LoginHardeningModule  `toml:"LoginHardening"`
+	SetupAssistantModule  SetupAssistantModule  `toml:"SetupAssistant"`
+	ScheduledJobsModule   ScheduledJobsModule   `toml:"ScheduledJobs"`
+	DeveloperModeModule   DeveloperModeModule   `toml:"DeveloperMode"`
+	HeadlessDisplayModule HeadlessDisplayModule `toml:"HeadlessDisplay"`
+	SnapshotModule        SnapshotModule        `toml:"Snapshot"`
+	InstanceFamilyModule  InstanceFamilyModule  `toml:"InstanceFamily"`
+	S3DownloadModule      S3DownloadModule      `toml:"S3Download"`
+	GitCloneModule        GitCloneModule        `toml:"GitClone"`
+	ArchiveModule         ArchiveModule         `toml:"Archive"`
 }
 
+// Phases in which modules run. Pre-network modules run before waiting for IMDS to provide an instance ID.
+const (
+	PhasePreNetwork  = "PreNetwork"
+	PhasePostNetwork = "PostNetwork"
+)
+
+// MinRunEvery is the shortest interval at which the daemon runs a module again.
+const MinRunEvery = time.Minute
+
 // ModuleContext contains fields that may need to be passed to the Do function for modules.
 type ModuleContext struct {
 	Logger        *Logger
 	IMDS          *IMDSConfig
 	BaseDirectory string
+
+	// executor runs the commands of modules, commands are run on the system when it is nil
+	executor commandExecutor
+	// userIDs caches the UIDs and GIDs of users for the run, users are looked up every time when it is nil
+	userIDs *userIDCache
+}
+
+// StartUserIDCache starts a new cache of user IDs for a run, shared by the contexts created with NewModuleContext until
+// the next run starts.
+func (c *InitConfig) StartUserIDCache() {
+	c.userIDs = newUserIDCache()
+}
+
+// NewModuleContext returns the context for running a module in the current run.
+func (c *InitConfig) NewModuleContext(logger *Logger, baseDir string) *ModuleContext {
+	return &ModuleContext{
+		Logger:        logger,
+		IMDS:          &c.IMDS,
+		BaseDirectory: baseDir,
+		executor:      c.executor,
+		userIDs:       c.userIDs,
+	}
+}
+
+// runCommand runs a command for a module with the given options through the context's executor.
+func (m *ModuleContext) runCommand(c []string, opts commandOptions) (output commandOutput, err error) {
+	if m == nil {
+		return systemExecutor{}.run(c, opts)
+	}
+	if m.executor == nil {
+		return systemExecutor{userIDs: m.userIDs}.run(c, opts)
+	}
+	return m.executor.run(c, opts)
+}
+
+// executeCommand runs a command for a module through the context's executor and returns stdout and stderr as strings.
+func (m *ModuleContext) executeCommand(c []string, runAsUser string, envVars []string) (output commandOutput, err error) {
+	return m.runCommand(c, commandOptions{RunAsUser: runAsUser, EnvVars: envVars})
+}
+
+// getUIDandGID takes a username and returns the uid and gid for that user, using the run's cache of user IDs.
+func (m *ModuleContext) getUIDandGID(username string) (uid int, gid int, err error) {
+	if m == nil {
+		return lookupUIDandGID(username)
+	}
+	return m.userIDs.getUIDandGID(username)
 }
 
 // InstanceHistoryPath provides the history storage path for the current
@@ -52,6 +135,7 @@ func (m ModuleContext) InstanceHistoryPath() string {
 // validateModule performs the following checks:
 //  1. Check that there is exactly one Run type set
 //  2. Check that Priority is set and is not less than 1
+//  3. Check that FatalOnError and ContinueOnError aren't both set
 func (m *Module) validateModule() (err error) {
 	// Check that there is exactly one Run type set
 	var runs int8
@@ -73,6 +157,37 @@ func (m *Module) validateModule() (err error) {
 		return fmt.Errorf("ec2macosinit: module priority is unset or less than 1\n")
 	}
 
+	// Check that the module doesn't both stop and continue the run on error
+	if m.FatalOnError && m.ContinueOnError {
+		return fmt.Errorf("ec2macosinit: only one of FatalOnError and ContinueOnError may be set\n")
+	}
+
+	// Check the phase, pre-network modules run before the instance ID is known so can't use per-instance history
+	switch m.Phase {
+	case "", PhasePostNetwork:
+	case PhasePreNetwork:
+		if !m.RunPerBoot {
+			return fmt.Errorf("ec2macosinit: modules in the %s phase must be RunPerBoot\n", PhasePreNetwork)
+		}
+	default:
+		return fmt.Errorf("ec2macosinit: unknown phase %q, must be %s or %s\n", m.Phase, PhasePreNetwork, PhasePostNetwork)
+	}
+
+	// Modules run by the daemon mustn't run so often that they get in each other's way
+	if m.RunEvery != 0 && m.RunEvery < MinRunEvery {
+		return fmt.Errorf("ec2macosinit: RunEvery must be at least %s\n", MinRunEvery)
+	}
+
+	// A shell command line is a single string, joining several would lose the boundaries between arguments
+	if m.CommandModule.Shell && len(m.CommandModule.Cmd) != 1 {
+		return fmt.Errorf("ec2macosinit: Cmd must be a single command line when Shell is set\n")
+	}
+
+	// Boothooks run every boot, so the user data module must too
+	if m.UserDataModule.Boothooks && !m.RunPerBoot {
+		return fmt.Errorf("ec2macosinit: user data modules with Boothooks must be RunPerBoot\n")
+	}
+
 	return nil
 }
 
@@ -107,6 +222,82 @@ func (m *Module) identifyModule() (err error) {
 		m.Type = "usermanagement"
 		return nil
 	}
+	if !cmp.Equal(m.WriteFilesModule, WriteFilesModule{}) {
+		m.Type = "writefiles"
+		return nil
+	}
+	if !cmp.Equal(m.LineInFileModule, LineInFileModule{}) {
+		m.Type = "lineinfile"
+		return nil
+	}
+	if !cmp.Equal(m.SystemSetupModule, SystemSetupModule{}) {
+		m.Type = "systemsetup"
+		return nil
+	}
+	if !cmp.Equal(m.ServiceAccountModule, ServiceAccountModule{}) {
+		m.Type = "serviceaccount"
+		return nil
+	}
+	if !cmp.Equal(m.AccountLockModule, AccountLockModule{}) {
+		m.Type = "accountlock"
+		return nil
+	}
+	if !cmp.Equal(m.SecureTokenModule, SecureTokenModule{}) {
+		m.Type = "securetoken"
+		return nil
+	}
+	if !cmp.Equal(m.ScriptModule, ScriptModule{}) {
+		m.Type = "script"
+		return nil
+	}
+	if !cmp.Equal(m.NVRAMModule, NVRAMModule{}) {
+		m.Type = "nvram"
+		return nil
+	}
+	if !cmp.Equal(m.LimitsModule, LimitsModule{}) {
+		m.Type = "limits"
+		return nil
+	}
+	if !cmp.Equal(m.LoginHardeningModule, LoginHardeningModule{}) {
+		m.Type = "loginhardening"
+		return nil
+	}
+	if !cmp.Equal(m.SetupAssistantModule, SetupAssistantModule{}) {
+		m.Type = "setupassistant"
+		return nil
+	}
+	if !cmp.Equal(m.ScheduledJobsModule, ScheduledJobsModule{}) {
+		m.Type = "scheduledjobs"
+		return nil
+	}
+	if !cmp.Equal(m.DeveloperModeModule, DeveloperModeModule{}) {
+		m.Type = "developermode"
+		return nil
+	}
+	if !cmp.Equal(m.HeadlessDisplayModule, HeadlessDisplayModule{}) {
+		m.Type = "headlessdisplay"
+		return nil
+	}
+	if !cmp.Equal(m.SnapshotModule, SnapshotModule{}) {
+		m.Type = "snapshot"
+		return nil
+	}
+	if !cmp.Equal(m.InstanceFamilyModule, InstanceFamilyModule{}) {
+		m.Type = "instancefamily"
+		return nil
+	}
+	if !cmp.Equal(m.S3DownloadModule, S3DownloadModule{}) {
+		m.Type = "s3download"
+		return nil
+	}
+	if !cmp.Equal(m.GitCloneModule, GitCloneModule{}) {
+		m.Type = "gitclone"
+		return nil
+	}
+	if !cmp.Equal(m.ArchiveModule, ArchiveModule{}) {
+		m.Type = "archive"
+		return nil
+	}
 
 	return fmt.Errorf("ec2macosinit: unable to identify module type\n")
 }
@@ -185,3 +376,25 @@ func (m *Module) ShouldRun(instanceID string, history []History) (shouldRun bool
 	// may be potentially mutating but are misconfigured.
 	return false
 }
+
+// PreNetwork returns whether the module runs in the pre-network phase.
+func (m *Module) PreNetwork() bool {
+	return m.Phase == PhasePreNetwork
+}
+
+// SucceededInLastRun returns whether the module ran, or was skipped, successfully in the most recent run on the
+// instance. Modules the run didn't reach are pending, and didn't succeed in it.
+func (m *Module) SucceededInLastRun(instanceID string, history []History) bool {
+	key := m.generateHistoryKey()
+	for _, instance := range history {
+		if instance.InstanceID != instanceID {
+			continue
+		}
+		for _, moduleHistory := range instance.ModuleHistories {
+			if key == moduleHistory.Key {
+				return moduleHistory.Success && !moduleHistory.Pending
+			}
+		}
+	}
+	return false
+}
@@ -47,6 +47,88 @@ func TestModule_validateModule(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Bad case: FatalOnError and ContinueOnError set",
+			fields: Module{
+				PriorityGroup:   1,
+				RunOnce:         true,
+				FatalOnError:    true,
+				ContinueOnError: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Good case: PreNetwork phase with RunPerBoot",
+			fields: Module{
+				PriorityGroup: 1,
+				RunPerBoot:    true,
+				Phase:         PhasePreNetwork,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Bad case: PreNetwork phase with RunOnce",
+			fields: Module{
+				PriorityGroup: 1,
+				RunOnce:       true,
+				Phase:         PhasePreNetwork,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Bad case: unknown phase",
+			fields: Module{
+				PriorityGroup: 1,
+				RunOnce:       true,
+				Phase:         "Later",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Good case: RunEvery",
+			fields: Module{
+				PriorityGroup: 1,
+				RunPerBoot:    true,
+				RunEvery:      15 * time.Minute,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Bad case: RunEvery too short",
+			fields: Module{
+				PriorityGroup: 1,
+				RunPerBoot:    true,
+				RunEvery:      time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Bad case: Boothooks with RunPerInstance",
+			fields: Module{
+				PriorityGroup:  1,
+				RunPerInstance: true,
+				UserDataModule: UserDataModule{Boothooks: true},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Bad case: Shell with several Cmd elements",
+			fields: Module{
+				PriorityGroup: 1,
+				RunOnce:       true,
+				CommandModule: CommandModule{Cmd: []string{"echo", "a b"}, Shell: true},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Good case: Shell with a single command line",
+			fields: Module{
+				PriorityGroup: 1,
+				RunOnce:       true,
+				CommandModule: CommandModule{Cmd: []string{"echo 'a b'"}, Shell: true},
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -129,6 +211,152 @@ func TestModule_identifyModule(t *testing.T) {
 			wantType: "systemconfig",
 			wantErr:  false,
 		},
+		{
+			name: "Good case: WriteFiles Module",
+			fields: Module{
+				WriteFilesModule: WriteFilesModule{
+					Files: []WriteFile{{Path: "/etc/example.conf"}},
+				},
+			},
+			wantType: "writefiles",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: SystemSetup Module",
+			fields: Module{
+				SystemSetupModule: SystemSetupModule{ComputerSleep: "Never"},
+			},
+			wantType: "systemsetup",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: ServiceAccount Module",
+			fields: Module{
+				ServiceAccountModule: ServiceAccountModule{User: "ec2-admin"},
+			},
+			wantType: "serviceaccount",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: AccountLock Module",
+			fields: Module{
+				AccountLockModule: AccountLockModule{DisableGuest: true},
+			},
+			wantType: "accountlock",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: SecureToken Module",
+			fields: Module{
+				SecureTokenModule: SecureTokenModule{EscrowBootstrapToken: true},
+			},
+			wantType: "securetoken",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: Script Module",
+			fields: Module{
+				ScriptModule: ScriptModule{Contents: "echo hello"},
+			},
+			wantType: "script",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: NVRAM Module",
+			fields: Module{
+				NVRAMModule: NVRAMModule{BootArgs: []string{"serverperfmode=1"}},
+			},
+			wantType: "nvram",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: Limits Module",
+			fields: Module{
+				LimitsModule: LimitsModule{MaxFiles: Limit{Soft: 65536}},
+			},
+			wantType: "limits",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: LoginHardening Module",
+			fields: Module{
+				LoginHardeningModule: LoginHardeningModule{Baseline: true},
+			},
+			wantType: "loginhardening",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: SetupAssistant Module",
+			fields: Module{
+				SetupAssistantModule: SetupAssistantModule{Skip: true},
+			},
+			wantType: "setupassistant",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: ScheduledJobs Module",
+			fields: Module{
+				ScheduledJobsModule: ScheduledJobsModule{Jobs: []ScheduledJob{{Name: "cleanup"}}},
+			},
+			wantType: "scheduledjobs",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: DeveloperMode Module",
+			fields: Module{
+				DeveloperModeModule: DeveloperModeModule{Enable: true},
+			},
+			wantType: "developermode",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: HeadlessDisplay Module",
+			fields: Module{
+				HeadlessDisplayModule: HeadlessDisplayModule{Width: 1920, Height: 1080},
+			},
+			wantType: "headlessdisplay",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: Snapshot Module",
+			fields: Module{
+				SnapshotModule: SnapshotModule{Name: "pre-provisioning"},
+			},
+			wantType: "snapshot",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: InstanceFamily Module",
+			fields: Module{
+				InstanceFamilyModule: InstanceFamilyModule{ApplyPresets: true},
+			},
+			wantType: "instancefamily",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: S3Download Module",
+			fields: Module{
+				S3DownloadModule: S3DownloadModule{Objects: []S3Object{{Source: "s3://bucket/key", Path: "/tmp/key"}}},
+			},
+			wantType: "s3download",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: GitClone Module",
+			fields: Module{
+				GitCloneModule: GitCloneModule{Repository: "https://github.com/aws/ec2-macos-init.git", Path: "/opt/ec2-macos-init"},
+			},
+			wantType: "gitclone",
+			wantErr:  false,
+		},
+		{
+			name: "Good case: Archive Module",
+			fields: Module{
+				ArchiveModule: ArchiveModule{Source: "s3://bucket/toolchain.tar.gz", Destination: "/opt/toolchain"},
+			},
+			wantType: "archive",
+			wantErr:  false,
+		},
 		{
 			name: "Bad case: don't provide secureSSHDConfig",
 			fields: Module{
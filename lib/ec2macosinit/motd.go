@@ -1,6 +1,8 @@
 package ec2macosinit
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -8,30 +10,60 @@ import (
 )
 
 const (
+	// sshBannerConfig is the content of the drop-in which points sshd at the SSH banner
+	sshBannerConfig = "Banner %s\n"
+)
+
+var (
+	// motdFile is shown after logging in to a shell
 	motdFile = "/etc/motd"
+	// sshBannerFile is shown by sshd before authentication, the closest macOS has to /etc/issue
+	sshBannerFile = "/etc/ssh/ec2-macos-banner"
+	// sshBannerConfigFile is the sshd drop-in which sets the Banner. It sorts after the EC2 drop-in, which doesn't
+	// set one, and before Apple's.
+	sshBannerConfigFile = "/etc/ssh/sshd_config.d/051-ec2-macos-banner.conf"
 )
 
+// softwareLicensePath is the macOS license, whose title contains the name of the installed version of macOS. It's the
+// only place the name is kept on the system.
+var softwareLicensePath = "/System/Library/CoreServices/Setup Assistant.app/Contents/Resources/en.lproj/OSXSoftwareLicense.rtf"
+
+// motdMacOSExpression matches the version string in /etc/motd, which is replaced by the current one.
+var motdMacOSExpression = regexp.MustCompile("macOS.*")
+
+// softwareLicenseTitle matches the name of macOS in the title of the license, such as
+// "SOFTWARE LICENSE AGREEMENT FOR macOS Sonoma".
+var softwareLicenseTitle = regexp.MustCompile(`SOFTWARE LICENSE AGREEMENT FOR macOS ([A-Z][A-Za-z]*(?: [A-Z][A-Za-z]*)*)`)
+
+// versionNames maps major versions of macOS to their names, for when the name can't be read from the system.
+var versionNames = map[string]string{
+	"10.14": "Mojave",
+	"10.15": "Catalina",
+	"11":    "Big Sur",
+	"12":    "Monterey",
+	"13":    "Ventura",
+	"14":    "Sonoma",
+	"15":    "Sequoia",
+	"26":    "Tahoe",
+}
+
 // MOTDModule contains all necessary configuration fields for running a MOTD module.
 type MOTDModule struct {
-	UpdateName bool `toml:"UpdateName"` // UpdateName specifies if the MOTDModule should run or not
+	UpdateName   bool              `toml:"UpdateName"`   // UpdateName updates the version string in /etc/motd
+	VersionNames map[string]string `toml:"VersionNames"` // VersionNames maps major versions to names, such as "16" = "Name"
+	Template     string            `toml:"Template"`     // Template is the banner, with {os}, {name}, and {version} replaced
+	SSHBanner    bool              `toml:"SSHBanner"`    // SSHBanner writes the banner shown by sshd before login
+	LoginWindow  bool              `toml:"LoginWindow"`  // LoginWindow sets the banner as the login window's message
 }
 
 // Do for MOTDModule gets the OS's current product version and maps the name of the OS to that version. It then writes
-// a string with the OS name and product version to /etc/motd.
+// a string with the OS name and product version to each of the enabled targets: /etc/motd, the SSH banner, and the
+// login window. Targets which already have the banner are left alone.
 func (c *MOTDModule) Do(ctx *ModuleContext) (message string, err error) {
-	if !c.UpdateName {
+	if !c.UpdateName && !c.SSHBanner && !c.LoginWindow {
 		return "Not requested to update MOTD", nil
 	}
 
-	// Create the macOS string
-	macosStr := "macOS"
-
-	// Create regex pattern to be replaced in the motd file
-	motdMacOSExpression, err := regexp.Compile("macOS.*")
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error compiling motd regex pattern: %s", err)
-	}
-
 	// Get the os product version number
 	osProductVersion, err := getOSProductVersion()
 	if err != nil {
@@ -39,54 +71,169 @@ func (c *MOTDModule) Do(ctx *ModuleContext) (message string, err error) {
 	}
 
 	// Get the version name using the os product version number
-	versionName := getVersionName(osProductVersion)
+	versionName := c.getVersionName(osProductVersion)
+
+	// Create the version string to be written to the targets
+	motdString := macOSVersionString(versionName, osProductVersion)
+	banner := c.banner(motdString, versionName, osProductVersion)
+
+	// Keep the previous targets so that they can be rolled back
+	backups := newFileBackups(ctx.BaseDirectory, "motd")
+	var updated []string
+	var unchanged int
+	count := func(changed bool, target string) {
+		if changed {
+			updated = append(updated, target)
+			ctx.Logger.Infof("Updated %s with version string [%s]", target, motdString)
+		} else {
+			unchanged++
+		}
+	}
 
-	// Create the version string to be written to the motd file
-	var motdString string
-	if versionName != "" {
-		motdString = fmt.Sprintf("%s %s %s", macosStr, versionName, osProductVersion)
-	} else {
-		motdString = fmt.Sprintf("%s %s", macosStr, osProductVersion)
+	if c.UpdateName {
+		changed, err := c.updateMOTDFile(motdString, banner, backups)
+		if err != nil {
+			return "", err
+		}
+		count(changed, motdFile)
+	}
+	if c.SSHBanner {
+		changed, err := writeSSHBanner(ctx, banner, backups)
+		if err != nil {
+			return "", err
+		}
+		count(changed, sshBannerFile)
 	}
+	if c.LoginWindow {
+		changed, err := modifyDefaults(ctx, ModifyDefaults{
+			Plist:     loginwindowPlist,
+			Parameter: "LoginwindowText",
+			Type:      "string",
+			Value:     strings.TrimSpace(banner),
+		}, backups)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error setting login window text: %s", err)
+		}
+		count(changed, "login window")
+	}
+
+	if len(updated) == 0 {
+		return fmt.Sprintf("motd targets already contain version string [%s]", motdString), nil
+	}
+	return fmt.Sprintf("successfully updated motd targets [%s] with version string [%s] [%d changed / %d unchanged]",
+		strings.Join(updated, ", "), motdString, len(updated), unchanged), nil
+}
+
+// macOSVersionString returns the version string, such as "macOS Sonoma 14.5", or "macOS 14.5" when the name isn't known.
+func macOSVersionString(versionName, osProductVersion string) string {
+	if versionName == "" {
+		return fmt.Sprintf("macOS %s", osProductVersion)
+	}
+	return fmt.Sprintf("macOS %s %s", versionName, osProductVersion)
+}
+
+// banner returns the text shared by the targets. It's the Template with {os}, {name}, and {version} replaced, or the
+// version string when there's no Template.
+func (c *MOTDModule) banner(motdString, versionName, osProductVersion string) string {
+	if c.Template == "" {
+		return motdString + "\n"
+	}
+	banner := strings.NewReplacer("{os}", motdString, "{name}", versionName, "{version}", osProductVersion).Replace(c.Template)
+	if !strings.HasSuffix(banner, "\n") {
+		banner += "\n"
+	}
+	return banner
+}
 
+// updateMOTDFile updates /etc/motd. Without a Template, the file is kept and each version string in it is replaced, so
+// any other text is left as it is. With a Template, the file is replaced by the banner.
+func (c *MOTDModule) updateMOTDFile(motdString, banner string, backups *fileBackups) (changed bool, err error) {
 	// Read in the raw contents of the motd file
 	rawFileContents, err := os.ReadFile(motdFile)
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error reading motd file: %s", err)
+	if err != nil && (c.Template == "" || !errors.Is(err, os.ErrNotExist)) {
+		return false, fmt.Errorf("ec2macosinit: error reading motd file: %s", err)
+	}
+
+	replacedContents := []byte(banner)
+	if c.Template == "" {
+		// Use the regexp object to replace all instances of the pattern with the updated motd version string
+		replacedContents = motdMacOSExpression.ReplaceAll(rawFileContents, []byte(motdString))
 	}
 
-	// Use the regexp object to replace all instances of the pattern with the updated motd version string
-	replacedContents := motdMacOSExpression.ReplaceAll(rawFileContents, []byte(motdString))
+	// Nothing to do if the motd is already current
+	if err == nil && bytes.Equal(rawFileContents, replacedContents) {
+		return false, nil
+	}
+
+	err = backups.save(motdFile)
+	if err != nil {
+		return false, err
+	}
 
 	// Write the updated contents back to the motd file
 	err = os.WriteFile(motdFile, replacedContents, 0644)
 	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error writing updated motd back to file: %s", err)
+		return false, fmt.Errorf("ec2macosinit: error writing updated motd back to file: %s", err)
+	}
+	return true, nil
+}
+
+// writeSSHBanner writes the banner to the SSH banner file, and the sshd drop-in which points sshd at it. The drop-in is
+// validated with sshd before it's written. sshd reads its configuration for each connection, so it isn't restarted.
+func writeSSHBanner(ctx *ModuleContext, banner string, backups *fileBackups) (changed bool, err error) {
+	bannerChanged, err := writeManagedFile(sshBannerFile, []byte(banner), backups)
+	if err != nil {
+		return false, err
+	}
+
+	config := fmt.Sprintf(sshBannerConfig, sshBannerFile)
+	if current, err := os.ReadFile(sshBannerConfigFile); err == nil && string(current) == config {
+		return bannerChanged, nil
+	}
+	err = validateSSHDDropIn(ctx, sshBannerConfigFile, config)
+	if err != nil {
+		return bannerChanged, fmt.Errorf("ec2macosinit: not applying changes to %s: %s", sshBannerConfigFile, err)
+	}
+	_, err = writeManagedFile(sshBannerConfigFile, []byte(config), backups)
+	if err != nil {
+		return bannerChanged, err
 	}
+	return true, nil
+}
 
-	return fmt.Sprintf("successfully updated motd file [%s] with version string [%s]", motdFile, motdString), nil
+// getVersionName returns the name of the version of macOS. Names configured in VersionNames come first, so that a
+// new version can be named without a new release, followed by the name in the system's license and then the built-in
+// names. An empty string is returned when the name isn't known.
+func (c *MOTDModule) getVersionName(osProductVersion string) (versionName string) {
+	major := majorVersion(osProductVersion)
+	if name, ok := c.VersionNames[major]; ok {
+		return name
+	}
+	if name := getLicenseVersionName(softwareLicensePath); name != "" {
+		return name
+	}
+	return versionNames[major]
 }
 
-// getVersionName maps os product version numbers to version names. A version name will be returned if the mapping is
-// known, otherwise it returns an empty string.
-func getVersionName(osProductVersion string) (versionName string) {
-	// Map product version number to version name
-	switch {
-	case strings.HasPrefix(osProductVersion, "10.14"):
-		versionName = "Mojave"
-	case strings.HasPrefix(osProductVersion, "10.15"):
-		versionName = "Catalina"
-	case strings.HasPrefix(osProductVersion, "11"):
-		versionName = "Big Sur"
-	case strings.HasPrefix(osProductVersion, "12"):
-		versionName = "Monterey"
-	case strings.HasPrefix(osProductVersion, "13"):
-		versionName = "Ventura"
-	case strings.HasPrefix(osProductVersion, "14"):
-		versionName = "Sonoma"
-	case strings.HasPrefix(osProductVersion, "15"):
-		versionName = "Sequoia"
-	}
-
-	return versionName
+// majorVersion returns the major version of macOS, which is the first two parts of the version before macOS 11.
+func majorVersion(osProductVersion string) string {
+	parts := strings.Split(osProductVersion, ".")
+	if parts[0] == "10" && len(parts) > 1 {
+		return parts[0] + "." + parts[1]
+	}
+	return parts[0]
+}
+
+// getLicenseVersionName reads the name of macOS from the title of the license at path, returning an empty string if it
+// can't be found.
+func getLicenseVersionName(path string) (versionName string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	match := softwareLicenseTitle.FindSubmatch(data)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
 }
@@ -0,0 +1,100 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMOTDModule_getVersionName(t *testing.T) {
+	defer func(p string) { softwareLicensePath = p }(softwareLicensePath)
+	softwareLicensePath = filepath.Join(t.TempDir(), "OSXSoftwareLicense.rtf")
+	c := &MOTDModule{UpdateName: true}
+
+	// The built-in names are used without a license
+	assert.Equal(t, "Catalina", c.getVersionName("10.15.7"))
+	assert.Equal(t, "Sequoia", c.getVersionName("15.1"))
+	assert.Equal(t, "", c.getVersionName("99.0"))
+
+	// The name in the license takes precedence
+	require.NoError(t, os.WriteFile(softwareLicensePath, []byte("{\\rtf1\\ansi\n\\f0\\b\\fs28 \\cf0 ENGLISH\\\n"+
+		"\\\nAPPLE INC.\\\nSOFTWARE LICENSE AGREEMENT FOR macOS Big Sur\\\nFor use on Apple-branded Systems\\\n"), 0644))
+	assert.Equal(t, "Big Sur", c.getVersionName("99.0"))
+
+	// Configured names take precedence over both
+	c.VersionNames = map[string]string{"99": "Future"}
+	assert.Equal(t, "Future", c.getVersionName("99.0.1"))
+}
+
+func TestMOTDModule_banner(t *testing.T) {
+	c := &MOTDModule{}
+	assert.Equal(t, "macOS Sonoma 14.5\n", c.banner(macOSVersionString("Sonoma", "14.5"), "Sonoma", "14.5"))
+	assert.Equal(t, "macOS 99.0\n", c.banner(macOSVersionString("", "99.0"), "", "99.0"))
+
+	c.Template = "Authorized use only.\n{os} ({name}, {version})"
+	assert.Equal(t, "Authorized use only.\nmacOS Sonoma 14.5 (Sonoma, 14.5)\n", c.banner("macOS Sonoma 14.5", "Sonoma", "14.5"))
+}
+
+func TestMOTDModule_updateMOTDFile(t *testing.T) {
+	defer func(p string) { motdFile = p }(motdFile)
+	motdFile = filepath.Join(t.TempDir(), "motd")
+	require.NoError(t, os.WriteFile(motdFile, []byte("Welcome\nmacOS Big Sur 11.2\n"), 0644))
+
+	// Without a Template, only the version string is replaced
+	c := &MOTDModule{UpdateName: true}
+	changed, err := c.updateMOTDFile("macOS Sonoma 14.5", "macOS Sonoma 14.5\n", nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	data, err := os.ReadFile(motdFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Welcome\nmacOS Sonoma 14.5\n", string(data))
+
+	changed, err = c.updateMOTDFile("macOS Sonoma 14.5", "macOS Sonoma 14.5\n", nil)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// With a Template, the file is replaced by the banner, even if it doesn't exist
+	require.NoError(t, os.Remove(motdFile))
+	c.Template = "Build host\n{os}"
+	changed, err = c.updateMOTDFile("macOS Sonoma 14.5", "Build host\nmacOS Sonoma 14.5\n", nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	data, err = os.ReadFile(motdFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Build host\nmacOS Sonoma 14.5\n", string(data))
+}
+
+func Test_writeSSHBanner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the SSH banner is owned by root")
+	}
+	dir := t.TempDir()
+	defer func(b, c, s string) { sshBannerFile, sshBannerConfigFile, sshdConfigFile = b, c, s }(sshBannerFile, sshBannerConfigFile, sshdConfigFile)
+	sshBannerFile = filepath.Join(dir, "ec2-macos-banner")
+	sshBannerConfigFile = filepath.Join(dir, "sshd_config.d", "051-ec2-macos-banner.conf")
+	sshdConfigFile = filepath.Join(dir, "sshd_config")
+	require.NoError(t, os.WriteFile(sshdConfigFile, []byte("Include "+filepath.Join(dir, "sshd_config.d")+"/*\n"), 0644))
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	changed, err := writeSSHBanner(ctx, "macOS Sonoma 14.5\n", nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	require.Len(t, fake.commands, 1)
+	assert.Contains(t, fake.commands[0], sshdBinary+" -t -f ")
+	data, err := os.ReadFile(sshBannerConfigFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Banner "+sshBannerFile+"\n", string(data))
+
+	// Nothing is validated or written when both are current
+	changed, err = writeSSHBanner(ctx, "macOS Sonoma 14.5\n", nil)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, fake.commands, 1)
+}
@@ -1,8 +1,12 @@
 package ec2macosinit
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -12,46 +16,344 @@ import (
 const (
 	pingCountDefault = 3
 	pingPayloadSize  = 56
+	// networkCheckTimeoutDefault is the timeout of each attempt of a TCP or HTTP check.
+	networkCheckTimeoutDefault = 5 * time.Second
+	// networkCheckStatusDefault is the HTTP status expected from an HTTP check.
+	networkCheckStatusDefault = http.StatusOK
 )
 
 // NetworkCheckModule contains contains all necessary configuration fields for running a NetworkCheck module.
 type NetworkCheckModule struct {
-	PingCount int `toml:"PingCount"`
+	PingCount int            `toml:"PingCount"`
+	Checks    []NetworkCheck `toml:"Check"`     // Checks replace pinging the default gateway when set
+	Interface string         `toml:"Interface"` // Interface is the network interface to check, such as en1
 }
 
-// Do for NetworkCheck Module gets the default gateway and pings it to check if the network is up.
+// NetworkCheck contains the configuration of a single check of a NetworkCheck module.
+type NetworkCheck struct {
+	Type           string `toml:"Type"`           // Type is icmp, tcp, http, or dns
+	Address        string `toml:"Address"`        // Address is the host to ping for icmp, or host:port for tcp
+	URL            string `toml:"URL"`            // URL is the URL to GET for http
+	Hostname       string `toml:"Hostname"`       // Hostname is the name to resolve for dns, the regional EC2 endpoint by default
+	ExpectedStatus int    `toml:"ExpectedStatus"` // ExpectedStatus is the HTTP status expected, 200 by default
+	Attempts       int    `toml:"Attempts"`       // Attempts is the number of attempts before the check fails, 3 by default
+	TimeoutSeconds int    `toml:"TimeoutSeconds"` // TimeoutSeconds is the timeout of each tcp, http, or dns attempt, 5 by default
+	Interface      string `toml:"Interface"`      // Interface is the network interface to check, the module's by default
+}
+
+// Do for NetworkCheck Module runs the configured checks, or pings the default gateway when there are none, to check if
+// the network is up.
 func (c *NetworkCheckModule) Do(ctx *ModuleContext) (message string, err error) {
-	// Get default gateway
-	out, err := executeCommand([]string{"/bin/zsh", "-c", "route -n get default | grep gateway"}, "", []string{})
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error while running route command to get default gateway with stderr [%s]: %s\n", out.stderr, err)
-	}
-	gatewayFields := strings.Fields(out.stdout)
-	if len(gatewayFields) != 2 {
-		return "", fmt.Errorf("ec2macosinit: unexpected output from route command: %s\n", out.stdout)
+	if len(c.Checks) == 0 {
+		return c.pingDefaultGateway(ctx)
 	}
 
-	// Resolve IP address
-	defaultGatewayIP, err := net.ResolveIPAddr("ip4", gatewayFields[1])
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error resolving default gateway IP address: %s\n", err)
+	var results []string
+	for _, check := range c.Checks {
+		if check.Interface == "" {
+			check.Interface = c.Interface
+		}
+		result, err := check.run(ctx)
+		if err != nil {
+			if check.Interface != "" {
+				return "", fmt.Errorf("%s [%s]", err, interfaceDetails(ctx, check.Interface))
+			}
+			return "", err
+		}
+		ctx.Logger.Infof("Network check passed: %s", result)
+		results = append(results, result)
 	}
 
-	// Ping default gateway
-	pinger, err := ping.New("0.0.0.0", "")
+	return fmt.Sprintf("successfully ran %d network checks: %s", len(results), strings.Join(results, "; ")), nil
+}
+
+// pingDefaultGateway gets the default gateway and pings it.
+func (c *NetworkCheckModule) pingDefaultGateway(ctx *ModuleContext) (message string, err error) {
+	// Get default gateway, scoped to the interface if one is set
+	routeCmd := []string{"/sbin/route", "-n", "get", "default"}
+	if c.Interface != "" {
+		routeCmd = []string{"/sbin/route", "-n", "get", "-ifscope", c.Interface, "default"}
+	}
+	out, err := ctx.executeCommand(routeCmd, "", []string{})
 	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error setting up new pinger: %s\n", err)
+		if c.Interface != "" {
+			return "", fmt.Errorf("ec2macosinit: error while running route command to get default gateway with stderr [%s]: %s [%s]\n", out.stderr, err, interfaceDetails(ctx, c.Interface))
+		}
+		return "", fmt.Errorf("ec2macosinit: error while running route command to get default gateway with stderr [%s]: %s\n", out.stderr, err)
+	}
+	gateway, iface := parseRoute(out.stdout)
+	if gateway == "" {
+		return "", fmt.Errorf("ec2macosinit: unexpected output from route command: %s\n", out.stdout)
 	}
+
 	// If PingCount is unset, default to 3
 	if c.PingCount == 0 {
 		c.PingCount = pingCountDefault
 	}
-	pinger.SetPayloadSize(pingPayloadSize)
-	rtt, err := pinger.PingAttempts(defaultGatewayIP, time.Second, int(c.PingCount))
+	bind := ""
+	if c.Interface != "" {
+		ip, err := interfaceIPv4(c.Interface)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: %s [%s]\n", err, interfaceDetails(ctx, c.Interface))
+		}
+		bind = ip.String()
+	}
+	rtt, err := pingHost(gateway, c.PingCount, bind)
 	if err != nil {
 		// If network is not up, this will error with an i/o timeout
+		if iface != "" {
+			return "", fmt.Errorf("ec2macosinit: error pinging default gateway %s: %s [%s]\n", gateway, err, interfaceDetails(ctx, iface))
+		}
 		return "", fmt.Errorf("ec2macosinit: error pinging default gateway: %s\n", err)
 	}
 
 	return fmt.Sprintf("successfully pinged default gateway with a RTT of %v", rtt), nil
 }
+
+// parseRoute gets the gateway and interface from the output of route get, which looks like:
+//
+//	   route to: default
+//	destination: default
+//	    gateway: 172.31.0.1
+//	  interface: en0
+func parseRoute(output string) (gateway, iface string) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if !found {
+			continue
+		}
+		switch key {
+		case "gateway":
+			gateway = strings.TrimSpace(value)
+		case "interface":
+			iface = strings.TrimSpace(value)
+		}
+	}
+	return gateway, iface
+}
+
+// interfaceIPv4 returns the first IPv4 address of a network interface.
+func interfaceIPv4(name string) (ip net.IP, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find interface %s: %s", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get addresses of interface %s: %s", name, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
+// interfaceDetails describes the link status and addresses of a network interface for failure messages.
+func interfaceDetails(ctx *ModuleContext, name string) (details string) {
+	out, err := ctx.executeCommand([]string{"/sbin/ifconfig", name}, "", []string{})
+	if err != nil {
+		return fmt.Sprintf("interface %s: unable to run ifconfig: %s %s", name, err, strings.TrimSpace(out.stderr))
+	}
+	return summarizeIfconfig(out.stdout)
+}
+
+// summarizeIfconfig keeps the flags, addresses, and status from the output of ifconfig for an interface, such as:
+//
+//	en1: flags=8863<UP,BROADCAST,SMART,RUNNING,SIMPLEX,MULTICAST> mtu 9001
+//	    ether 0e:12:34:56:78:9a
+//	    inet 172.31.2.3 netmask 0xfffff000 broadcast 172.31.15.255
+//	    status: active
+func summarizeIfconfig(output string) (summary string) {
+	var parts []string
+	for i, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if i == 0 || strings.HasPrefix(line, "inet ") || strings.HasPrefix(line, "inet6 ") || strings.HasPrefix(line, "status:") {
+			if line != "" {
+				parts = append(parts, line)
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pingHost resolves a host and pings it from the bind address, or any address when empty, returning the round trip time
+// of the first reply.
+func pingHost(host string, attempts int, bind string) (rtt time.Duration, err error) {
+	// Resolve IP address
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return 0, fmt.Errorf("error resolving IP address of %s: %s", host, err)
+	}
+
+	if bind == "" {
+		bind = "0.0.0.0"
+	}
+	pinger, err := ping.New(bind, "")
+	if err != nil {
+		return 0, fmt.Errorf("error setting up new pinger: %s", err)
+	}
+	defer pinger.Close()
+	pinger.SetPayloadSize(pingPayloadSize)
+
+	return pinger.PingAttempts(ip, time.Second, attempts)
+}
+
+// run runs the check, making several attempts before giving up.
+func (n NetworkCheck) run(ctx *ModuleContext) (result string, err error) {
+	attempts := n.Attempts
+	if attempts <= 0 {
+		attempts = pingCountDefault
+	}
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second, Jitter: 0.2, Attempts: attempts}
+	timeout := networkCheckTimeoutDefault
+	if n.TimeoutSeconds > 0 {
+		timeout = time.Duration(n.TimeoutSeconds) * time.Second
+	}
+
+	// Connections are made from the interface's address when an interface is set
+	var local net.IP
+	if n.Interface != "" {
+		local, err = interfaceIPv4(n.Interface)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: %s check failed: %s", n.Type, err)
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	}
+
+	switch n.Type {
+	case "icmp":
+		if n.Address == "" {
+			return "", fmt.Errorf("ec2macosinit: Address must be provided for icmp checks")
+		}
+		bind := ""
+		if local != nil {
+			bind = local.String()
+		}
+		rtt, err := pingHost(n.Address, attempts, bind)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: icmp check of %s failed: %s", n.Address, err)
+		}
+		return fmt.Sprintf("pinged %s with a RTT of %v", n.Address, rtt), nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(n.Address); err != nil {
+			return "", fmt.Errorf("ec2macosinit: Address must be host:port for tcp checks: %s", err)
+		}
+		err = Retry(context.Background(), backoff, func() error {
+			conn, err := dialer.Dial("tcp", n.Address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: tcp check of %s failed: %s", n.Address, err)
+		}
+		return fmt.Sprintf("connected to %s", n.Address), nil
+	case "http":
+		if n.URL == "" {
+			return "", fmt.Errorf("ec2macosinit: URL must be provided for http checks")
+		}
+		expected := n.ExpectedStatus
+		if expected == 0 {
+			expected = networkCheckStatusDefault
+		}
+		client := &http.Client{Timeout: timeout, Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DialContext: dialer.DialContext}}
+		err = Retry(context.Background(), backoff, func() error {
+			resp, err := client.Get(n.URL)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				return fmt.Errorf("received HTTP %d, expected %d", resp.StatusCode, expected)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: http check of %s failed: %s", n.URL, err)
+		}
+		return fmt.Sprintf("received HTTP %d from %s", expected, n.URL), nil
+	case "dns":
+		hostname := n.Hostname
+		if hostname == "" {
+			region, err := ctx.IMDS.getRegion()
+			if err != nil {
+				return "", fmt.Errorf("ec2macosinit: unable to get region for default dns check hostname: %s", err)
+			}
+			hostname = "ec2." + region + "." + awsDomain(region)
+		}
+		resolver := net.DefaultResolver
+		if local != nil {
+			resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{IP: local}}
+				if strings.HasPrefix(network, "udp") {
+					d.LocalAddr = &net.UDPAddr{IP: local}
+				}
+				return d.DialContext(ctx, network, address)
+			}}
+		}
+		var addrs []string
+		err = Retry(context.Background(), backoff, func() (err error) {
+			lookupCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			addrs, err = resolver.LookupHost(lookupCtx, hostname)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: dns check of %s failed, %s: %s", hostname, diagnoseDNSFailure(ctx, err, resolvConfPath), err)
+		}
+		return fmt.Sprintf("resolved %s to %s", hostname, strings.Join(addrs, ", ")), nil
+	}
+
+	return "", fmt.Errorf("ec2macosinit: unknown network check type %q, must be one of icmp, tcp, http, or dns", n.Type)
+}
+
+// resolvConfPath is the resolver configuration listing the DNS servers.
+const resolvConfPath = "/etc/resolv.conf"
+
+// diagnoseDNSFailure explains why resolving a name failed, telling apart a network without a route, unreachable DNS
+// servers, and DNS servers which are reachable but don't resolve the name.
+func diagnoseDNSFailure(ctx *ModuleContext, err error, resolvConf string) (diagnosis string) {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "DNS is working but the name does not exist"
+	}
+
+	out, routeErr := ctx.executeCommand([]string{"/sbin/route", "-n", "get", "default"}, "", []string{})
+	if routeErr != nil || !strings.Contains(out.stdout, "gateway") {
+		return "no route: there is no default route, the network is not up"
+	}
+
+	servers := dnsServers(resolvConf)
+	if len(servers) == 0 {
+		return "no DNS: no DNS servers are configured in " + resolvConf
+	}
+	for _, server := range servers {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, "53"), 2*time.Second)
+		if err == nil {
+			conn.Close()
+			return fmt.Sprintf("no DNS: DNS server %s is reachable but did not resolve the name", server)
+		}
+	}
+	return fmt.Sprintf("no route to DNS: none of the DNS servers [%s] are reachable", strings.Join(servers, ", "))
+}
+
+// dnsServers returns the nameservers listed in a resolv.conf file.
+func dnsServers(resolvConf string) (servers []string) {
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
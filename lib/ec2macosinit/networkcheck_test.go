@@ -0,0 +1,172 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkCheck_run(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	// Nothing listens on a port which was just released
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name    string
+		check   NetworkCheck
+		want    string
+		wantErr bool
+	}{
+		{"tcp", NetworkCheck{Type: "tcp", Address: address}, "connected to " + address, false},
+		{"tcp closed", NetworkCheck{Type: "tcp", Address: closed, Attempts: 1}, "", true},
+		{"tcp missing port", NetworkCheck{Type: "tcp", Address: "127.0.0.1"}, "", true},
+		{"http", NetworkCheck{Type: "http", URL: server.URL}, "received HTTP 200 from " + server.URL, false},
+		{"http expected status", NetworkCheck{Type: "http", URL: server.URL + "/missing", ExpectedStatus: 404}, "received HTTP 404 from " + server.URL + "/missing", false},
+		{"http unexpected status", NetworkCheck{Type: "http", URL: server.URL + "/missing", Attempts: 1}, "", true},
+		{"icmp missing address", NetworkCheck{Type: "icmp"}, "", true},
+		{"unknown type", NetworkCheck{Type: "udp", Address: address}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.check.run(&ModuleContext{Logger: &Logger{}})
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNetworkCheckModule_Do_checks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	c := &NetworkCheckModule{Checks: []NetworkCheck{
+		{Type: "tcp", Address: strings.TrimPrefix(server.URL, "http://")},
+		{Type: "http", URL: server.URL},
+	}}
+	message, err := c.Do(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(message, "successfully ran 2 network checks: connected to "), message)
+}
+
+func TestNetworkCheck_run_dns(t *testing.T) {
+	got, err := NetworkCheck{Type: "dns", Hostname: "localhost"}.run(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(got, "resolved localhost to "), got)
+}
+
+func Test_diagnoseDNSFailure(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "missing.example", IsNotFound: true}
+	assert.Equal(t, "DNS is working but the name does not exist", diagnoseDNSFailure(&ModuleContext{}, notFound, ""))
+
+	noRoute := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stderr: "route: writing to routing socket: not in table"}, errors.New("exit status 1")
+	}}
+	timeout := &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}
+	assert.Equal(t, "no route: there is no default route, the network is not up", diagnoseDNSFailure(&ModuleContext{executor: noRoute}, timeout, ""))
+	assert.Equal(t, []string{"/sbin/route -n get default"}, noRoute.commands)
+}
+
+func TestNetworkCheckModule_Do_gateway(t *testing.T) {
+	route := commandOutput{stderr: "route: writing to routing socket: not in table"}
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		if c[0] == "/sbin/ifconfig" {
+			return commandOutput{stdout: "en1: flags=8822<BROADCAST,SMART,SIMPLEX,MULTICAST> mtu 1500\n\tstatus: inactive\n"}, nil
+		}
+		if route.stderr != "" {
+			return route, errors.New("exit status 1")
+		}
+		return route, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	// A missing default route fails with the details of the interface
+	_, err := (&NetworkCheckModule{Interface: "en1"}).Do(ctx)
+	assert.ErrorContains(t, err, "not in table")
+	assert.ErrorContains(t, err, "status: inactive")
+	assert.Equal(t, []string{"/sbin/route -n get -ifscope en1 default", "/sbin/ifconfig en1"}, fake.commands)
+
+	// Output without a gateway isn't pinged
+	fake.commands = nil
+	route = commandOutput{stdout: "   route to: default\n"}
+	_, err = (&NetworkCheckModule{}).Do(ctx)
+	assert.ErrorContains(t, err, "unexpected output from route command")
+	assert.Equal(t, []string{"/sbin/route -n get default"}, fake.commands)
+}
+
+func Test_dnsServers(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("#\n# macOS Notice\n#\nsearch ec2.internal\nnameserver 172.31.0.2\nnameserver fd00:ec2::253\n"), 0644))
+	assert.Equal(t, []string{"172.31.0.2", "fd00:ec2::253"}, dnsServers(resolvConf))
+	assert.Empty(t, dnsServers(filepath.Join(t.TempDir(), "missing")))
+}
+
+func Test_parseRoute(t *testing.T) {
+	output := `   route to: default
+destination: default
+       mask: default
+    gateway: 172.31.0.1
+  interface: en0
+      flags: <UP,GATEWAY,DONE,STATIC,PRCLONING,GLOBAL>
+`
+	gateway, iface := parseRoute(output)
+	assert.Equal(t, "172.31.0.1", gateway)
+	assert.Equal(t, "en0", iface)
+
+	gateway, iface = parseRoute("route: writing to routing socket: not in table\n")
+	assert.Empty(t, gateway)
+	assert.Empty(t, iface)
+}
+
+func Test_summarizeIfconfig(t *testing.T) {
+	output := `en1: flags=8863<UP,BROADCAST,SMART,RUNNING,SIMPLEX,MULTICAST> mtu 9001
+	options=400<CHANNEL_IO>
+	ether 0e:12:34:56:78:9a
+	inet 172.31.2.3 netmask 0xfffff000 broadcast 172.31.15.255
+	media: autoselect
+	status: inactive
+`
+	assert.Equal(t, "en1: flags=8863<UP,BROADCAST,SMART,RUNNING,SIMPLEX,MULTICAST> mtu 9001, inet 172.31.2.3 netmask 0xfffff000 broadcast 172.31.15.255, status: inactive", summarizeIfconfig(output))
+}
+
+func TestNetworkCheck_run_interface(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Find the loopback interface, lo0 on macOS
+	var loopback string
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	ctx := &ModuleContext{Logger: &Logger{}}
+	_, err = NetworkCheck{Type: "http", URL: server.URL, Interface: loopback}.run(ctx)
+	assert.NoError(t, err)
+
+	_, err = NetworkCheck{Type: "http", URL: server.URL, Interface: "missing0"}.run(ctx)
+	assert.ErrorContains(t, err, "unable to find interface missing0")
+}
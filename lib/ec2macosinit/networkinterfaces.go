@@ -0,0 +1,103 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// networkInterfacesEndpoint is the IMDS path listing the instance's network interfaces by MAC address.
+const networkInterfacesEndpoint = "meta-data/network/interfaces/macs/"
+
+// NetworkInterface describes an elastic network interface attached to the instance.
+type NetworkInterface struct {
+	MAC              string
+	InterfaceID      string
+	DeviceNumber     int
+	LocalIPv4s       []string
+	SubnetID         string
+	SubnetIPv4CIDR   string
+	SecurityGroupIDs []string
+	VPCID            string
+	VPCIPv4CIDRs     []string
+}
+
+// NetworkInterfaces gets the network interfaces attached to the instance from IMDS, ordered by device number, so
+// that modules configuring networking don't need to parse IMDS themselves.
+func (i *IMDSConfig) NetworkInterfaces() (interfaces []NetworkInterface, err error) {
+	macs, err := i.networkProperty(networkInterfacesEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mac := range imdsList(macs) {
+		mac = strings.TrimSuffix(mac, "/")
+		ni := NetworkInterface{MAC: mac}
+		base := networkInterfacesEndpoint + mac + "/"
+
+		strs := map[string]*string{
+			"interface-id":           &ni.InterfaceID,
+			"subnet-id":              &ni.SubnetID,
+			"subnet-ipv4-cidr-block": &ni.SubnetIPv4CIDR,
+			"vpc-id":                 &ni.VPCID,
+		}
+		for name, field := range strs {
+			*field, err = i.networkProperty(base + name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		lists := map[string]*[]string{
+			"local-ipv4s":          &ni.LocalIPv4s,
+			"security-group-ids":   &ni.SecurityGroupIDs,
+			"vpc-ipv4-cidr-blocks": &ni.VPCIPv4CIDRs,
+		}
+		for name, field := range lists {
+			value, err := i.networkProperty(base + name)
+			if err != nil {
+				return nil, err
+			}
+			*field = imdsList(value)
+		}
+		deviceNumber, err := i.networkProperty(base + "device-number")
+		if err != nil {
+			return nil, err
+		}
+		ni.DeviceNumber, err = strconv.Atoi(deviceNumber)
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: invalid device number %q for network interface %s", deviceNumber, mac)
+		}
+
+		interfaces = append(interfaces, ni)
+	}
+
+	sort.Slice(interfaces, func(a, b int) bool { return interfaces[a].DeviceNumber < interfaces[b].DeviceNumber })
+	return interfaces, nil
+}
+
+// networkProperty gets a network interface property from IMDS. Properties which don't apply to an interface, such as
+// the VPC of an interface outside of a VPC, are 404s and returned as empty.
+func (i *IMDSConfig) networkProperty(endpoint string) (value string, err error) {
+	value, respCode, err := i.getIMDSProperty(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error getting %s from IMDS: %s", endpoint, err)
+	}
+	switch respCode {
+	case 200:
+		return strings.TrimSpace(value), nil
+	case 404:
+		return "", nil
+	}
+	return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS for %s: %d", endpoint, respCode)
+}
+
+// imdsList splits an IMDS value listing one item per line.
+func imdsList(value string) (items []string) {
+	for _, item := range strings.Split(value, "\n") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
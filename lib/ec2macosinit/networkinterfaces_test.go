@@ -0,0 +1,58 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIMDSConfig_NetworkInterfaces(t *testing.T) {
+	const primary = "meta-data/network/interfaces/macs/0a:00:00:00:00:01/"
+	const secondary = "meta-data/network/interfaces/macs/0a:00:00:00:00:02/"
+	i, _ := newTestIMDS(t, map[string]string{
+		"meta-data/network/interfaces/macs/": "0a:00:00:00:00:02/\n0a:00:00:00:00:01/",
+		primary + "device-number":            "0",
+		primary + "interface-id":             "eni-01",
+		primary + "local-ipv4s":              "10.0.0.10\n10.0.0.11",
+		primary + "subnet-id":                "subnet-01",
+		primary + "subnet-ipv4-cidr-block":   "10.0.0.0/24",
+		primary + "security-group-ids":       "sg-01\nsg-02",
+		primary + "vpc-id":                   "vpc-01",
+		primary + "vpc-ipv4-cidr-blocks":     "10.0.0.0/16\n10.1.0.0/16",
+		secondary + "device-number":          "1",
+		secondary + "interface-id":           "eni-02",
+		secondary + "local-ipv4s":            "10.0.1.10",
+		secondary + "subnet-id":              "subnet-02",
+		secondary + "subnet-ipv4-cidr-block": "10.0.1.0/24",
+		secondary + "security-group-ids":     "sg-01",
+		secondary + "vpc-id":                 "vpc-01",
+		secondary + "vpc-ipv4-cidr-blocks":   "10.0.0.0/16",
+	})
+
+	interfaces, err := i.NetworkInterfaces()
+	assert.NoError(t, err)
+	assert.Equal(t, []NetworkInterface{
+		{
+			MAC:              "0a:00:00:00:00:01",
+			InterfaceID:      "eni-01",
+			DeviceNumber:     0,
+			LocalIPv4s:       []string{"10.0.0.10", "10.0.0.11"},
+			SubnetID:         "subnet-01",
+			SubnetIPv4CIDR:   "10.0.0.0/24",
+			SecurityGroupIDs: []string{"sg-01", "sg-02"},
+			VPCID:            "vpc-01",
+			VPCIPv4CIDRs:     []string{"10.0.0.0/16", "10.1.0.0/16"},
+		},
+		{
+			MAC:              "0a:00:00:00:00:02",
+			InterfaceID:      "eni-02",
+			DeviceNumber:     1,
+			LocalIPv4s:       []string{"10.0.1.10"},
+			SubnetID:         "subnet-02",
+			SubnetIPv4CIDR:   "10.0.1.0/24",
+			SecurityGroupIDs: []string{"sg-01"},
+			VPCID:            "vpc-01",
+			VPCIPv4CIDRs:     []string{"10.0.0.0/16"},
+		},
+	}, interfaces)
+}
@@ -0,0 +1,175 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// nvramPath is the path to the nvram utility
+	nvramPath = "/usr/sbin/nvram"
+	// bootArgsVariable is the NVRAM variable holding the kernel boot arguments
+	bootArgsVariable = "boot-args"
+)
+
+// NVRAMVariable is a single NVRAM variable to set or delete.
+type NVRAMVariable struct {
+	Name   string `toml:"Name"`
+	Value  string `toml:"Value"`
+	Delete bool   `toml:"Delete"` // Delete removes the variable instead of setting a value
+}
+
+// NVRAMModule contains all necessary configuration fields for running an NVRAM module. NVRAM is read at boot, so
+// changes take effect after the next reboot.
+type NVRAMModule struct {
+	Variables []NVRAMVariable `toml:"Variable"`
+	BootArgs  []string        `toml:"BootArgs"` // BootArgs are added to boot-args, replacing arguments with the same name
+}
+
+// Do for the NVRAMModule sets each variable which doesn't already have the desired value, and adds any boot arguments
+// missing from boot-args, then reads each one back to verify it. The message reports when a reboot is required.
+func (c *NVRAMModule) Do(ctx *ModuleContext) (message string, err error) {
+	if len(c.Variables) == 0 && len(c.BootArgs) == 0 {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	for _, v := range c.Variables {
+		if v.Name == "" {
+			return "", fmt.Errorf("ec2macosinit: NVRAM variables must have a Name")
+		}
+		if v.Name == bootArgsVariable && len(c.BootArgs) > 0 {
+			return "", fmt.Errorf("ec2macosinit: %s can't be set as a variable when BootArgs are provided", bootArgsVariable)
+		}
+		current, exists, err := nvramRead(ctx, v.Name)
+		if err != nil {
+			return "", err
+		}
+		if v.Delete {
+			if !exists {
+				unchanged++
+				continue
+			}
+			err = nvramDelete(ctx, v.Name)
+		} else {
+			if exists && current == v.Value {
+				unchanged++
+				ctx.Logger.Infof("NVRAM variable [%s] already set to [%s]", v.Name, current)
+				continue
+			}
+			err = nvramWrite(ctx, v.Name, v.Value)
+		}
+		if err != nil {
+			return "", err
+		}
+		changed++
+	}
+
+	if len(c.BootArgs) > 0 {
+		current, _, err := nvramRead(ctx, bootArgsVariable)
+		if err != nil {
+			return "", err
+		}
+		merged := mergeBootArgs(current, c.BootArgs)
+		if merged == current {
+			unchanged++
+			ctx.Logger.Infof("NVRAM boot-args already contain [%s]", strings.Join(c.BootArgs, " "))
+		} else {
+			err = nvramWrite(ctx, bootArgsVariable, merged)
+			if err != nil {
+				return "", err
+			}
+			changed++
+		}
+	}
+
+	message = fmt.Sprintf("successfully applied NVRAM settings [%d changed / %d unchanged]", changed, unchanged)
+	if changed > 0 {
+		ctx.Logger.Warn("NVRAM was changed, a reboot is required for the changes to take effect")
+		return message + ", a reboot is required for the changes to take effect", nil
+	}
+	return message, nil
+}
+
+// nvramRead reads the value of a variable. Variables which aren't set aren't an error.
+func nvramRead(ctx *ModuleContext, name string) (value string, exists bool, err error) {
+	out, err := ctx.executeCommand([]string{nvramPath, name}, "", []string{})
+	if err != nil {
+		if strings.Contains(out.stderr, "data was not found") {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("ec2macosinit: unable to read NVRAM variable %s: %s %s", name, err, strings.TrimSpace(out.stderr))
+	}
+	return parseNVRAMOutput(out.stdout, name), true, nil
+}
+
+// parseNVRAMOutput extracts the value from nvram output, which is the name and value separated by a tab, such as
+// "boot-args\tserverperfmode=1".
+func parseNVRAMOutput(output, name string) (value string) {
+	return strings.TrimSuffix(strings.TrimPrefix(output, name+"\t"), "\n")
+}
+
+// nvramWrite sets a variable, then reads it back to verify it.
+func nvramWrite(ctx *ModuleContext, name, value string) (err error) {
+	out, err := ctx.executeCommand([]string{nvramPath, name + "=" + value}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to set NVRAM variable %s: %s %s", name, err, strings.TrimSpace(out.stderr))
+	}
+
+	// Validate new value
+	current, exists, err := nvramRead(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !exists || current != value {
+		return fmt.Errorf("ec2macosinit: verification failed for NVRAM variable %s, expected %s but got %s", name, value, current)
+	}
+	ctx.Logger.Infof("Set NVRAM variable [%s] to [%s]", name, value)
+	return nil
+}
+
+// nvramDelete deletes a variable, then reads it back to verify it's gone.
+func nvramDelete(ctx *ModuleContext, name string) (err error) {
+	out, err := ctx.executeCommand([]string{nvramPath, "-d", name}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to delete NVRAM variable %s: %s %s", name, err, strings.TrimSpace(out.stderr))
+	}
+
+	// Validate new state
+	_, exists, err := nvramRead(ctx, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("ec2macosinit: verification failed, NVRAM variable %s still exists", name)
+	}
+	ctx.Logger.Infof("Deleted NVRAM variable [%s]", name)
+	return nil
+}
+
+// mergeBootArgs adds boot arguments to the current boot-args. An argument replaces any existing argument with the same
+// name, the part before "=", and other existing arguments are kept in order.
+func mergeBootArgs(current string, args []string) (merged string) {
+	name := func(arg string) string {
+		return strings.SplitN(arg, "=", 2)[0]
+	}
+	existing := strings.Fields(current)
+	for _, arg := range args {
+		replaced := false
+		for i, e := range existing {
+			if name(e) == name(arg) {
+				existing[i] = arg
+				replaced = true
+			}
+		}
+		if !replaced {
+			existing = append(existing, arg)
+		}
+	}
+	merged = strings.Join(existing, " ")
+	if merged == strings.Join(strings.Fields(current), " ") {
+		// Keep the original spacing when nothing changes
+		return current
+	}
+	return merged
+}
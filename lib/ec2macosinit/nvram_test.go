@@ -0,0 +1,61 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNVRAM answers nvram commands from a map of variables.
+func fakeNVRAM(vars map[string]string) *fakeExecutor {
+	return &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch {
+		case len(c) == 3 && c[1] == "-d":
+			delete(vars, c[2])
+		case strings.Contains(c[1], "="):
+			kv := strings.SplitN(c[1], "=", 2)
+			vars[kv[0]] = kv[1]
+		default:
+			v, ok := vars[c[1]]
+			if !ok {
+				return commandOutput{stderr: "nvram: Error getting variable - '" + c[1] + "': (iokit/common) data was not found"}, fmt.Errorf("exit status 1")
+			}
+			return commandOutput{stdout: c[1] + "\t" + v + "\n"}, nil
+		}
+		return commandOutput{}, nil
+	}}
+}
+
+func TestNVRAMModule_Do(t *testing.T) {
+	vars := map[string]string{"boot-args": "-v", "old": "1", "same": "x"}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fakeNVRAM(vars)}
+	c := &NVRAMModule{
+		Variables: []NVRAMVariable{{Name: "same", Value: "x"}, {Name: "old", Delete: true}, {Name: "new", Value: "y"}},
+		BootArgs:  []string{"serverperfmode=1"},
+	}
+
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied NVRAM settings [3 changed / 1 unchanged], a reboot is required for the changes to take effect", message)
+	assert.Equal(t, map[string]string{"boot-args": "-v serverperfmode=1", "new": "y", "same": "x"}, vars)
+
+	// Nothing changes on the next run
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully applied NVRAM settings [0 changed / 4 unchanged]", message)
+
+	// boot-args can't be managed both ways
+	c.Variables = []NVRAMVariable{{Name: "boot-args", Value: "-v"}}
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+}
+
+func Test_mergeBootArgs(t *testing.T) {
+	assert.Equal(t, "serverperfmode=1", mergeBootArgs("", []string{"serverperfmode=1"}))
+	assert.Equal(t, "-v serverperfmode=1", mergeBootArgs("-v serverperfmode=0", []string{"serverperfmode=1"}))
+	assert.Equal(t, "-v  serverperfmode=1", mergeBootArgs("-v  serverperfmode=1", []string{"serverperfmode=1"}))
+	assert.Equal(t, "-v debug=0x144", mergeBootArgs("-v", []string{"-v", "debug=0x144"}))
+}
@@ -0,0 +1,55 @@
+//go:build cgo
+
+package ec2macosinit
+
+/*
+#include <os/log.h>
+#include <stdlib.h>
+
+// ec2_os_log writes a message to the unified logging system. os_log_with_type is a macro requiring a constant format
+// string, so messages are passed as a public string argument.
+static void ec2_os_log(os_log_t log, os_log_type_t type, const char *message) {
+	os_log_with_type(log, type, "%{public}s", message);
+}
+*/
+import "C"
+
+import "unsafe"
+
+// osLogger writes messages to the unified logging system, which can be searched with log show --predicate.
+type osLogger struct {
+	log C.os_log_t
+}
+
+// newOSLogger creates a logger for the given subsystem and category.
+func newOSLogger(subsystem, category string) (logger *osLogger, err error) {
+	cSubsystem := C.CString(subsystem)
+	defer C.free(unsafe.Pointer(cSubsystem))
+	cCategory := C.CString(category)
+	defer C.free(unsafe.Pointer(cCategory))
+
+	return &osLogger{log: C.os_log_create(cSubsystem, cCategory)}, nil
+}
+
+// write writes a message with the given type.
+func (l *osLogger) write(t C.os_log_type_t, m string) error {
+	message := C.CString(m)
+	defer C.free(unsafe.Pointer(message))
+	C.ec2_os_log(l.log, t, message)
+	return nil
+}
+
+// Info writes a message using the default type, since info messages aren't persisted by default.
+func (l *osLogger) Info(m string) error {
+	return l.write(C.OS_LOG_TYPE_DEFAULT, m)
+}
+
+// Warning writes a message using the default type, there is no separate warning type.
+func (l *osLogger) Warning(m string) error {
+	return l.write(C.OS_LOG_TYPE_DEFAULT, m)
+}
+
+// Err writes a message using the error type.
+func (l *osLogger) Err(m string) error {
+	return l.write(C.OS_LOG_TYPE_ERROR, m)
+}
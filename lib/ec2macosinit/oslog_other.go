@@ -0,0 +1,15 @@
+//go:build !darwin || !cgo
+
+package ec2macosinit
+
+import "fmt"
+
+// osLogger is unavailable without cgo on macOS.
+type osLogger struct {
+	SystemLogger
+}
+
+// newOSLogger always fails, causing callers to fall back to syslog.
+func newOSLogger(subsystem, category string) (logger *osLogger, err error) {
+	return nil, fmt.Errorf("ec2macosinit: unified logging is not available in this build")
+}
@@ -0,0 +1,120 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// PasswordEscrowSecretsManager stores the password as a secret in AWS Secrets Manager
+	PasswordEscrowSecretsManager = "secretsmanager"
+	// PasswordEscrowSSM stores the password as a SecureString parameter in AWS Systems Manager Parameter Store
+	PasswordEscrowSSM = "ssm"
+	// passwordEscrowNamePrefix is the prefix of the default secret or parameter name
+	passwordEscrowNamePrefix = "ec2-macos-init"
+)
+
+// escrowPassword stores the password in the configured service so that administrators can retrieve it later.
+func (c *UserManagementModule) escrowPassword(ctx *ModuleContext, password string) (name string, err error) {
+	if ctx.IMDS == nil || ctx.IMDS.InstanceID == "" {
+		return "", fmt.Errorf("ec2macosinit: instance ID is required to escrow the password")
+	}
+	name = c.passwordEscrowName(ctx.IMDS.InstanceID)
+	description := fmt.Sprintf("Password for %s on %s, set by ec2-macos-init", c.User, ctx.IMDS.InstanceID)
+
+	switch strings.ToLower(c.PasswordEscrow) {
+	case PasswordEscrowSecretsManager:
+		return name, putSecretsManagerSecret(ctx, name, description, password, c.PasswordEscrowKMSKeyID)
+	case PasswordEscrowSSM:
+		return name, putSSMSecureString(ctx, name, description, password, c.PasswordEscrowKMSKeyID)
+	}
+
+	return "", fmt.Errorf("ec2macosinit: unsupported PasswordEscrow %q, must be %q or %q", c.PasswordEscrow, PasswordEscrowSecretsManager, PasswordEscrowSSM)
+}
+
+// passwordEscrowName returns the configured name, or the default per-instance name. SSM parameter names containing a
+// path must begin with a slash, while Secrets Manager names conventionally don't.
+func (c *UserManagementModule) passwordEscrowName(instanceID string) (name string) {
+	if c.PasswordEscrowName != "" {
+		return c.PasswordEscrowName
+	}
+	name = strings.Join([]string{passwordEscrowNamePrefix, instanceID, c.User, "password"}, "/")
+	if strings.EqualFold(c.PasswordEscrow, PasswordEscrowSSM) {
+		name = "/" + name
+	}
+	return name
+}
+
+// putSecretsManagerSecret creates the secret, or stores a new version of it if it already exists.
+func putSecretsManagerSecret(ctx *ModuleContext, name, description, value, kmsKeyID string) (err error) {
+	create := map[string]string{
+		"Name":         name,
+		"Description":  description,
+		"SecretString": value,
+	}
+	if kmsKeyID != "" {
+		create["KmsKeyId"] = kmsKeyID
+	}
+	err = callAWSJSON(ctx, "secretsmanager", "secretsmanager.CreateSecret", create, nil)
+	var apiErr *awsAPIError
+	if !errors.As(err, &apiErr) || apiErr.Type != "ResourceExistsException" {
+		return err
+	}
+
+	// The secret already exists, e.g. from a previous run on this instance, so add a new current version
+	put := map[string]string{
+		"SecretId":     name,
+		"SecretString": value,
+	}
+	return callAWSJSON(ctx, "secretsmanager", "secretsmanager.PutSecretValue", put, nil)
+}
+
+// putSSMSecureString creates or overwrites a SecureString parameter.
+func putSSMSecureString(ctx *ModuleContext, name, description, value, kmsKeyID string) (err error) {
+	input := map[string]interface{}{
+		"Name":        name,
+		"Description": description,
+		"Value":       value,
+		"Type":        "SecureString",
+		"Overwrite":   true,
+	}
+	if kmsKeyID != "" {
+		input["KeyId"] = kmsKeyID
+	}
+	return callAWSJSON(ctx, "ssm", "AmazonSSM.PutParameter", input, nil)
+}
+
+// getSecretsManagerSecret returns the current value of a secret as a string.
+func getSecretsManagerSecret(ctx *ModuleContext, secretID string) (value string, err error) {
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	err = callAWSJSON(ctx, "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": secretID}, &out)
+	if err != nil {
+		return "", err
+	}
+	if out.SecretString == "" {
+		return "", fmt.Errorf("ec2macosinit: secret %s has no string value", secretID)
+	}
+	ctx.Logger.AddSensitive(out.SecretString)
+	return out.SecretString, nil
+}
+
+// getSSMParameter returns the value of a parameter, decrypting SecureString parameters.
+func getSSMParameter(ctx *ModuleContext, name string) (value string, err error) {
+	var out struct {
+		Parameter struct {
+			Type  string `json:"Type"`
+			Value string `json:"Value"`
+		} `json:"Parameter"`
+	}
+	err = callAWSJSON(ctx, "ssm", "AmazonSSM.GetParameter", map[string]interface{}{"Name": name, "WithDecryption": true}, &out)
+	if err != nil {
+		return "", err
+	}
+	if out.Parameter.Type == "SecureString" {
+		ctx.Logger.AddSensitive(out.Parameter.Value)
+	}
+	return out.Parameter.Value, nil
+}
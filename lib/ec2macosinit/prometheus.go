@@ -0,0 +1,85 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// textfileMetricsFile is the name of the file written to the textfile collector directory. node_exporter only reads
+// files ending in .prom, so the temporary file used to write it atomically is never read.
+const textfileMetricsFile = "ec2_macos_init.prom"
+
+// textfileMetrics returns the metrics for a run in the Prometheus text format: the time, duration, and result of the
+// run as a whole, the number of modules with each outcome, and the duration and result of each module which ran.
+func (c *InitConfig) textfileMetrics(s RunSummary, now time.Time) string {
+	var b strings.Builder
+	metric := func(name, help string, samples ...string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, sample := range samples {
+			fmt.Fprintf(&b, "%s%s\n", name, sample)
+		}
+	}
+	value := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	success := func(ok bool) string {
+		if ok {
+			return "1"
+		}
+		return "0"
+	}
+
+	metric("ec2_macos_init_last_run_timestamp_seconds", "Time the last run finished, in seconds since the epoch.",
+		" "+strconv.FormatInt(now.Unix(), 10))
+	metric("ec2_macos_init_run_duration_seconds", "Duration of the last run.", " "+value(s.Duration.Seconds()))
+	metric("ec2_macos_init_run_success", "Whether every module in the last run succeeded.", " "+success(s.Result() == "success"))
+	metric("ec2_macos_init_modules", "Number of modules in the last run with each result.",
+		`{result="succeeded"} `+strconv.Itoa(s.Succeeded),
+		`{result="skipped"} `+strconv.Itoa(s.Skipped),
+		`{result="failed"} `+strconv.Itoa(s.Failed),
+		`{result="ignored"} `+strconv.Itoa(s.Ignored),
+		`{result="not_run"} `+strconv.Itoa(s.NotRun),
+	)
+
+	var durations, results []string
+	for _, group := range c.ModulesByPriority {
+		for _, m := range group {
+			if m.Skipped || m.StartTime.IsZero() {
+				continue
+			}
+			labels := fmt.Sprintf(`{module="%s",type="%s",group="%d"} `, escapeLabelValue(m.Name), m.Type, m.PriorityGroup)
+			durations = append(durations, labels+value(m.EndTime.Sub(m.StartTime).Seconds()))
+			results = append(results, labels+success(m.Success))
+		}
+	}
+	metric("ec2_macos_init_module_duration_seconds", "Duration of each module which ran in the last run.", durations...)
+	metric("ec2_macos_init_module_success", "Whether each module which ran in the last run succeeded.", results...)
+
+	return b.String()
+}
+
+// escapeLabelValue escapes a Prometheus label value.
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// WriteTextfileMetrics writes the metrics of a run for the node_exporter textfile collector, if a directory is
+// configured. The file is replaced atomically so that a partial file is never collected.
+func (c *InitConfig) WriteTextfileMetrics(s RunSummary) (err error) {
+	if c.Metrics.TextfileDirectory == "" {
+		return nil
+	}
+	path := filepath.Join(c.Metrics.TextfileDirectory, textfileMetricsFile)
+	err = os.MkdirAll(c.Metrics.TextfileDirectory, 0755)
+	if err == nil {
+		err = safeWriteFile(path, []byte(c.textfileMetrics(s, time.Now())), 0644, -1, -1)
+	}
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write metrics to %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitConfig_textfileMetrics(t *testing.T) {
+	started := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &InitConfig{
+		ModulesByPriority: [][]Module{
+			{
+				{Name: "ok", Type: "command", PriorityGroup: 1, Success: true, StartTime: started, EndTime: started.Add(250 * time.Millisecond)},
+				{Name: "skipped", Type: "motd", PriorityGroup: 1, Success: true, Skipped: true},
+				{Name: `say "hi"`, Type: "script", PriorityGroup: 1, StartTime: started, EndTime: started.Add(time.Second)},
+			},
+		},
+	}
+
+	assert.Equal(t, `# HELP ec2_macos_init_last_run_timestamp_seconds Time the last run finished, in seconds since the epoch.
+# TYPE ec2_macos_init_last_run_timestamp_seconds gauge
+ec2_macos_init_last_run_timestamp_seconds 1672531202
+# HELP ec2_macos_init_run_duration_seconds Duration of the last run.
+# TYPE ec2_macos_init_run_duration_seconds gauge
+ec2_macos_init_run_duration_seconds 2
+# HELP ec2_macos_init_run_success Whether every module in the last run succeeded.
+# TYPE ec2_macos_init_run_success gauge
+ec2_macos_init_run_success 0
+# HELP ec2_macos_init_modules Number of modules in the last run with each result.
+# TYPE ec2_macos_init_modules gauge
+ec2_macos_init_modules{result="succeeded"} 1
+ec2_macos_init_modules{result="skipped"} 1
+ec2_macos_init_modules{result="failed"} 1
+ec2_macos_init_modules{result="ignored"} 0
+ec2_macos_init_modules{result="not_run"} 0
+# HELP ec2_macos_init_module_duration_seconds Duration of each module which ran in the last run.
+# TYPE ec2_macos_init_module_duration_seconds gauge
+ec2_macos_init_module_duration_seconds{module="ok",type="command",group="1"} 0.25
+ec2_macos_init_module_duration_seconds{module="say \"hi\"",type="script",group="1"} 1
+# HELP ec2_macos_init_module_success Whether each module which ran in the last run succeeded.
+# TYPE ec2_macos_init_module_success gauge
+ec2_macos_init_module_success{module="ok",type="command",group="1"} 1
+ec2_macos_init_module_success{module="say \"hi\"",type="script",group="1"} 0
+`, c.textfileMetrics(c.Summarize(2*time.Second, ""), started.Add(2*time.Second)))
+
+	// Nothing is written unless a directory is configured
+	assert.NoError(t, c.WriteTextfileMetrics(RunSummary{}))
+	c.Metrics.TextfileDirectory = filepath.Join(t.TempDir(), "textfile")
+	assert.NoError(t, c.WriteTextfileMetrics(RunSummary{}))
+	data, err := os.ReadFile(filepath.Join(c.Metrics.TextfileDirectory, "ec2_macos_init.prom"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "ec2_macos_init_run_success 1\n")
+}
@@ -0,0 +1,53 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"os"
+)
+
+// DefaultReadyFile is the readiness marker written after a successful run. It's under /var/run so that it's removed on
+// every boot and only exists once the current boot's run has succeeded.
+const DefaultReadyFile = "/var/run/ec2-macos-init.ready"
+
+// ReadinessConfig controls how other services are told that a run has succeeded.
+type ReadinessConfig struct {
+	Path         string `toml:"Path"`         // Path is the readiness marker file, defaults to DefaultReadyFile
+	Notification string `toml:"Notification"` // Notification is the name of a notification posted with notifyutil, empty disables it
+}
+
+// ReadyFile returns the configured readiness marker file or the default.
+func (r ReadinessConfig) ReadyFile() string {
+	if r.Path != "" {
+		return r.Path
+	}
+	return DefaultReadyFile
+}
+
+// ClearReady removes the readiness marker so that dependent services don't treat an earlier run as the current one.
+func (c *InitConfig) ClearReady() (err error) {
+	err = os.Remove(c.Readiness.ReadyFile())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ec2macosinit: unable to remove readiness marker: %s", err)
+	}
+	return nil
+}
+
+// MarkReady writes the readiness marker, containing the run summary, and posts the readiness notification if one is
+// configured.
+func (c *InitConfig) MarkReady(s RunSummary) (err error) {
+	path := c.Readiness.ReadyFile()
+	err = safeWriteFile(path, []byte(s.String()+"\n"), 0644, -1, -1)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write readiness marker %s: %s", path, err)
+	}
+
+	if c.Readiness.Notification != "" {
+		ctx := &ModuleContext{Logger: c.Log, executor: c.executor}
+		out, err := ctx.executeCommand([]string{"/usr/bin/notifyutil", "-p", c.Readiness.Notification}, "", []string{})
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: unable to post notification %s: %s: %s", c.Readiness.Notification, err, out.stderr)
+		}
+	}
+
+	return nil
+}
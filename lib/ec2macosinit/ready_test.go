@@ -0,0 +1,37 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitConfig_MarkReady(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ec2-macos-init.ready")
+	c := &InitConfig{Readiness: ReadinessConfig{Path: path}}
+	s := RunSummary{InstanceID: "i-0123456789abcdef0", Total: 1, Succeeded: 1}
+
+	assert.NoError(t, c.ClearReady(), "clearing a missing marker is not an error")
+	assert.NoError(t, c.MarkReady(s))
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, s.String()+"\n", string(contents))
+
+	assert.NoError(t, c.ClearReady())
+	assert.NoFileExists(t, path)
+}
+
+func TestInitConfig_MarkReady_notification(t *testing.T) {
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) { return commandOutput{}, nil }}
+	c := &InitConfig{Readiness: ReadinessConfig{Path: filepath.Join(t.TempDir(), "ec2-macos-init.ready"), Notification: "com.amazon.ec2.macos-init.ready"}, executor: fake}
+
+	assert.NoError(t, c.MarkReady(RunSummary{}))
+	assert.Equal(t, []string{"/usr/bin/notifyutil -p com.amazon.ec2.macos-init.ready"}, fake.commands)
+}
+
+func TestReadinessConfig_ReadyFile(t *testing.T) {
+	assert.Equal(t, DefaultReadyFile, ReadinessConfig{}.ReadyFile())
+	assert.Equal(t, "/tmp/ready", ReadinessConfig{Path: "/tmp/ready"}.ReadyFile())
+}
@@ -0,0 +1,63 @@
+package ec2macosinit
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// redactedText replaces sensitive values in logs.
+	redactedText = "[REDACTED]"
+	// minSensitiveLength is the shortest value which is redacted, shorter values would mask unrelated text.
+	minSensitiveLength = 4
+)
+
+// redactor replaces sensitive values, such as passwords and secrets, in text. It is safe for concurrent use.
+type redactor struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// add marks values as sensitive.
+func (r *redactor) add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		if len(v) < minSensitiveLength {
+			continue
+		}
+		r.values = append(r.values, v)
+	}
+	// Replace longer values first so that a value containing another is fully redacted
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+// redact replaces every sensitive value in s.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, redactedText)
+	}
+	return s
+}
+
+// AddSensitive marks values, such as passwords, secrets, and key material, as sensitive so that they are masked in
+// everything logged afterwards, including module messages and errors. Values shorter than 4 characters are ignored.
+func (l *Logger) AddSensitive(values ...string) {
+	if l == nil {
+		return
+	}
+	l.rootLogger().sensitive.add(values...)
+}
+
+// Redact masks every sensitive value in s.
+func (l *Logger) Redact(s string) string {
+	if l == nil {
+		return s
+	}
+	return l.rootLogger().sensitive.redact(s)
+}
@@ -0,0 +1,25 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_Redact(t *testing.T) {
+	l := &Logger{}
+	assert.Equal(t, "password is hunter22", l.Redact("password is hunter22"))
+
+	l.AddSensitive("hunter22", "hunter22-admin", "abc")
+	assert.Equal(t, "password is [REDACTED], admin [REDACTED], abc unchanged", l.Redact("password is hunter22, admin hunter22-admin, abc unchanged"))
+
+	// A nil logger, such as in a ModuleContext without one, is a no-op
+	var nilLogger *Logger
+	nilLogger.AddSensitive("secret")
+	assert.Equal(t, "secret", nilLogger.Redact("secret"))
+}
+
+func Test_redactedOutput(t *testing.T) {
+	assert.Equal(t, commandOutput{stdout: redactedText}, redactedOutput(commandOutput{stdout: "token"}))
+	assert.Equal(t, commandOutput{stdout: redactedText, stderr: redactedText}, redactedOutput(commandOutput{stdout: "a", stderr: "b"}))
+}
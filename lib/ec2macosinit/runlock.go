@@ -0,0 +1,83 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runLockPollInterval is how often a waiting run retries the lock.
+const runLockPollInterval = time.Second
+
+// RunLock is an exclusive lock held for the duration of a run, so that two invocations can't interleave module
+// execution or history writes. The lock is released by the kernel if the process exits without releasing it.
+type RunLock struct {
+	f *os.File
+}
+
+// AcquireRunLock takes the exclusive lock at path, waiting up to timeout for another run holding it to finish. onWait
+// is called once, with the PID of the holder if known, when the lock is busy.
+func AcquireRunLock(path string, timeout time.Duration, onWait func(holder string)) (lock *RunLock, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to open lock file %s: %s", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("ec2macosinit: unable to lock %s: %s", path, err)
+		}
+
+		holder := readLockHolder(f)
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("ec2macosinit: another run (PID %s) still holds %s after waiting %s", holder, path, timeout)
+		}
+		if !waiting && onWait != nil {
+			onWait(holder)
+		}
+		waiting = true
+		time.Sleep(runLockPollInterval)
+	}
+
+	// Record the holder so that a waiting run can report who it is waiting for
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("ec2macosinit: unable to write lock file %s: %s", path, err)
+	}
+
+	return &RunLock{f: f}, nil
+}
+
+// Release releases the lock.
+func (l *RunLock) Release() (err error) {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// readLockHolder returns the PID recorded in the lock file, or "unknown".
+func readLockHolder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	if pid := strings.TrimSpace(string(buf[:n])); pid != "" {
+		return pid
+	}
+	return "unknown"
+}
@@ -0,0 +1,30 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.lock")
+
+	lock, err := AcquireRunLock(path, 0, nil)
+	require.NoError(t, err)
+
+	// A second lock can't be taken while the first is held
+	var holder string
+	_, err = AcquireRunLock(path, 10*time.Millisecond, func(h string) { holder = h })
+	assert.Error(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid()), holder)
+
+	require.NoError(t, lock.Release())
+	lock, err = AcquireRunLock(path, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
@@ -0,0 +1,207 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// S3Object contains the configuration for a single object downloaded by the S3Download module.
+type S3Object struct {
+	Source string `toml:"Source"` // Source is the s3:// URI of the object
+	Path   string `toml:"Path"`   // Path is the absolute path to download the object to
+	Region string `toml:"Region"` // Region of the bucket, default is the instance's region
+	SHA256 string `toml:"SHA256"` // SHA256 is the expected hex encoded SHA-256 checksum of the object
+	Owner  string `toml:"Owner"`  // Owner of the file, default is root
+	Group  string `toml:"Group"`  // Group of the file, default is the owner's primary group
+	Mode   string `toml:"Mode"`   // Mode is the octal permission string, default is "0644"
+}
+
+// S3DownloadModule contains all necessary configuration fields for running an S3Download module.
+type S3DownloadModule struct {
+	Objects []S3Object `toml:"Object"`
+}
+
+// Do for the S3DownloadModule downloads each object from S3 with the instance profile role credentials, without
+// needing the AWS CLI. Each download is verified against the configured SHA-256 and the checksum S3 stored for the
+// object, if there is one, before it replaces the file. Files which already have the configured checksum aren't
+// downloaded again.
+func (c *S3DownloadModule) Do(ctx *ModuleContext) (message string, err error) {
+	if len(c.Objects) == 0 {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	for _, o := range c.Objects {
+		objectChanged, err := o.download(ctx)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error downloading %s to %s: %s", o.Source, o.Path, err)
+		}
+		if objectChanged {
+			changed++
+			ctx.Logger.Infof("Downloaded [%s] to [%s]", o.Source, o.Path)
+		} else {
+			unchanged++
+			ctx.Logger.Infof("File [%s] already up to date", o.Path)
+		}
+	}
+
+	return fmt.Sprintf("successfully downloaded objects [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// download downloads the object to its path, if the file doesn't already have the expected content, mode, and
+// ownership.
+func (o *S3Object) download(ctx *ModuleContext) (changed bool, err error) {
+	if !filepath.IsAbs(o.Path) {
+		return false, fmt.Errorf("path must be absolute")
+	}
+	u, err := url.Parse(o.Source)
+	if err != nil || u.Scheme != "s3" {
+		return false, fmt.Errorf("source must be an s3:// URI")
+	}
+	bucket, key, err := parseS3URI(u)
+	if err != nil {
+		return false, err
+	}
+	var expected []byte
+	if o.SHA256 != "" {
+		expected, err = hex.DecodeString(o.SHA256)
+		if err != nil || len(expected) != sha256.Size {
+			return false, fmt.Errorf("invalid SHA256 %q, expected 64 hex digits", o.SHA256)
+		}
+	}
+	// The mode and ownership are handled in the same way as for WriteFiles
+	attrs := WriteFile{Owner: o.Owner, Group: o.Group, Mode: o.Mode}
+	perm, err := attrs.fileMode()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := attrs.ownership(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Without a SHA256 the object is always downloaded, since it may have changed
+	if expected != nil {
+		sum, err := fileSHA256(o.Path)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(sum, expected) {
+			return setFileAttributes(o.Path, perm, uid, gid)
+		}
+	}
+
+	region := o.Region
+	if region == "" {
+		region, err = ctx.IMDS.getRegion()
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(o.Path), 0755)
+	if err != nil {
+		return false, err
+	}
+	// Ask S3 to return the checksum stored with the object, so that it's verified even without a SHA256
+	header := http.Header{"X-Amz-Checksum-Mode": []string{"ENABLED"}}
+	tmp, sum, err := downloadFile(s3Request(ctx, bucket, key, region, header), o.Path, func(header http.Header, sum []byte) error {
+		return verifyS3Checksum(header, sum, expected)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	// Leave the file alone if it already had the object's content
+	if current, err := fileSHA256(o.Path); err == nil && bytes.Equal(current, sum) {
+		return setFileAttributes(o.Path, perm, uid, gid)
+	}
+
+	err = os.Chmod(tmp, perm)
+	if err != nil {
+		return false, err
+	}
+	err = os.Chown(tmp, uid, gid)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmp, o.Path)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyS3Checksum checks the SHA-256 of a download against the expected checksum, if there is one, and the
+// x-amz-checksum-sha256 header. The header is only returned for objects uploaded with a SHA-256 checksum, and for
+// multipart uploads it's a checksum of the parts' checksums, marked with a "-<parts>" suffix, which can't be compared.
+func verifyS3Checksum(header http.Header, sum, expected []byte) (err error) {
+	if expected != nil && !bytes.Equal(sum, expected) {
+		return fmt.Errorf("checksum mismatch, expected SHA256 %x but got %x", expected, sum)
+	}
+	stored := header.Get("X-Amz-Checksum-Sha256")
+	if stored == "" || strings.Contains(stored, "-") {
+		return nil
+	}
+	storedSum, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return fmt.Errorf("invalid x-amz-checksum-sha256 %q: %s", stored, err)
+	}
+	if !bytes.Equal(sum, storedSum) {
+		return fmt.Errorf("checksum mismatch, S3 stored SHA256 %x but got %x", storedSum, sum)
+	}
+	return nil
+}
+
+// fileSHA256 returns the SHA-256 of the file at path, or nil if it doesn't exist.
+func fileSHA256(path string) (sum []byte, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// setFileAttributes sets the mode and ownership of the file at path, if they differ.
+func setFileAttributes(path string, perm os.FileMode, uid, gid int) (changed bool, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode().Perm() != perm {
+		err = os.Chmod(path, perm)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid || int(st.Gid) != gid {
+		err = os.Chown(path, uid, gid)
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,84 @@
+package ec2macosinit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_verifyS3Checksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("artifact"))
+	other := sha256.Sum256([]byte("other"))
+
+	assert.NoError(t, verifyS3Checksum(http.Header{}, sum[:], nil))
+	assert.NoError(t, verifyS3Checksum(http.Header{}, sum[:], sum[:]))
+	assert.Error(t, verifyS3Checksum(http.Header{}, sum[:], other[:]))
+
+	header := http.Header{"X-Amz-Checksum-Sha256": []string{base64.StdEncoding.EncodeToString(sum[:])}}
+	assert.NoError(t, verifyS3Checksum(header, sum[:], nil))
+	header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(other[:]))
+	assert.Error(t, verifyS3Checksum(header, sum[:], nil))
+
+	// Checksums of multipart uploads can't be compared
+	header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(other[:])+"-3")
+	assert.NoError(t, verifyS3Checksum(header, sum[:], nil))
+}
+
+func Test_downloadFile(t *testing.T) {
+	defer func(b Backoff) { fetchBackoff = b }(fetchBackoff)
+	fetchBackoff = Backoff{Attempts: 2}
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// The first response is corrupted
+		if requests == 1 {
+			w.Write([]byte("corrupt"))
+			return
+		}
+		w.Write([]byte("artifact"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "artifact.tar")
+	expected := sha256.Sum256([]byte("artifact"))
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, server.URL, nil)
+	}
+	tmp, sum, err := downloadFile(newRequest, path, func(header http.Header, sum []byte) error {
+		return verifyS3Checksum(header, sum, expected[:])
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, expected[:], sum)
+	assert.Equal(t, dir, filepath.Dir(tmp))
+	data, err := os.ReadFile(tmp)
+	require.NoError(t, err)
+	assert.Equal(t, "artifact", string(data))
+
+	// Only the temporary file from the successful attempt is left
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func Test_fileSHA256(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	sum, err := fileSHA256(path)
+	require.NoError(t, err)
+	assert.Nil(t, sum)
+
+	require.NoError(t, os.WriteFile(path, []byte("artifact"), 0644))
+	sum, err = fileSHA256(path)
+	require.NoError(t, err)
+	expected := sha256.Sum256([]byte("artifact"))
+	assert.Equal(t, expected[:], sum)
+}
@@ -0,0 +1,250 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// scheduledJobLabelPrefix prefixes the labels of the launchd jobs installed by ScheduledJobs modules, so that jobs
+// which are no longer configured can be found and removed.
+const scheduledJobLabelPrefix = "com.amazon.ec2.macos-init.job."
+
+var (
+	// scheduledJobsDirectory is where the plists of scheduled jobs are written
+	scheduledJobsDirectory = LaunchDaemonsDirectory
+	// scheduledJobName matches the names allowed for scheduled jobs, which become part of their labels
+	scheduledJobName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// CalendarInterval is a time a scheduled job starts at, as with launchd's StartCalendarInterval. Fields which aren't set
+// match every value, so a job with only Minute set starts every hour.
+type CalendarInterval struct {
+	Minute  *int `toml:"Minute"`  // Minute of the hour, 0 to 59
+	Hour    *int `toml:"Hour"`    // Hour of the day, 0 to 23
+	Day     *int `toml:"Day"`     // Day of the month, 1 to 31
+	Weekday *int `toml:"Weekday"` // Weekday, 0 to 7 where 0 and 7 are Sunday
+	Month   *int `toml:"Month"`   // Month of the year, 1 to 12
+}
+
+// ScheduledJob is a recurring launchd job which runs a command, or a module with ec2-macos-init test-module.
+type ScheduledJob struct {
+	Name       string             `toml:"Name"`       // Name of the job, used in its label
+	Command    []string           `toml:"Command"`    // Command to run, as a program and its arguments
+	ModuleFile string             `toml:"ModuleFile"` // ModuleFile is a module to run with ec2-macos-init test-module
+	RunAsUser  string             `toml:"RunAsUser"`  // RunAsUser runs the job as the user, defaults to root
+	Interval   int                `toml:"Interval"`   // Interval starts the job every number of seconds
+	Calendar   []CalendarInterval `toml:"Calendar"`   // Calendar starts the job at the given times
+	LogFile    string             `toml:"LogFile"`    // LogFile receives the job's stdout and stderr
+}
+
+// ScheduledJobsModule contains all necessary configuration fields for running a ScheduledJobs module.
+type ScheduledJobsModule struct {
+	Jobs []ScheduledJob `toml:"Job"`
+}
+
+// Do for the ScheduledJobsModule writes a LaunchDaemon for each job and loads it, replacing the loaded job when its
+// plist changes. Jobs installed by an earlier run which are no longer configured are unloaded and removed. Jobs which
+// are already current are left alone, so they keep their schedule.
+func (c *ScheduledJobsModule) Do(ctx *ModuleContext) (message string, err error) {
+	// Every job is validated before any of them are installed
+	wanted := map[string]bool{}
+	jobs := make([]map[string]interface{}, 0, len(c.Jobs))
+	for _, j := range c.Jobs {
+		if wanted[j.label()] {
+			return "", fmt.Errorf("ec2macosinit: duplicate scheduled job name %s", j.Name)
+		}
+		wanted[j.label()] = true
+		job, err := j.launchdJob(ctx.BaseDirectory)
+		if err != nil {
+			return "", err
+		}
+		jobs = append(jobs, job)
+	}
+
+	var changed, unchanged, removed int
+	for i, j := range c.Jobs {
+		jobChanged, err := installScheduledJob(ctx, j.label(), jobs[i])
+		if err != nil {
+			return "", err
+		}
+		if jobChanged {
+			ctx.Logger.Infof("Installed scheduled job %s", j.label())
+			changed++
+		} else {
+			unchanged++
+		}
+	}
+
+	stale, _ := filepath.Glob(filepath.Join(scheduledJobsDirectory, scheduledJobLabelPrefix+"*.plist"))
+	for _, path := range stale {
+		label := strings.TrimSuffix(filepath.Base(path), ".plist")
+		if wanted[label] {
+			continue
+		}
+		_, _ = ctx.executeCommand([]string{"/bin/launchctl", "bootout", "system/" + label}, "", []string{})
+		err = os.Remove(path)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to remove scheduled job %s: %s", path, err)
+		}
+		ctx.Logger.Infof("Removed scheduled job %s which is no longer configured", label)
+		removed++
+	}
+
+	return fmt.Sprintf("successfully installed scheduled jobs [%d changed / %d unchanged / %d removed]", changed, unchanged, removed), nil
+}
+
+// label returns the launchd label of the job.
+func (j ScheduledJob) label() string {
+	return scheduledJobLabelPrefix + j.Name
+}
+
+// launchdJob validates the job and returns its launchd definition. Modules are run with the ec2-macos-init binary
+// which is running, using the same base directory.
+func (j ScheduledJob) launchdJob(baseDir string) (job map[string]interface{}, err error) {
+	if !scheduledJobName.MatchString(j.Name) {
+		return nil, fmt.Errorf("ec2macosinit: invalid scheduled job name %q, only letters, digits, '.', '_' and '-' are allowed", j.Name)
+	}
+
+	var args []interface{}
+	switch {
+	case len(j.Command) > 0 && j.ModuleFile != "":
+		return nil, fmt.Errorf("ec2macosinit: scheduled job %s can't have both Command and ModuleFile", j.Name)
+	case len(j.Command) > 0:
+		if !filepath.IsAbs(j.Command[0]) {
+			return nil, fmt.Errorf("ec2macosinit: scheduled job %s must run a program with an absolute path, not %s", j.Name, j.Command[0])
+		}
+		for _, a := range j.Command {
+			args = append(args, a)
+		}
+	case j.ModuleFile != "":
+		if !filepath.IsAbs(j.ModuleFile) {
+			return nil, fmt.Errorf("ec2macosinit: scheduled job %s must have an absolute ModuleFile, not %s", j.Name, j.ModuleFile)
+		}
+		program, err := os.Executable()
+		if err == nil {
+			program, err = filepath.EvalSymlinks(program)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: unable to find the ec2-macos-init binary: %s", err)
+		}
+		args = []interface{}{program}
+		if baseDir != "" {
+			args = append(args, "--base-dir", baseDir)
+		}
+		args = append(args, "test-module", j.ModuleFile)
+	default:
+		return nil, fmt.Errorf("ec2macosinit: scheduled job %s needs a Command or ModuleFile", j.Name)
+	}
+
+	job = map[string]interface{}{
+		"Label":                j.label(),
+		"ProgramArguments":     args,
+		"EnvironmentVariables": map[string]interface{}{"PATH": launchdJobPath},
+	}
+
+	switch {
+	case j.Interval > 0 && len(j.Calendar) > 0:
+		return nil, fmt.Errorf("ec2macosinit: scheduled job %s can't have both Interval and Calendar", j.Name)
+	case j.Interval > 0:
+		job["StartInterval"] = j.Interval
+	case len(j.Calendar) > 0:
+		var calendar []interface{}
+		for _, ci := range j.Calendar {
+			entry, err := ci.launchdEntry()
+			if err != nil {
+				return nil, fmt.Errorf("ec2macosinit: invalid Calendar for scheduled job %s: %s", j.Name, err)
+			}
+			calendar = append(calendar, entry)
+		}
+		job["StartCalendarInterval"] = calendar
+	default:
+		return nil, fmt.Errorf("ec2macosinit: scheduled job %s needs a positive Interval or a Calendar", j.Name)
+	}
+
+	if j.RunAsUser != "" {
+		job["UserName"] = j.RunAsUser
+	}
+	if j.LogFile != "" {
+		if !filepath.IsAbs(j.LogFile) {
+			return nil, fmt.Errorf("ec2macosinit: scheduled job %s must have an absolute LogFile, not %s", j.Name, j.LogFile)
+		}
+		job["StandardOutPath"] = j.LogFile
+		job["StandardErrorPath"] = j.LogFile
+	}
+
+	return job, nil
+}
+
+// launchdEntry validates the calendar interval and returns it as a StartCalendarInterval dictionary.
+func (ci CalendarInterval) launchdEntry() (entry map[string]interface{}, err error) {
+	entry = map[string]interface{}{}
+	fields := []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"Minute", ci.Minute, 0, 59},
+		{"Hour", ci.Hour, 0, 23},
+		{"Day", ci.Day, 1, 31},
+		{"Weekday", ci.Weekday, 0, 7},
+		{"Month", ci.Month, 1, 12},
+	}
+	for _, f := range fields {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < f.min || *f.value > f.max {
+			return nil, fmt.Errorf("%s must be between %d and %d, not %d", f.name, f.min, f.max, *f.value)
+		}
+		entry[f.name] = *f.value
+	}
+	if len(entry) == 0 {
+		return nil, fmt.Errorf("at least one of Minute, Hour, Day, Weekday, or Month must be set")
+	}
+	return entry, nil
+}
+
+// installScheduledJob writes the plist for the job and loads it, unless the plist is already current and the job is
+// loaded. A job whose plist changed is unloaded first so that launchd picks up the new definition.
+func installScheduledJob(ctx *ModuleContext, label string, job map[string]interface{}) (changed bool, err error) {
+	data, err := plist.MarshalIndent(job, plist.XMLFormat, "	")
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to encode launchd plist: %s", err)
+	}
+	path := filepath.Join(scheduledJobsDirectory, label+".plist")
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ec2macosinit: unable to read %s: %s", path, err)
+	}
+	_, loadErr := ctx.executeCommand([]string{"/bin/launchctl", "print", "system/" + label}, "", []string{})
+	if bytes.Equal(current, data) && loadErr == nil {
+		return false, nil
+	}
+
+	if logFile, ok := job["StandardOutPath"].(string); ok {
+		err = os.MkdirAll(filepath.Dir(logFile), 0755)
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to create log directory: %s", err)
+		}
+	}
+	err = safeWriteFile(path, data, 0644, 0, 0)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to write launchd plist %s: %s", path, err)
+	}
+
+	if loadErr == nil {
+		_, _ = ctx.executeCommand([]string{"/bin/launchctl", "bootout", "system/" + label}, "", []string{})
+	}
+	out, err := ctx.executeCommand([]string{"/bin/launchctl", "bootstrap", "system", path}, "", []string{})
+	if err != nil {
+		return true, fmt.Errorf("ec2macosinit: unable to load %s: %s: %s", path, err, strings.TrimSpace(out.stderr))
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestScheduledJob_launchdJob(t *testing.T) {
+	two, thirty := 2, 30
+	job, err := ScheduledJob{
+		Name:      "cache-cleanup",
+		Command:   []string{"/bin/rm", "-rf", "/Users/ec2-user/Library/Caches/build"},
+		RunAsUser: "ec2-user",
+		Calendar:  []CalendarInterval{{Hour: &two, Minute: &thirty}},
+		LogFile:   "/var/log/cache-cleanup.log",
+	}.launchdJob("")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"Label":                 "com.amazon.ec2.macos-init.job.cache-cleanup",
+		"ProgramArguments":      []interface{}{"/bin/rm", "-rf", "/Users/ec2-user/Library/Caches/build"},
+		"EnvironmentVariables":  map[string]interface{}{"PATH": launchdJobPath},
+		"StartCalendarInterval": []interface{}{map[string]interface{}{"Hour": 2, "Minute": 30}},
+		"UserName":              "ec2-user",
+		"StandardOutPath":       "/var/log/cache-cleanup.log",
+		"StandardErrorPath":     "/var/log/cache-cleanup.log",
+	}, job)
+
+	// Modules run with the binary that installed the job
+	job, err = ScheduledJob{Name: "keys", ModuleFile: "/usr/local/etc/keys.toml", Interval: 3600}.launchdJob("/opt/init")
+	require.NoError(t, err)
+	args := job["ProgramArguments"].([]interface{})
+	assert.Equal(t, []interface{}{"--base-dir", "/opt/init", "test-module", "/usr/local/etc/keys.toml"}, args[1:])
+	assert.Equal(t, 3600, job["StartInterval"])
+
+	bad, sixty := 99, 60
+	for _, j := range []ScheduledJob{
+		{Name: "a/b", Command: []string{"/bin/true"}, Interval: 60},
+		{Name: "none", Interval: 60},
+		{Name: "both", Command: []string{"/bin/true"}, ModuleFile: "/tmp/m.toml", Interval: 60},
+		{Name: "relative", Command: []string{"true"}, Interval: 60},
+		{Name: "unscheduled", Command: []string{"/bin/true"}},
+		{Name: "twice", Command: []string{"/bin/true"}, Interval: 60, Calendar: []CalendarInterval{{Minute: &thirty}}},
+		{Name: "hour", Command: []string{"/bin/true"}, Calendar: []CalendarInterval{{Hour: &bad}}},
+		{Name: "minute", Command: []string{"/bin/true"}, Calendar: []CalendarInterval{{Minute: &sixty}}},
+		{Name: "empty", Command: []string{"/bin/true"}, Calendar: []CalendarInterval{{}}},
+	} {
+		_, err = j.launchdJob("")
+		assert.Error(t, err, j.Name)
+	}
+}
+
+func TestScheduledJobsModule_Do(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("scheduled job plists are owned by root")
+	}
+	defer func(d string) { scheduledJobsDirectory = d }(scheduledJobsDirectory)
+	scheduledJobsDirectory = t.TempDir()
+	stale := filepath.Join(scheduledJobsDirectory, scheduledJobLabelPrefix+"old.plist")
+	other := filepath.Join(scheduledJobsDirectory, "com.example.other.plist")
+	require.NoError(t, os.WriteFile(stale, []byte{}, 0644))
+	require.NoError(t, os.WriteFile(other, []byte{}, 0644))
+
+	loaded := map[string]bool{}
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch c[1] {
+		case "print":
+			if !loaded[strings.TrimPrefix(c[2], "system/")] {
+				return commandOutput{}, assert.AnError
+			}
+		case "bootstrap":
+			loaded[strings.TrimSuffix(filepath.Base(c[3]), ".plist")] = true
+		case "bootout":
+			delete(loaded, strings.TrimPrefix(c[2], "system/"))
+		}
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	c := &ScheduledJobsModule{Jobs: []ScheduledJob{{Name: "cleanup", Command: []string{"/bin/true"}, Interval: 60}}}
+
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully installed scheduled jobs [1 changed / 0 unchanged / 1 removed]", message)
+	assert.True(t, loaded[scheduledJobLabelPrefix+"cleanup"])
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, other)
+
+	data, err := os.ReadFile(filepath.Join(scheduledJobsDirectory, scheduledJobLabelPrefix+"cleanup.plist"))
+	require.NoError(t, err)
+	var job interface{}
+	_, err = plist.Unmarshal(data, &job)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(60), job.(map[string]interface{})["StartInterval"])
+
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully installed scheduled jobs [0 changed / 1 unchanged / 0 removed]", message)
+
+	// A changed job is reloaded
+	fake.commands = nil
+	c.Jobs[0].Interval = 120
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully installed scheduled jobs [1 changed / 0 unchanged / 0 removed]", message)
+	assert.Contains(t, fake.commands, "/bin/launchctl bootout system/"+scheduledJobLabelPrefix+"cleanup")
+
+	// Nothing is installed when any job is invalid
+	c.Jobs = append(c.Jobs, ScheduledJob{Name: "broken"})
+	_, err = c.Do(ctx)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(scheduledJobsDirectory, scheduledJobLabelPrefix+"broken.plist"))
+}
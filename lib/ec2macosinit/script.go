@@ -0,0 +1,149 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scriptInterpreters maps the interpreter names accepted by the Script module to their commands.
+var scriptInterpreters = map[string][]string{
+	"zsh":         {"/bin/zsh"},
+	"bash":        {"/bin/bash"},
+	"sh":          {"/bin/sh"},
+	"python3":     {"/usr/bin/python3"},
+	"applescript": {osascriptPath},
+	"javascript":  {osascriptPath, "-l", "JavaScript"},
+}
+
+// osascriptPath is the path of osascript, which runs AppleScript and JavaScript for Automation.
+const osascriptPath = "/usr/bin/osascript"
+
+// ScriptModule contains all necessary configuration fields for running a Script module.
+type ScriptModule struct {
+	Contents         string   `toml:"Contents"`         // Contents is the script to run
+	Interpreter      string   `toml:"Interpreter"`      // Interpreter is zsh, bash, sh, python3, applescript, javascript, or a path
+	Args             []string `toml:"Args"`             // Args are passed to the script
+	RunAsUser        string   `toml:"RunAsUser"`        // RunAsUser is the user to run the script as
+	EnvironmentVars  []string `toml:"EnvironmentVars"`  // EnvironmentVars are added to the environment in the form key=value
+	WorkingDirectory string   `toml:"WorkingDirectory"` // WorkingDirectory is the directory the script is run from
+	TimeoutSeconds   int      `toml:"TimeoutSeconds"`   // TimeoutSeconds stops the script after this many seconds
+}
+
+// Do for ScriptModule writes the script to a temporary file, runs it with the interpreter, and removes it.
+func (c *ScriptModule) Do(ctx *ModuleContext) (message string, err error) {
+	if strings.TrimSpace(c.Contents) == "" {
+		return "", fmt.Errorf("ec2macosinit: Contents must be provided")
+	}
+	interpreter, err := c.interpreterCommand()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(interpreter[0])
+
+	path, err := c.writeScript(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+
+	cmd := append(append(interpreter, path), c.Args...)
+	opts := commandOptions{
+		RunAsUser: c.RunAsUser,
+		EnvVars:   c.EnvironmentVars,
+		Timeout:   time.Duration(c.TimeoutSeconds) * time.Second,
+		Dir:       c.WorkingDirectory,
+	}
+	// osascript must run in the user's GUI session to control applications such as Finder and System Events
+	if interpreter[0] == osascriptPath && c.RunAsUser != "" {
+		cmd, err = guiSessionCommand(ctx, c.RunAsUser, cmd)
+		if err != nil {
+			return "", err
+		}
+		opts.RunAsUser = ""
+	}
+
+	out, err := ctx.runCommand(cmd, opts)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error running %s script with stdout [%s] and stderr [%s]: %s",
+			name, strings.TrimSuffix(out.stdout, "\n"), strings.TrimSuffix(out.stderr, "\n"), err)
+	}
+
+	return fmt.Sprintf("successfully ran %s script with stdout [%s] and stderr [%s]",
+		name, strings.TrimSuffix(out.stdout, "\n"), strings.TrimSuffix(out.stderr, "\n")), nil
+}
+
+// guiSessionCommand wraps a command so that it runs as the user within their GUI (Aqua) session. The user should be
+// logged in at the console, otherwise scripts which control applications fail.
+func guiSessionCommand(ctx *ModuleContext, username string, cmd []string) (wrapped []string, err error) {
+	uid, _, err := ctx.getUIDandGID(username)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error looking up user: %s", err)
+	}
+	if user, err := consoleUser(ctx); err == nil && user != username {
+		ctx.Logger.Warnf("User [%s] is not logged in at the console (console user is [%s]), AppleScript which controls applications may fail", username, user)
+	}
+	return append([]string{"/bin/launchctl", "asuser", strconv.Itoa(uid), "/usr/bin/sudo", "-u", username}, cmd...), nil
+}
+
+// consoleUser returns the user logged in at the console, which owns /dev/console.
+func consoleUser(ctx *ModuleContext) (username string, err error) {
+	out, err := ctx.executeCommand([]string{"/usr/bin/stat", "-f", "%Su", ConsoleDevice}, "", []string{})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to get console user: %s", err)
+	}
+	return strings.TrimSpace(out.stdout), nil
+}
+
+// interpreterCommand returns the command of the interpreter, zsh by default.
+func (c *ScriptModule) interpreterCommand() (cmd []string, err error) {
+	if c.Interpreter == "" {
+		return scriptInterpreters["zsh"], nil
+	}
+	if filepath.IsAbs(c.Interpreter) {
+		return []string{c.Interpreter}, nil
+	}
+	cmd, ok := scriptInterpreters[c.Interpreter]
+	if !ok {
+		return nil, fmt.Errorf("ec2macosinit: unknown interpreter %q, must be one of zsh, bash, sh, python3, applescript, javascript, or an absolute path", c.Interpreter)
+	}
+	// Copy so that appending to the command never modifies the map
+	return append([]string{}, cmd...), nil
+}
+
+// writeScript writes the script to a temporary file only readable by the user running it.
+func (c *ScriptModule) writeScript(ctx *ModuleContext) (path string, err error) {
+	f, err := os.CreateTemp("", "ec2-macos-init-script-*")
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to create script file: %s", err)
+	}
+	defer f.Close()
+	path = f.Name()
+
+	fail := func(err error) (string, error) {
+		os.Remove(path)
+		return "", fmt.Errorf("ec2macosinit: unable to write script file: %s", err)
+	}
+	_, err = f.WriteString(c.Contents)
+	if err != nil {
+		return fail(err)
+	}
+	err = f.Chmod(0700)
+	if err != nil {
+		return fail(err)
+	}
+	if c.RunAsUser != "" {
+		uid, gid, err := ctx.getUIDandGID(c.RunAsUser)
+		if err == nil {
+			err = f.Chown(uid, gid)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	return path, nil
+}
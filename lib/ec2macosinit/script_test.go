@@ -0,0 +1,60 @@
+package ec2macosinit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptModule_interpreterCommand(t *testing.T) {
+	tests := []struct {
+		interpreter string
+		want        []string
+		wantErr     bool
+	}{
+		{"", []string{"/bin/zsh"}, false},
+		{"bash", []string{"/bin/bash"}, false},
+		{"python3", []string{"/usr/bin/python3"}, false},
+		{"applescript", []string{"/usr/bin/osascript"}, false},
+		{"javascript", []string{"/usr/bin/osascript", "-l", "JavaScript"}, false},
+		{"/opt/homebrew/bin/ruby", []string{"/opt/homebrew/bin/ruby"}, false},
+		{"perl", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.interpreter, func(t *testing.T) {
+			got, err := (&ScriptModule{Interpreter: tt.interpreter}).interpreterCommand()
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestScriptModule_Do(t *testing.T) {
+	c := &ScriptModule{
+		Interpreter: "sh",
+		Contents:    "set -e\necho \"hello $1\"\nx='quoted \"text\"'\necho \"$x\" >&2\n",
+		Args:        []string{"world"},
+	}
+	message, err := c.Do(&ModuleContext{Logger: &Logger{}})
+	require.NoError(t, err)
+	assert.Equal(t, `successfully ran sh script with stdout [hello world] and stderr [quoted "text"]`, message)
+
+	// Script files are only accessible to the user running them
+	path, err := c.writeScript(&ModuleContext{})
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	os.Remove(path)
+
+	_, err = (&ScriptModule{Interpreter: "sh", Contents: "exit 3"}).Do(&ModuleContext{Logger: &Logger{}})
+	assert.ErrorContains(t, err, "exit status 3")
+}
+
+func Test_guiSessionCommand(t *testing.T) {
+	cmd, err := guiSessionCommand(&ModuleContext{Logger: &Logger{}}, "root", []string{"/usr/bin/osascript", "/tmp/script"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bin/launchctl", "asuser", "0", "/usr/bin/sudo", "-u", "root", "/usr/bin/osascript", "/tmp/script"}, cmd)
+}
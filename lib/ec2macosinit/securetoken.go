@@ -0,0 +1,187 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SecureTokenGrant contains the configuration for granting a Secure Token to a single user.
+type SecureTokenGrant struct {
+	User           string `toml:"User"`           // User is the user to grant a Secure Token to
+	PasswordSecret string `toml:"PasswordSecret"` // PasswordSecret is the Secrets Manager secret holding the user's password
+}
+
+// SecureTokenModule contains all necessary configuration fields for running a SecureToken module.
+type SecureTokenModule struct {
+	AdminUser            string             `toml:"AdminUser"`            // AdminUser is an admin which already has a Secure Token
+	AdminSecret          string             `toml:"AdminSecret"`          // AdminSecret is the Secrets Manager secret holding the admin credential
+	Grants               []SecureTokenGrant `toml:"Grant"`                // Grants lists the users to grant a Secure Token to
+	EscrowBootstrapToken bool               `toml:"EscrowBootstrapToken"` // EscrowBootstrapToken escrows the Bootstrap Token to MDM
+}
+
+// adminCredential is the credential of an admin holding a Secure Token.
+type adminCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Do for the SecureTokenModule grants Secure Tokens to the configured users and escrows the Bootstrap Token to the
+// MDM server, both authorized by an admin whose credential is retrieved from Secrets Manager. Users which already have
+// a Secure Token, and a Bootstrap Token which is already escrowed, are left untouched.
+func (c *SecureTokenModule) Do(ctx *ModuleContext) (message string, err error) {
+	if len(c.Grants) == 0 && !c.EscrowBootstrapToken {
+		return "nothing to do", nil
+	}
+	if c.AdminSecret == "" {
+		return "", fmt.Errorf("ec2macosinit: AdminSecret must be provided")
+	}
+
+	admin, err := c.adminCredential(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var granted, unchanged int
+	for _, g := range c.Grants {
+		changed, err := grantSecureToken(ctx, g, admin)
+		if err != nil {
+			return "", err
+		}
+		if changed {
+			granted++
+			ctx.Logger.Infof("Granted Secure Token to [%s]", g.User)
+		} else {
+			unchanged++
+			ctx.Logger.Infof("User [%s] already has a Secure Token", g.User)
+		}
+	}
+
+	if c.EscrowBootstrapToken {
+		escrowed, err := escrowBootstrapToken(ctx, admin)
+		if err != nil {
+			return "", err
+		}
+		if escrowed {
+			ctx.Logger.Info("Escrowed Bootstrap Token to the MDM server")
+		} else {
+			ctx.Logger.Info("Bootstrap Token already escrowed")
+		}
+	}
+
+	return fmt.Sprintf("successfully processed Secure Tokens [%d granted / %d unchanged]", granted, unchanged), nil
+}
+
+// adminCredential retrieves the admin credential. The secret may be JSON with "username" and "password" keys, or the
+// plain password of AdminUser.
+func (c *SecureTokenModule) adminCredential(ctx *ModuleContext) (admin adminCredential, err error) {
+	secret, err := getSecretsManagerSecret(ctx, c.AdminSecret)
+	if err != nil {
+		return adminCredential{}, fmt.Errorf("ec2macosinit: unable to get admin credential: %s", err)
+	}
+	admin, err = parseAdminCredential(secret, c.AdminUser)
+	if err != nil {
+		return adminCredential{}, err
+	}
+	ctx.Logger.AddSensitive(admin.Password)
+	return admin, nil
+}
+
+// parseAdminCredential parses the admin secret, preferring the configured user name over one in the secret.
+func parseAdminCredential(secret, adminUser string) (admin adminCredential, err error) {
+	if strings.HasPrefix(strings.TrimSpace(secret), "{") {
+		err = json.Unmarshal([]byte(secret), &admin)
+		if err != nil {
+			return adminCredential{}, fmt.Errorf("ec2macosinit: unable to parse admin credential: %s", err)
+		}
+	} else {
+		admin.Password = secret
+	}
+	if adminUser != "" {
+		admin.Username = adminUser
+	}
+	if admin.Username == "" || admin.Password == "" {
+		return adminCredential{}, fmt.Errorf("ec2macosinit: admin credential requires both a user name and a password")
+	}
+	return admin, nil
+}
+
+// grantSecureToken grants a Secure Token to the user, if not already set. The user's own password is required.
+func grantSecureToken(ctx *ModuleContext, g SecureTokenGrant, admin adminCredential) (changed bool, err error) {
+	if g.User == "" || g.PasswordSecret == "" {
+		return false, fmt.Errorf("ec2macosinit: User and PasswordSecret must be provided for each grant")
+	}
+
+	user := &UserManagementModule{User: g.User}
+	enabled, err := user.isSecureTokenSet(ctx)
+	if err != nil {
+		return false, err
+	}
+	if enabled {
+		return false, nil
+	}
+
+	password, err := getSecretsManagerSecret(ctx, g.PasswordSecret)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to get password for %s: %s", g.User, err)
+	}
+
+	// sysadminctl reports most failures on stderr while still exiting zero, so always verify the result
+	_, err = ctx.executeCommand([]string{sysadminctlPath,
+		"-secureTokenOn", g.User, "-password", password,
+		"-adminUser", admin.Username, "-adminPassword", admin.Password}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to grant Secure Token to %s: %s", g.User, err)
+	}
+
+	// Validate new state
+	enabled, err = user.isSecureTokenSet(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !enabled {
+		return false, fmt.Errorf("ec2macosinit: verification failed, Secure Token is still disabled for %s", g.User)
+	}
+
+	return true, nil
+}
+
+// escrowBootstrapToken escrows the Bootstrap Token to the MDM server, if not already escrowed. The status looks like:
+//
+//	profiles: Bootstrap Token supported on server: YES
+//	profiles: Bootstrap Token escrowed to server: NO
+func escrowBootstrapToken(ctx *ModuleContext, admin adminCredential) (changed bool, err error) {
+	escrowed := func() (bool, error) {
+		out, err := ctx.executeCommand([]string{"/usr/bin/profiles", "status", "-type", "bootstraptoken"}, "", []string{})
+		if err != nil {
+			return false, fmt.Errorf("ec2macosinit: unable to get Bootstrap Token status: %s %s", err, strings.TrimSpace(out.stderr))
+		}
+		output := out.stdout + out.stderr
+		if strings.Contains(output, "supported on server: NO") {
+			return false, fmt.Errorf("ec2macosinit: the MDM server does not support Bootstrap Tokens")
+		}
+		return strings.Contains(output, "escrowed to server: YES"), nil
+	}
+
+	isEscrowed, err := escrowed()
+	if err != nil || isEscrowed {
+		return false, err
+	}
+
+	_, err = ctx.executeCommand([]string{"/usr/bin/profiles", "install", "-type", "bootstraptoken",
+		"-user", admin.Username, "-password", admin.Password}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to escrow Bootstrap Token: %s", err)
+	}
+
+	// Validate new state
+	isEscrowed, err = escrowed()
+	if err != nil {
+		return false, err
+	}
+	if !isEscrowed {
+		return false, fmt.Errorf("ec2macosinit: verification failed, Bootstrap Token is not escrowed")
+	}
+
+	return true, nil
+}
@@ -0,0 +1,23 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseAdminCredential(t *testing.T) {
+	admin, err := parseAdminCredential(`{"username":"mgmt","password":"hunter2"}`, "")
+	assert.NoError(t, err)
+	assert.Equal(t, adminCredential{Username: "mgmt", Password: "hunter2"}, admin)
+
+	admin, err = parseAdminCredential("hunter2", "ec2-user")
+	assert.NoError(t, err)
+	assert.Equal(t, adminCredential{Username: "ec2-user", Password: "hunter2"}, admin)
+
+	_, err = parseAdminCredential("hunter2", "")
+	assert.Error(t, err, "a plain password requires AdminUser")
+
+	_, err = parseAdminCredential(`{"username":"mgmt"`, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,260 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// serviceAccountUIDRangeStart is the default start of the UID range for service accounts. UIDs below 500 are not
+	// shown in the login window or System Settings.
+	serviceAccountUIDRangeStart = 400
+	// serviceAccountUIDRangeEnd is the default end (inclusive) of the UID range for service accounts.
+	serviceAccountUIDRangeEnd = 499
+	// staffGID is the primary group of standard macOS users
+	staffGID = 20
+	// secureTokenNever permanently prevents the account from receiving a Secure Token
+	secureTokenNever = "never"
+	// secureTokenAllow lets macOS grant a Secure Token to the account as it would for any other user
+	secureTokenAllow = "allow"
+)
+
+// ServiceAccountModule contains all necessary configuration fields for running a ServiceAccount module.
+type ServiceAccountModule struct {
+	User                   string `toml:"User"`                   // User is the account name
+	RealName               string `toml:"RealName"`               // RealName is the full name, default is User
+	UID                    int    `toml:"UID"`                    // UID is a fixed UID, default is the first free UID in the range
+	UIDRangeStart          int    `toml:"UIDRangeStart"`          // UIDRangeStart is the start of the range to pick a UID from
+	UIDRangeEnd            int    `toml:"UIDRangeEnd"`            // UIDRangeEnd is the end (inclusive) of the range to pick a UID from
+	Home                   string `toml:"Home"`                   // Home is the home directory, default is /var/<User>
+	Shell                  string `toml:"Shell"`                  // Shell is the login shell, default is /bin/zsh
+	Admin                  bool   `toml:"Admin"`                  // Admin adds the account to the admin group
+	SecureToken            string `toml:"SecureToken"`            // SecureToken is "never" (default) or "allow"
+	PasswordEscrow         string `toml:"PasswordEscrow"`         // PasswordEscrow is "secretsmanager" or "ssm"
+	PasswordEscrowName     string `toml:"PasswordEscrowName"`     // PasswordEscrowName overrides the per-instance name
+	PasswordEscrowKMSKeyID string `toml:"PasswordEscrowKMSKeyID"` // PasswordEscrowKMSKeyID encrypts with a customer key
+}
+
+// Do for the ServiceAccountModule creates a hidden local account for management tools and break-glass access. The
+// account is given a random password, which is escrowed if requested. By default the account is permanently excluded
+// from receiving a Secure Token: otherwise, on a fresh instance it could be granted the first Secure Token and become
+// the only account able to grant tokens to others. Existing accounts are not recreated, but are kept hidden and in the
+// admin group if requested.
+func (c *ServiceAccountModule) Do(ctx *ModuleContext) (message string, err error) {
+	if c.User == "" {
+		return "", fmt.Errorf("ec2macosinit: User must be provided")
+	}
+	secureToken := strings.ToLower(c.SecureToken)
+	if secureToken == "" {
+		secureToken = secureTokenNever
+	}
+	if secureToken != secureTokenNever && secureToken != secureTokenAllow {
+		return "", fmt.Errorf("ec2macosinit: unknown SecureToken %q, must be %q or %q", c.SecureToken, secureTokenNever, secureTokenAllow)
+	}
+
+	exists, err := userExists(c.User)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		err = c.ensureHiddenAndAdmin(ctx)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("service account %s already exists", c.User), nil
+	}
+
+	uid, err := c.pickUID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	password, err := generateSecurePassword(PasswordLength)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to generate secure password: %s", err)
+	}
+	ctx.Logger.AddSensitive(password)
+
+	// Escrow the password before the account exists, so that a failure doesn't leave an account nobody can log in to
+	var escrowName string
+	if c.PasswordEscrow != "" {
+		escrow := UserManagementModule{
+			User:                   c.User,
+			PasswordEscrow:         c.PasswordEscrow,
+			PasswordEscrowName:     c.PasswordEscrowName,
+			PasswordEscrowKMSKeyID: c.PasswordEscrowKMSKeyID,
+		}
+		escrowName, err = escrow.escrowPassword(ctx, password)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to escrow password, not creating account: %s", err)
+		}
+	}
+
+	err = c.createAccount(ctx, uid, password, secureToken == secureTokenNever)
+	if err != nil {
+		return "", err
+	}
+
+	message = fmt.Sprintf("successfully created service account %s with UID %d", c.User, uid)
+	if escrowName != "" {
+		message += fmt.Sprintf(", password stored in %s as %s", c.PasswordEscrow, escrowName)
+	}
+	return message, nil
+}
+
+// createAccount creates the account record, sets the password, and creates the home directory. If any step fails, the
+// record is deleted again, so that the next run doesn't find a half-created account and treat it as existing.
+func (c *ServiceAccountModule) createAccount(ctx *ModuleContext, uid int, password string, disableSecureToken bool) (err error) {
+	home := c.Home
+	if home == "" {
+		home = filepath.Join("/var", c.User)
+	}
+	shell := c.Shell
+	if shell == "" {
+		shell = "/bin/zsh"
+	}
+	realName := c.RealName
+	if realName == "" {
+		realName = c.User
+	}
+
+	_, err = ctx.executeCommand([]string{DsclPath, ".", "-create", dsclUserPath(c.User)}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to create user %s: %s", c.User, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		_, deleteErr := ctx.executeCommand([]string{DsclPath, ".", "-delete", dsclUserPath(c.User)}, "", []string{})
+		if deleteErr != nil {
+			ctx.Logger.Warnf("Unable to delete partially created user %s: %s", c.User, deleteErr)
+		}
+	}()
+	attributes := [][2]string{
+		{"UniqueID", strconv.Itoa(uid)},
+		{"PrimaryGroupID", strconv.Itoa(staffGID)},
+		{"RealName", realName},
+		{"UserShell", shell},
+		{"NFSHomeDirectory", home},
+		{"IsHidden", "1"},
+	}
+	for _, a := range attributes {
+		err = dsclCreateUserAttribute(ctx, c.User, a[0], a[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	// The tag must be in place before the password is set, since setting the password is what grants the token
+	if disableSecureToken {
+		_, err = ctx.executeCommand([]string{DsclPath, ".", "append", dsclUserPath(c.User), "AuthenticationAuthority", ";DisabledTags;SecureToken"}, "", []string{})
+		if err != nil {
+			return fmt.Errorf("ec2macosinit: failed to disable Secure Token for %s: %s", c.User, err)
+		}
+	}
+
+	_, err = ctx.executeCommand([]string{DsclPath, ".", "-passwd", dsclUserPath(c.User), password}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: failed to set %s's password: %s", c.User, err)
+	}
+
+	if c.Admin {
+		err = addUserToAdminGroup(ctx, c.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = ctx.executeCommand([]string{"/usr/sbin/createhomedir", "-c", "-u", c.User}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to create home directory for %s: %s", c.User, err)
+	}
+
+	// Verify that the account can be found
+	exists, err := userExists(c.User)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ec2macosinit: verification failed, user %s was not found after creation", c.User)
+	}
+
+	return nil
+}
+
+// ensureHiddenAndAdmin keeps an existing account hidden and, if requested, in the admin group.
+func (c *ServiceAccountModule) ensureHiddenAndAdmin(ctx *ModuleContext) (err error) {
+	hidden, err := dsclReadUserAttribute(ctx, c.User, "IsHidden")
+	if err != nil {
+		return err
+	}
+	if len(hidden) != 1 || hidden[0] != "1" {
+		err = dsclCreateUserAttribute(ctx, c.User, "IsHidden", "1")
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Admin {
+		return addUserToAdminGroup(ctx, c.User)
+	}
+	return nil
+}
+
+// pickUID returns the configured UID, or the first UID in the configured range which isn't in use.
+func (c *ServiceAccountModule) pickUID(ctx *ModuleContext) (uid int, err error) {
+	used, err := listLocalUIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if c.UID != 0 {
+		if used[c.UID] {
+			return 0, fmt.Errorf("ec2macosinit: UID %d is already in use", c.UID)
+		}
+		return c.UID, nil
+	}
+
+	start, end := c.UIDRangeStart, c.UIDRangeEnd
+	if start == 0 {
+		start = serviceAccountUIDRangeStart
+	}
+	if end == 0 {
+		end = serviceAccountUIDRangeEnd
+	}
+	return firstFreeUID(used, start, end)
+}
+
+// firstFreeUID returns the lowest UID in [start, end] which isn't in used.
+func firstFreeUID(used map[int]bool, start, end int) (uid int, err error) {
+	if start < 1 || end < start {
+		return 0, fmt.Errorf("ec2macosinit: invalid UID range %d-%d", start, end)
+	}
+	for uid = start; uid <= end; uid++ {
+		if !used[uid] {
+			return uid, nil
+		}
+	}
+	return 0, fmt.Errorf("ec2macosinit: no free UID in range %d-%d", start, end)
+}
+
+// addUserToAdminGroup adds the user to the admin group, if not already a member.
+func addUserToAdminGroup(ctx *ModuleContext, username string) (err error) {
+	_, err = addUserToGroup(ctx, username, "admin")
+	return err
+}
+
+// addUserToGroup adds the user to the group, if not already a member, and returns whether the user was added.
+func addUserToGroup(ctx *ModuleContext, username, group string) (added bool, err error) {
+	_, err = ctx.executeCommand([]string{"/usr/sbin/dseditgroup", "-o", "checkmember", "-m", username, group}, "", []string{})
+	if err == nil {
+		return false, nil // Already a member
+	}
+	_, err = ctx.executeCommand([]string{"/usr/sbin/dseditgroup", "-o", "edit", "-a", username, "-t", "user", group}, "", []string{})
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to add %s to the %s group: %s", username, group, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_firstFreeUID(t *testing.T) {
+	used := parseDsclUIDList("_www 70\nroot 0\nadmin1 400\nadmin2 401\nec2-user 501\n")
+
+	uid, err := firstFreeUID(used, 400, 499)
+	assert.NoError(t, err)
+	assert.Equal(t, 402, uid)
+
+	_, err = firstFreeUID(used, 400, 401)
+	assert.Error(t, err, "range is full")
+
+	_, err = firstFreeUID(used, 499, 400)
+	assert.Error(t, err, "range is invalid")
+}
+
+func Test_parseDsclAttribute(t *testing.T) {
+	assert.Equal(t, []string{"/bin/zsh"}, parseDsclAttribute("UserShell: /bin/zsh\n", "UserShell"))
+	assert.Equal(t, []string{"EC2 Default User"}, parseDsclAttribute("RealName:\n EC2 Default User\n", "RealName"))
+	assert.Nil(t, parseDsclAttribute("", "RealName"))
+}
+
+func TestServiceAccountModule_createAccount_cleanup(t *testing.T) {
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		if c[2] == "-passwd" {
+			return commandOutput{}, errors.New("exit status 1")
+		}
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	// A failure after the record is created deletes it again
+	c := &ServiceAccountModule{User: "ec2-service"}
+	err := c.createAccount(ctx, 401, "password", true)
+	assert.Error(t, err)
+	assert.Equal(t, DsclPath+" . -create /Users/ec2-service", fake.commands[0])
+	assert.Equal(t, DsclPath+" . -delete /Users/ec2-service", fake.commands[len(fake.commands)-1])
+}
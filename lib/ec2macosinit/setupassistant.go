@@ -0,0 +1,189 @@
+package ec2macosinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// setupAssistantDomain holds the per-user Setup Assistant settings
+	setupAssistantDomain = "com.apple.SetupAssistant"
+	// firstRegularUID is the lowest UID macOS gives to users created for people rather than services
+	firstRegularUID = 501
+)
+
+// appleSetupDonePath marks the Setup Assistant which runs on the first boot as finished.
+var appleSetupDonePath = "/var/db/.AppleSetupDone"
+
+// setupAssistantPanes are the Setup Assistant panes shown to a user at their first login, or after a macOS update,
+// which are marked as seen.
+var setupAssistantPanes = []string{
+	"DidSeeAccessibility",
+	"DidSeeActivationLock",
+	"DidSeeAppearanceSetup",
+	"DidSeeApplePaySetup",
+	"DidSeeCloudSetup",
+	"DidSeeiCloudLoginForStorageServices",
+	"DidSeeLockdownMode",
+	"DidSeePrivacy",
+	"DidSeeScreenTime",
+	"DidSeeSiriSetup",
+	"DidSeeSyncSetup",
+	"DidSeeSyncSetup2",
+	"DidSeeTouchIDSetup",
+	"DidSeeTrueTonePrivacy",
+}
+
+// SetupAssistantModule contains all necessary configuration fields for running a SetupAssistant module.
+type SetupAssistantModule struct {
+	Skip  bool     `toml:"Skip"`  // Skip marks Setup Assistant as finished and suppresses the first login dialogs
+	Users []string `toml:"Users"` // Users to suppress the dialogs for, defaults to every local user with a home directory
+}
+
+// Do for the SetupAssistantModule marks the system Setup Assistant as finished, and marks the panes shown at a user's
+// first login as seen for the current macOS version, so GUI sessions on a new instance don't wait on modal dialogs.
+// Users without a home directory yet are skipped, since macOS creates it from the user template at their first login
+// and writing into it beforehand would stop that; they're handled by the next run.
+func (c *SetupAssistantModule) Do(ctx *ModuleContext) (message string, err error) {
+	if !c.Skip {
+		return "Not requested to skip Setup Assistant", nil
+	}
+
+	var changed, unchanged int
+	if _, err := os.Stat(appleSetupDonePath); errors.Is(err, os.ErrNotExist) {
+		err = safeWriteFile(appleSetupDonePath, []byte{}, 0644, -1, -1)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to create %s: %s", appleSetupDonePath, err)
+		}
+		ctx.Logger.Infof("Marked Setup Assistant as finished with %s", appleSetupDonePath)
+		changed++
+	} else if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to check %s: %s", appleSetupDonePath, err)
+	} else {
+		unchanged++
+	}
+
+	users := c.Users
+	if len(users) == 0 {
+		users, err = listRegularUsers(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	version, build, err := getOSVersionAndBuild(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var skipped []string
+	for _, u := range users {
+		home, err := getUserHomeDirectory(u)
+		if err == nil {
+			_, err = os.Stat(home)
+		}
+		if err != nil {
+			ctx.Logger.Infof("Skipping Setup Assistant settings for user %s without a home directory: %s", u, err)
+			skipped = append(skipped, u)
+			continue
+		}
+
+		userChanged, err := skipSetupAssistantForUser(ctx, u, home, version, build)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to skip Setup Assistant for user %s: %s", u, err)
+		}
+		if userChanged {
+			ctx.Logger.Infof("Suppressed first login dialogs for user %s", u)
+			changed++
+		} else {
+			unchanged++
+		}
+	}
+
+	message = fmt.Sprintf("successfully skipped Setup Assistant [%d changed / %d unchanged]", changed, unchanged)
+	if len(skipped) > 0 {
+		message += fmt.Sprintf(", skipped users without a home directory: %s", strings.Join(skipped, ", "))
+	}
+	return message, nil
+}
+
+// skipSetupAssistantForUser writes the Setup Assistant settings into the user's preferences. Missing preference
+// directories are created and owned by the user, so the user can still write their own preferences.
+func skipSetupAssistantForUser(ctx *ModuleContext, username, home, version, build string) (changed bool, err error) {
+	uid, gid, err := ctx.getUIDandGID(username)
+	if err != nil {
+		return false, err
+	}
+	dir := home
+	for _, d := range strings.Split(preferencesDir, "/") {
+		dir = filepath.Join(dir, d)
+		err = os.Mkdir(dir, 0700)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		err = os.Chown(dir, uid, gid)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	path := filepath.Join(dir, setupAssistantDomain)
+	for _, m := range setupAssistantSettings(path, username, version, build) {
+		settingChanged, err := modifyDefaults(ctx, m, nil)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || settingChanged
+	}
+	return changed, nil
+}
+
+// setupAssistantSettings returns the settings which mark every pane as seen, and the prompts shown after an update as
+// seen for the current macOS version and build.
+func setupAssistantSettings(path, username, version, build string) (settings []ModifyDefaults) {
+	for _, pane := range setupAssistantPanes {
+		settings = append(settings, ModifyDefaults{Plist: path, User: username, Parameter: pane, Type: "bool", Value: "true"})
+	}
+	return append(settings,
+		ModifyDefaults{Plist: path, User: username, Parameter: "GestureMovieSeen", Type: "string", Value: "none"},
+		ModifyDefaults{Plist: path, User: username, Parameter: "LastSeenCloudProductVersion", Type: "string", Value: version},
+		ModifyDefaults{Plist: path, User: username, Parameter: "LastSeenBuddyBuildVersion", Type: "string", Value: build},
+		ModifyDefaults{Plist: path, User: username, Parameter: "LastPreLoginTasksPerformedVersion", Type: "string", Value: version},
+		ModifyDefaults{Plist: path, User: username, Parameter: "LastPreLoginTasksPerformedBuild", Type: "string", Value: build},
+	)
+}
+
+// getOSVersionAndBuild returns the macOS product version, such as 14.5, and build, such as 23F79.
+func getOSVersionAndBuild(ctx *ModuleContext) (version, build string, err error) {
+	out, err := ctx.executeCommand([]string{"sysctl", "-n", "kern.osproductversion", "kern.osversion"}, "", []string{})
+	if err != nil {
+		return "", "", fmt.Errorf("ec2macosinit: error getting kernel state for product version and build: %s", err)
+	}
+	fields := strings.Fields(out.stdout)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("ec2macosinit: unexpected product version and build: %q", out.stdout)
+	}
+	return fields[0], fields[1], nil
+}
+
+// listRegularUsers returns the local users created for people rather than services, sorted by name.
+func listRegularUsers(ctx *ModuleContext) (users []string, err error) {
+	out, err := ctx.executeCommand([]string{DsclPath, ".", "-list", "/Users", "UniqueID"}, "", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to list local users: %s", err)
+	}
+	for name, uid := range parseDsclUserList(out.stdout) {
+		if uid >= firstRegularUID && !strings.HasPrefix(name, "_") {
+			users = append(users, name)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
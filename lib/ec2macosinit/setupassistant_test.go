@@ -0,0 +1,71 @@
+package ec2macosinit
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func TestSetupAssistantModule_Do(t *testing.T) {
+	defer func(p string) { appleSetupDonePath = p }(appleSetupDonePath)
+	appleSetupDonePath = filepath.Join(t.TempDir(), ".AppleSetupDone")
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		if c[0] == "sysctl" {
+			return commandOutput{stdout: "14.5\n23F79\n"}, nil
+		}
+		return commandOutput{stdout: "_www 70\nnobody -2\nroot 0\nno-such-user-ec2 501\n"}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+
+	c := &SetupAssistantModule{Skip: true}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully skipped Setup Assistant [1 changed / 0 unchanged], skipped users without a home directory: no-such-user-ec2", message)
+	assert.FileExists(t, appleSetupDonePath)
+
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(message, "successfully skipped Setup Assistant [0 changed / 1 unchanged]"))
+
+	message, err = (&SetupAssistantModule{}).Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Not requested to skip Setup Assistant", message)
+}
+
+func Test_skipSetupAssistantForUser(t *testing.T) {
+	u, err := user.Current()
+	require.NoError(t, err)
+	home := t.TempDir()
+	ctx := &ModuleContext{Logger: &Logger{}, executor: &fakeExecutor{}}
+
+	changed, err := skipSetupAssistantForUser(ctx, u.Username, home, "14.5", "23F79")
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	path := filepath.Join(home, preferencesDir, setupAssistantDomain+".plist")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var v interface{}
+	_, err = plist.Unmarshal(data, &v)
+	require.NoError(t, err)
+	settings := v.(map[string]interface{})
+	assert.Len(t, settings, len(setupAssistantPanes)+5)
+	assert.Equal(t, true, settings["DidSeePrivacy"])
+	assert.Equal(t, "14.5", settings["LastSeenCloudProductVersion"])
+	assert.Equal(t, "23F79", settings["LastSeenBuddyBuildVersion"])
+
+	// A macOS update changes the version, which is updated so the prompts stay suppressed
+	changed, err = skipSetupAssistantForUser(ctx, u.Username, home, "14.5", "23F79")
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = skipSetupAssistantForUser(ctx, u.Username, home, "14.6", "23G80")
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
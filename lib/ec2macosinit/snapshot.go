@@ -0,0 +1,267 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+)
+
+const (
+	// localSnapshotPrefix and localSnapshotSuffix surround the date in the names of snapshots created by tmutil
+	localSnapshotPrefix = "com.apple.TimeMachine."
+	localSnapshotSuffix = ".local"
+	// dataVolume is the mount point of the data volume, which holds everything that isn't part of the sealed system
+	dataVolume = "/System/Volumes/Data"
+	// tmutilPath is the path to the Time Machine utility, which creates and lists local snapshots
+	tmutilPath = "/usr/bin/tmutil"
+)
+
+var (
+	// snapshotName matches the names allowed for snapshots
+	snapshotName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	// localSnapshotCreated matches the output of tmutil localsnapshot, such as
+	// "Created local snapshot with date: 2024-05-01-123456"
+	localSnapshotCreated = regexp.MustCompile(`Created local snapshot with date: (\S+)`)
+	// DefaultRevertPaths are the paths restored when reverting to a snapshot, which control SSH access and sudo.
+	DefaultRevertPaths = []string{"/private/etc/ssh", "/private/etc/pam.d", "/private/etc/sudoers", "/private/etc/sudoers.d"}
+)
+
+// SnapshotRecord maps the name given to a snapshot in init.toml to the local snapshot created for it.
+type SnapshotRecord struct {
+	Name     string    `json:"name"`
+	Snapshot string    `json:"snapshot"`
+	Created  time.Time `json:"created"`
+}
+
+// SnapshotModule contains all necessary configuration fields for running a Snapshot module.
+type SnapshotModule struct {
+	Name string `toml:"Name"` // Name identifies the snapshot when reverting to it
+}
+
+// Do for the SnapshotModule creates an APFS local snapshot of the data volume with tmutil, and records it under the
+// name so that it can be reverted to with ec2-macos-init snapshot revert. A snapshot which was already recorded under
+// the name and still exists is kept, so the rollback point is from before the first run.
+func (c *SnapshotModule) Do(ctx *ModuleContext) (message string, err error) {
+	if !snapshotName.MatchString(c.Name) {
+		return "", fmt.Errorf("ec2macosinit: invalid snapshot name %q, only letters, digits, '.', '_' and '-' are allowed", c.Name)
+	}
+	recordsPath := filepath.Join(ctx.BaseDirectory, paths.Snapshots)
+	records, err := readSnapshotRecords(recordsPath)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := listLocalSnapshots(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range records {
+		if r.Name == c.Name && existing[r.Snapshot] {
+			ctx.Logger.Infof("Snapshot %s already exists as %s", c.Name, r.Snapshot)
+			return fmt.Sprintf("snapshot %s already exists as %s", c.Name, r.Snapshot), nil
+		}
+	}
+
+	out, err := ctx.executeCommand([]string{tmutilPath, "localsnapshot", "/"}, "", []string{})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to create local snapshot: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+	match := localSnapshotCreated.FindStringSubmatch(out.stdout)
+	if match == nil {
+		return "", fmt.Errorf("ec2macosinit: unexpected output creating local snapshot: %q", strings.TrimSpace(out.stdout))
+	}
+	snapshot := localSnapshotPrefix + match[1] + localSnapshotSuffix
+
+	// Validate new value
+	existing, err = listLocalSnapshots(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !existing[snapshot] {
+		return "", fmt.Errorf("ec2macosinit: verification failed, local snapshot %s doesn't exist", snapshot)
+	}
+
+	updated := []SnapshotRecord{{Name: c.Name, Snapshot: snapshot, Created: time.Now()}}
+	for _, r := range records {
+		if r.Name != c.Name {
+			updated = append(updated, r)
+		}
+	}
+	err = writeSnapshotRecords(recordsPath, updated)
+	if err != nil {
+		return "", err
+	}
+	ctx.Logger.Infof("Created snapshot %s as %s", c.Name, snapshot)
+
+	return fmt.Sprintf("successfully created snapshot %s as %s", c.Name, snapshot), nil
+}
+
+// readSnapshotRecords reads the recorded snapshots, sorted by name. A missing file has no records.
+func readSnapshotRecords(path string) (records []SnapshotRecord, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read snapshot records: %s", err)
+	}
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: invalid snapshot records in %s: %s", path, err)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// writeSnapshotRecords writes the recorded snapshots.
+func writeSnapshotRecords(path string, records []SnapshotRecord) (err error) {
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to encode snapshot records: %s", err)
+	}
+	err = safeWriteFile(path, data, 0600, -1, -1)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write snapshot records: %s", err)
+	}
+	return nil
+}
+
+// listLocalSnapshots returns the local snapshots of the data volume. tmutil prints a header followed by one snapshot
+// per line.
+func listLocalSnapshots(ctx *ModuleContext) (snapshots map[string]bool, err error) {
+	out, err := ctx.executeCommand([]string{tmutilPath, "listlocalsnapshots", "/"}, "", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to list local snapshots: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+	snapshots = map[string]bool{}
+	for _, line := range strings.Split(out.stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, localSnapshotPrefix) {
+			snapshots[line] = true
+		}
+	}
+	return snapshots, nil
+}
+
+// Snapshots returns the snapshots recorded by Snapshot modules, and whether each of them still exists. macOS removes
+// local snapshots after a day, or sooner when disk space is low.
+func Snapshots(baseDir string) (records []SnapshotRecord, exists map[string]bool, err error) {
+	records, err = readSnapshotRecords(filepath.Join(baseDir, paths.Snapshots))
+	if err != nil {
+		return nil, nil, err
+	}
+	exists, err = listLocalSnapshots(&ModuleContext{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, exists, nil
+}
+
+// RevertSnapshot restores paths from the snapshot recorded under the name, or DefaultRevertPaths when none are given.
+// The snapshot is mounted read-only and each path is copied back over the live one, removing anything added since the
+// snapshot; a path which didn't exist in the snapshot is removed. The rest of the volume is left as it is.
+func RevertSnapshot(baseDir, name string, restorePaths []string) (restored []string, err error) {
+	return revertSnapshot(&ModuleContext{BaseDirectory: baseDir}, name, restorePaths)
+}
+
+// revertSnapshot restores paths from the named snapshot.
+func revertSnapshot(ctx *ModuleContext, name string, restorePaths []string) (restored []string, err error) {
+	if len(restorePaths) == 0 {
+		restorePaths = DefaultRevertPaths
+	}
+	var dataPaths []string
+	for _, p := range restorePaths {
+		dataPath, err := snapshotDataPath(p)
+		if err != nil {
+			return nil, err
+		}
+		dataPaths = append(dataPaths, dataPath)
+	}
+
+	records, err := readSnapshotRecords(filepath.Join(ctx.BaseDirectory, paths.Snapshots))
+	if err != nil {
+		return nil, err
+	}
+	var snapshot string
+	for _, r := range records {
+		if r.Name == name {
+			snapshot = r.Snapshot
+		}
+	}
+	if snapshot == "" {
+		return nil, fmt.Errorf("ec2macosinit: no snapshot named %s has been created", name)
+	}
+	existing, err := listLocalSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !existing[snapshot] {
+		return nil, fmt.Errorf("ec2macosinit: snapshot %s (%s) no longer exists", name, snapshot)
+	}
+
+	mountPoint, err := os.MkdirTemp("", "ec2-macos-init-snapshot-")
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to create snapshot mount point: %s", err)
+	}
+	defer os.Remove(mountPoint)
+	out, err := ctx.executeCommand([]string{"/sbin/mount_apfs", "-o", "ro,nobrowse", "-s", snapshot, dataVolume, mountPoint}, "", []string{})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to mount snapshot %s: %s %s", snapshot, err, strings.TrimSpace(out.stderr))
+	}
+	defer func() {
+		_, _ = ctx.executeCommand([]string{"/sbin/umount", mountPoint}, "", []string{})
+	}()
+
+	for _, p := range dataPaths {
+		source := filepath.Join(mountPoint, p)
+		_, err = os.Lstat(source)
+		if errors.Is(err, os.ErrNotExist) {
+			err = os.RemoveAll(p)
+			if err != nil {
+				return restored, fmt.Errorf("ec2macosinit: unable to remove %s, which didn't exist in the snapshot: %s", p, err)
+			}
+			restored = append(restored, p)
+			continue
+		}
+		if err != nil {
+			return restored, fmt.Errorf("ec2macosinit: unable to read %s from the snapshot: %s", p, err)
+		}
+		out, err = ctx.executeCommand([]string{"/usr/bin/rsync", "-a", "--delete", source, filepath.Dir(p) + "/"}, "", []string{})
+		if err != nil {
+			return restored, fmt.Errorf("ec2macosinit: unable to restore %s: %s %s", p, err, strings.TrimSpace(out.stderr))
+		}
+		restored = append(restored, p)
+	}
+	return restored, nil
+}
+
+// snapshotDataPath returns where a path lives on the data volume, which is what the snapshot contains. Paths through
+// the data volume's mount point, or through the /etc, /tmp, and /var symlinks, are accepted as well.
+func snapshotDataPath(p string) (dataPath string, err error) {
+	if !filepath.IsAbs(p) {
+		return "", fmt.Errorf("ec2macosinit: paths to revert must be absolute, not %s", p)
+	}
+	dataPath = filepath.Clean(p)
+	if dataPath == dataVolume || dataPath == "/" {
+		return "", fmt.Errorf("ec2macosinit: the whole volume can't be reverted, only paths on it")
+	}
+	if strings.HasPrefix(dataPath, dataVolume+"/") {
+		dataPath = strings.TrimPrefix(dataPath, dataVolume)
+	}
+	// /etc, /tmp, and /var are symlinks into /private on the system volume
+	for _, dir := range []string{"/etc", "/tmp", "/var"} {
+		if dataPath == dir || strings.HasPrefix(dataPath, dir+"/") {
+			dataPath = "/private" + dataPath
+		}
+	}
+	return dataPath, nil
+}
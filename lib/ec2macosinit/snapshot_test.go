@@ -0,0 +1,112 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTmutil answers tmutil commands from a list of local snapshots.
+func fakeTmutil(snapshots map[string]bool) *fakeExecutor {
+	return &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		switch {
+		case c[0] == tmutilPath && c[1] == "localsnapshot":
+			snapshots["com.apple.TimeMachine.2024-05-01-123456.local"] = true
+			return commandOutput{stdout: "Created local snapshot with date: 2024-05-01-123456\n"}, nil
+		case c[0] == tmutilPath:
+			out := "Snapshots for disk /:\n"
+			for s := range snapshots {
+				out += s + "\n"
+			}
+			return commandOutput{stdout: out}, nil
+		}
+		return commandOutput{}, nil
+	}}
+}
+
+func TestSnapshotModule_Do(t *testing.T) {
+	snapshots := map[string]bool{}
+	ctx := &ModuleContext{Logger: &Logger{}, BaseDirectory: t.TempDir(), executor: fakeTmutil(snapshots)}
+
+	c := &SnapshotModule{Name: "pre-provisioning"}
+	message, err := c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "successfully created snapshot pre-provisioning as com.apple.TimeMachine.2024-05-01-123456.local", message)
+	records, err := readSnapshotRecords(filepath.Join(ctx.BaseDirectory, paths.Snapshots))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "com.apple.TimeMachine.2024-05-01-123456.local", records[0].Snapshot)
+
+	// The first snapshot is kept while it exists
+	message, err = c.Do(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot pre-provisioning already exists as com.apple.TimeMachine.2024-05-01-123456.local", message)
+
+	_, err = (&SnapshotModule{Name: "../x"}).Do(ctx)
+	assert.Error(t, err)
+}
+
+func Test_revertSnapshot(t *testing.T) {
+	snapshots := map[string]bool{"com.apple.TimeMachine.2024-05-01-123456.local": true}
+	fake := fakeTmutil(snapshots)
+	tmutil := fake.handle
+	fake.handle = func(c []string) (commandOutput, error) {
+		// The mounted snapshot contains the SSH configuration
+		if c[0] == "/sbin/mount_apfs" {
+			mountPoint := c[len(c)-1]
+			require.NoError(t, os.MkdirAll(filepath.Join(mountPoint, "private/etc/ssh"), 0755))
+		}
+		return tmutil(c)
+	}
+	ctx := &ModuleContext{Logger: &Logger{}, BaseDirectory: t.TempDir(), executor: fake}
+
+	_, err := revertSnapshot(ctx, "pre-provisioning", nil)
+	assert.EqualError(t, err, "ec2macosinit: no snapshot named pre-provisioning has been created")
+
+	require.NoError(t, writeSnapshotRecords(filepath.Join(ctx.BaseDirectory, paths.Snapshots), []SnapshotRecord{
+		{Name: "pre-provisioning", Snapshot: "com.apple.TimeMachine.2024-05-01-123456.local"},
+	}))
+	missing := "/private/ec2-macos-init-test-missing"
+	restored, err := revertSnapshot(ctx, "pre-provisioning", []string{"/etc/ssh", missing})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/private/etc/ssh", missing}, restored)
+
+	var rsync, umount string
+	for _, c := range fake.commands {
+		switch {
+		case strings.HasPrefix(c, "/usr/bin/rsync"):
+			rsync = c
+		case strings.HasPrefix(c, "/sbin/umount"):
+			umount = c
+		}
+	}
+	assert.Regexp(t, `^/usr/bin/rsync -a --delete \S+/private/etc/ssh /private/etc/$`, rsync)
+	assert.NotEmpty(t, umount)
+
+	// Snapshots which macOS has removed can't be reverted to
+	delete(snapshots, "com.apple.TimeMachine.2024-05-01-123456.local")
+	_, err = revertSnapshot(ctx, "pre-provisioning", nil)
+	assert.Error(t, err)
+}
+
+func Test_snapshotDataPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/etc/ssh":                           "/private/etc/ssh",
+		"/private/etc/sudoers":               "/private/etc/sudoers",
+		"/System/Volumes/Data/Users/x/.ssh/": "/Users/x/.ssh",
+		"/Library/LaunchDaemons":             "/Library/LaunchDaemons",
+	} {
+		got, err := snapshotDataPath(path)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	for _, path := range []string{"etc/ssh", "/", "/System/Volumes/Data"} {
+		_, err := snapshotDataPath(path)
+		assert.Error(t, err, path)
+	}
+}
@@ -0,0 +1,231 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// sshClientConfigPrefix names the drop-ins and known hosts files managed by ec2-macos-init, so that ones which are
+	// no longer configured can be found and removed
+	sshClientConfigPrefix = "050-ec2-macos-"
+	// sshClientConfigWarning is a header warning for managed ssh_config drop-ins
+	sshClientConfigWarning = "### This file is managed by EC2 macOS Init, changes will be overwritten on every run. Configure SSHClient in /usr/local/aws/ec2-macos-init/init.toml instead ###\n"
+	// sshBinary is the path to ssh, used to validate client configuration before it is applied
+	sshBinary = "/usr/bin/ssh"
+	// sshValidationHost is the host name used to validate client configuration, which only needs to be parsed
+	sshValidationHost = "ec2-macos-init.invalid"
+)
+
+var (
+	// sshClientConfigDir holds the drop-ins included by /etc/ssh/ssh_config
+	sshClientConfigDir = "/etc/ssh/ssh_config.d"
+	// sshKnownHostsDir holds the known hosts files which trust the configured certificate authorities
+	sshKnownHostsDir = "/etc/ssh/ssh_known_hosts.d"
+	// sshClientConfigName matches the names allowed for drop-ins, which become part of their file names
+	sshClientConfigName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	// sshClientOptionName matches ssh_config keywords
+	sshClientOptionName = regexp.MustCompile(`^[A-Za-z]+$`)
+)
+
+// SSHClientConfig is an ssh client configuration drop-in, written to /etc/ssh/ssh_config.d for a set of hosts.
+type SSHClientConfig struct {
+	Name            string            `toml:"name"`            // Name of the drop-in, used in its file name
+	Host            string            `toml:"host"`            // Host patterns the options apply to, defaults to "*"
+	Options         map[string]string `toml:"options"`         // Options are ssh_config keywords and their values
+	CertAuthorities []string          `toml:"certAuthorities"` // CertAuthorities are CA keys trusted to sign host keys
+}
+
+// configPath returns the path of the drop-in.
+func (s SSHClientConfig) configPath() string {
+	return filepath.Join(sshClientConfigDir, sshClientConfigPrefix+s.Name+".conf")
+}
+
+// knownHostsPath returns the path of the known hosts file trusting the drop-in's certificate authorities.
+func (s SSHClientConfig) knownHostsPath() string {
+	return filepath.Join(sshKnownHostsDir, sshClientConfigPrefix+s.Name)
+}
+
+// hosts returns the host patterns the drop-in applies to.
+func (s SSHClientConfig) hosts() []string {
+	hosts := strings.Fields(s.Host)
+	if len(hosts) == 0 {
+		return []string{"*"}
+	}
+	return hosts
+}
+
+// content returns the drop-in and, when certificate authorities are configured, the known hosts file marking them as
+// @cert-authority for the hosts. The known hosts file is added to the default global files for the hosts only.
+func (s SSHClientConfig) content() (config, knownHosts string, err error) {
+	if !sshClientConfigName.MatchString(s.Name) {
+		return "", "", fmt.Errorf("ec2macosinit: invalid ssh client config name %q, only letters, digits, '.', '_' and '-' are allowed", s.Name)
+	}
+
+	var b strings.Builder
+	b.WriteString(sshClientConfigWarning)
+	b.WriteString("Host " + strings.Join(s.hosts(), " ") + "\n")
+	keys := make([]string, 0, len(s.Options))
+	for k := range s.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := s.Options[k]
+		if !sshClientOptionName.MatchString(k) {
+			return "", "", fmt.Errorf("ec2macosinit: invalid ssh client option %q in %s", k, s.Name)
+		}
+		if strings.EqualFold(k, "Host") || strings.EqualFold(k, "Match") || strings.EqualFold(k, "Include") {
+			return "", "", fmt.Errorf("ec2macosinit: ssh client option %s is not allowed in %s", k, s.Name)
+		}
+		if strings.TrimSpace(v) == "" || strings.ContainsAny(v, "\r\n") {
+			return "", "", fmt.Errorf("ec2macosinit: invalid value for ssh client option %s in %s", k, s.Name)
+		}
+		b.WriteString(fmt.Sprintf("  %s %s\n", k, v))
+	}
+
+	if len(s.CertAuthorities) > 0 {
+		if _, set := s.Options["GlobalKnownHostsFile"]; set {
+			return "", "", fmt.Errorf("ec2macosinit: GlobalKnownHostsFile can't be set with certAuthorities in %s", s.Name)
+		}
+		b.WriteString(fmt.Sprintf("  GlobalKnownHostsFile /etc/ssh/ssh_known_hosts /etc/ssh/ssh_known_hosts2 %s\n", s.knownHostsPath()))
+
+		var k strings.Builder
+		k.WriteString(strings.Replace(sshClientConfigWarning, "###", "#", 1))
+		for _, key := range s.CertAuthorities {
+			if len(strings.Fields(key)) < 2 || strings.ContainsAny(key, "\r\n") {
+				return "", "", fmt.Errorf("ec2macosinit: invalid certificate authority key in %s: %q", s.Name, key)
+			}
+			k.WriteString(fmt.Sprintf("@cert-authority %s %s\n", strings.Join(s.hosts(), ","), strings.TrimSpace(key)))
+		}
+		knownHosts = k.String()
+	}
+
+	return b.String(), knownHosts, nil
+}
+
+// writeSSHClientConfigs writes the configured ssh client drop-ins and known hosts files, and removes the ones managed
+// by ec2-macos-init which are no longer configured. Each drop-in is validated with ssh before it is moved into place,
+// so a bad drop-in can never break ssh for every host.
+func writeSSHClientConfigs(ctx *ModuleContext, configs []SSHClientConfig, backups *fileBackups) (changed, unchanged int, err error) {
+	wanted := map[string]bool{}
+	for _, s := range configs {
+		if wanted[s.configPath()] {
+			return 0, 0, fmt.Errorf("ec2macosinit: duplicate ssh client config name %s", s.Name)
+		}
+		wanted[s.configPath()] = true
+		if len(s.CertAuthorities) > 0 {
+			wanted[s.knownHostsPath()] = true
+		}
+	}
+
+	for _, s := range configs {
+		config, knownHosts, err := s.content()
+		if err != nil {
+			return changed, unchanged, err
+		}
+		err = validateSSHClientConfig(ctx, config)
+		if err != nil {
+			return changed, unchanged, fmt.Errorf("ec2macosinit: refusing to write %s: %s", s.configPath(), err)
+		}
+
+		configChanged := false
+		// The known hosts file is written first, so that the drop-in never refers to a file which doesn't exist
+		if knownHosts != "" {
+			fileChanged, err := writeManagedFile(s.knownHostsPath(), []byte(knownHosts), backups)
+			if err != nil {
+				return changed, unchanged, err
+			}
+			configChanged = configChanged || fileChanged
+		}
+		fileChanged, err := writeManagedFile(s.configPath(), []byte(config), backups)
+		if err != nil {
+			return changed, unchanged, err
+		}
+		configChanged = configChanged || fileChanged
+
+		if configChanged {
+			changed++
+			ctx.Logger.Infof("Updated ssh client config %s", s.configPath())
+		} else {
+			unchanged++
+		}
+	}
+
+	// Drop-ins are removed before their known hosts files for the same reason
+	for _, dir := range []string{sshClientConfigDir, sshKnownHostsDir} {
+		stale, _ := filepath.Glob(filepath.Join(dir, sshClientConfigPrefix+"*"))
+		for _, path := range stale {
+			if wanted[path] {
+				continue
+			}
+			err = backups.save(path)
+			if err != nil {
+				return changed, unchanged, err
+			}
+			err = os.Remove(path)
+			if err != nil {
+				return changed, unchanged, fmt.Errorf("ec2macosinit: unable to remove %s: %s", path, err)
+			}
+			ctx.Logger.Infof("Removed ssh client config %s which is no longer configured", path)
+			changed++
+		}
+	}
+
+	return changed, unchanged, nil
+}
+
+// writeManagedFile replaces the file at path with data, owned by root, unless it already contains it. The file is saved
+// to backups before it is changed.
+func writeManagedFile(path string, data []byte, backups *fileBackups) (changed bool, err error) {
+	current, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ec2macosinit: unable to read %s: %s", path, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to create %s: %s", filepath.Dir(path), err)
+	}
+	err = backups.save(path)
+	if err != nil {
+		return false, err
+	}
+	err = safeWriteFile(path, data, 0644, 0, 0)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to write %s: %s", path, err)
+	}
+	return true, nil
+}
+
+// validateSSHClientConfig writes a candidate drop-in to a temporary file, outside of ssh_config.d so that it's never
+// picked up by the Include directive, and has ssh parse it. The temporary file is always removed.
+func validateSSHClientConfig(ctx *ModuleContext, config string) (err error) {
+	f, err := os.CreateTemp("", "ssh_config_candidate.*")
+	if err != nil {
+		return fmt.Errorf("unable to create candidate file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(config)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write candidate file %s: %s", f.Name(), err)
+	}
+
+	out, err := ctx.executeCommand([]string{sshBinary, "-G", "-F", f.Name(), sshValidationHost}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ssh configuration test failed: %s %s", err, strings.TrimSpace(out.stderr))
+	}
+	return nil
+}
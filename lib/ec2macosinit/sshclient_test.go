@@ -0,0 +1,105 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHClientConfig_content(t *testing.T) {
+	defer func(d string) { sshKnownHostsDir = d }(sshKnownHostsDir)
+	sshKnownHostsDir = "/etc/ssh/ssh_known_hosts.d"
+
+	s := SSHClientConfig{
+		Name:            "build",
+		Host:            "*.build.internal git.internal",
+		Options:         map[string]string{"StrictHostKeyChecking": "yes", "ServerAliveInterval": "30"},
+		CertAuthorities: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample build-ca"},
+	}
+	config, knownHosts, err := s.content()
+	require.NoError(t, err)
+	assert.Equal(t, sshClientConfigWarning+`Host *.build.internal git.internal
+  ServerAliveInterval 30
+  StrictHostKeyChecking yes
+  GlobalKnownHostsFile /etc/ssh/ssh_known_hosts /etc/ssh/ssh_known_hosts2 /etc/ssh/ssh_known_hosts.d/050-ec2-macos-build
+`, config)
+	assert.Contains(t, knownHosts, "\n@cert-authority *.build.internal,git.internal ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample build-ca\n")
+
+	// Options apply to every host by default
+	config, knownHosts, err = SSHClientConfig{Name: "keepalive", Options: map[string]string{"ServerAliveInterval": "60"}}.content()
+	require.NoError(t, err)
+	assert.Contains(t, config, "\nHost *\n  ServerAliveInterval 60\n")
+	assert.Empty(t, knownHosts)
+
+	for _, bad := range []SSHClientConfig{
+		{Name: "../escape"},
+		{Name: "x", Options: map[string]string{"Host": "other"}},
+		{Name: "x", Options: map[string]string{"User": "a\nHost *"}},
+		{Name: "x", Options: map[string]string{"GlobalKnownHostsFile": "/dev/null"}, CertAuthorities: []string{"ssh-ed25519 AAAA"}},
+		{Name: "x", CertAuthorities: []string{"not-a-key"}},
+	} {
+		_, _, err = bad.content()
+		assert.Error(t, err, bad)
+	}
+}
+
+func Test_writeSSHClientConfigs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("managed ssh client configs are owned by root")
+	}
+	dir := t.TempDir()
+	defer func(c, k string) { sshClientConfigDir, sshKnownHostsDir = c, k }(sshClientConfigDir, sshKnownHostsDir)
+	sshClientConfigDir = filepath.Join(dir, "ssh_config.d")
+	sshKnownHostsDir = filepath.Join(dir, "ssh_known_hosts.d")
+	require.NoError(t, os.MkdirAll(sshClientConfigDir, 0755))
+	stale := filepath.Join(sshClientConfigDir, sshClientConfigPrefix+"old.conf")
+	other := filepath.Join(sshClientConfigDir, "100-other.conf")
+	require.NoError(t, os.WriteFile(stale, []byte("Host *\n"), 0644))
+	require.NoError(t, os.WriteFile(other, []byte("Host *\n"), 0644))
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{Logger: &Logger{}, executor: fake}
+	configs := []SSHClientConfig{{
+		Name:            "build",
+		Options:         map[string]string{"ServerAliveInterval": "30"},
+		CertAuthorities: []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample"},
+	}}
+
+	changed, unchanged, err := writeSSHClientConfigs(ctx, configs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, changed)
+	assert.Equal(t, 0, unchanged)
+	assert.Contains(t, fake.commands[0], sshBinary+" -G -F ")
+	assert.FileExists(t, filepath.Join(sshClientConfigDir, sshClientConfigPrefix+"build.conf"))
+	assert.FileExists(t, filepath.Join(sshKnownHostsDir, sshClientConfigPrefix+"build"))
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, other)
+
+	changed, unchanged, err = writeSSHClientConfigs(ctx, configs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, changed)
+	assert.Equal(t, 1, unchanged)
+
+	// Removing the certificate authorities removes their known hosts file
+	configs[0].CertAuthorities = nil
+	changed, _, err = writeSSHClientConfigs(ctx, configs, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, changed)
+	assert.NoFileExists(t, filepath.Join(sshKnownHostsDir, sshClientConfigPrefix+"build"))
+
+	// Nothing is written when ssh rejects the drop-in
+	fake.handle = func(c []string) (commandOutput, error) {
+		return commandOutput{stderr: "Bad configuration option"}, assert.AnError
+	}
+	configs[0].Options["ServerAliveInterval"] = "60"
+	_, _, err = writeSSHClientConfigs(ctx, configs, nil)
+	assert.Error(t, err)
+	data, err := os.ReadFile(filepath.Join(sshClientConfigDir, sshClientConfigPrefix+"build.conf"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "ServerAliveInterval 30")
+}
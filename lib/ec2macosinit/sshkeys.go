@@ -1,7 +1,8 @@
 package ec2macosinit
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,37 +11,129 @@ import (
 
 // SSHKeysModule contains all necessary configuration fields for running an SSH Keys module.
 type SSHKeysModule struct {
-	DedupKeys               bool     `toml:"DedupKeys"`
-	GetIMDSOpenSSHKey       bool     `toml:"GetIMDSOpenSSHKey"`
-	StaticOpenSSHKeys       []string `toml:"StaticOpenSSHKeys"`
-	OverwriteAuthorizedKeys bool     `toml:"OverwriteAuthorizedKeys"`
-	User                    string   `toml:"User"`
+	DedupKeys               bool              `toml:"DedupKeys"`
+	GetIMDSOpenSSHKey       bool              `toml:"GetIMDSOpenSSHKey"`
+	StaticOpenSSHKeys       []string          `toml:"StaticOpenSSHKeys"`
+	OverwriteAuthorizedKeys bool              `toml:"OverwriteAuthorizedKeys"`
+	User                    string            `toml:"User"`
+	Users                   []string          `toml:"Users"`                 // Users are also given the keys, along with User
+	SSMParameters           []string          `toml:"SSMParameters"`         // SSMParameters are parameter names holding keys, one per line
+	SecretsManagerSecrets   []string          `toml:"SecretsManagerSecrets"` // SecretsManagerSecrets are secret IDs holding keys, one per line
+	KeyURLs                 []string          `toml:"KeyURLs"`               // KeyURLs are https:// or s3:// locations of keys, one per line
+	KeyURLChecksums         map[string]string `toml:"KeyURLChecksums"`       // KeyURLChecksums maps KeyURLs to the SHA-256 their content must have
+	ManagedKeys             bool              `toml:"ManagedKeys"`           // ManagedKeys replaces the keys written by the last run, leaving other keys alone
 }
 
-// Do for the SSHKeysModule does some brief validation, gets the IMDS key (if configured), appends static keys (if
-// configured), and then writes them to the authorized_keys file for the user.
+// Markers around the keys written in ManagedKeys mode.
+const (
+	managedKeysBegin = "# BEGIN ec2-macos-init managed keys"
+	managedKeysEnd   = "# END ec2-macos-init managed keys"
+)
+
+// maxKeysSize is the largest list of keys downloaded from a URL.
+const maxKeysSize = 1 << 20 // 1 MiB
+
+// Do for the SSHKeysModule does some brief validation, gets the IMDS keys (if configured), appends static keys (if
+// configured), and then writes them to the authorized_keys file for each user.
 func (c *SSHKeysModule) Do(ctx *ModuleContext) (message string, err error) {
 	// If we're not getting the key from IMDS and there are no keys provided, there's nothing to do here
-	if !c.GetIMDSOpenSSHKey && len(c.StaticOpenSSHKeys) == 0 {
+	if !c.GetIMDSOpenSSHKey && len(c.StaticOpenSSHKeys) == 0 && len(c.SSMParameters) == 0 && len(c.SecretsManagerSecrets) == 0 && len(c.KeyURLs) == 0 {
 		return "nothing to do", nil
 	}
 
-	// If user is undefined, default to ec2-user
-	if c.User == "" {
-		c.User = "ec2-user"
+	// Get IMDS keys
+	var keys []string
+	if c.GetIMDSOpenSSHKey {
+		imdsKeys, err := ctx.IMDS.getOpenSSHKeys()
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, imdsKeys...)
+	}
+
+	// Add all provided static keys
+	for _, k := range c.StaticOpenSSHKeys {
+		keys = append(keys, strings.TrimSpace(k))
+	}
+
+	// Get centrally managed keys with the instance profile role
+	for _, name := range c.SSMParameters {
+		value, err := getSSMParameter(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to get keys from SSM parameter %s: %s", name, err)
+		}
+		keys = append(keys, authorizedKeyLines(value)...)
+	}
+	for _, id := range c.SecretsManagerSecrets {
+		value, err := getSecretsManagerSecret(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to get keys from secret %s: %s", id, err)
+		}
+		keys = append(keys, authorizedKeyLines(value)...)
+	}
+	for _, source := range c.KeyURLs {
+		urlKeys, err := c.fetchKeys(ctx, source)
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, urlKeys...)
+	}
+
+	users := c.users()
+	var results []string
+	for _, user := range users {
+		message, err = c.authorizeKeys(ctx, user, keys)
+		if err != nil {
+			return "", err
+		}
+		results = append(results, fmt.Sprintf("%s: %s", user, message))
+	}
+	if len(users) == 1 {
+		return message, nil
+	}
+	return fmt.Sprintf("updated authorized_keys for %d users: [%s]", len(users), strings.Join(results, "; ")), nil
+}
+
+// users returns the users to provision keys for, in order and without duplicates, defaulting to ec2-user.
+func (c *SSHKeysModule) users() (users []string) {
+	seen := map[string]struct{}{}
+	for _, user := range append([]string{c.User}, c.Users...) {
+		if _, ok := seen[user]; ok || user == "" {
+			continue
+		}
+		seen[user] = struct{}{}
+		users = append(users, user)
+	}
+	if len(users) == 0 {
+		users = []string{"ec2-user"}
 	}
+	return users
+}
 
+// authorizeKeys writes the keys to the authorized_keys file for the user. The new file is built in memory and
+// installed with its final mode and ownership in a single rename, so sshd never sees a partial or root owned file.
+func (c *SSHKeysModule) authorizeKeys(ctx *ModuleContext, user string, newKeys []string) (message string, err error) {
 	// Verify that user exists
-	exists, err := userExists(c.User)
+	exists, err := userExists(user)
 	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error while checking if user %s exists: %s\n", c.User, err)
+		return "", fmt.Errorf("ec2macosinit: error while checking if user %s exists: %s\n", user, err)
 	}
 	if !exists { // if the user doesn't exist, error out
-		return "", fmt.Errorf("ec2macosinit: user %s does not exist\n", c.User)
+		return "", fmt.Errorf("ec2macosinit: user %s does not exist\n", user)
+	}
+
+	// Get UID and GID for user
+	uid, gid, err := ctx.getUIDandGID(user)
+	if err != nil && user == "ec2-user" {
+		// Use default values for ec2-user
+		uid = 501
+		gid = 20
+	} else if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error while getting user info: %s\n", err)
 	}
 
 	// Set directory and authorized_keys file
-	authorizedKeysDir := filepath.Join("/Users", c.User, ".ssh")
+	authorizedKeysDir := filepath.Join("/Users", user, ".ssh")
 	authorizedKeysFile := filepath.Join(authorizedKeysDir, "authorized_keys")
 	if _, err := os.Stat(authorizedKeysDir); os.IsNotExist(err) { // If directory doesn't exist, create it
 		err := os.MkdirAll(authorizedKeysDir, 0700)
@@ -48,98 +141,177 @@ func (c *SSHKeysModule) Do(ctx *ModuleContext) (message string, err error) {
 			return "", fmt.Errorf("ec2macosinit: unable to create directory [%s]: %s\n", authorizedKeysDir, err)
 		}
 	}
+	err = os.Chown(authorizedKeysDir, uid, gid)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to change ownership of .ssh directory: %s\n", err)
+	}
 
-	// Get IMDS key
-	keySet := map[string]struct{}{}
-	if c.GetIMDSOpenSSHKey {
-		// Get IMDS property "meta-data/public-keys/0/openssh-key"
-		imdsKey, respCode, err := ctx.IMDS.getIMDSProperty("meta-data/public-keys/0/openssh-key")
-		if err != nil {
-			return "", fmt.Errorf("ec2macosinit: error getting openSSH key from IMDS: %s\n", err)
-		}
-		if respCode == 200 { // 200 = ok
-			keySet[strings.TrimSpace(imdsKey)] = struct{}{}
-		} else if respCode != 404 { // 404 is the only other allowable response code as it indicates no key was provided - if not 404 error out
-			return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d - %s\n", respCode, err)
-		}
+	// Read the current keys, which are kept unless overwriting
+	current, err := os.ReadFile(authorizedKeysFile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("ec2macosinit: unable to read %s: %s\n", authorizedKeysFile, err)
 	}
 
-	// Add all unique provided static keys
-	if len(c.StaticOpenSSHKeys) > 0 {
-		for _, k := range c.StaticOpenSSHKeys {
-			keySet[strings.TrimSpace(k)] = struct{}{}
+	var content string
+	var count int
+	if c.ManagedKeys {
+		content, count = managedKeysContent(string(current), newKeys)
+	} else {
+		if len(newKeys) == 0 && !c.OverwriteAuthorizedKeys && !c.DedupKeys {
+			return "no keys found and not overwriting authorized_keys", nil
 		}
+		content, count = authorizedKeysContent(string(current), newKeys, c.OverwriteAuthorizedKeys, c.DedupKeys)
 	}
 
-	// If authorized_keys file exists and deduplication is requested, read file and add to set
-	if _, err := os.Stat(authorizedKeysFile); err == nil && c.DedupKeys {
-		file, err := os.Open(authorizedKeysFile)
-		if err != nil {
-			return "", fmt.Errorf("ec2macosinit: unable to open %s: %s\n", authorizedKeysFile, err)
-		}
-		defer file.Close()
+	err = safeWriteFile(authorizedKeysFile, []byte(content), 0600, uid, gid)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: error while writing authorized_keys file: %s\n", err)
+	}
 
-		// Read file and add each line to set
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			keySet[strings.TrimSpace(scanner.Text())] = struct{}{}
-		}
-		if err := scanner.Err(); err != nil {
-			return "", fmt.Errorf("ec2macosinit: error while reading %s: %s\n", authorizedKeysFile, err)
-		}
+	return fmt.Sprintf("successfully added %d keys to authorized_users", count), nil
+}
 
-		// Set OverwriteAuthorizedKeys to true so that duplicate keys are overwritten
-		c.OverwriteAuthorizedKeys = true
+// authorizedKeysContent returns the new content of an authorized_keys file and the number of keys added to it. The new
+// keys are appended to the current content, or replace it when overwriting. When deduplicating, the current keys are
+// kept and every key appears once, in the order first seen.
+func authorizedKeysContent(current string, keys []string, overwrite, dedup bool) (content string, count int) {
+	if dedup {
+		var unique []string
+		seen := map[string]struct{}{}
+		for _, k := range append(strings.Split(current, "\n"), keys...) {
+			k = strings.TrimSpace(k)
+			if _, ok := seen[k]; ok || k == "" {
+				continue
+			}
+			seen[k] = struct{}{}
+			unique = append(unique, k)
+		}
+		keys, current, overwrite = unique, "", true
+	}
+	if overwrite {
+		current = ""
+	}
+	if current != "" && !strings.HasSuffix(current, "\n") {
+		current += "\n"
+	}
+	if len(keys) == 0 {
+		return current, 0
 	}
+	return current + strings.Join(keys, "\n") + "\n", len(keys)
+}
 
-	// Check if there's anything else to do
-	if len(keySet) == 0 && !c.OverwriteAuthorizedKeys {
-		return "no keys found and not overwriting authorized_keys", nil
+// managedKeysContent returns the new content of an authorized_keys file with the managed block replaced by the keys,
+// and the number of keys in it. Keys outside of the block, such as those added by users, are kept as they are. Keys
+// which are no longer provided are removed, so revoked keys stop working when the keys are refreshed.
+func managedKeysContent(current string, keys []string) (content string, count int) {
+	var kept []string
+	inBlock := false
+	for _, line := range strings.Split(strings.TrimSuffix(current, "\n"), "\n") {
+		switch {
+		case line == managedKeysBegin:
+			inBlock = true
+		case line == managedKeysEnd:
+			inBlock = false
+		case !inBlock && (line != "" || len(kept) > 0):
+			kept = append(kept, line)
+		}
 	}
 
-	// Add all keys to a slice
-	var keys []string
-	for k := range keySet {
-		keys = append(keys, k)
+	var b strings.Builder
+	if len(kept) > 0 {
+		b.WriteString(strings.Join(kept, "\n") + "\n")
 	}
+	b.WriteString(managedKeysBegin + "\n")
+	seen := map[string]struct{}{}
+	for _, k := range keys {
+		if _, ok := seen[k]; ok || k == "" {
+			continue
+		}
+		seen[k] = struct{}{}
+		b.WriteString(k + "\n")
+	}
+	b.WriteString(managedKeysEnd + "\n")
+	return b.String(), len(seen)
+}
 
-	// Write to authorized_keys file
-	var f *os.File
-	if !c.OverwriteAuthorizedKeys {
-		// Append to authorized_keys
-		f, err = os.OpenFile(authorizedKeysFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-	} else {
-		// Overwrite (truncate) authorized_keys
-		f, err = os.OpenFile(authorizedKeysFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+// fetchKeys downloads keys from an https:// URL, such as https://github.com/<user>.keys, or an s3:// URI. The download
+// must be no larger than maxKeysSize and, when a checksum is configured for the URL, match it.
+func (c *SSHKeysModule) fetchKeys(ctx *ModuleContext, source string) (keys []string, err error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "s3://") {
+		return nil, fmt.Errorf("ec2macosinit: key URL %s must be an https:// URL or s3:// URI", source)
 	}
+	data, err := fetchSource(ctx, source)
 	if err != nil {
-		f.Close()
-		return "", fmt.Errorf("ec2macosinit: error while opening authorized_keys file: %s\n", err)
+		return nil, err
 	}
-	if _, err := f.WriteString(strings.Join(keys, "\n") + "\n"); err != nil {
-		return "", fmt.Errorf("ec2macosinit: error while writing to authorized_keys file: %s\n", err)
+	err = c.verifyKeys(source, data)
+	if err != nil {
+		return nil, err
 	}
-	f.Close()
+	return authorizedKeyLines(string(data)), nil
+}
 
-	// Get UID and GID for user
-	uid, gid, err := getUIDandGID(c.User)
-	if err != nil && c.User == "ec2-user" {
-		// Use default values for ec2-user
-		uid = 501
-		gid = 20
-	} else if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error while getting user info: %s\n", err)
+// verifyKeys checks the size of keys downloaded from a URL and, when a checksum is configured for it, their checksum.
+func (c *SSHKeysModule) verifyKeys(source string, data []byte) (err error) {
+	if len(data) > maxKeysSize {
+		return fmt.Errorf("ec2macosinit: keys from %s exceed the maximum size of %d bytes", source, maxKeysSize)
+	}
+	if want, ok := c.KeyURLChecksums[source]; ok {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, strings.TrimSpace(want)) {
+			return fmt.Errorf("ec2macosinit: keys from %s have SHA-256 %s, expected %s", source, got, want)
+		}
 	}
+	return nil
+}
 
-	// Fix file ownership and directory permissions
-	err = os.Chown(authorizedKeysDir, uid, gid)
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: unable to change ownership of .ssh directory: %s\n", err)
+// authorizedKeyLines returns the keys in authorized_keys formatted text, one per line. Blank lines and comments are
+// ignored.
+func authorizedKeyLines(text string) (keys []string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
 	}
-	err = os.Chown(authorizedKeysFile, uid, gid)
+	return keys
+}
+
+// publicKeysEndpoint is the IMDS path listing the public keys provided at launch, one per line as index=name.
+const publicKeysEndpoint = "meta-data/public-keys/"
+
+// getOpenSSHKeys gets every OpenSSH public key provided at launch from IMDS, in index order. No keys is not an error.
+func (i *IMDSConfig) getOpenSSHKeys() (keys []string, err error) {
+	listing, respCode, err := i.getIMDSProperty(publicKeysEndpoint)
 	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: unable to change ownership of authorized_keys file: %s\n", err)
+		return nil, fmt.Errorf("ec2macosinit: error getting public keys from IMDS: %s\n", err)
+	}
+	if respCode == 404 { // 404 = no keys were provided
+		return nil, nil
+	}
+	if respCode != 200 {
+		return nil, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d\n", respCode)
 	}
 
-	return fmt.Sprintf("successfully added %d keys to authorized_users", len(keys)), nil
+	for _, line := range strings.Split(listing, "\n") {
+		index := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+		if index == "" {
+			continue
+		}
+		key, respCode, err := i.getIMDSProperty(publicKeysEndpoint + index + "/openssh-key")
+		if err != nil {
+			return nil, fmt.Errorf("ec2macosinit: error getting openSSH key %s from IMDS: %s\n", index, err)
+		}
+		if respCode == 404 { // 404 = the key isn't an OpenSSH key
+			continue
+		}
+		if respCode != 200 {
+			return nil, fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS for key %s: %d\n", index, respCode)
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
 }
@@ -0,0 +1,87 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIMDSConfig_getOpenSSHKeys(t *testing.T) {
+	i, _ := newTestIMDS(t, map[string]string{
+		"meta-data/public-keys/":              "0=launch-key\n1=ci-key",
+		"meta-data/public-keys/0/openssh-key": "ssh-ed25519 AAAAlaunch launch-key\n",
+		"meta-data/public-keys/1/openssh-key": "ssh-rsa AAAAci ci-key",
+	})
+	keys, err := i.getOpenSSHKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 AAAAlaunch launch-key", "ssh-rsa AAAAci ci-key"}, keys)
+
+	// Instances launched without a key pair have no keys
+	i, _ = newTestIMDS(t, map[string]string{})
+	keys, err = i.getOpenSSHKeys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestSSHKeysModule_users(t *testing.T) {
+	assert.Equal(t, []string{"ec2-user"}, (&SSHKeysModule{}).users())
+	assert.Equal(t, []string{"admin"}, (&SSHKeysModule{User: "admin"}).users())
+	assert.Equal(t, []string{"ec2-user", "admin", "ci"}, (&SSHKeysModule{User: "ec2-user", Users: []string{"admin", "ec2-user", "ci"}}).users())
+	assert.Equal(t, []string{"admin", "ci"}, (&SSHKeysModule{Users: []string{"admin", "ci"}}).users())
+}
+
+func Test_authorizedKeyLines(t *testing.T) {
+	keys := authorizedKeyLines("# fleet access\nssh-ed25519 AAAAone one\r\n\nssh-rsa AAAAtwo two\n")
+	assert.Equal(t, []string{"ssh-ed25519 AAAAone one", "ssh-rsa AAAAtwo two"}, keys)
+}
+
+func TestSSHKeysModule_verifyKeys(t *testing.T) {
+	const source = "https://example.com/keys"
+	data := []byte("ssh-ed25519 AAAAone one\n")
+	c := &SSHKeysModule{KeyURLChecksums: map[string]string{
+		source: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}}
+	assert.Error(t, c.verifyKeys(source, data), "checksum doesn't match")
+	assert.NoError(t, c.verifyKeys(source, nil))
+	assert.NoError(t, c.verifyKeys("s3://bucket/keys", data), "no checksum configured")
+	assert.Error(t, c.verifyKeys("s3://bucket/keys", make([]byte, maxKeysSize+1)))
+
+	_, err := c.fetchKeys(&ModuleContext{}, "http://example.com/keys")
+	assert.EqualError(t, err, "ec2macosinit: key URL http://example.com/keys must be an https:// URL or s3:// URI")
+}
+
+func Test_authorizedKeysContent(t *testing.T) {
+	const current = "ssh-rsa AAAAold old\nssh-ed25519 AAAAone one"
+	keys := []string{"ssh-ed25519 AAAAone one", "ssh-rsa AAAAtwo two"}
+
+	content, count := authorizedKeysContent(current, keys, false, false)
+	assert.Equal(t, "ssh-rsa AAAAold old\nssh-ed25519 AAAAone one\nssh-ed25519 AAAAone one\nssh-rsa AAAAtwo two\n", content)
+	assert.Equal(t, 2, count)
+
+	content, _ = authorizedKeysContent(current, keys, true, false)
+	assert.Equal(t, "ssh-ed25519 AAAAone one\nssh-rsa AAAAtwo two\n", content)
+
+	content, count = authorizedKeysContent(current, keys, false, true)
+	assert.Equal(t, "ssh-rsa AAAAold old\nssh-ed25519 AAAAone one\nssh-rsa AAAAtwo two\n", content)
+	assert.Equal(t, 3, count)
+
+	content, count = authorizedKeysContent(current, nil, true, false)
+	assert.Equal(t, "", content)
+	assert.Equal(t, 0, count)
+}
+
+func Test_managedKeysContent(t *testing.T) {
+	// The first run adds the block after the user's keys
+	content, count := managedKeysContent("ssh-rsa AAAAuser user\n", []string{"ssh-ed25519 AAAAone one", "ssh-rsa AAAAtwo two", "ssh-rsa AAAAtwo two"})
+	assert.Equal(t, "ssh-rsa AAAAuser user\n"+managedKeysBegin+"\nssh-ed25519 AAAAone one\nssh-rsa AAAAtwo two\n"+managedKeysEnd+"\n", content)
+	assert.Equal(t, 2, count)
+
+	// Later runs replace the block, removing revoked keys, and keep keys added after it
+	content, count = managedKeysContent(content+"ssh-rsa AAAAlater later\n", []string{"ssh-rsa AAAAtwo two"})
+	assert.Equal(t, "ssh-rsa AAAAuser user\nssh-rsa AAAAlater later\n"+managedKeysBegin+"\nssh-rsa AAAAtwo two\n"+managedKeysEnd+"\n", content)
+	assert.Equal(t, 1, count)
+
+	content, count = managedKeysContent("", nil)
+	assert.Equal(t, managedKeysBegin+"\n"+managedKeysEnd+"\n", content)
+	assert.Equal(t, 0, count)
+}
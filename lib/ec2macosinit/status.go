@@ -0,0 +1,224 @@
+package ec2macosinit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultStatusSocket is the unix socket the status server listens on when none is configured.
+const DefaultStatusSocket = "/var/run/ec2-macos-init.sock"
+
+// Run states reported by the status server.
+const (
+	StatusRunning     = "running"     // StatusRunning is reported while a run is in progress
+	StatusComplete    = "complete"    // StatusComplete is reported once a run has finished
+	StatusInterrupted = "interrupted" // StatusInterrupted is reported when a run exited without finishing
+	StatusUnknown     = "unknown"     // StatusUnknown is reported when no run has recorded its status yet
+)
+
+// StatusConfig configures the status server run by the daemon, which reports the state of the current or last run.
+type StatusConfig struct {
+	Enabled     bool   `toml:"Enabled"`     // Enabled records the status of runs and starts the status server
+	Socket      string `toml:"Socket"`      // Socket is the unix socket to listen on, defaults to DefaultStatusSocket
+	HTTPAddress string `toml:"HTTPAddress"` // HTTPAddress is an optional loopback address, such as 127.0.0.1:8990
+}
+
+// RunStatus is the state of the current or last run, as reported by the status server.
+type RunStatus struct {
+	State          string      `json:"state"`
+	PID            int         `json:"pid,omitempty"`
+	RunID          string      `json:"runID,omitempty"`
+	InstanceID     string      `json:"instanceID,omitempty"`
+	StartTime      time.Time   `json:"startTime,omitempty"`
+	EndTime        time.Time   `json:"endTime,omitempty"`
+	RunningModules []string    `json:"runningModules"`
+	Result         string      `json:"result,omitempty"`
+	Summary        *RunSummary `json:"summary,omitempty"`
+}
+
+// runStatus is the status of the run in progress, written to the status file as it changes.
+type runStatus struct {
+	mu      sync.Mutex
+	status  RunStatus
+	running map[string]struct{}
+}
+
+// StatusStarted records that a run has started. Nothing is recorded unless the status server is enabled.
+func (c *InitConfig) StatusStarted(runID string) {
+	if !c.Status.Enabled {
+		return
+	}
+	c.runStatus = &runStatus{
+		status:  RunStatus{State: StatusRunning, PID: os.Getpid(), RunID: runID, StartTime: time.Now()},
+		running: map[string]struct{}{},
+	}
+	c.writeStatus()
+}
+
+// ModuleStarted records that a module has started running.
+func (c *InitConfig) ModuleStarted(name string) {
+	if c.runStatus == nil {
+		return
+	}
+	c.runStatus.mu.Lock()
+	c.runStatus.running[name] = struct{}{}
+	c.runStatus.mu.Unlock()
+	c.writeStatus()
+}
+
+// ModuleFinished records that a module has finished running.
+func (c *InitConfig) ModuleFinished(name string) {
+	if c.runStatus == nil {
+		return
+	}
+	c.runStatus.mu.Lock()
+	delete(c.runStatus.running, name)
+	c.runStatus.mu.Unlock()
+	c.writeStatus()
+}
+
+// StatusFinished records the summary of a finished run.
+func (c *InitConfig) StatusFinished(s RunSummary) {
+	if c.runStatus == nil {
+		return
+	}
+	c.runStatus.mu.Lock()
+	c.runStatus.status.State = StatusComplete
+	c.runStatus.status.EndTime = time.Now()
+	c.runStatus.status.Result = s.Result()
+	c.runStatus.status.Summary = &s
+	c.runStatus.running = map[string]struct{}{}
+	c.runStatus.mu.Unlock()
+	c.writeStatus()
+}
+
+// writeStatus writes the status of the run to the status file. Failing to do so is logged but doesn't affect the run.
+func (c *InitConfig) writeStatus() {
+	c.runStatus.mu.Lock()
+	defer c.runStatus.mu.Unlock()
+	c.runStatus.status.InstanceID = c.IMDS.InstanceID
+	c.runStatus.status.RunningModules = []string{}
+	for name := range c.runStatus.running {
+		c.runStatus.status.RunningModules = append(c.runStatus.status.RunningModules, name)
+	}
+	sort.Strings(c.runStatus.status.RunningModules)
+
+	data, err := json.Marshal(c.runStatus.status)
+	if err == nil {
+		err = safeWriteFile(c.StatusFile, data, 0600, -1, -1)
+	}
+	if err != nil {
+		c.Log.Warnf("Unable to write run status to %s: %s", c.StatusFile, err)
+	}
+}
+
+// ReadRunStatus reads the status of the current or last run from the status file. A run which is still marked as
+// running but whose process has exited is reported as interrupted.
+func ReadRunStatus(path string) (s RunStatus, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return RunStatus{State: StatusUnknown, RunningModules: []string{}}, nil
+	}
+	if err != nil {
+		return RunStatus{}, fmt.Errorf("ec2macosinit: unable to read run status: %s", err)
+	}
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return RunStatus{}, fmt.Errorf("ec2macosinit: invalid run status in %s: %s", path, err)
+	}
+	if s.State == StatusRunning && !processRunning(s.PID) {
+		s.State = StatusInterrupted
+		s.RunningModules = []string{}
+	}
+	return s, nil
+}
+
+// processRunning returns whether a process with the PID exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// statusHandler serves the run status read from the status file as JSON.
+func statusHandler(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path != "/" && r.URL.Path != "/status" {
+			http.NotFound(w, r)
+			return
+		}
+		s, err := ReadRunStatus(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	})
+}
+
+// ServeStatus starts the status server on the configured unix socket, which is only accessible by root, and on the
+// HTTP address if one is configured. The returned function stops the servers.
+func (c *InitConfig) ServeStatus() (stop func(), err error) {
+	socket := c.Status.Socket
+	if socket == "" {
+		socket = DefaultStatusSocket
+	}
+
+	// A socket left by a daemon which didn't exit cleanly stops the new one from listening
+	err = os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ec2macosinit: unable to remove stale status socket %s: %s", socket, err)
+	}
+	listeners := []net.Listener{}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to listen on status socket %s: %s", socket, err)
+	}
+	listeners = append(listeners, l)
+	err = os.Chmod(socket, 0600)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("ec2macosinit: unable to set permissions of status socket %s: %s", socket, err)
+	}
+
+	if c.Status.HTTPAddress != "" {
+		host, _, err := net.SplitHostPort(c.Status.HTTPAddress)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() {
+			l.Close()
+			return nil, fmt.Errorf("ec2macosinit: status HTTP address %s must be a loopback address and port", c.Status.HTTPAddress)
+		}
+		h, err := net.Listen("tcp", c.Status.HTTPAddress)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("ec2macosinit: unable to listen on %s: %s", c.Status.HTTPAddress, err)
+		}
+		listeners = append(listeners, h)
+	}
+
+	server := &http.Server{Handler: statusHandler(c.StatusFile), ReadHeaderTimeout: 10 * time.Second}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			_ = server.Serve(l)
+		}(l)
+	}
+	return func() {
+		server.Close()
+		os.Remove(socket)
+	}, nil
+}
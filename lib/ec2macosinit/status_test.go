@@ -0,0 +1,88 @@
+package ec2macosinit
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitConfig_StatusFile(t *testing.T) {
+	dir := t.TempDir()
+	c := &InitConfig{Log: &Logger{}, StatusFile: filepath.Join(dir, "status.json"), IMDS: IMDSConfig{InstanceID: "i-0123456789abcdef0"}}
+
+	// Nothing is recorded unless the status server is enabled
+	c.StatusStarted("run")
+	c.ModuleStarted("Hello")
+	s, err := ReadRunStatus(c.StatusFile)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusUnknown, s.State)
+
+	c.Status.Enabled = true
+	c.StatusStarted("run")
+	c.ModuleStarted("Hello")
+	c.ModuleStarted("Goodbye")
+	c.ModuleFinished("Hello")
+	s, err = ReadRunStatus(c.StatusFile)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRunning, s.State)
+	assert.Equal(t, "run", s.RunID)
+	assert.Equal(t, "i-0123456789abcdef0", s.InstanceID)
+	assert.Equal(t, []string{"Goodbye"}, s.RunningModules)
+
+	c.StatusFinished(RunSummary{Total: 2, Succeeded: 2})
+	s, err = ReadRunStatus(c.StatusFile)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusComplete, s.State)
+	assert.Equal(t, "success", s.Result)
+	assert.Equal(t, 2, s.Summary.Succeeded)
+	assert.Empty(t, s.RunningModules)
+
+	// A run whose process has gone away was interrupted
+	require.NoError(t, os.WriteFile(c.StatusFile, []byte(`{"state": "running", "pid": -1, "runningModules": ["Hello"]}`), 0600))
+	s, err = ReadRunStatus(c.StatusFile)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusInterrupted, s.State)
+	assert.Empty(t, s.RunningModules)
+}
+
+func TestInitConfig_ServeStatus(t *testing.T) {
+	// Unix socket paths are limited in length, so the socket can't be in the test's temporary directory
+	dir, err := os.MkdirTemp("/tmp", "status")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "s.sock")
+
+	c := &InitConfig{Log: &Logger{}, StatusFile: filepath.Join(dir, "status.json"), Status: StatusConfig{Enabled: true, Socket: socket}}
+	c.StatusStarted("run")
+	stop, err := c.ServeStatus()
+	require.NoError(t, err)
+	defer stop()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	resp, err := client.Get("http://localhost/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var s RunStatus
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	assert.Equal(t, StatusRunning, s.State)
+	assert.Equal(t, "run", s.RunID)
+
+	// Only loopback HTTP addresses are allowed
+	stop()
+	c.Status.HTTPAddress = "0.0.0.0:8990"
+	_, err = c.ServeStatus()
+	assert.Error(t, err)
+}
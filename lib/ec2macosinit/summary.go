@@ -0,0 +1,98 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RunSummary is the overall outcome of a run.
+type RunSummary struct {
+	InstanceID    string
+	Total         int             // Total is the number of configured modules
+	Succeeded     int             // Succeeded is the number of modules which ran successfully
+	Skipped       int             // Skipped is the number of modules skipped due to their Run type setting
+	Failed        int             // Failed is the number of modules which returned an error
+	Ignored       int             // Ignored is the number of modules which returned an error with ContinueOnError set
+	NotRun        int             // NotRun is the number of modules in groups after a fatal error
+	FailedModules []string        // FailedModules are the names of the modules which returned an error
+	Failures      []ModuleFailure // Failures are the details of every module which returned an error, including ignored ones
+	FatalModule   string          // FatalModule is the module which stopped the run, if any
+	Duration      time.Duration   // Duration is the total run time
+}
+
+// ModuleFailure is the error returned by a single module.
+type ModuleFailure struct {
+	Name    string
+	Group   int
+	Error   string
+	Ignored bool // Ignored is true when the module has ContinueOnError set
+}
+
+// String formats the failure for logging.
+func (f ModuleFailure) String() string {
+	s := fmt.Sprintf("[%s] (group: %d): %s", f.Name, f.Group, f.Error)
+	if f.Ignored {
+		s += " (ignored)"
+	}
+	return s
+}
+
+// Summarize counts the outcome of every module in ModulesByPriority.
+func (c *InitConfig) Summarize(duration time.Duration, fatalModule string) (s RunSummary) {
+	s = RunSummary{InstanceID: c.IMDS.InstanceID, FatalModule: fatalModule, Duration: duration}
+	for _, group := range c.ModulesByPriority {
+		for _, m := range group {
+			s.Total++
+			switch {
+			case m.Skipped:
+				s.Skipped++
+			case m.Success:
+				s.Succeeded++
+			case m.StartTime.IsZero():
+				s.NotRun++
+			case m.ContinueOnError:
+				s.Ignored++
+				s.Failures = append(s.Failures, ModuleFailure{Name: m.Name, Group: m.PriorityGroup, Error: m.Error, Ignored: true})
+			default:
+				s.Failed++
+				s.FailedModules = append(s.FailedModules, m.Name)
+				s.Failures = append(s.Failures, ModuleFailure{Name: m.Name, Group: m.PriorityGroup, Error: m.Error})
+			}
+		}
+	}
+	return s
+}
+
+// Result returns "success", "failed" when a module failed without stopping the run, or "fatal".
+func (s RunSummary) Result() string {
+	switch {
+	case s.FatalModule != "":
+		return "fatal"
+	case s.Failed > 0:
+		return "failed"
+	}
+	return "success"
+}
+
+// String formats the summary as a single line of key=value pairs so that it can be found with a single grep.
+func (s RunSummary) String() string {
+	fields := []string{
+		"result=" + s.Result(),
+		"instance=" + s.InstanceID,
+		fmt.Sprintf("modules=%d", s.Total),
+		fmt.Sprintf("succeeded=%d", s.Succeeded),
+		fmt.Sprintf("skipped=%d", s.Skipped),
+		fmt.Sprintf("failed=%d", s.Failed),
+		fmt.Sprintf("ignored=%d", s.Ignored),
+		fmt.Sprintf("not_run=%d", s.NotRun),
+		"duration=" + s.Duration.Round(time.Millisecond).String(),
+	}
+	if len(s.FailedModules) > 0 {
+		fields = append(fields, fmt.Sprintf("failed_modules=%q", strings.Join(s.FailedModules, ",")))
+	}
+	if s.FatalModule != "" {
+		fields = append(fields, fmt.Sprintf("fatal_module=%q", s.FatalModule))
+	}
+	return "Run summary: " + strings.Join(fields, " ")
+}
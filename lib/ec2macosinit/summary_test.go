@@ -0,0 +1,46 @@
+package ec2macosinit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitConfig_Summarize(t *testing.T) {
+	started := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &InitConfig{
+		ModulesByPriority: [][]Module{
+			{
+				{Name: "ok", Success: true, StartTime: started},
+				{Name: "skipped", Success: true, Skipped: true},
+				{Name: "broken", PriorityGroup: 1, StartTime: started, Error: "exit status 1"},
+				{Name: "optional", PriorityGroup: 1, StartTime: started, ContinueOnError: true, Error: "timed out"},
+			},
+			{
+				{Name: "later"},
+			},
+		},
+	}
+	c.IMDS.InstanceID = "i-0123456789abcdef0"
+
+	s := c.Summarize(1500*time.Millisecond, "broken")
+	assert.Equal(t, RunSummary{
+		InstanceID:    "i-0123456789abcdef0",
+		Total:         5,
+		Succeeded:     1,
+		Skipped:       1,
+		Failed:        1,
+		Ignored:       1,
+		NotRun:        1,
+		FailedModules: []string{"broken"},
+		Failures: []ModuleFailure{
+			{Name: "broken", Group: 1, Error: "exit status 1"},
+			{Name: "optional", Group: 1, Error: "timed out", Ignored: true},
+		},
+		FatalModule: "broken",
+		Duration:    1500 * time.Millisecond,
+	}, s)
+	assert.Equal(t, `Run summary: result=fatal instance=i-0123456789abcdef0 modules=5 succeeded=1 skipped=1 failed=1 ignored=1 not_run=1 duration=1.5s failed_modules="broken" fatal_module="broken"`, s.String())
+	assert.Equal(t, "[optional] (group: 1): timed out (ignored)", s.Failures[1].String())
+}
@@ -0,0 +1,112 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// SysctlJobLabel is the label of the launchd job which sets persisted sysctl values on every boot.
+const SysctlJobLabel = "com.amazon.ec2.macos-init.sysctl"
+
+// sysctlPath is the sysctl command run by the job which sets persisted values.
+const sysctlPath = "/usr/sbin/sysctl"
+
+// sysctlValue converts the desired value of a sysctl into the raw form used to set it, and reports whether the current
+// raw value already matches. The type of a sysctl isn't known from its name, so a desired value which is an integer is
+// treated as one when the current value is 4 or 8 bytes long, and anything else is treated as a string. Both
+// architectures supported by macOS are little endian.
+func sysctlValue(current []byte, desired string) (raw []byte, matches bool) {
+	if n, ok := parseSysctlInt(desired); ok && (len(current) == 4 || len(current) == 8) {
+		raw = make([]byte, len(current))
+		if len(current) == 4 {
+			binary.LittleEndian.PutUint32(raw, uint32(n))
+		} else {
+			binary.LittleEndian.PutUint64(raw, n)
+		}
+		return raw, bytes.Equal(current, raw)
+	}
+
+	// Strings are read with a terminating NUL but set without one
+	return []byte(desired), string(bytes.TrimRight(current, "\x00")) == desired
+}
+
+// parseSysctlInt parses a signed or unsigned integer value into its two's complement bits.
+func parseSysctlInt(s string) (n uint64, ok bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return uint64(i), true
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return u, true
+	}
+	return 0, false
+}
+
+// sysctlJob returns the launchd job which sets the values with sysctl when it's loaded at boot.
+func sysctlJob(values []string) (job map[string]interface{}) {
+	args := []interface{}{sysctlPath, "-w"}
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return map[string]interface{}{
+		"Label":            SysctlJobLabel,
+		"ProgramArguments": args,
+		"RunAtLoad":        true,
+		"UserName":         "root",
+	}
+}
+
+// persistSysctls makes sure that the job in the plist at path sets exactly the given values on every boot, so that they
+// survive reboots even if the module is no longer run. The job is replaced and reloaded when the values change, and the
+// plist is read back to verify it. A module without any persisted values leaves the job alone, since it's shared, so
+// the values are those of the last module which persisted any.
+func persistSysctls(ctx *ModuleContext, values []string, path string, backups *fileBackups) (changed bool, err error) {
+	if len(values) == 0 {
+		return false, nil
+	}
+	for _, v := range values {
+		if len(strings.SplitN(v, "=", 2)) != 2 {
+			return false, fmt.Errorf("ec2macosinit: unable to split input sysctl value: %s", v)
+		}
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("ec2macosinit: unable to read %s: %s", path, err)
+	}
+	want, err := plist.MarshalIndent(sysctlJob(values), plist.XMLFormat, "\t")
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to encode launchd plist: %s", err)
+	}
+	if bytes.Equal(current, want) {
+		return false, nil
+	}
+
+	err = backups.save(path)
+	if err != nil {
+		return false, err
+	}
+	err = safeWriteFile(path, want, 0644, 0, 0)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: unable to write launchd plist %s: %s", path, err)
+	}
+	// Validate the persisted values
+	written, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(written, want) {
+		return true, fmt.Errorf("ec2macosinit: verification failed, %s doesn't contain the persisted sysctl values", path)
+	}
+
+	// Reload the job so that launchd has the new values, which also sets them again now
+	_, _ = ctx.executeCommand([]string{"/bin/launchctl", "bootout", "system/" + SysctlJobLabel}, "", []string{})
+	out, err := ctx.executeCommand([]string{"/bin/launchctl", "bootstrap", "system", path}, "", []string{})
+	if err != nil {
+		return true, fmt.Errorf("ec2macosinit: unable to load %s: %s: %s", path, err, strings.TrimSpace(out.stderr))
+	}
+	return true, nil
+}
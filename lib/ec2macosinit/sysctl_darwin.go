@@ -0,0 +1,26 @@
+package ec2macosinit
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysctlRead reads the raw value of a sysctl.
+func sysctlRead(name string) (raw []byte, err error) {
+	return unix.SysctlRaw(name)
+}
+
+// sysctlString reads the value of a string sysctl.
+func sysctlString(name string) (value string, err error) {
+	return unix.Sysctl(name)
+}
+
+// getBootTime gets the time of the current boot from kern.boottime.
+func getBootTime() (bootTime int64, err error) {
+	tv, err := unix.SysctlTimeval("kern.boottime")
+	if err != nil {
+		return 0, fmt.Errorf("ec2macosinit: unable to get boot time: %s", err)
+	}
+	return tv.Sec, nil
+}
@@ -0,0 +1,20 @@
+//go:build !darwin
+
+package ec2macosinit
+
+import "fmt"
+
+// sysctlRead is only available on macOS.
+func sysctlRead(name string) (raw []byte, err error) {
+	return nil, fmt.Errorf("ec2macosinit: sysctl is not available on this platform")
+}
+
+// sysctlString is only available on macOS.
+func sysctlString(name string) (value string, err error) {
+	return "", fmt.Errorf("ec2macosinit: sysctl is not available on this platform")
+}
+
+// getBootTime is only available on macOS.
+func getBootTime() (bootTime int64, err error) {
+	return 0, fmt.Errorf("ec2macosinit: unable to get boot time: sysctl is not available on this platform")
+}
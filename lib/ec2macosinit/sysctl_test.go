@@ -0,0 +1,118 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"howett.net/plist"
+)
+
+func Test_sysctlValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     []byte
+		desired     string
+		wantRaw     []byte
+		wantMatches bool
+	}{
+		{
+			name:        "int matches",
+			current:     []byte{0x00, 0x04, 0x00, 0x00},
+			desired:     "1024",
+			wantRaw:     []byte{0x00, 0x04, 0x00, 0x00},
+			wantMatches: true,
+		},
+		{
+			name:    "int differs",
+			current: []byte{0x00, 0x04, 0x00, 0x00},
+			desired: "2048",
+			wantRaw: []byte{0x00, 0x08, 0x00, 0x00},
+		},
+		{
+			name:    "negative int",
+			current: []byte{0x00, 0x00, 0x00, 0x00},
+			desired: "-1",
+			wantRaw: []byte{0xff, 0xff, 0xff, 0xff},
+		},
+		{
+			name:    "quad",
+			current: []byte{0, 0, 0, 0, 0, 0, 0, 0},
+			desired: "4294967296",
+			wantRaw: []byte{0, 0, 0, 0, 1, 0, 0, 0},
+		},
+		{
+			name:        "string matches",
+			current:     []byte("enabled\x00"),
+			desired:     "enabled",
+			wantRaw:     []byte("enabled"),
+			wantMatches: true,
+		},
+		{
+			name:    "number for a string",
+			current: []byte("1.2.3\x00"),
+			desired: "2",
+			wantRaw: []byte("2"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, matches := sysctlValue(tt.current, tt.desired)
+			assert.Equal(t, tt.wantRaw, raw)
+			assert.Equal(t, tt.wantMatches, matches)
+		})
+	}
+}
+
+func Test_persistSysctls(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("launchd plists are owned by root")
+	}
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{}, nil
+	}}
+	ctx := &ModuleContext{executor: fake}
+	path := filepath.Join(t.TempDir(), SysctlJobLabel+".plist")
+
+	// Nothing is written when no values are persisted
+	changed, err := persistSysctls(ctx, nil, path, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.NoFileExists(t, path)
+
+	changed, err = persistSysctls(ctx, []string{"kern.maxfiles=65536", "net.inet.tcp.delayed_ack=0"}, path, nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var job interface{}
+	_, err = plist.Unmarshal(data, &job)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"/usr/sbin/sysctl", "-w", "kern.maxfiles=65536", "net.inet.tcp.delayed_ack=0"}, job.(map[string]interface{})["ProgramArguments"])
+	assert.Equal(t, []string{
+		"/bin/launchctl bootout system/" + SysctlJobLabel,
+		"/bin/launchctl bootstrap system " + path,
+	}, fake.commands)
+
+	// The job is left alone when the values haven't changed, without creating a backup set
+	fake.commands = nil
+	baseDir := t.TempDir()
+	changed, err = persistSysctls(ctx, []string{"kern.maxfiles=65536", "net.inet.tcp.delayed_ack=0"}, path, newFileBackups(baseDir, "systemconfig"))
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, fake.commands)
+	assert.NoDirExists(t, paths.ModuleBackups(baseDir, "systemconfig"))
+
+	// A module without persisted values leaves the job of another module alone
+	changed, err = persistSysctls(ctx, nil, path, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.FileExists(t, path)
+	assert.Empty(t, fake.commands)
+
+	_, err = persistSysctls(ctx, []string{"kern.maxfiles"}, path, nil)
+	assert.Error(t, err)
+}
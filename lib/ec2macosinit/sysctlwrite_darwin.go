@@ -0,0 +1,28 @@
+//go:build cgo
+
+package ec2macosinit
+
+/*
+#include <stdlib.h>
+#include <sys/sysctl.h>
+*/
+import "C"
+
+import "unsafe"
+
+// sysctlWrite sets the raw value of a sysctl. x/sys/unix only provides reads, and the sysctlbyname syscall isn't
+// usable directly on arm64, so this calls sysctlbyname from libc.
+func sysctlWrite(name string, raw []byte) (err error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	var cRaw unsafe.Pointer
+	if len(raw) > 0 {
+		cRaw = C.CBytes(raw)
+		defer C.free(cRaw)
+	}
+	ret, err := C.sysctlbyname(cName, nil, nil, cRaw, C.size_t(len(raw)))
+	if ret != 0 {
+		return err
+	}
+	return nil
+}
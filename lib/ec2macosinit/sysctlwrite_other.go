@@ -0,0 +1,10 @@
+//go:build !darwin || !cgo
+
+package ec2macosinit
+
+import "fmt"
+
+// sysctlWrite is only available on macOS, when built with cgo.
+func sysctlWrite(name string, raw []byte) (err error) {
+	return fmt.Errorf("ec2macosinit: setting sysctls is not available in this build")
+}
@@ -2,10 +2,12 @@ package ec2macosinit
 
 import (
 	"bufio"
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,53 +20,82 @@ const (
 	ConfigurationManagementWarning = "### This file is managed by EC2 macOS Init, changes will be applied on every boot. To disable set secureSSHDConfig = false in /usr/local/aws/ec2-macos-init/init.toml ###"
 	// InlineWarning is a warning line for each entry to help encourage users to avoid doing the risky configuration change
 	InlineWarning = "# EC2 Configuration: The follow setting is recommended by EC2 and set on boot. Set secureSSHDConfig = false in /usr/local/aws/ec2-macos-init/init.toml to disable.\n"
-	// DefaultsCmd is the path to the script edit macOS defaults
-	DefaultsCmd = "/usr/bin/defaults"
-	// DefaultsRead is the command to read from a plist
-	DefaultsRead = "read"
-	// DefaultsReadType is the command to read the type of a parameter from a plist
-	DefaultsReadType = "read-type"
-	// DefaultsWrite is the command to write a value of a parameter to a plist
-	DefaultsWrite = "write"
-	// sshdConfigFile is the default path for the SSHD configuration file
-	sshdConfigFile = "/etc/ssh/sshd_config"
 	// ec2SSHDConfigFile is the ssh configs file path
 	ec2SSHDConfigFile = "/etc/ssh/sshd_config.d/050-ec2-macos.conf"
 	// macOSSSHDConfigDir is Apple's custom ssh configs
 	macOSSSHDConfigDir = "/etc/ssh/sshd_config.d"
+	// sshdBinary is the path to sshd, used to validate configuration before it is applied
+	sshdBinary = "/usr/sbin/sshd"
 )
 
 //go:embed assets/ec2-macos-ssh.txt
 var ec2SSHData string
 
 var (
-	// numberOfBytesInCustomSSHFile is the number of bytes in assets/ec2-macos-ssh.txt
-	numberOfBytesInCustomSSHFile = len(ec2SSHData)
+	// sshdConfigFile is the default path for the SSHD configuration file
+	sshdConfigFile = "/etc/ssh/sshd_config"
 )
 
+// networkTuningPresets maps a preset name to a curated set of sysctl values. Presets are applied before any explicitly
+// configured Sysctl entries so that a single parameter can still be overridden in init.toml.
+var networkTuningPresets = map[string][]string{
+	// high-throughput raises socket buffers, window scaling, and queue lengths for bulk transfers over the ENA
+	// interfaces on EC2 Mac instances.
+	"high-throughput": {
+		"kern.ipc.maxsockbuf=8388608",
+		"net.inet.tcp.win_scale_factor=8",
+		"net.inet.tcp.autorcvbufmax=33554432",
+		"net.inet.tcp.autosndbufmax=33554432",
+		"net.inet.tcp.sendspace=1048576",
+		"net.inet.tcp.recvspace=1048576",
+		"net.inet.tcp.mssdflt=1440",
+		"net.inet.tcp.delayed_ack=0",
+		"net.link.generic.system.rcvq_maxlen=1024",
+		"net.link.generic.system.sndq_maxlen=1024",
+	},
+}
+
 // ModifySysctl contains sysctl values we want to modify
 type ModifySysctl struct {
-	Value string `toml:"value"`
+	Value   string `toml:"value"`
+	Persist bool   `toml:"persist"` // Persist also sets the value on every boot, even if the module stops running
 }
 
-// ModifyDefaults contains the necessary values to change a parameter in a given plist
+// ModifyDefaults contains the necessary values to change a parameter in a given plist. The parameter may address a
+// nested key by separating each level with a colon, for example "Outer:Inner".
 type ModifyDefaults struct {
-	Plist     string `toml:"plist"`
-	Parameter string `toml:"parameter"`
-	Type      string `toml:"type"`
-	Value     string `toml:"value"`
+	Plist       string            `toml:"plist"`
+	Parameter   string            `toml:"parameter"`
+	Type        string            `toml:"type"`
+	Value       string            `toml:"value"`
+	Values      []string          `toml:"values"`      // Values is used for the array type
+	Dict        map[string]string `toml:"dict"`        // Dict is used for the dict type
+	Delete      bool              `toml:"delete"`      // Delete removes the parameter instead of writing a value
+	User        string            `toml:"user"`        // User targets the given user's preferences for the domain
+	CurrentHost bool              `toml:"currentHost"` // CurrentHost targets the -currentHost (ByHost) domain
 }
 
 // SystemConfigModule contains all necessary configuration fields for running a System Configuration module.
 type SystemConfigModule struct {
-	SecureSSHDConfig *bool            `toml:"secureSSHDConfig"`
-	ModifySysctl     []ModifySysctl   `toml:"Sysctl"`
-	ModifyDefaults   []ModifyDefaults `toml:"Defaults"`
+	SecureSSHDConfig    *bool             `toml:"secureSSHDConfig"`
+	NetworkTuningPreset string            `toml:"NetworkTuningPreset"`
+	ModifySysctl        []ModifySysctl    `toml:"Sysctl"`
+	ModifyDefaults      []ModifyDefaults  `toml:"Defaults"`
+	SSHClient           []SSHClientConfig `toml:"SSHClient"`
 }
 
-// Do for the SystemConfigModule modifies system configuration such as sysctl, plist defaults, and secures the SSHD
-// configuration file.
+// Do for the SystemConfigModule modifies system configuration such as sysctl, plist defaults, and ssh client drop-ins,
+// and secures the SSHD configuration file.
 func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error) {
+	// Expand any network tuning preset into the list of sysctl values to apply
+	sysctlValues, err := c.sysctlValues()
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the original state of every file modified by this run so that it can be rolled back
+	backups := newFileBackups(ctx.BaseDirectory, "systemconfig")
+
 	wg := sync.WaitGroup{}
 
 	// Secure SSHD configuration
@@ -72,7 +103,7 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 	if c.SecureSSHDConfig != nil && *c.SecureSSHDConfig {
 		wg.Add(1)
 		go func() {
-			err := writeEC2SSHConfigs()
+			err := writeEC2SSHConfigs(ctx, backups)
 			if err != nil {
 				ctx.Logger.Errorf("Error writing ec2 custom ssh configs: %s", err)
 			}
@@ -80,7 +111,7 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 		}()
 		wg.Add(1)
 		go func() {
-			changes, err := c.configureSSHD(ctx)
+			changes, err := c.configureSSHD(ctx, backups)
 			if err != nil {
 				atomic.AddInt32(&sshdErrors, 1)
 				ctx.Logger.Errorf("Error while attempting to correct SSHD configuration: %s", err)
@@ -98,7 +129,7 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 
 	// Modifications using sysctl
 	var sysctlChanged, sysctlUnchanged, sysctlErrors int32
-	for _, m := range c.ModifySysctl {
+	for _, v := range sysctlValues {
 		wg.Add(1)
 		go func(val string) {
 			changed, err := modifySysctl(val)
@@ -114,7 +145,7 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 				ctx.Logger.Infof("Did not modify sysctl property [%s]", val)
 			}
 			wg.Done()
-		}(m.Value)
+		}(v)
 	}
 
 	// Modifications using defaults
@@ -122,7 +153,7 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 	for _, m := range c.ModifyDefaults {
 		wg.Add(1)
 		go func(modifyDefault ModifyDefaults) {
-			changed, err := modifyDefaults(modifyDefault)
+			changed, err := modifyDefaults(ctx, modifyDefault, backups)
 			if err != nil {
 				atomic.AddInt32(&defaultsErrors, 1)
 				ctx.Logger.Errorf("Error while attempting to modify default [%s]: %s", modifyDefault.Parameter, err)
@@ -138,13 +169,43 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 		}(m)
 	}
 
+	// Persisted sysctl values are set by a launchd job on every boot
+	var persistChanged, persistErrors int32
+	wg.Add(1)
+	go func() {
+		changed, err := persistSysctls(ctx, c.persistedSysctlValues(), LaunchDaemonPlist(SysctlJobLabel), backups)
+		if err != nil {
+			atomic.AddInt32(&persistErrors, 1)
+			ctx.Logger.Errorf("Error while attempting to persist sysctl properties: %s", err)
+		}
+		if changed {
+			atomic.AddInt32(&persistChanged, 1)
+			ctx.Logger.Infof("Updated persisted sysctl properties in %s", LaunchDaemonPlist(SysctlJobLabel))
+		}
+		wg.Done()
+	}()
+
+	// SSH client drop-ins, including removing the ones which are no longer configured
+	var sshClientChanged, sshClientUnchanged, sshClientErrors int32
+	wg.Add(1)
+	go func() {
+		changed, unchanged, err := writeSSHClientConfigs(ctx, c.SSHClient, backups)
+		if err != nil {
+			atomic.AddInt32(&sshClientErrors, 1)
+			ctx.Logger.Errorf("Error while attempting to write ssh client configs: %s", err)
+		}
+		atomic.AddInt32(&sshClientChanged, int32(changed))
+		atomic.AddInt32(&sshClientUnchanged, int32(unchanged))
+		wg.Done()
+	}()
+
 	// Wait for everything to finish
 	wg.Wait()
 
 	// Craft output message
-	totalChanged := sysctlChanged + defaultsChanged + sshdConfigChanges
-	totalUnchanged := sysctlUnchanged + defaultsUnchanged + sshdUnchanged
-	totalErrors := sysctlErrors + defaultsErrors + sshdErrors
+	totalChanged := sysctlChanged + defaultsChanged + sshdConfigChanges + persistChanged + sshClientChanged
+	totalUnchanged := sysctlUnchanged + defaultsUnchanged + sshdUnchanged + sshClientUnchanged
+	totalErrors := sysctlErrors + defaultsErrors + sshdErrors + persistErrors + sshClientErrors
 	baseMessage := fmt.Sprintf("[%d changed / %d unchanged / %d error(s)] out of %d requested changes",
 		totalChanged, totalUnchanged, totalErrors, totalChanged+totalUnchanged)
 
@@ -155,27 +216,171 @@ func (c *SystemConfigModule) Do(ctx *ModuleContext) (message string, err error)
 	return "system configuration completed with " + baseMessage, nil
 }
 
-// writeEC2SSHConfigs writes custom ec2 ssh configs file
-func writeEC2SSHConfigs() (err error) {
+// sysctlValues returns the sysctl values to be applied, combining the selected network tuning preset (if any) with the
+// explicitly configured Sysctl entries. Explicit entries take precedence over preset values for the same parameter.
+func (c *SystemConfigModule) sysctlValues() (values []string, err error) {
+	var preset []string
+	if c.NetworkTuningPreset != "" {
+		var ok bool
+		preset, ok = networkTuningPresets[c.NetworkTuningPreset]
+		if !ok {
+			return nil, fmt.Errorf("ec2macosinit: unknown network tuning preset: %s", c.NetworkTuningPreset)
+		}
+	}
+
+	// Collect explicitly configured parameters so they can override the preset
+	explicit := map[string]struct{}{}
+	for _, m := range c.ModifySysctl {
+		explicit[strings.SplitN(m.Value, "=", 2)[0]] = struct{}{}
+	}
+
+	for _, v := range preset {
+		if _, ok := explicit[strings.SplitN(v, "=", 2)[0]]; ok {
+			continue
+		}
+		values = append(values, v)
+	}
+	for _, m := range c.ModifySysctl {
+		values = append(values, m.Value)
+	}
+
+	return values, nil
+}
+
+// persistedSysctlValues returns the Sysctl values which are set on every boot.
+func (c *SystemConfigModule) persistedSysctlValues() (values []string) {
+	for _, m := range c.ModifySysctl {
+		if m.Persist {
+			values = append(values, m.Value)
+		}
+	}
+	return values
+}
+
+// writeEC2SSHConfigs writes custom ec2 ssh configs file. The content is validated with sshd, along with the rest of the
+// configuration, before it is moved into place so that a bad drop-in can never prevent sshd from starting.
+func writeEC2SSHConfigs(ctx *ModuleContext, backups *fileBackups) (err error) {
+	// Nothing to do if the drop-in is already current
+	if existing, err := os.ReadFile(ec2SSHDConfigFile); err == nil && string(existing) == ec2SSHData {
+		return nil
+	}
+
 	err = os.MkdirAll(macOSSSHDConfigDir, 0755)
 	if err != nil {
 		return fmt.Errorf("error while attempting to create %s dir: %s", macOSSSHDConfigDir, err)
 	}
-	f, err := os.OpenFile(ec2SSHDConfigFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	err = validateSSHDDropIn(ctx, ec2SSHDConfigFile, ec2SSHData)
 	if err != nil {
-		return fmt.Errorf("error while attempting to create %s file: %s", ec2SSHDConfigFile, err)
+		return fmt.Errorf("refusing to write %s: %s", ec2SSHDConfigFile, err)
 	}
-	defer f.Close()
-	n, err := f.WriteString(ec2SSHData)
+	err = backups.save(ec2SSHDConfigFile)
+	if err != nil {
+		return err
+	}
+	err = safeWriteFile(ec2SSHDConfigFile, []byte(ec2SSHData), 0644, -1, -1)
 	if err != nil {
 		return fmt.Errorf("error while writing ec2-macos ssh data on file: %s. %s", ec2SSHDConfigFile, err)
 	}
-	if n != numberOfBytesInCustomSSHFile {
-		return fmt.Errorf("error while writing ec2-macos ssh data on file: %s. %d should equal %d", ec2SSHDConfigFile, n, numberOfBytesInCustomSSHFile)
+	return nil
+}
+
+// validateSSHDConfig runs sshd in test mode against the configuration file at path and returns an error describing
+// the problem if sshd rejects it.
+func validateSSHDConfig(ctx *ModuleContext, path string) (err error) {
+	out, err := ctx.executeCommand([]string{sshdBinary, "-t", "-f", path}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: sshd configuration test failed for %s: %s %s", path, err, strings.TrimSpace(out.stderr))
 	}
 	return nil
 }
 
+// validateSSHDCandidate writes a candidate sshd configuration to a temporary file, outside of sshd_config.d so that it's
+// never picked up by an Include directive, and validates it with sshd. The temporary file is always removed.
+func validateSSHDCandidate(ctx *ModuleContext, candidate string) (err error) {
+	f, err := os.CreateTemp("", "sshd_config_candidate.*")
+	if err != nil {
+		return fmt.Errorf("unable to create candidate file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(candidate)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write candidate file %s: %s", f.Name(), err)
+	}
+	return validateSSHDConfig(ctx, f.Name())
+}
+
+// validateSSHDDropIn validates a candidate for a drop-in in sshd_config.d as sshd would load it, merged with
+// sshd_config and the other drop-ins, since a drop-in which is valid alone may still conflict with them. The merged
+// configuration is assembled in a temporary directory, which is always removed: sshd_config with its Include of the
+// drop-in directory pointed at a copy of the directory, in which the candidate replaces the drop-in.
+func validateSSHDDropIn(ctx *ModuleContext, dropIn, candidate string) (err error) {
+	mainConfig, err := os.ReadFile(sshdConfigFile)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %s", sshdConfigFile, err)
+	}
+	dir, err := os.MkdirTemp("", "sshd_config_candidate.*")
+	if err != nil {
+		return fmt.Errorf("unable to create candidate directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Copy the other drop-ins, then add the candidate in place of the current drop-in. The copy is kept apart from the
+	// merged sshd_config so that including every file in it doesn't include sshd_config too.
+	dropInDir, copyDir := filepath.Dir(dropIn), filepath.Join(dir, "sshd_config.d")
+	err = os.Mkdir(copyDir, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to create candidate directory: %s", err)
+	}
+	entries, err := os.ReadDir(dropInDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read %s: %s", dropInDir, err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == filepath.Base(dropIn) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dropInDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", entry.Name(), err)
+		}
+		err = os.WriteFile(filepath.Join(copyDir, entry.Name()), data, 0600)
+		if err != nil {
+			return fmt.Errorf("unable to write candidate directory: %s", err)
+		}
+	}
+	candidateDropIn := filepath.Join(copyDir, filepath.Base(dropIn))
+	err = os.WriteFile(candidateDropIn, []byte(candidate), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write candidate file %s: %s", candidateDropIn, err)
+	}
+
+	// Point the Include directives at the copy. If sshd_config doesn't include the directory, the candidate is included
+	// first so that it's still checked.
+	var merged strings.Builder
+	included := false
+	for _, line := range strings.SplitAfter(string(mainConfig), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && strings.EqualFold(fields[0], "Include") && strings.Contains(line, dropInDir+"/") {
+			line = strings.ReplaceAll(line, dropInDir+"/", copyDir+"/")
+			included = true
+		}
+		merged.WriteString(line)
+	}
+	config := merged.String()
+	if !included {
+		config = "Include " + candidateDropIn + "\n" + config
+	}
+	mergedPath := filepath.Join(dir, "sshd_config")
+	err = os.WriteFile(mergedPath, []byte(config), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write candidate file %s: %s", mergedPath, err)
+	}
+	return validateSSHDConfig(ctx, mergedPath)
+}
+
 // modifySysctl modifies a sysctl parameter, if necessary.
 func modifySysctl(value string) (changed bool, err error) {
 	// Separate parameter
@@ -183,32 +388,33 @@ func modifySysctl(value string) (changed bool, err error) {
 	if len(inputSplit) != 2 {
 		return false, fmt.Errorf("ec2macosinit: unable to split input sysctl value: %s", value)
 	}
-	param := inputSplit[0]
+	param, desired := inputSplit[0], inputSplit[1]
 
 	// Check current value
-	output, err := executeCommand([]string{"sysctl", "-e", param}, "", []string{})
+	current, err := sysctlRead(param)
 	if err != nil {
-		return false, fmt.Errorf("ec2macosinit: unable to get current value from sysctl: %s", err)
+		return false, fmt.Errorf("ec2macosinit: unable to get current value of sysctl %s: %s", param, err)
 	}
-	if strings.TrimSpace(output.stdout) == value {
+	raw, matches := sysctlValue(current, desired)
+	if matches {
 		return false, nil // Exit early if value is already set
 	}
 
-	// Attempt to set the value five times, with 100ms in between each attempt
-	err = retry(5, 100*time.Millisecond, func() (err error) {
+	// Attempt to set the value five times, backing off from 100ms between attempts
+	err = Retry(context.Background(), Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Attempts: 5}, func() (err error) {
 		// Set value
-		_, err = executeCommand([]string{"sysctl", value}, "", []string{})
+		err = sysctlWrite(param, raw)
 		if err != nil {
-			return fmt.Errorf("ec2macosinit: unable to set desired value using sysctl: %s", err)
+			return fmt.Errorf("ec2macosinit: unable to set sysctl %s to %s: %s", param, desired, err)
 		}
 
 		// Validate new value
-		output, err = executeCommand([]string{"sysctl", "-e", param}, "", []string{})
+		current, err = sysctlRead(param)
 		if err != nil {
-			return fmt.Errorf("ec2macosinit: unable to get current value from sysctl: %s", err)
+			return fmt.Errorf("ec2macosinit: unable to get current value of sysctl %s: %s", param, err)
 		}
-		if strings.TrimSpace(output.stdout) != value {
-			return fmt.Errorf("ec2macosinit: error setting new value using sysctl: %s", output.stdout)
+		if _, matches := sysctlValue(current, desired); !matches {
+			return fmt.Errorf("ec2macosinit: sysctl %s was not set to %s", param, desired)
 		}
 
 		return nil
@@ -220,84 +426,10 @@ func modifySysctl(value string) (changed bool, err error) {
 	return true, nil
 }
 
-// modifyDefaults modifies a default, if necessary.
-func modifyDefaults(modifyDefault ModifyDefaults) (changed bool, err error) {
-	// Check to see if current value already matches
-	err = checkDefaultsValue(modifyDefault)
-	if err == nil {
-		return false, err // Exit early if value is already set correctly, otherwise attempt to update value
-	}
-
-	// If the values did not match, update value in the plist
-	err = updateDefaultsValue(modifyDefault)
-	if err != nil {
-		return false, fmt.Errorf("ec2macosinit: unable to update value for plist %s, parameter %s to value %s", modifyDefault.Plist, modifyDefault.Parameter, modifyDefault.Value)
-	}
-
-	// Validate new value
-	err = checkDefaultsValue(modifyDefault)
-	if err != nil {
-		return false, fmt.Errorf("ec2macosinit: verification failed for updating value for plist %s, parameter %s", modifyDefault.Plist, modifyDefault.Parameter)
-	}
-
-	return true, nil
-}
-
-// checkDefaultsValue checks the value for a given parameter in a plist.
-func checkDefaultsValue(modifyDefault ModifyDefaults) (err error) {
-	// Check value of current parameter in plist
-	readCmd := []string{DefaultsCmd, DefaultsRead, modifyDefault.Plist, modifyDefault.Parameter}
-	out, err := executeCommand(readCmd, "", []string{})
-	if err != nil {
-		return err
-	}
-
-	// Get value by trimming whitespace
-	actualValue := strings.TrimSpace(out.stdout)
-
-	// Run comparisons depending on the parameter's type
-	switch modifyDefault.Type {
-	// Only implemented for bool[ean] now, more types to be implemented later
-	case "bool", "boolean":
-		return checkBoolean(modifyDefault.Value, actualValue)
-	}
-
-	return nil
-}
-
-// updateDefaultsValue updates the value of a parameter in a given plist.
-func updateDefaultsValue(modifyDefault ModifyDefaults) (err error) {
-	// Update the value, specifying its type
-	writeCmd := []string{DefaultsCmd, DefaultsWrite, modifyDefault.Plist, modifyDefault.Parameter, "-" + modifyDefault.Type, modifyDefault.Value}
-	_, err = executeCommand(writeCmd, "", []string{})
-	return err
-}
-
-// checkBoolean is designed to convert both inputs into a boolean and compare.
-func checkBoolean(expectedValue, actualValue string) (err error) {
-	// Convert our expected value into a boolean
-	expectedOutput, err := strconv.ParseBool(expectedValue)
-	if err != nil {
-		return err
-	}
-
-	// Convert our actual value into a boolean
-	actualOutput, err := strconv.ParseBool(actualValue)
-	if err != nil {
-		return err
-	}
-
-	if expectedOutput != actualOutput {
-		return fmt.Errorf("ec2macosinit: boolean values did not match - expected: %v, actual: %v", expectedOutput, actualOutput)
-	} else {
-		return nil
-	}
-}
-
 // checkSSHDReturn uses launchctl to find the exit code for ssh.plist and returns if it was successful
-func (c *SystemConfigModule) checkSSHDReturn() (success bool, err error) {
+func (c *SystemConfigModule) checkSSHDReturn(ctx *ModuleContext) (success bool, err error) {
 	// Launchd can provide status on processes running, this gets that output to be parsed
-	out, _ := executeCommand([]string{"launchctl", "list"}, "", []string{})
+	out, _ := ctx.executeCommand([]string{"launchctl", "list"}, "", []string{})
 	// Start a line by line scanner
 	scanner := bufio.NewScanner(strings.NewReader(out.stdout))
 	for scanner.Scan() {
@@ -321,35 +453,17 @@ func (c *SystemConfigModule) checkSSHDReturn() (success bool, err error) {
 }
 
 // checkAndWriteWarning is a helper function to write out the warning if not present
-func checkAndWriteWarning(lastLine string, tempSSHDFile *os.File) (err error) {
+func checkAndWriteWarning(lastLine string, candidate *strings.Builder) {
 	if !strings.Contains(lastLine, "EC2 Configuration") && lastLine != InlineWarning {
-		_, err := tempSSHDFile.WriteString(InlineWarning)
-		if err != nil {
-			return fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-		}
+		candidate.WriteString(InlineWarning)
 	}
-	return nil
 }
 
-// configureSSHD scans the SSHConfigFile and writes to a temporary file if changes are detected. If changes are detected
-// it replaces the SSHConfigFile. If SSHD is detected as running, it restarts it.
-func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bool, err error) {
-	// Look for each thing and fix them if found
-	sshdFile, err := os.Open(sshdConfigFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer sshdFile.Close()
-
-	// Create scanner for the SSHD file
-	scanner := bufio.NewScanner(sshdFile)
-
-	// Create a new temporary file, if changes are detected, it will be moved over the existing file
-	tempSSHDFile, err := os.CreateTemp("", "sshd_config_fixed.*")
-	if err != nil {
-		return false, fmt.Errorf("ec2macosinit: error creating %s", tempSSHDFile.Name())
-	}
-	defer tempSSHDFile.Close()
+// secureSSHDConfig builds the desired sshd configuration from the current one in memory, returning whether anything
+// was changed.
+func secureSSHDConfig(current string) (candidate string, configChanges bool, err error) {
+	var b strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(current))
 
 	// Keep track of line number simply for confirming warning header
 	var lineNumber int
@@ -361,10 +475,7 @@ func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bo
 		currentLine := scanner.Text()
 		// If this is the first line in the file, look for the warning header and add if missing
 		if lineNumber == 1 && currentLine != ConfigurationManagementWarning {
-			_, err = tempSSHDFile.WriteString(ConfigurationManagementWarning + "\n")
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			b.WriteString(ConfigurationManagementWarning + "\n")
 			configChanges = true
 			lastLine = ConfigurationManagementWarning
 		}
@@ -374,15 +485,9 @@ func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bo
 		// PasswordAuthentication allows SSHD to respond to user password brute force attacks and can result in lowered
 		// security, especially if a simple password is set. In EC2, this is undesired and therefore turned off by default
 		case strings.Contains(currentLine, "PasswordAuthentication yes"):
-			err = checkAndWriteWarning(lastLine, tempSSHDFile)
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			checkAndWriteWarning(lastLine, &b)
 			// Overwrite with desired configuration line
-			_, err = tempSSHDFile.WriteString("PasswordAuthentication no\n")
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			b.WriteString("PasswordAuthentication no\n")
 			// Changes detected so this will enforce updating the file later
 			configChanges = true
 
@@ -390,15 +495,9 @@ func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bo
 			// PAM authentication enables challenge-response authentication which can allow brute force attacks on SSHD
 			// In EC2, this is undesired and therefore turned off by default
 		case strings.TrimSpace(currentLine) == "UsePAM yes":
-			err = checkAndWriteWarning(lastLine, tempSSHDFile)
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			checkAndWriteWarning(lastLine, &b)
 			// Overwrite with desired configuration line
-			_, err = tempSSHDFile.WriteString("UsePAM no\n")
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			b.WriteString("UsePAM no\n")
 			// Changes detected so this will enforce updating the file later
 			configChanges = true
 
@@ -406,59 +505,74 @@ func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bo
 			// Challenge-response authentication via SSHD can allow brute force attacks for SSHD. In EC2, this is undesired
 			// and therefore turned off by default
 		case strings.Contains(currentLine, "ChallengeResponseAuthentication yes"):
-			err = checkAndWriteWarning(lastLine, tempSSHDFile)
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			checkAndWriteWarning(lastLine, &b)
 			// Overwrite with desired configuration line
-			_, err = tempSSHDFile.WriteString("ChallengeResponseAuthentication no\n")
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			b.WriteString("ChallengeResponseAuthentication no\n")
 			// Changes detected so this will enforce updating the file later
 			configChanges = true
 
 		default:
-			// Otherwise write the line as is to the temp file without modification
-			_, err = tempSSHDFile.WriteString(currentLine + "\n")
-			if err != nil {
-				return false, fmt.Errorf("ec2macosinit: error writing to %s", tempSSHDFile.Name())
-			}
+			// Otherwise keep the line as is
+			b.WriteString(currentLine + "\n")
 		}
 		// Rotate the current line to the last line so that comments can be inserted above rewritten lines
 		lastLine = currentLine
 	}
 	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+
+	return b.String(), configChanges, nil
+}
+
+// configureSSHD builds the secured SSHConfigFile in memory and, only if it differs from the current file, validates it
+// and atomically replaces the SSHConfigFile. If SSHD is detected as running, it restarts it. The only temporary file is
+// the candidate given to sshd for validation, which is always removed.
+func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext, backups *fileBackups) (configChanges bool, err error) {
+	current, err := os.ReadFile(sshdConfigFile)
+	if err != nil {
+		return false, fmt.Errorf("ec2macosinit: error reading %s: %s", sshdConfigFile, err)
+	}
+
+	// Look for each thing and fix them if found
+	candidate, configChanges, err := secureSSHDConfig(string(current))
+	if err != nil {
 		return false, fmt.Errorf("ec2macosinit: error reading %s: %s", sshdConfigFile, err)
 	}
 
 	// If there was a change detected, then copy the file and restart sshd
 	if configChanges {
 		// Get the current status of SSHD, if its not running, then it should not be started
-		sshdRunning, err := c.checkSSHDReturn()
+		sshdRunning, err := c.checkSSHDReturn(ctx)
 		if err != nil {
 			ctx.Logger.Errorf("ec2macosinit: unable to get SSHD status: %s", err)
 		}
 
-		// Move the temporary file to the SSHDConfigFile
-		err = os.Rename(tempSSHDFile.Name(), sshdConfigFile)
+		// Validate the candidate before it replaces the live configuration, a bad sshd_config would lock out SSH access
+		err = validateSSHDCandidate(ctx, candidate)
 		if err != nil {
-			return false, fmt.Errorf("ec2macosinit: unable to save updated configuration to %s", sshdConfigFile)
+			return false, fmt.Errorf("ec2macosinit: not applying changes to %s: %s", sshdConfigFile, err)
 		}
-		// Temporary files have different permissions by design, correct the permissions for SSHDConfigFile
-		err = os.Chmod(sshdConfigFile, 0644)
+
+		err = backups.save(sshdConfigFile)
+		if err != nil {
+			return false, err
+		}
+
+		// Atomically replace the SSHDConfigFile
+		err = safeWriteFile(sshdConfigFile, []byte(candidate), 0644, -1, -1)
 		if err != nil {
-			return false, fmt.Errorf("ec2macosinit: unable to set correct permssions of %s", sshdConfigFile)
+			return false, fmt.Errorf("ec2macosinit: unable to save updated configuration to %s: %s", sshdConfigFile, err)
 		}
 		// If SSHD was detected as running, then a restart must happen, if it was not running, the work is complete
 		if sshdRunning {
 			// Unload and load SSHD, the launchctl method for re-loading SSHD with new configuration
-			_, err = executeCommand([]string{"/bin/zsh", "-c", "launchctl unload /System/Library/LaunchDaemons/ssh.plist"}, "", []string{})
+			_, err = ctx.executeCommand([]string{"/bin/zsh", "-c", "launchctl unload /System/Library/LaunchDaemons/ssh.plist"}, "", []string{})
 			if err != nil {
 				ctx.Logger.Errorf("ec2macosinit: unable to stop SSHD %s", err)
 				return false, fmt.Errorf("ec2macosinit: unable to stop SSHD %s", err)
 			}
-			_, err = executeCommand([]string{"/bin/zsh", "-c", "launchctl load -w /System/Library/LaunchDaemons/ssh.plist"}, "", []string{})
+			_, err = ctx.executeCommand([]string{"/bin/zsh", "-c", "launchctl load -w /System/Library/LaunchDaemons/ssh.plist"}, "", []string{})
 			if err != nil {
 				ctx.Logger.Errorf("ec2macosinit: unable to restart SSHD %s", err)
 				return false, fmt.Errorf("ec2macosinit: unable to restart SSHD %s", err)
@@ -470,7 +584,7 @@ func (c *SystemConfigModule) configureSSHD(ctx *ModuleContext) (configChanges bo
 			ctx.Logger.Info("Modified SSHD configuration, did not restart SSHD since it was not running")
 		}
 	} else {
-		// There were no changes detected from desired state, simply exit and let the temp file be
+		// There were no changes detected from desired state, nothing was written
 		ctx.Logger.Info("Did not modify SSHD configuration")
 	}
 	// Return the message to caller for logging
@@ -0,0 +1,96 @@
+package ec2macosinit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemConfigModule_sysctlValues(t *testing.T) {
+	t.Run("NoPreset", func(t *testing.T) {
+		c := &SystemConfigModule{
+			ModifySysctl: []ModifySysctl{{Value: "kern.aiomax=900"}},
+		}
+		values, err := c.sysctlValues()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"kern.aiomax=900"}, values)
+	})
+
+	t.Run("UnknownPreset", func(t *testing.T) {
+		c := &SystemConfigModule{NetworkTuningPreset: "warp-speed"}
+		_, err := c.sysctlValues()
+		assert.Error(t, err, "should reject unknown presets")
+	})
+
+	t.Run("ExplicitOverridesPreset", func(t *testing.T) {
+		c := &SystemConfigModule{
+			NetworkTuningPreset: "high-throughput",
+			ModifySysctl:        []ModifySysctl{{Value: "net.inet.tcp.sendspace=65536"}},
+		}
+		values, err := c.sysctlValues()
+		assert.NoError(t, err)
+		assert.Len(t, values, len(networkTuningPresets["high-throughput"]))
+		assert.Contains(t, values, "net.inet.tcp.sendspace=65536")
+		assert.NotContains(t, values, "net.inet.tcp.sendspace=1048576")
+	})
+}
+
+func Test_secureSSHDConfig(t *testing.T) {
+	current := "# sshd_config\nPasswordAuthentication yes\nUsePAM yes\n"
+	candidate, changed, err := secureSSHDConfig(current)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, ConfigurationManagementWarning+"\n# sshd_config\n"+InlineWarning+"PasswordAuthentication no\n"+InlineWarning+"UsePAM no\n", candidate)
+
+	// Securing an already secured configuration changes nothing
+	again, changed, err := secureSSHDConfig(candidate)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, candidate, again)
+}
+
+func Test_validateSSHDDropIn(t *testing.T) {
+	dir := t.TempDir()
+	defer func(s string) { sshdConfigFile = s }(sshdConfigFile)
+	sshdConfigFile = filepath.Join(dir, "sshd_config")
+	dropInDir := filepath.Join(dir, "sshd_config.d")
+	require.NoError(t, os.Mkdir(dropInDir, 0755))
+	require.NoError(t, os.WriteFile(sshdConfigFile, []byte("Include "+dropInDir+"/*\nPasswordAuthentication no\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "050-ec2-macos.conf"), []byte("old\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dropInDir, "100-macos.conf"), []byte("UsePAM yes\n"), 0644))
+
+	// sshd is given sshd_config including a copy of the drop-ins, with the candidate in place of the current drop-in
+	var merged string
+	dropIns := map[string]string{}
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		data, err := os.ReadFile(c[len(c)-1])
+		require.NoError(t, err)
+		merged = string(data)
+		included, _ := filepath.Glob(strings.Fields(merged)[1])
+		for _, path := range included {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			dropIns[filepath.Base(path)] = string(data)
+		}
+		return commandOutput{}, nil
+	}}
+	err := validateSSHDDropIn(&ModuleContext{executor: fake}, filepath.Join(dropInDir, "050-ec2-macos.conf"), "new\n")
+	require.NoError(t, err)
+	require.Len(t, fake.commands, 1)
+	assert.True(t, strings.HasPrefix(fake.commands[0], sshdBinary+" -t -f "))
+	assert.NotContains(t, merged, dropInDir)
+	assert.Contains(t, merged, "PasswordAuthentication no\n")
+	assert.Equal(t, map[string]string{"050-ec2-macos.conf": "new\n", "100-macos.conf": "UsePAM yes\n"}, dropIns)
+
+	// The candidate is still checked when sshd_config doesn't include the drop-ins
+	require.NoError(t, os.WriteFile(sshdConfigFile, []byte("PasswordAuthentication no\n"), 0644))
+	dropIns = map[string]string{}
+	err = validateSSHDDropIn(&ModuleContext{executor: fake}, filepath.Join(dropInDir, "050-ec2-macos.conf"), "new\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(merged, "Include "), merged)
+	assert.Equal(t, map[string]string{"050-ec2-macos.conf": "new\n"}, dropIns)
+}
@@ -0,0 +1,137 @@
+package ec2macosinit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// systemsetupPath is the path to the systemsetup utility
+	systemsetupPath = "/usr/sbin/systemsetup"
+	// maxComputerSleepMinutes is the largest idle time accepted by systemsetup -setcomputersleep
+	maxComputerSleepMinutes = 180
+)
+
+// SystemSetupModule contains all necessary configuration fields for running a SystemSetup module. Unset fields are
+// left as they are.
+type SystemSetupModule struct {
+	RemoteLogin       *bool  `toml:"RemoteLogin"`       // RemoteLogin enables or disables SSH access
+	RemoteAppleEvents *bool  `toml:"RemoteAppleEvents"` // RemoteAppleEvents enables or disables remote Apple events
+	RestartFreeze     *bool  `toml:"RestartFreeze"`     // RestartFreeze restarts the system automatically if it freezes
+	ComputerSleep     string `toml:"ComputerSleep"`     // ComputerSleep is the idle time in minutes before sleep, or "Never"
+}
+
+// systemsetupSetting is a single systemsetup setting along with the flags used to read and write it.
+type systemsetupSetting struct {
+	name  string
+	get   string
+	set   string
+	value string
+}
+
+// Do for the SystemSetupModule applies each configured systemsetup setting which doesn't already have the desired
+// value, then reads the setting back to verify it was applied.
+func (c *SystemSetupModule) Do(ctx *ModuleContext) (message string, err error) {
+	settings, err := c.settings()
+	if err != nil {
+		return "", err
+	}
+	if len(settings) == 0 {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	for _, s := range settings {
+		current, err := s.current(ctx)
+		if err != nil {
+			return "", err
+		}
+		if systemsetupValueMatches(s.value, current) {
+			unchanged++
+			ctx.Logger.Infof("systemsetup setting [%s] already set to [%s]", s.name, current)
+			continue
+		}
+
+		// -f avoids the interactive confirmation when turning off remote login
+		_, err = ctx.executeCommand([]string{systemsetupPath, "-f", s.set, s.value}, "", []string{})
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to set %s to %s: %s", s.name, s.value, err)
+		}
+
+		// Validate new value
+		current, err = s.current(ctx)
+		if err != nil {
+			return "", err
+		}
+		if !systemsetupValueMatches(s.value, current) {
+			return "", fmt.Errorf("ec2macosinit: verification failed for %s, expected %s but got %s", s.name, s.value, current)
+		}
+		changed++
+		ctx.Logger.Infof("Set systemsetup setting [%s] to [%s]", s.name, current)
+	}
+
+	return fmt.Sprintf("successfully applied systemsetup settings [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// settings converts the configured fields into the systemsetup settings to apply.
+func (c *SystemSetupModule) settings() (settings []systemsetupSetting, err error) {
+	onOff := func(b bool) string {
+		if b {
+			return "on"
+		}
+		return "off"
+	}
+
+	if c.RemoteLogin != nil {
+		settings = append(settings, systemsetupSetting{"RemoteLogin", "-getremotelogin", "-setremotelogin", onOff(*c.RemoteLogin)})
+	}
+	if c.RemoteAppleEvents != nil {
+		settings = append(settings, systemsetupSetting{"RemoteAppleEvents", "-getremoteappleevents", "-setremoteappleevents", onOff(*c.RemoteAppleEvents)})
+	}
+	if c.RestartFreeze != nil {
+		settings = append(settings, systemsetupSetting{"RestartFreeze", "-getrestartfreeze", "-setrestartfreeze", onOff(*c.RestartFreeze)})
+	}
+	if c.ComputerSleep != "" {
+		value := c.ComputerSleep
+		if strings.EqualFold(value, "never") {
+			value = "Never"
+		} else if minutes, err := strconv.Atoi(value); err != nil || minutes < 1 || minutes > maxComputerSleepMinutes {
+			return nil, fmt.Errorf("ec2macosinit: invalid ComputerSleep %q, must be \"Never\" or between 1 and %d minutes", c.ComputerSleep, maxComputerSleepMinutes)
+		}
+		settings = append(settings, systemsetupSetting{"ComputerSleep", "-getcomputersleep", "-setcomputersleep", value})
+	}
+
+	return settings, nil
+}
+
+// current reads the current value of the setting using systemsetup.
+func (s systemsetupSetting) current(ctx *ModuleContext) (value string, err error) {
+	out, err := ctx.executeCommand([]string{systemsetupPath, s.get}, "", []string{})
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to get current value of %s: %s", s.name, err)
+	}
+	return parseSystemsetupOutput(out.stdout), nil
+}
+
+// parseSystemsetupOutput extracts the value from systemsetup output, which looks like:
+//
+//	Remote Login: On
+//	Computer Sleep: after 10 minutes
+func parseSystemsetupOutput(output string) (value string) {
+	output = strings.TrimSpace(output)
+	if i := strings.LastIndex(output, ": "); i != -1 {
+		return strings.TrimSpace(output[i+2:])
+	}
+	return output
+}
+
+// systemsetupValueMatches compares a value as passed to a systemsetup setter with the value reported by the getter.
+func systemsetupValueMatches(want, got string) bool {
+	if strings.EqualFold(want, got) {
+		return true
+	}
+	// Sleep times are reported as "after N minutes" (or "after 1 minute")
+	fields := strings.Fields(got)
+	return len(fields) == 3 && fields[0] == "after" && fields[1] == want
+}
@@ -0,0 +1,43 @@
+package ec2macosinit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_systemsetupValueMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		output string
+		match  bool
+	}{
+		{"Remote login on", "on", "Remote Login: On\n", true},
+		{"Remote login off", "on", "Remote Login: Off\n", false},
+		{"Sleep never", "Never", "Computer Sleep: Never\n", true},
+		{"Sleep minutes", "10", "Computer Sleep: after 10 minutes\n", true},
+		{"Sleep one minute", "1", "Computer Sleep: after 1 minute\n", true},
+		{"Sleep different minutes", "10", "Computer Sleep: after 15 minutes\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, systemsetupValueMatches(tt.want, parseSystemsetupOutput(tt.output)))
+		})
+	}
+}
+
+func TestSystemSetupModule_settings(t *testing.T) {
+	on := true
+	c := SystemSetupModule{RemoteLogin: &on, ComputerSleep: "never"}
+	settings, err := c.settings()
+	assert.NoError(t, err)
+	assert.Equal(t, []systemsetupSetting{
+		{"RemoteLogin", "-getremotelogin", "-setremotelogin", "on"},
+		{"ComputerSleep", "-getcomputersleep", "-setcomputersleep", "Never"},
+	}, settings)
+
+	c = SystemSetupModule{ComputerSleep: "500"}
+	_, err = c.settings()
+	assert.Error(t, err)
+}
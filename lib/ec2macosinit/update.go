@@ -0,0 +1,172 @@
+package ec2macosinit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// UpdateManifest is the name of the file under the update source which describes the latest build.
+const UpdateManifest = "ec2-macos-init.json"
+
+// UpdateConfig configures where the update command gets new builds from.
+type UpdateConfig struct {
+	Source string `toml:"Source"` // Source is the https:// URL or s3:// URI of the directory containing UpdateManifest
+	TeamID string `toml:"TeamID"` // TeamID is the Apple team ID which must have signed new builds, required to install them
+}
+
+// UpdateRelease is the build described by the update manifest.
+type UpdateRelease struct {
+	Version string `json:"version"` // Version is the release version, compared with the running version
+	URL     string `json:"url"`     // URL is the location of the binary, either absolute or relative to the source
+	SHA256  string `json:"sha256"`  // SHA256 is the hex encoded checksum of the binary
+}
+
+// LatestRelease reads the update manifest from the update source.
+func (c *InitConfig) LatestRelease() (r UpdateRelease, err error) {
+	if c.Update.Source == "" {
+		return UpdateRelease{}, fmt.Errorf("ec2macosinit: no update source is configured")
+	}
+
+	ctx := &ModuleContext{Logger: c.Log, IMDS: &c.IMDS}
+	manifest := strings.TrimSuffix(c.Update.Source, "/") + "/" + UpdateManifest
+	data, err := fetchSource(ctx, manifest)
+	if err != nil {
+		return UpdateRelease{}, err
+	}
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		return UpdateRelease{}, fmt.Errorf("ec2macosinit: invalid update manifest %s: %s", manifest, err)
+	}
+	if r.Version == "" || r.URL == "" || r.SHA256 == "" {
+		return UpdateRelease{}, fmt.Errorf("ec2macosinit: update manifest %s must contain version, url, and sha256", manifest)
+	}
+
+	// Relative URLs are resolved against the manifest, so that a source can be copied to another bucket as is
+	base, err := url.Parse(manifest)
+	if err != nil {
+		return UpdateRelease{}, fmt.Errorf("ec2macosinit: invalid update source %s: %s", c.Update.Source, err)
+	}
+	ref, err := url.Parse(r.URL)
+	if err != nil {
+		return UpdateRelease{}, fmt.Errorf("ec2macosinit: invalid url %q in update manifest: %s", r.URL, err)
+	}
+	r.URL = base.ResolveReference(ref).String()
+
+	return r, nil
+}
+
+// InstallRelease downloads the release and replaces the binary at path with it. The download must match the checksum
+// in the manifest and be signed by the configured team. The new binary is written next to the
+// current one and renamed over it, so the binary is never partially written, and the current binary is kept with a
+// .previous suffix.
+func (c *InitConfig) InstallRelease(r UpdateRelease, path string) (err error) {
+	// The checksum comes from the same source as the binary, so it only proves the download is intact
+	if c.Update.TeamID == "" {
+		return fmt.Errorf("ec2macosinit: a TeamID must be configured to install updates")
+	}
+	ctx := &ModuleContext{Logger: c.Log, IMDS: &c.IMDS}
+	data, err := fetchSource(ctx, r.URL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), strings.TrimSpace(r.SHA256)) {
+		return fmt.Errorf("ec2macosinit: checksum of %s doesn't match the update manifest", r.URL)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*", filepath.Base(path)))
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write update: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0755)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to write update: %s", err)
+	}
+
+	err = verifyCodeSignature(f.Name(), c.Update.TeamID)
+	if err != nil {
+		return err
+	}
+
+	// Keep the current binary so that the update can be undone by hand
+	previous := path + ".previous"
+	err = os.Remove(previous)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ec2macosinit: unable to remove %s: %s", previous, err)
+	}
+	err = os.Link(path, previous)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to keep current binary as %s: %s", previous, err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: unable to replace %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// verifyCodeSignature checks that the binary has a valid code signature from a Developer ID certificate of the team.
+var verifyCodeSignature = func(path, teamID string) (err error) {
+	out, err := executeCommand([]string{"/usr/bin/codesign", "--verify", "--strict", "-R=" + codeSignatureRequirement(teamID), path}, "", []string{})
+	if err != nil {
+		return fmt.Errorf("ec2macosinit: update isn't signed by team %s: %s: %s", teamID, err, strings.TrimSpace(out.stderr))
+	}
+	return nil
+}
+
+// codeSignatureRequirement returns the code requirement for a Developer ID Application certificate issued to the team.
+// The intermediate must be the Developer ID CA and the leaf a Developer ID Application certificate, so that other
+// certificates of the team, such as development ones, aren't accepted.
+func codeSignatureRequirement(teamID string) string {
+	return fmt.Sprintf("anchor apple generic and certificate 1[field.1.2.840.113635.100.6.2.6] and "+
+		"certificate leaf[field.1.2.840.113635.100.6.1.13] and certificate leaf[subject.OU] = %q", teamID)
+}
+
+// NewerVersion returns whether candidate is a later version than current. Versions are compared by their dot separated
+// numbers, ignoring a leading v and anything following a hyphen, such as the suffix added by git describe.
+func NewerVersion(current, candidate string) bool {
+	cur, cand := versionNumbers(current), versionNumbers(candidate)
+	for i := 0; i < len(cur) || i < len(cand); i++ {
+		var a, b int
+		if i < len(cur) {
+			a = cur[i]
+		}
+		if i < len(cand) {
+			b = cand[i]
+		}
+		if a != b {
+			return b > a
+		}
+	}
+	return false
+}
+
+// versionNumbers returns the numbers of a version, with any part which isn't a number treated as zero.
+func versionNumbers(version string) (numbers []int) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	version = strings.SplitN(version, "-", 2)[0]
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
@@ -0,0 +1,99 @@
+package ec2macosinit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewerVersion(t *testing.T) {
+	assert.True(t, NewerVersion("1.4.0", "1.5.0"))
+	assert.True(t, NewerVersion("v1.4.9", "v1.10.0"))
+	assert.True(t, NewerVersion("1.4", "1.4.1"))
+	assert.True(t, NewerVersion("0.0.0-dev", "1.0.0"))
+	assert.False(t, NewerVersion("1.5.0", "1.5.0"))
+	assert.False(t, NewerVersion("1.5.0-3-gabcdef0", "1.5.0"))
+	assert.False(t, NewerVersion("2.0.0", "1.9.9"))
+}
+
+func TestInitConfig_InstallRelease(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho new\n")
+	sum := sha256.Sum256(binary)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/" + UpdateManifest:
+			_, _ = w.Write([]byte(`{"version": "1.5.0", "url": "1.5.0/ec2-macos-init", "sha256": "` + hex.EncodeToString(sum[:]) + `"}`))
+		case "/releases/1.5.0/ec2-macos-init":
+			_, _ = w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var verified []string
+	defer func(f func(path, teamID string) error) { verifyCodeSignature = f }(verifyCodeSignature)
+	verifyCodeSignature = func(path, teamID string) error {
+		verified = append(verified, teamID)
+		return nil
+	}
+
+	c := &InitConfig{Log: &Logger{}, Update: UpdateConfig{Source: server.URL + "/releases/", TeamID: "ABCDE12345"}}
+	r, err := c.LatestRelease()
+	require.NoError(t, err)
+	assert.Equal(t, UpdateRelease{Version: "1.5.0", URL: server.URL + "/releases/1.5.0/ec2-macos-init", SHA256: hex.EncodeToString(sum[:])}, r)
+
+	path := filepath.Join(t.TempDir(), "ec2-macos-init")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0755))
+	require.NoError(t, c.InstallRelease(r, path))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, binary, data)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	data, err = os.ReadFile(path + ".previous")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+	assert.Equal(t, []string{"ABCDE12345"}, verified)
+
+	// A download which doesn't match the checksum leaves the binary alone
+	r.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	assert.Error(t, c.InstallRelease(r, path))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, binary, data)
+
+	// A download which isn't signed by the team leaves the binary alone
+	r.SHA256 = hex.EncodeToString(sum[:])
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0755))
+	verifyCodeSignature = func(path, teamID string) error { return assert.AnError }
+	assert.Error(t, c.InstallRelease(r, path))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// Nothing is installed without a team ID
+	c.Update.TeamID = ""
+	verified = nil
+	assert.Error(t, c.InstallRelease(r, path))
+	assert.Empty(t, verified)
+
+	// No update source is configured
+	c.Update.Source = ""
+	_, err = c.LatestRelease()
+	assert.Error(t, err)
+}
+
+func TestCodeSignatureRequirement(t *testing.T) {
+	assert.Equal(t, `anchor apple generic and certificate 1[field.1.2.840.113635.100.6.2.6] and `+
+		`certificate leaf[field.1.2.840.113635.100.6.1.13] and certificate leaf[subject.OU] = "ABCDE12345"`,
+		codeSignatureRequirement("ABCDE12345"))
+}
@@ -2,6 +2,7 @@ package ec2macosinit
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -9,55 +10,304 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// gzipMagic is the header of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // UserDataModule contains contains all necessary configuration fields for running a User Data module.
 type UserDataModule struct {
 	// ExecuteUserData must be set to `true` for the userdata script contents to
 	// be executed.
 	ExecuteUserData bool `toml:"ExecuteUserData"`
+	// Source is an http(s):// URL or s3:// URI to fetch user data from
+	// instead of IMDS. S3 objects are fetched with the instance profile role.
+	Source string `toml:"Source"`
+	// DefaultInterpreter runs scripts which don't start with a shebang,
+	// defaults to /bin/zsh.
+	DefaultInterpreter string `toml:"DefaultInterpreter"`
+	// RunAsUser runs scripts as the user, with their login environment and
+	// home directory as the working directory, instead of root.
+	RunAsUser string `toml:"RunAsUser"`
+	// Boothooks runs #cloud-boothook scripts every boot while the rest of the
+	// user data still runs once per instance. The module must be RunPerBoot.
+	Boothooks bool `toml:"Boothooks"`
+	// TimeoutSeconds stops each script, and anything it started, after this
+	// many seconds. Zero disables the timeout.
+	TimeoutSeconds int `toml:"TimeoutSeconds"`
+	// ConsoleOutput also writes script output to the console, so it's
+	// available with get-console-output.
+	ConsoleOutput bool `toml:"ConsoleOutput"`
+	// InstanceEnvironmentNetwork adds EC2_* variables describing the primary
+	// network interface to the environment of scripts.
+	InstanceEnvironmentNetwork bool `toml:"InstanceEnvironmentNetwork"`
+	// InstanceEnvironmentTags adds an EC2_TAG_<key> variable for each
+	// instance tag to the environment of scripts.
+	InstanceEnvironmentTags bool `toml:"InstanceEnvironmentTags"`
 }
 
+// defaultUserDataInterpreter runs user data scripts without a shebang.
+const defaultUserDataInterpreter = "/bin/zsh"
+
+// userDataOutputFile collects the output and exit code of every user data script run for the instance.
+const userDataOutputFile = "userdata-output.log"
+
+// userDataCompleteFile marks, in the instance history, that user data other than boothooks has been handled.
+const userDataCompleteFile = "userdata-complete"
+
 // Do fetches userdata and writes it to a file in the instance history. The
 // written script is then executed when ExecuteUserData is true.
 func (m *UserDataModule) Do(mctx *ModuleContext) (message string, err error) {
 	const scriptFileName = "userdata"
 	userdataScript := filepath.Join(mctx.InstanceHistoryPath(), scriptFileName)
 
-	// Get user data from IMDS
-	ud, respCode, err := mctx.IMDS.getIMDSProperty("user-data")
-	if err != nil {
-		return "", fmt.Errorf("ec2macosinit: error getting user data from IMDS: %s\n", err)
-	}
-	if respCode == 404 { // 404 = no user data provided, exit nicely
-		return "no user data provided through IMDS", nil
+	var data []byte
+	if m.Source != "" {
+		// Get user data from the configured source
+		data, err = fetchSource(mctx, m.Source)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error getting user data: %s", err)
+		}
+	} else {
+		// Get user data from IMDS
+		ud, respCode, err := mctx.IMDS.getIMDSProperty("user-data")
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error getting user data from IMDS: %s\n", err)
+		}
+		if respCode == 404 { // 404 = no user data provided, exit nicely
+			return "no user data provided through IMDS", nil
+		}
+		if respCode != 200 { // 200 = ok
+			return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d - %s\n", respCode, err)
+		}
+
+		data, err = io.ReadAll(userdataReader(ud))
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error reading user data: %s", err)
+		}
 	}
-	if respCode != 200 { // 200 = ok
-		return "", fmt.Errorf("ec2macosinit: received an unexpected response code from IMDS: %d - %s\n", respCode, err)
+	data, err = gunzipUserData(data)
+	if err != nil {
+		return "", err
 	}
 
-	err = writeShellScript(userdataScript, userdataReader(ud))
+	err = writeShellScript(userdataScript, bytes.NewReader(data))
 	if err != nil {
 		return "", fmt.Errorf("userdata script: %w", err)
 	}
 
+	// Multipart and #include user data is handled part by part, the whole of it is still kept in the userdata file
+	parts, err := splitUserData(data)
+	if err != nil {
+		return "", err
+	}
+	if m.Boothooks || len(parts) != 1 || parts[0].contentType != userDataShellScript {
+		return m.doParts(mctx, parts)
+	}
+
 	// If we don't want to execute the user data, exit nicely - we're done
 	if !m.ExecuteUserData {
 		return "successfully handled user data with no execution request", nil
 	}
 
-	// Execute user data script
-	out, err := executeCommand([]string{userdataScript}, "", []string{})
+	return m.runScript(mctx, userdataScript, data)
+}
+
+// scriptCommand returns the command used to run a user data script. Scripts starting with a shebang, for any
+// interpreter, are executed directly. Other text is run with the default interpreter, and anything else, which isn't a
+// script, returns nil.
+func (m *UserDataModule) scriptCommand(path string, content []byte) (cmd []string) {
+	if bytes.HasPrefix(content, []byte("#!")) {
+		return []string{path}
+	}
+	if !strings.HasPrefix(http.DetectContentType(content), "text/plain") {
+		return nil
+	}
+	interpreter := m.DefaultInterpreter
+	if interpreter == "" {
+		interpreter = defaultUserDataInterpreter
+	}
+	return []string{interpreter, path}
+}
+
+// runScript executes a user data script, with environment variables describing the instance. If they can't be read
+// from IMDS, the script is run without them. When TimeoutSeconds is set, the script and anything it started are
+// stopped once it's reached. Output is logged line by line as the script runs and written to a log file next to the
+// script, which is replaced each run. It's also appended, along with the exit code, to the user data output file for
+// the instance. Content which isn't a script is reported but isn't an error.
+func (m *UserDataModule) runScript(mctx *ModuleContext, path string, content []byte) (message string, err error) {
+	cmd := m.scriptCommand(path, content)
+	if cmd == nil {
+		return fmt.Sprintf("provided user data is not executable (detected type: %s)", http.DetectContentType(content)), nil
+	}
+	opts := commandOptions{Timeout: time.Duration(m.TimeoutSeconds) * time.Second}
+	opts.EnvVars, err = mctx.IMDS.InstanceEnvironment(m.InstanceEnvironmentNetwork, m.InstanceEnvironmentTags)
+	if err != nil {
+		mctx.Logger.Warnf("Running user data without instance environment variables: %s", err)
+	}
+	if m.RunAsUser != "" {
+		env, home, err := userEnvironment(mctx, m.RunAsUser)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to get environment for user %s: %s", m.RunAsUser, err)
+		}
+		opts.RunAsUser, opts.EnvVars, opts.Dir = m.RunAsUser, append(opts.EnvVars, env...), home
+	}
+
+	logPath := path + ".log"
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to open user data output file: %s", err)
+	}
+	defer f.Close()
+	combined, err := os.OpenFile(filepath.Join(mctx.InstanceHistoryPath(), userDataOutputFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to open user data output file: %s", err)
+	}
+	defer combined.Close()
+	name := filepath.Base(path)
+	lines := newLineWriter(mctx.Logger, name)
+	lines.console = m.ConsoleOutput
+	opts.Output = io.MultiWriter(f, combined, lines)
+
+	_, _ = fmt.Fprintf(combined, "==> %s started at %s\n", name, time.Now().UTC().Format(time.RFC3339))
+	_, err = mctx.runCommand(cmd, opts)
+	lines.Flush()
+	_, _ = fmt.Fprintf(combined, "==> %s finished at %s with exit code %d\n", name, time.Now().UTC().Format(time.RFC3339), exitCode(err))
 	if err != nil {
 		if strings.Contains(err.Error(), "exec format error") {
-			contentType := http.DetectContentType([]byte(ud))
+			contentType := http.DetectContentType(content)
 			return fmt.Sprintf("provided user data is not executable (detected type: %s)", contentType), nil
 		} else {
-			return fmt.Sprintf("error while running user data with stdout: [%s] and stderr: [%s]", out.stdout, out.stderr), err
+			return fmt.Sprintf("error while running user data with output written to %s", logPath), err
+		}
+	}
+
+	return fmt.Sprintf("successfully ran user data with output written to %s", logPath), nil
+}
+
+// maxIncludeDepth limits how deeply #include user data may include more #include user data.
+const maxIncludeDepth = 3
+
+// userDataRun tracks the handling of user data parts.
+type userDataRun struct {
+	mctx                 *ModuleContext
+	m                    *UserDataModule
+	count                int // count is the number of parts seen, used to name their files
+	ran, parsed, skipped int
+	failures             []string
+	boothooksOnly        bool // boothooksOnly is set when the rest of the user data already ran for this instance
+}
+
+// doParts handles each part of multipart or #include user data in order. Shell scripts and boothooks are written to the
+// instance history and, when ExecuteUserData is true, executed. Cloud-config is parsed and saved but not applied,
+// #include parts are fetched and handled in place when ExecuteUserData is true, and any other content type is skipped.
+//
+// With Boothooks, only boothooks are run once the rest of the user data has been handled successfully for the instance.
+func (m *UserDataModule) doParts(mctx *ModuleContext, parts []userDataPart) (message string, err error) {
+	r := &userDataRun{mctx: mctx, m: m}
+	completeFile := filepath.Join(mctx.InstanceHistoryPath(), userDataCompleteFile)
+	if m.Boothooks {
+		_, err = os.Stat(completeFile)
+		r.boothooksOnly = err == nil
+	}
+	r.handle(parts, 0)
+
+	message = fmt.Sprintf("handled user data with %d part(s): %d script(s) run, %d cloud-config part(s) parsed, %d part(s) skipped", r.count, r.ran, r.parsed, r.skipped)
+	if len(r.failures) > 0 {
+		return message, fmt.Errorf("ec2macosinit: %d user data part(s) failed: %s", len(r.failures), strings.Join(r.failures, "; "))
+	}
+	if m.Boothooks && !r.boothooksOnly {
+		err = os.WriteFile(completeFile, []byte{}, 0600)
+		if err != nil {
+			return message, fmt.Errorf("ec2macosinit: unable to record user data completion: %s", err)
+		}
+	}
+	return message, nil
+}
+
+// handle handles each part in order, recording the outcome.
+func (r *userDataRun) handle(parts []userDataPart, depth int) {
+	for _, p := range parts {
+		r.count++
+		n := r.count
+		path := filepath.Join(r.mctx.InstanceHistoryPath(), fmt.Sprintf("userdata-part-%03d", n))
+		if r.boothooksOnly && p.contentType != userDataBoothook && p.contentType != userDataInclude {
+			r.mctx.Logger.Infof("Skipping user data part %d (%s) which already ran for this instance", n, p.contentType)
+			r.skipped++
+			continue
+		}
+		switch p.contentType {
+		case userDataShellScript, userDataBoothook:
+			if p.contentType == userDataBoothook {
+				p.content = stripBoothookMarker(p.content)
+			}
+			err := writeShellScript(path, bytes.NewReader(p.content))
+			if err != nil {
+				r.failures = append(r.failures, fmt.Sprintf("part %d: %s", n, err))
+				continue
+			}
+			if !r.m.ExecuteUserData {
+				continue
+			}
+			message, err := r.m.runScript(r.mctx, path, p.content)
+			r.mctx.Logger.Infof("User data part %d (%s): %s", n, p.contentType, message)
+			if err != nil {
+				r.failures = append(r.failures, fmt.Sprintf("part %d: %s", n, err))
+				continue
+			}
+			r.ran++
+		case userDataCloudConfig:
+			keys, err := cloudConfigKeys(p.content)
+			if err != nil {
+				r.failures = append(r.failures, fmt.Sprintf("part %d: %s", n, err))
+				continue
+			}
+			err = os.WriteFile(path, p.content, 0600)
+			if err != nil {
+				r.failures = append(r.failures, fmt.Sprintf("part %d: %s", n, err))
+				continue
+			}
+			r.mctx.Logger.Warnf("User data part %d is cloud-config, which is saved to %s but not applied (keys: %s)", n, path, strings.Join(keys, ", "))
+			r.parsed++
+		case userDataInclude:
+			// Included user data is only fetched to be run, so nothing is fetched unless it would be run
+			if !r.m.ExecuteUserData {
+				r.mctx.Logger.Infof("Not fetching user data included by part %d since ExecuteUserData isn't set", n)
+				r.skipped++
+				continue
+			}
+			if depth >= maxIncludeDepth {
+				r.failures = append(r.failures, fmt.Sprintf("part %d: #include nested more than %d deep", n, maxIncludeDepth))
+				continue
+			}
+			for _, source := range includeURLs(p.content) {
+				r.mctx.Logger.Infof("Fetching user data included by part %d from %s", n, source)
+				included, err := r.fetchIncluded(source)
+				if err != nil {
+					r.failures = append(r.failures, fmt.Sprintf("part %d: %s", n, err))
+					continue
+				}
+				r.handle(included, depth+1)
+			}
+		default:
+			r.mctx.Logger.Infof("Skipping user data part %d with unsupported content type %s", n, p.contentType)
+			r.skipped++
 		}
 	}
+}
 
-	return fmt.Sprintf("successfully ran user data with stdout: [%s] and stderr: [%s]", out.stdout, out.stderr), nil
+// fetchIncluded fetches user data included with #include and splits it into parts.
+func (r *userDataRun) fetchIncluded(source string) (parts []userDataPart, err error) {
+	data, err := fetchSource(r.mctx, source)
+	if err != nil {
+		return nil, err
+	}
+	data, err = gunzipUserData(data)
+	if err != nil {
+		return nil, err
+	}
+	return splitUserData(data)
 }
 
 // userdataReader provides a decoded reader for the provided userdata text.
@@ -79,6 +329,27 @@ func userdataReader(text string) io.Reader {
 	}
 }
 
+// gunzipUserData decompresses gzip compressed user data, which is used to fit larger scripts within the 16KB limit.
+// Anything else is returned as is.
+func gunzipUserData(data []byte) (decompressed []byte, err error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error decompressing user data: %s", err)
+	}
+	defer zr.Close()
+	decompressed, err = io.ReadAll(io.LimitReader(zr, maxFetchSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error decompressing user data: %s", err)
+	}
+	if len(decompressed) > maxFetchSize {
+		return nil, fmt.Errorf("ec2macosinit: decompressed user data exceeds the maximum size of %d bytes", maxFetchSize)
+	}
+	return decompressed, nil
+}
+
 // writeShellScript writes an executable file to the provided path.
 func writeShellScript(path string, rd io.Reader) error {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
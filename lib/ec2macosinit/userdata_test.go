@@ -1,13 +1,36 @@
 package ec2macosinit
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// newTestUserDataContext returns a module context with an instance history directory and IMDS serving the instance
+// metadata used by user data scripts.
+func newTestUserDataContext(t *testing.T) *ModuleContext {
+	imds, _ := newTestIMDS(t, map[string]string{
+		"meta-data/instance-id":                 "i-0123456789abcdef0",
+		"meta-data/instance-type":               "mac2.metal",
+		"meta-data/placement/region":            "us-west-2",
+		"meta-data/placement/availability-zone": "us-west-2a",
+	})
+	imds.InstanceID = "i-0123456789abcdef0"
+	mctx := &ModuleContext{Logger: &Logger{}, IMDS: imds, BaseDirectory: t.TempDir()}
+	require.NoError(t, os.MkdirAll(mctx.InstanceHistoryPath(), 0755))
+	return mctx
+}
+
 func TestUserdataReader_ValidTexts(t *testing.T) {
 	const expected = "hello, world!"
 	texts := []string{
@@ -24,3 +47,201 @@ func TestUserdataReader_ValidTexts(t *testing.T) {
 		})
 	}
 }
+
+func Test_splitUserData(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		parts, err := splitUserData([]byte("#!/bin/sh\necho hello\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, []userDataPart{{contentType: userDataShellScript, content: []byte("#!/bin/sh\necho hello\n")}}, parts)
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		const data = "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\n" +
+			"MIME-Version: 1.0\n" +
+			"\n" +
+			"--BOUNDARY\n" +
+			"Content-Type: text/cloud-config; charset=\"us-ascii\"\n" +
+			"\n" +
+			"packages:\n  - git\n" +
+			"--BOUNDARY\n" +
+			"Content-Type: text/x-shellscript; charset=\"us-ascii\"\n" +
+			"Content-Transfer-Encoding: base64\n" +
+			"Content-Disposition: attachment; filename=\"setup.sh\"\n" +
+			"\n" +
+			"IyEvYmluL3NoCmVjaG8g\naGVsbG8K\n" +
+			"--BOUNDARY\n" +
+			"Content-Type: text/plain\n" +
+			"\n" +
+			"notes\n" +
+			"--BOUNDARY--\n"
+		parts, err := splitUserData([]byte(data))
+		assert.NoError(t, err)
+		assert.Equal(t, []userDataPart{
+			{contentType: userDataCloudConfig, content: []byte("packages:\n  - git")},
+			{contentType: userDataShellScript, filename: "setup.sh", content: []byte("#!/bin/sh\necho hello\n")},
+			{contentType: "text/plain", content: []byte("notes")},
+		}, parts)
+
+		keys, err := cloudConfigKeys(parts[0].content)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"packages"}, keys)
+	})
+}
+
+func Test_gunzipUserData(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte("#!/bin/sh\necho hello\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	// Compressed user data, either raw or base64 encoded as it may be when given to the API
+	for _, text := range []string{compressed.String(), base64.StdEncoding.EncodeToString(compressed.Bytes())} {
+		data, err := io.ReadAll(userdataReader(text))
+		assert.NoError(t, err)
+		data, err = gunzipUserData(data)
+		assert.NoError(t, err)
+		assert.Equal(t, "#!/bin/sh\necho hello\n", string(data))
+	}
+
+	// Uncompressed user data is unchanged
+	data, err := gunzipUserData([]byte("plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", string(data))
+}
+
+func TestUserDataModule_doParts_include(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/setup.sh":
+			_, _ = w.Write([]byte("#!/bin/sh\necho setup\n"))
+		case "/config.yaml":
+			_, _ = w.Write([]byte("#cloud-config\npackages: [git]\n"))
+		case "/nested":
+			_, _ = w.Write([]byte("#include\n" + "http://" + r.Host + "/setup.sh\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	include := []byte("#include\n# bootstrap scripts\n" + server.URL + "/nested\n\n" + server.URL + "/config.yaml\n")
+	assert.Equal(t, []string{server.URL + "/nested", server.URL + "/config.yaml"}, includeURLs(include))
+	parts, err := splitUserData(include)
+	assert.NoError(t, err)
+	assert.Equal(t, userDataInclude, parts[0].contentType)
+
+	mctx := &ModuleContext{Logger: &Logger{}, IMDS: &IMDSConfig{InstanceID: "i-0123456789abcdef0"}, BaseDirectory: t.TempDir()}
+	require.NoError(t, os.MkdirAll(mctx.InstanceHistoryPath(), 0755))
+
+	// Nothing is fetched unless user data is executed
+	m := &UserDataModule{}
+	message, err := m.doParts(mctx, parts)
+	assert.NoError(t, err)
+	assert.Equal(t, "handled user data with 1 part(s): 0 script(s) run, 0 cloud-config part(s) parsed, 1 part(s) skipped", message)
+	assert.NoFileExists(t, filepath.Join(mctx.InstanceHistoryPath(), "userdata-part-002"))
+
+	m = &UserDataModule{ExecuteUserData: true}
+	message, err = m.doParts(mctx, parts)
+	assert.NoError(t, err)
+	assert.Equal(t, "handled user data with 4 part(s): 1 script(s) run, 1 cloud-config part(s) parsed, 0 part(s) skipped", message)
+
+	// Parts are numbered in the order they're handled, with included parts following the part including them
+	script, err := os.ReadFile(filepath.Join(mctx.InstanceHistoryPath(), "userdata-part-003"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho setup\n", string(script))
+}
+
+func TestUserDataModule_Do_source(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#!/bin/sh\necho bootstrap\n"))
+	}))
+	defer server.Close()
+
+	mctx := &ModuleContext{Logger: &Logger{}, IMDS: &IMDSConfig{InstanceID: "i-0123456789abcdef0"}, BaseDirectory: t.TempDir()}
+	require.NoError(t, os.MkdirAll(mctx.InstanceHistoryPath(), 0755))
+	m := &UserDataModule{Source: server.URL + "/bootstrap.sh"}
+	message, err := m.Do(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "successfully handled user data with no execution request", message)
+
+	script, err := os.ReadFile(filepath.Join(mctx.InstanceHistoryPath(), "userdata"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho bootstrap\n", string(script))
+}
+
+func TestUserDataModule_scriptCommand(t *testing.T) {
+	m := &UserDataModule{}
+	assert.Equal(t, []string{"/path/userdata"}, m.scriptCommand("/path/userdata", []byte("#!/usr/bin/env python3\nprint('hi')\n")))
+	assert.Equal(t, []string{"/bin/zsh", "/path/userdata"}, m.scriptCommand("/path/userdata", []byte("echo hello\n")))
+	assert.Nil(t, m.scriptCommand("/path/userdata", []byte{0x00, 0x01, 0x02}))
+
+	m.DefaultInterpreter = "/bin/sh"
+	path := filepath.Join(t.TempDir(), "userdata")
+	require.NoError(t, writeShellScript(path, bytes.NewBufferString("echo hello\n")))
+	mctx := newTestUserDataContext(t)
+	message, err := m.runScript(mctx, path, []byte("echo hello\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "successfully ran user data with output written to "+path+".log", message)
+	out, err := os.ReadFile(path + ".log")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(out))
+
+	// Scripts can use the instance's metadata from the environment
+	require.NoError(t, writeShellScript(path, bytes.NewBufferString("echo $EC2_INSTANCE_ID $EC2_AVAILABILITY_ZONE\n")))
+	_, err = m.runScript(mctx, path, []byte("echo $EC2_INSTANCE_ID $EC2_AVAILABILITY_ZONE\n"))
+	assert.NoError(t, err)
+	out, err = os.ReadFile(path + ".log")
+	assert.NoError(t, err)
+	assert.Equal(t, "i-0123456789abcdef0 us-west-2a\n", string(out))
+
+	// Scripts still run when the metadata can't be read
+	noMetadata := *mctx
+	noMetadata.IMDS, _ = newTestIMDS(t, map[string]string{})
+	noMetadata.IMDS.InstanceID = mctx.IMDS.InstanceID
+	_, err = m.runScript(&noMetadata, path, []byte("echo $EC2_INSTANCE_ID $EC2_AVAILABILITY_ZONE\n"))
+	assert.NoError(t, err)
+	out, err = os.ReadFile(path + ".log")
+	assert.NoError(t, err)
+	assert.Equal(t, "\n", string(out))
+
+	// Scripts which run too long are stopped
+	m.TimeoutSeconds = 1
+	require.NoError(t, writeShellScript(path, bytes.NewBufferString("echo started\nsleep 10\n")))
+	_, err = m.runScript(mctx, path, []byte("echo started\nsleep 10\n"))
+	assert.EqualError(t, err, "ec2macosinit: command timed out after 1s")
+	out, err = os.ReadFile(path + ".log")
+	assert.NoError(t, err)
+	assert.Equal(t, "started\n", string(out))
+
+	// Every run is collected, with its exit code, in the output file for the instance
+	out, err = os.ReadFile(filepath.Join(mctx.InstanceHistoryPath(), userDataOutputFile))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^==> userdata started at \S+\nhello\n==> userdata finished at \S+ with exit code 0\n`+
+		`==> userdata started at \S+\ni-0123456789abcdef0 us-west-2a\n==> userdata finished at \S+ with exit code 0\n`+
+		`==> userdata started at \S+\n\n==> userdata finished at \S+ with exit code 0\n`+
+		`==> userdata started at \S+\nstarted\n==> userdata finished at \S+ with exit code -1\n$`, string(out))
+}
+
+func TestUserDataModule_doParts_boothooks(t *testing.T) {
+	mctx := newTestUserDataContext(t)
+	runs := filepath.Join(t.TempDir(), "runs")
+
+	hook := []byte("#cloud-boothook\n#!/bin/sh\necho hook >> " + runs + "\n")
+	assert.Equal(t, userDataBoothook, plainUserDataType(hook))
+	assert.Equal(t, "#!/bin/sh\necho hook >> "+runs+"\n", string(stripBoothookMarker(hook)))
+	parts := []userDataPart{
+		{contentType: userDataBoothook, content: hook},
+		{contentType: userDataShellScript, content: []byte("#!/bin/sh\necho script >> " + runs + "\n")},
+	}
+
+	// The first boot runs everything, later boots only run the boothook
+	m := &UserDataModule{ExecuteUserData: true, Boothooks: true}
+	for i := 0; i < 2; i++ {
+		_, err := m.doParts(mctx, parts)
+		assert.NoError(t, err)
+	}
+	out, err := os.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, "hook\nscript\nhook\n", string(out))
+}
@@ -0,0 +1,170 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// User data content types, matching those used by cloud-init.
+const (
+	userDataShellScript = "text/x-shellscript"
+	userDataCloudConfig = "text/cloud-config"
+	userDataInclude     = "text/x-include-url"
+	userDataBoothook    = "text/cloud-boothook"
+)
+
+// userDataStartsWith maps the first line of plain user data to its content type, as cloud-init does.
+var userDataStartsWith = map[string]string{
+	"#include":        userDataInclude,
+	"#cloud-config":   userDataCloudConfig,
+	"#cloud-boothook": userDataBoothook,
+}
+
+// userDataPart is a single piece of user data, handled according to its content type.
+type userDataPart struct {
+	contentType string
+	filename    string
+	content     []byte
+}
+
+// isMIMEUserData returns whether the user data is a MIME message, which always starts with a header.
+func isMIMEUserData(data []byte) bool {
+	firstLine := strings.ToLower(string(bytes.SplitN(data, []byte("\n"), 2)[0]))
+	return strings.HasPrefix(firstLine, "content-type:") || strings.HasPrefix(firstLine, "mime-version:")
+}
+
+// splitUserData splits user data into its parts. A multipart MIME message, like those created by cloud-init's
+// make-mime or Packer, is split into its parts in order, including the parts of nested multipart messages. Anything
+// else is a single part, with the content type given by its first line and defaulting to a shell script.
+func splitUserData(data []byte) (parts []userDataPart, err error) {
+	if !isMIMEUserData(data) {
+		return []userDataPart{{contentType: plainUserDataType(data), content: data}}, nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to parse MIME user data: %s", err)
+	}
+	return splitMIMEPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+}
+
+// splitMIMEPart returns the parts of a single MIME entity, recursing into multipart entities.
+func splitMIMEPart(contentType, encoding, filename string, body io.Reader) (parts []userDataPart, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: invalid content type %q in MIME user data: %s", contentType, err)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return parts, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ec2macosinit: unable to read MIME user data part: %s", err)
+			}
+			partType := p.Header.Get("Content-Type")
+			if partType == "" {
+				partType = "text/plain"
+			}
+			subparts, err := splitMIMEPart(partType, p.Header.Get("Content-Transfer-Encoding"), p.FileName(), p)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, subparts...)
+		}
+	}
+
+	if strings.EqualFold(strings.TrimSpace(encoding), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: unable to read MIME user data part: %s", err)
+	}
+	return []userDataPart{{contentType: mediaType, filename: filename, content: content}}, nil
+}
+
+// plainUserDataType returns the content type of user data which isn't a MIME message.
+func plainUserDataType(data []byte) string {
+	firstLine := strings.TrimSpace(string(bytes.SplitN(data, []byte("\n"), 2)[0]))
+	for prefix, contentType := range userDataStartsWith {
+		if strings.HasPrefix(firstLine, prefix) {
+			return contentType
+		}
+	}
+	return userDataShellScript
+}
+
+// includeURLs returns the URLs listed in #include user data, one per line. Blank lines and comments, including the
+// #include line itself, are ignored.
+func includeURLs(content []byte) (urls []string) {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls
+}
+
+// stripBoothookMarker removes the #cloud-boothook line from the start of a boothook, so that a shebang following it is
+// used to run the script.
+func stripBoothookMarker(content []byte) []byte {
+	if !bytes.HasPrefix(bytes.TrimLeft(content, " \t"), []byte("#cloud-boothook")) {
+		return content
+	}
+	lines := bytes.SplitN(content, []byte("\n"), 2)
+	if len(lines) < 2 {
+		return []byte{}
+	}
+	return lines[1]
+}
+
+// newlineStripper removes line breaks, which base64 encoded MIME parts are wrapped with.
+type newlineStripper struct {
+	r io.Reader
+}
+
+// Read reads from the underlying reader with line breaks removed.
+func (n newlineStripper) Read(p []byte) (int, error) {
+	for {
+		c, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:c] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+// cloudConfigKeys parses cloud-config and returns its top level keys.
+func cloudConfigKeys(content []byte) (keys []string, err error) {
+	var config map[string]interface{}
+	err = yaml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: invalid cloud-config: %s", err)
+	}
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
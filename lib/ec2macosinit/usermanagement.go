@@ -17,25 +17,114 @@ const (
 
 // UserManagementModule contains the necessary values to run a User Management Module
 type UserManagementModule struct {
-	RandomizePassword bool   `toml:"RandomizePassword"`
-	User              string `toml:"User"`
+	RandomizePassword      bool   `toml:"RandomizePassword"`
+	User                   string `toml:"User"`
+	PasswordEscrow         string `toml:"PasswordEscrow"`         // PasswordEscrow is "secretsmanager" or "ssm"
+	PasswordEscrowName     string `toml:"PasswordEscrowName"`     // PasswordEscrowName overrides the per-instance name
+	PasswordEscrowKMSKeyID string `toml:"PasswordEscrowKMSKeyID"` // PasswordEscrowKMSKeyID encrypts with a customer key
+	PasswordToConsole      bool   `toml:"PasswordToConsole"`      // PasswordToConsole writes the encrypted password to the console
+	Shell                  string `toml:"Shell"`                  // Shell is the user's login shell
+	RealName               string `toml:"RealName"`               // RealName is the user's full name
+	Home                   string `toml:"Home"`                   // Home is the user's home directory
+	PasswordHint           string `toml:"PasswordHint"`           // PasswordHint is shown at the login window
+	Picture                string `toml:"Picture"`                // Picture is the path to the user's picture
+}
+
+// userAttribute is a directory services attribute of a user and its desired value.
+type userAttribute struct {
+	name  string
+	value string
 }
 
 // Do for the UserManagementModule is the primary entry point for the User Management Module.
 func (c *UserManagementModule) Do(ctx *ModuleContext) (message string, err error) {
-	// Check if randomizing password is requested. If so, then perform action, otherwise return with no work to do
+	attributes := c.attributes()
+	// Check if there is anything to do, otherwise return with no work to do
+	if !c.RandomizePassword && len(attributes) == 0 {
+		return "randomizing password disabled, skipping", nil
+	}
+
+	var messages []string
+	if len(attributes) > 0 {
+		if c.User == "" {
+			c.User = "ec2-user"
+		}
+		changed, err := setUserAttributes(ctx, c.User, attributes)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: failed to set user attributes: %s", err)
+		}
+		messages = append(messages, fmt.Sprintf("successfully set user attributes for %s [%d changed / %d unchanged]", c.User, changed, len(attributes)-changed))
+	}
+
+	// Check if randomizing password is requested. If so, then perform action
 	if c.RandomizePassword {
-		message, err = c.randomizePassword()
+		message, err = c.randomizePassword(ctx)
 		if err != nil {
 			return "", fmt.Errorf("ec2macosinit: failed to randomize password: %s", err)
 		}
-	} else {
-		return "randomizing password disabled, skipping", nil
+		messages = append(messages, message)
 	}
 
-	// For now, `message` will only be set if RandomizePassword is true. Instead of returning above, it is returned here
-	// for readability and future additions to the module
-	return message, nil
+	return strings.Join(messages, ", "), nil
+}
+
+// attributes returns the configured user attributes.
+func (c *UserManagementModule) attributes() (attributes []userAttribute) {
+	for _, a := range []userAttribute{
+		{"UserShell", c.Shell},
+		{"RealName", c.RealName},
+		{"NFSHomeDirectory", c.Home},
+		{"AuthenticationHint", c.PasswordHint},
+		{"Picture", c.Picture},
+	} {
+		if a.value != "" {
+			attributes = append(attributes, a)
+		}
+	}
+	return attributes
+}
+
+// setUserAttributes sets each attribute which doesn't already have the desired value, verifying it afterwards. Only
+// the directory record is changed: changing the home directory does not move its contents.
+func setUserAttributes(ctx *ModuleContext, username string, attributes []userAttribute) (changed int, err error) {
+	exists, err := userExists(username)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, fmt.Errorf("ec2macosinit: user %s does not exist", username)
+	}
+
+	for _, a := range attributes {
+		current, err := dsclReadUserAttribute(ctx, username, a.name)
+		if err != nil {
+			return changed, err
+		}
+		if strings.Join(current, " ") == a.value {
+			continue
+		}
+
+		// A JPEGPhoto takes precedence over Picture, so it must be removed for the new picture to show
+		if a.name == "Picture" {
+			_, _ = ctx.executeCommand([]string{DsclPath, ".", "-delete", dsclUserPath(username), "JPEGPhoto"}, "", []string{})
+		}
+		err = dsclCreateUserAttribute(ctx, username, a.name, a.value)
+		if err != nil {
+			return changed, err
+		}
+
+		// Validate new value
+		current, err = dsclReadUserAttribute(ctx, username, a.name)
+		if err != nil {
+			return changed, err
+		}
+		if strings.Join(current, " ") != a.value {
+			return changed, fmt.Errorf("ec2macosinit: verification failed for %s of user %s, expected %q but got %q", a.name, username, a.value, strings.Join(current, " "))
+		}
+		changed++
+	}
+
+	return changed, nil
 }
 
 // isSecureTokenSet wraps the sysadminctl call to provide a bool for checking if its enabled
@@ -44,9 +133,9 @@ func (c *UserManagementModule) Do(ctx *ModuleContext) (message string, err error
 //     2021-01-14 18:17:47.414 sysadminctl[96836:904874] Secure token is DISABLED for user ec2-user
 // When enabled it shows:
 //     2021-01-14 19:21:55.854 sysadminctl[14193:181530] Secure token is ENABLED for user ec2-user
-func (c *UserManagementModule) isSecureTokenSet() (enabled bool, err error) {
+func (c *UserManagementModule) isSecureTokenSet(ctx *ModuleContext) (enabled bool, err error) {
 	// Fetch the text from the built-in tool sysadminctl
-	statusText, err := executeCommand([]string{"/usr/sbin/sysadminctl", "-secureTokenStatus", c.User}, "", []string{})
+	statusText, err := ctx.executeCommand([]string{"/usr/sbin/sysadminctl", "-secureTokenStatus", c.User}, "", []string{})
 	if err != nil {
 		return false, fmt.Errorf("ec2macosinit: unable to get Secure Token status for %s: %s", c.User, err)
 	}
@@ -61,8 +150,8 @@ func (c *UserManagementModule) isSecureTokenSet() (enabled bool, err error) {
 // From https://support.apple.com/guide/deployment-reference-macos/using-secure-and-bootstrap-tokens-apdff2cf769b/web
 // This is the command used to avoid setting the SecureToken when changing the password
 //     /usr/bin/dscl . append /Users/ec2-user AuthenticationAuthority ";DisabledTags;SecureToken"
-func (c *UserManagementModule) disableSecureTokenCreation() (err error) {
-	_, err = executeCommand([]string{DsclPath, ".", "append", filepath.Join("Users", c.User), "AuthenticationAuthority", ";DisabledTags;SecureToken"}, "", []string{})
+func (c *UserManagementModule) disableSecureTokenCreation(ctx *ModuleContext) (err error) {
+	_, err = ctx.executeCommand([]string{DsclPath, ".", "append", filepath.Join("Users", c.User), "AuthenticationAuthority", ";DisabledTags;SecureToken"}, "", []string{})
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: failed disable Secure Token creation: %s", err)
 	}
@@ -73,8 +162,8 @@ func (c *UserManagementModule) disableSecureTokenCreation() (err error) {
 // From https://support.apple.com/guide/deployment-reference-macos/using-secure-and-bootstrap-tokens-apdff2cf769b/web
 // This is the command used to remove the setting for the SecureToken when changing the password
 //     /usr/bin/dscl . delete /Users/ec2-user AuthenticationAuthority ";DisabledTags;SecureToken"
-func (c *UserManagementModule) enableSecureTokenCreation() (err error) {
-	_, err = executeCommand([]string{DsclPath, ".", "delete", filepath.Join("Users", c.User), "AuthenticationAuthority", ";DisabledTags;SecureToken"}, "", []string{})
+func (c *UserManagementModule) enableSecureTokenCreation(ctx *ModuleContext) (err error) {
+	_, err = ctx.executeCommand([]string{DsclPath, ".", "delete", filepath.Join("Users", c.User), "AuthenticationAuthority", ";DisabledTags;SecureToken"}, "", []string{})
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: failed to disable Secure Token creation: %s", err)
 	}
@@ -82,8 +171,8 @@ func (c *UserManagementModule) enableSecureTokenCreation() (err error) {
 }
 
 // changePassword changes the password to a provided string.
-func (c *UserManagementModule) changePassword(password string) (err error) {
-	_, err = executeCommand([]string{DsclPath, ".", "-passwd", filepath.Join("Users", c.User), password}, "", []string{})
+func (c *UserManagementModule) changePassword(ctx *ModuleContext, password string) (err error) {
+	_, err = ctx.executeCommand([]string{DsclPath, ".", "-passwd", filepath.Join("Users", c.User), password}, "", []string{})
 	if err != nil {
 		return fmt.Errorf("ec2macosinit: failed to set %s's password: %s", c.User, err)
 	}
@@ -100,7 +189,10 @@ func (c *UserManagementModule) changePassword(password string) (err error) {
 //   2. Add a special property to avoid the Secure Token from being set
 //   3. Change the password to a random string
 //   4. Undo the special property so that the next password change will set the Secure Token
-func (c *UserManagementModule) randomizePassword() (message string, err error) {
+// If PasswordEscrow is set, the new password is stored once it has been applied, so that a failed change never replaces
+// an escrowed password which is still in use. If PasswordToConsole is set, the password is encrypted with the launch
+// key pair and written to the console.
+func (c *UserManagementModule) randomizePassword(ctx *ModuleContext) (message string, err error) {
 	// This detection of the user probably needs to move into the Do() function when there is more to do, but since this
 	// is the first place the c.User is used, its handled here
 	// If user is undefined, default to ec2-user
@@ -118,7 +210,7 @@ func (c *UserManagementModule) randomizePassword() (message string, err error) {
 	}
 
 	// Check for Secure Token, if its already set then attempting to change the password will fail
-	secureTokenSet, err := c.isSecureTokenSet()
+	secureTokenSet, err := c.isSecureTokenSet(ctx)
 	if err != nil {
 		return "", fmt.Errorf("ec2macosinit: unable to confirm Secure Token is DISABLED: %s", err)
 	}
@@ -129,13 +221,13 @@ func (c *UserManagementModule) randomizePassword() (message string, err error) {
 	}
 
 	// Change Secure Token behavior if needed
-	err = c.disableSecureTokenCreation()
+	err = c.disableSecureTokenCreation(ctx)
 	if err != nil {
 		return "", fmt.Errorf("ec2macosinit: unable to disable Secure Token generation: %s", err)
 	}
 	defer func() {
 		// Set Secure Token behavior back if needed
-		deferErr := c.enableSecureTokenCreation()
+		deferErr := c.enableSecureTokenCreation(ctx)
 		if deferErr != nil {
 			// Catch a failure and change status returns to represent an error condition
 			message = "" // Overwrite new message to indicate error
@@ -148,13 +240,42 @@ func (c *UserManagementModule) randomizePassword() (message string, err error) {
 	if err != nil {
 		return "", fmt.Errorf("ec2macosinit: unable to generate secure password: %s", err)
 	}
+	ctx.Logger.AddSensitive(password)
+
+	// Encrypt the password before changing it, so a missing or unsupported launch key leaves the password as it was
+	var encrypted string
+	if c.PasswordToConsole {
+		encrypted, err = encryptPasswordForConsole(ctx, password)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: unable to encrypt password for the console, not changing it: %s", err)
+		}
+	}
 
 	// Change the password
-	err = c.changePassword(password)
+	err = c.changePassword(ctx, password)
 	if err != nil {
 		return "", fmt.Errorf("ec2macosinit: unable to set secure password: %s", err)
 	}
 
+	// Escrow the password only once it's in use, a previously escrowed password stays valid if the change fails
+	var escrowName string
+	if c.PasswordEscrow != "" {
+		escrowName, err = c.escrowPassword(ctx, password)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: password was changed but could not be escrowed: %s", err)
+		}
+	}
+
+	if encrypted != "" {
+		err = writePasswordToConsole(c.User, encrypted)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: password was changed but could not be written to the console: %s", err)
+		}
+	}
+
+	if escrowName != "" {
+		return fmt.Sprintf("successfully set secure password for %s and stored it in %s as %s", c.User, c.PasswordEscrow, escrowName), nil
+	}
 	return fmt.Sprintf("successfully set secure password for %s", c.User), nil
 }
 
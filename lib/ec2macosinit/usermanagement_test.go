@@ -1,6 +1,7 @@
 package ec2macosinit
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -112,3 +113,29 @@ func Test_generateSecurePassword(t *testing.T) {
 		t.Errorf("generateSecurePassword() collision detected: length of unique passwords: %d, number of tests: %d", len(repeatedResults), len(tests))
 	}
 }
+
+func TestUserManagementModule_passwordEscrowName(t *testing.T) {
+	c := &UserManagementModule{User: "ec2-user", PasswordEscrow: PasswordEscrowSecretsManager}
+	if got := c.passwordEscrowName("i-0123456789abcdef0"); got != "ec2-macos-init/i-0123456789abcdef0/ec2-user/password" {
+		t.Errorf("passwordEscrowName() = %v", got)
+	}
+	c.PasswordEscrow = PasswordEscrowSSM
+	if got := c.passwordEscrowName("i-0123456789abcdef0"); got != "/ec2-macos-init/i-0123456789abcdef0/ec2-user/password" {
+		t.Errorf("passwordEscrowName() = %v", got)
+	}
+	c.PasswordEscrowName = "custom"
+	if got := c.passwordEscrowName("i-0123456789abcdef0"); got != "custom" {
+		t.Errorf("passwordEscrowName() = %v", got)
+	}
+}
+
+func TestUserManagementModule_attributes(t *testing.T) {
+	c := &UserManagementModule{Shell: "/bin/bash", Picture: "/Library/User Pictures/Animals/Eagle.heic"}
+	want := []userAttribute{
+		{"UserShell", "/bin/bash"},
+		{"Picture", "/Library/User Pictures/Animals/Eagle.heic"},
+	}
+	if got := c.attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes() = %v, want %v", got, want)
+	}
+}
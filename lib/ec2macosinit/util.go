@@ -2,13 +2,20 @@ package ec2macosinit
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -29,8 +36,46 @@ type commandOutput struct {
 	stderr string
 }
 
+// commandOptions are the optional settings for running a command with runCommand.
+type commandOptions struct {
+	Context   context.Context // Context kills the command and everything it started when done, none when nil
+	RunAsUser string          // RunAsUser is the user to run as, root when empty
+	EnvVars   []string        // EnvVars are added to the environment in the form key=value
+	Timeout   time.Duration   // Timeout kills the command and everything it started when exceeded, zero disables it
+	Dir       string          // Dir is the working directory, the current directory when empty
+	Stdin     []byte          // Stdin is passed to the command on standard input
+	Output    io.Writer       // Output receives stdout and stderr as they are written, instead of them being returned
+	Log       *Logger         // Log logs each line of stdout and stderr as it's written, as well as it being returned
+}
+
+// commandExecutor runs external commands. Modules run commands through the executor of their ModuleContext, so that
+// tests can stand in for tools which only exist on macOS, such as dscl, sysadminctl, launchctl and defaults.
+type commandExecutor interface {
+	run(c []string, opts commandOptions) (output commandOutput, err error)
+}
+
+// systemExecutor is the commandExecutor which runs commands on the system, looking up the users they run as through
+// the cache of user IDs for the run.
+type systemExecutor struct {
+	userIDs *userIDCache
+}
+
+func (e systemExecutor) run(c []string, opts commandOptions) (output commandOutput, err error) {
+	return runCommandAs(c, opts, e.userIDs)
+}
+
 // executeCommand executes the command and returns stdout and stderr as strings.
 func executeCommand(c []string, runAsUser string, envVars []string) (output commandOutput, err error) {
+	return runCommand(c, commandOptions{RunAsUser: runAsUser, EnvVars: envVars})
+}
+
+// runCommand executes the command with the given options and returns stdout and stderr as strings.
+func runCommand(c []string, opts commandOptions) (output commandOutput, err error) {
+	return runCommandAs(c, opts, nil)
+}
+
+// runCommandAs executes the command like runCommand, looking up the user the command runs as in the given cache.
+func runCommandAs(c []string, opts commandOptions, userIDs *userIDCache) (output commandOutput, err error) {
 	// Separate name and args, plus catch a few error cases
 	var name string
 	var args []string
@@ -51,97 +96,229 @@ func executeCommand(c []string, runAsUser string, envVars []string) (output comm
 	var stdoutb, stderrb bytes.Buffer
 	cmd.Stdout = &stdoutb
 	cmd.Stderr = &stderrb
+	if opts.Output != nil {
+		cmd.Stdout = opts.Output
+		cmd.Stderr = opts.Output
+	}
+	if opts.Log != nil {
+		stdoutLines := newLineWriter(opts.Log, filepath.Base(name)+" stdout")
+		stderrLines := newLineWriter(opts.Log, filepath.Base(name)+" stderr")
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, stdoutLines)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderrLines)
+	}
+	cmd.Dir = opts.Dir
+	if opts.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(opts.Stdin)
+	}
+	// Run in a new process group so that a timeout also stops anything the command started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	// Set runAsUser, if defined, otherwise will run as root
-	if runAsUser != "" {
-		uid, gid, err := getUIDandGID(runAsUser)
+	if opts.RunAsUser != "" {
+		uid, gid, err := userIDs.getUIDandGID(opts.RunAsUser)
 		if err != nil {
 			return commandOutput{}, fmt.Errorf("ec2macosinit: error looking up user: %s\n", err)
 		}
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
 		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
 	}
 
 	// Append environment variables
 	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, envVars...)
+	cmd.Env = append(cmd.Env, opts.EnvVars...)
+
+	// The timeout is a deadline on the context, which kills the command's process group when done
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if ctx.Err() != nil {
+		return commandOutput{}, fmt.Errorf("ec2macosinit: command not started: %s", ctx.Err())
+	}
 
 	// Run command
-	err = cmd.Run()
-	if err != nil {
-		return commandOutput{stdout: stdoutb.String(), stderr: stderrb.String()}, err
-	}
-
-	return commandOutput{stdout: stdoutb.String(), stderr: stderrb.String()}, nil
-}
-
-// getUIDandGID takes a username and returns the uid and gid for that user.
-// While testing UID/GID lookup for a user, it was found that the user.Lookup() function does not always return
-// information for a new user on first boot. In the case that user.Lookup() fails, we try dscacheutil, which has a
-// higher success rate. If that fails, we return an error. Any successful case returns the UID and GID as ints.
-func getUIDandGID(username string) (uid int, gid int, err error) {
-	var uidstr, gidstr string
-	// Preference is user.Lookup(), if it works
-	u, lookuperr := user.Lookup(username)
-	if lookuperr != nil {
-		// user.Lookup() has failed, second try by checking the DS cache
-		out, cmderr := executeCommand([]string{"dscacheutil", "-q", "user", "-a", "name", username}, "", []string{})
-		if cmderr != nil {
-			// dscacheutil has failed with an error
-			return 0, 0, fmt.Errorf("ec2macosinit: error while looking up user %s: \n"+
-				"user.Lookup() error: %s \ndscacheutil error: %s\ndscacheutil stderr: %s\n",
-				username, lookuperr, cmderr, out.stderr)
+	err = cmd.Start()
+	if err != nil {
+		return commandOutput{}, err
+	}
+	var killed int32
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&killed, 1)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
 		}
-		// Check length of stdout - dscacheutil returns nothing if user is not found
-		if len(out.stdout) > 0 { // dscacheutil has returned something
-			// Command output from dscacheutil should look like:
-			//   name: ec2-user
-			//   password: ********
-			//   uid: 501
-			//   gid: 20
-			//   dir: /Users/ec2-user
-			//   shell: /bin/bash
-			//   gecos: ec2-user
-			dsSplit := strings.Split(out.stdout, "\n") // split on newline to separate uid and gid
-			for _, e := range dsSplit {
-				eSplit := strings.Fields(e) // split into fields to separate tag with id
-				// Find UID and GID and set them
-				if strings.HasPrefix(e, "uid") {
-					if len(eSplit) != 2 {
-						// dscacheutil has returned some sort of weird output that can't be split
-						return 0, 0, fmt.Errorf("ec2macosinit: error while splitting dscacheutil uid output for user %s: %s\n"+
-							"user.Lookup() error: %s \ndscacheutil error: %s\ndscacheutil stderr: %s\n",
-							username, out.stdout, lookuperr, cmderr, out.stderr)
-					}
-					uidstr = eSplit[1]
-				} else if strings.HasPrefix(e, "gid") {
-					if len(eSplit) != 2 {
-						// dscacheutil has returned some sort of weird output that can't be split
-						return 0, 0, fmt.Errorf("ec2macosinit: error while splitting dscacheutil gid output for user %s: %s\n"+
-							"user.Lookup() error: %s \ndscacheutil error: %s\ndscacheutil stderr: %s\n",
-							username, out.stdout, lookuperr, cmderr, out.stderr)
-					}
-					gidstr = eSplit[1]
-				}
-			}
-		} else {
-			// dscacheutil has returned nothing, user is not found
-			return 0, 0, fmt.Errorf("ec2macosinit: user %s not found: \n"+
-				"user.Lookup() error: %s \ndscacheutil error: %s\ndscacheutil stderr: %s\n",
-				username, lookuperr, cmderr, out.stderr)
+	}()
+	err = cmd.Wait()
+	close(exited)
+	output = commandOutput{stdout: stdoutb.String(), stderr: stderrb.String()}
+	if atomic.LoadInt32(&killed) == 1 {
+		if opts.Timeout > 0 && (opts.Context == nil || opts.Context.Err() == nil) {
+			return output, fmt.Errorf("ec2macosinit: command timed out after %s", opts.Timeout)
 		}
-	} else {
-		// user.Lookup() was successful, use the returned UID/GID
-		uidstr = u.Uid
-		gidstr = u.Gid
+		return output, fmt.Errorf("ec2macosinit: command stopped: %s", opts.Context.Err())
+	}
+	if err != nil {
+		return output, err
+	}
+
+	return output, nil
+}
+
+// exitCode returns the exit code of a command from the error returned by runCommand, or -1 when the command didn't
+// exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// safeWriteFile atomically writes data to path with the given permissions. When uid and gid are not -1, ownership is
+// set on the temporary file before it is renamed into place so the final file never has the wrong owner or mode.
+func safeWriteFile(path string, data []byte, perm os.FileMode, uid, gid int) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(perm)
+	if err != nil {
+		return err
+	}
+
+	if uid != -1 || gid != -1 {
+		err = f.Chown(uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// userIDCache caches successful UID and GID lookups for a single run, since a lookup may be retried while directory
+// services catch up and modules running many commands as the same user would otherwise repeat it for every command.
+// Entries are removed when a user's UID or primary group is changed with dscl. A nil cache looks up every time.
+type userIDCache struct {
+	mu  sync.Mutex
+	ids map[string][2]int
+}
+
+// newUserIDCache returns an empty cache of user IDs.
+func newUserIDCache() *userIDCache {
+	return &userIDCache{ids: map[string][2]int{}}
+}
+
+// forget removes any cached UID and GID for the user, so that the next lookup sees the current values.
+func (u *userIDCache) forget(username string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.ids, username)
+}
+
+// getUIDandGID takes a username and returns the uid and gid for that user, using the cached result of an earlier
+// lookup in the same run if there is one.
+func (u *userIDCache) getUIDandGID(username string) (uid int, gid int, err error) {
+	if u == nil {
+		return lookupUIDandGID(username)
+	}
+	u.mu.Lock()
+	ids, ok := u.ids[username]
+	u.mu.Unlock()
+	if ok {
+		return ids[0], ids[1], nil
+	}
+
+	uid, gid, err = lookupUIDandGID(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	u.mu.Lock()
+	u.ids[username] = [2]int{uid, gid}
+	u.mu.Unlock()
+	return uid, gid, nil
+}
+
+// userEnvironment returns the login environment of a user, so that commands run as the user see the same HOME, USER,
+// LOGNAME, and SHELL they would after logging in, along with their home directory.
+func userEnvironment(ctx *ModuleContext, username string) (env []string, home string, err error) {
+	homes, err := dsclReadUserAttribute(ctx, username, "NFSHomeDirectory")
+	if err != nil {
+		return nil, "", err
+	}
+	home = filepath.Join("/Users", username)
+	if len(homes) > 0 {
+		home = homes[0]
+	}
+	shells, err := dsclReadUserAttribute(ctx, username, "UserShell")
+	if err != nil {
+		return nil, "", err
+	}
+	shell := "/bin/zsh"
+	if len(shells) > 0 {
+		shell = shells[0]
+	}
+	return []string{"HOME=" + home, "USER=" + username, "LOGNAME=" + username, "SHELL=" + shell}, home, nil
+}
+
+// userLookupBackoff is the backoff between lookups of a user. On first boot, directory services may not return a user
+// created moments earlier for a short while.
+var userLookupBackoff = Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Jitter: 0.2, MaxElapsed: 10 * time.Second}
+
+// lookupUser looks up a user with getpwnam_r, through os/user, which asks Open Directory directly. Failed lookups,
+// including the user not being found, are retried until userLookupBackoff runs out.
+func lookupUser(username string) (u *user.User, err error) {
+	err = Retry(context.Background(), userLookupBackoff, func() (err error) {
+		u, err = user.Lookup(username)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ec2macosinit: error while looking up user %s: %s", username, err)
+	}
+	return u, nil
+}
+
+// lookupUIDandGID takes a username and returns the uid and gid for that user.
+func lookupUIDandGID(username string) (uid int, gid int, err error) {
+	u, err := lookupUser(username)
+	if err != nil {
+		return 0, 0, err
 	}
 
 	// Convert UID and GID to int
-	uid, err = strconv.Atoi(uidstr)
+	uid, err = strconv.Atoi(u.Uid)
 	if err != nil {
 		return 0, 0, fmt.Errorf("ec2macosinit: error while converting UID to int: %s\n", err)
 	}
-	gid, err = strconv.Atoi(gidstr)
+	gid, err = strconv.Atoi(u.Gid)
 	if err != nil {
 		return 0, 0, fmt.Errorf("ec2macosinit: error while converting GID to int: %s\n", err)
 	}
@@ -149,48 +326,108 @@ func getUIDandGID(username string) (uid int, gid int, err error) {
 	return uid, gid, nil
 }
 
-// userExists takes a username and returns whether or not the user exists on the system.
+// getUserHomeDirectory takes a username and returns the home directory for that user. If the home directory can't be
+// found through user.Lookup(), the default macOS location of /Users/<username> is returned when it exists.
+func getUserHomeDirectory(username string) (home string, err error) {
+	u, err := user.Lookup(username)
+	if err == nil && u.HomeDir != "" {
+		return u.HomeDir, nil
+	}
+
+	// Fall back to the default home directory location
+	home = filepath.Join("/Users", username)
+	if _, statErr := os.Stat(home); statErr != nil {
+		return "", fmt.Errorf("ec2macosinit: unable to find home directory for user %s: %s", username, statErr)
+	}
+
+	return home, nil
+}
+
+// userExists takes a username and returns whether or not the user exists on the system. A user which isn't found
+// doesn't exist, while other failed lookups are retried.
 func userExists(username string) (exists bool, err error) {
-	out, err := executeCommand([]string{"dscacheutil", "-q", "user", "-a", "name", username}, "", []string{})
+	err = Retry(context.Background(), userLookupBackoff, func() (err error) {
+		_, err = user.Lookup(username)
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
 	if err != nil {
-		return false, fmt.Errorf("ec2macosinit: error while checking dscacheutil for user %s: %s\n", username, err)
-	}
-	// If dscacheutil output containing the username, the user exists
-	if strings.Contains(out.stdout, username) {
-		return true, nil
+		return false, fmt.Errorf("ec2macosinit: error while looking up user %s: %s", username, err)
 	}
+	return exists, nil
+}
+
+// Backoff configures how Retry waits between attempts. The delay starts at Initial and is multiplied after each
+// failed attempt, up to Max. Jitter spreads the delays of instances retrying at the same time, such as a fleet booting
+// together, so that they don't all hit a service at once.
+type Backoff struct {
+	Initial    time.Duration // Initial is the delay after the first failed attempt
+	Max        time.Duration // Max caps the delay between attempts, zero leaves it uncapped
+	Multiplier float64       // Multiplier grows the delay after each failed attempt, 2 when unset
+	Jitter     float64       // Jitter randomizes each delay by up to this fraction of it, from 0 to 1
+	Attempts   int           // Attempts limits the number of attempts, zero leaves them unlimited
+	MaxElapsed time.Duration // MaxElapsed stops retrying once this much time has passed, zero leaves it unlimited
+
+	// OnRetry, if set, is called after each failed attempt which will be retried, with the delay before the next one
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
 
-	// No output means the user does not exist
-	return false, nil
+// delay returns the delay after the given failed attempt, counting from 1.
+func (b Backoff) delay(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	d := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
 }
 
-// retry is an extremely simple retry function which waits a specified duration on error and retries.
-func retry(attempts int, sleep time.Duration, f func() error) (err error) {
-	for i := 0; ; i++ {
+// Retry calls f until it succeeds, waiting between attempts as configured by the backoff. It gives up when the
+// attempts or elapsed time run out, returning the last error, or as soon as the context is canceled.
+func Retry(ctx context.Context, b Backoff, f func() error) (err error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
 		err = f()
 		if err == nil {
-			return
+			return nil
+		}
+		if b.Attempts > 0 && attempt >= b.Attempts {
+			return fmt.Errorf("after %d attempts, last error: %s", attempt, err)
+		}
+		delay := b.delay(attempt)
+		if b.MaxElapsed > 0 && time.Since(start)+delay > b.MaxElapsed {
+			return fmt.Errorf("after %d attempts in %s, last error: %s", attempt, time.Since(start).Round(time.Millisecond), err)
 		}
-		if i >= (attempts - 1) {
-			break
+		if b.OnRetry != nil {
+			b.OnRetry(attempt, delay, err)
 		}
 
-		time.Sleep(sleep)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s after %d attempts, last error: %s", ctx.Err(), attempt, err)
+		case <-timer.C:
+		}
 	}
-	return fmt.Errorf("after %d attempts, last error: %s", attempts, err)
 }
 
-// getOSProductVersion uses the sysctl command to retrieve the product version number from the kernel
+// getOSProductVersion reads the product version number from the kernel
 func getOSProductVersion() (version string, err error) {
-	cmdGetProductVersion := []string{"sysctl", "-n", "kern.osproductversion"}
-
-	output, err := executeCommand(cmdGetProductVersion, "", []string{})
+	version, err = sysctlString("kern.osproductversion")
 	if err != nil {
 		return version, fmt.Errorf("ec2macosinit: error getting kernel state for product version: %s", err)
 	}
 
-	// Remove any extra space characters from the output to leave only the product version number
-	version = strings.TrimSpace(output.stdout)
-
-	return version, nil
+	return strings.TrimSpace(version), nil
 }
@@ -1,8 +1,12 @@
 package ec2macosinit
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"log"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -10,6 +14,67 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeExecutor is a commandExecutor for tests, which records commands and answers them with handle instead of running
+// them.
+type fakeExecutor struct {
+	commands []string
+	handle   func(c []string) (output commandOutput, err error)
+}
+
+func (f *fakeExecutor) run(c []string, opts commandOptions) (output commandOutput, err error) {
+	f.commands = append(f.commands, strings.Join(c, " "))
+	return f.handle(c)
+}
+
+func TestModuleContext_executeCommand(t *testing.T) {
+	// Commands run on the system without an executor
+	out, err := (&ModuleContext{}).executeCommand([]string{"echo", "hello"}, "", []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", out.stdout)
+
+	fake := &fakeExecutor{handle: func(c []string) (commandOutput, error) {
+		return commandOutput{stdout: "faked"}, nil
+	}}
+	out, err = (&ModuleContext{executor: fake}).executeCommand([]string{"/usr/bin/dscl", ".", "-list", "/Users"}, "", []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "faked", out.stdout)
+	assert.Equal(t, []string{"/usr/bin/dscl . -list /Users"}, fake.commands)
+}
+
+func Test_runCommand_context(t *testing.T) {
+	// Canceling the context stops the command and anything it started
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := runCommand([]string{"/bin/sh", "-c", "sleep 10 & wait"}, commandOptions{Context: ctx})
+	assert.EqualError(t, err, "ec2macosinit: command stopped: context canceled")
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Commands aren't started with a context which is already done
+	_, err = runCommand([]string{"/bin/echo"}, commandOptions{Context: ctx})
+	assert.ErrorContains(t, err, "command not started")
+
+	// The timeout applies alongside the context
+	_, err = runCommand([]string{"/bin/sleep", "10"}, commandOptions{Context: context.Background(), Timeout: 100 * time.Millisecond})
+	assert.EqualError(t, err, "ec2macosinit: command timed out after 100ms")
+}
+
+func Test_runCommand_log(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	out, err := runCommand([]string{"/bin/sh", "-c", "echo one; echo two >&2; printf three"}, commandOptions{Log: &Logger{LogToStdout: true}})
+	assert.NoError(t, err)
+	assert.Equal(t, "one\nthree", out.stdout)
+	assert.Equal(t, "two\n", out.stderr)
+	assert.Contains(t, buf.String(), "sh stdout: one\n")
+	assert.Contains(t, buf.String(), "sh stderr: two\n")
+	assert.Contains(t, buf.String(), "sh stdout: three\n")
+}
+
 func Test_ioReadCloserToString(t *testing.T) {
 	expected := "test string"
 	input := io.NopCloser(strings.NewReader(expected))
@@ -19,45 +84,101 @@ func Test_ioReadCloserToString(t *testing.T) {
 	assert.Equal(t, expected, out)
 }
 
-func Test_retry(t *testing.T) {
-	type args struct {
-		attempts int
-		sleep    time.Duration
-		f        func() error
-	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "FunctionWithNoError",
-			args: args{
-				attempts: 2,
-				sleep:    1 * time.Nanosecond,
-				f: func() error {
-					return nil
-				},
-			},
-			wantErr: false,
-		},
-		{
-			name: "FunctionWithError",
-			args: args{
-				attempts: 2,
-				sleep:    1 * time.Nanosecond,
-				f: func() error {
-					return fmt.Errorf("test error")
-				},
-			},
-			wantErr: true,
+func TestRetry(t *testing.T) {
+	// Succeeds on the third attempt
+	var calls int
+	var delays []time.Duration
+	err := Retry(context.Background(), Backoff{
+		Initial:  time.Millisecond,
+		Attempts: 5,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
+			delays = append(delays, delay)
 		},
+	}, func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("test error")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond}, delays)
+
+	// Gives up after the attempts run out
+	calls = 0
+	err = Retry(context.Background(), Backoff{Initial: time.Nanosecond, Attempts: 2}, func() error {
+		calls++
+		return fmt.Errorf("test error")
+	})
+	assert.EqualError(t, err, "after 2 attempts, last error: test error")
+	assert.Equal(t, 2, calls)
+
+	// Gives up when the next delay would pass the maximum elapsed time
+	err = Retry(context.Background(), Backoff{Initial: time.Hour, MaxElapsed: time.Minute}, func() error {
+		return fmt.Errorf("test error")
+	})
+	assert.Error(t, err)
+
+	// Stops waiting when the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	err = Retry(ctx, Backoff{Initial: time.Hour}, func() error {
+		return fmt.Errorf("test error")
+	})
+	assert.ErrorContains(t, err, "context canceled")
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+func TestBackoff_delay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 3}
+	assert.Equal(t, time.Second, b.delay(1))
+	assert.Equal(t, 3*time.Second, b.delay(2))
+	assert.Equal(t, 5*time.Second, b.delay(3))
+
+	b = Backoff{Initial: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := b.delay(2)
+		assert.GreaterOrEqual(t, d, time.Second)
+		assert.LessOrEqual(t, d, 3*time.Second)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := retry(tt.args.attempts, tt.args.sleep, tt.args.f); (err != nil) != tt.wantErr {
-				t.Errorf("retry() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
+}
+
+func Test_lookupUser(t *testing.T) {
+	defer func(b Backoff) { userLookupBackoff = b }(userLookupBackoff)
+	userLookupBackoff = Backoff{Initial: time.Millisecond, Attempts: 2}
+
+	uid, gid, err := lookupUIDandGID("root")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 0, gid)
+
+	exists, err := userExists("root")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Users which don't exist aren't an error for userExists, but are once retries run out when a user is needed
+	exists, err = userExists("ec2-macos-init-missing-user")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	_, _, err = lookupUIDandGID("ec2-macos-init-missing-user")
+	assert.ErrorContains(t, err, "after 2 attempts")
+}
+
+func Test_getUIDandGID_cache(t *testing.T) {
+	ctx := &ModuleContext{userIDs: newUserIDCache()}
+	ctx.userIDs.ids["cached-user"] = [2]int{600, 20}
+
+	uid, gid, err := ctx.getUIDandGID("cached-user")
+	assert.NoError(t, err)
+	assert.Equal(t, 600, uid)
+	assert.Equal(t, 20, gid)
+
+	// Changing the user's UID with dscl drops the cached IDs
+	ctx.executor = &fakeExecutor{handle: func(c []string) (commandOutput, error) { return commandOutput{}, nil }}
+	err = dsclCreateUserAttribute(ctx, "cached-user", "UniqueID", "601")
+	assert.NoError(t, err)
+	_, ok := ctx.userIDs.ids["cached-user"]
+	assert.False(t, ok)
 }
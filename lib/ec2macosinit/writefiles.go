@@ -0,0 +1,162 @@
+package ec2macosinit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// defaultWriteFileMode is the mode used for files written by the WriteFiles module when none is provided.
+	defaultWriteFileMode = 0644
+)
+
+// WriteFile contains the configuration for a single file written by the WriteFiles module.
+type WriteFile struct {
+	Path     string `toml:"Path"`     // Path is the absolute path of the file to write
+	Content  string `toml:"Content"`  // Content is the inline content of the file
+	Encoding string `toml:"Encoding"` // Encoding of Content, either "plain" (default) or "base64"
+	Source   string `toml:"Source"`   // Source is an http(s):// URL or s3:// URI to fetch the content from
+	Owner    string `toml:"Owner"`    // Owner of the file, default is root
+	Group    string `toml:"Group"`    // Group of the file, default is the owner's primary group
+	Mode     string `toml:"Mode"`     // Mode is the octal permission string, default is "0644"
+}
+
+// WriteFilesModule contains all necessary configuration fields for running a WriteFiles module.
+type WriteFilesModule struct {
+	Files []WriteFile `toml:"File"`
+}
+
+// Do for the WriteFilesModule writes each configured file with the requested content, ownership, and mode. Files which
+// already match are left untouched.
+func (c *WriteFilesModule) Do(ctx *ModuleContext) (message string, err error) {
+	if len(c.Files) == 0 {
+		return "nothing to do", nil
+	}
+
+	var changed, unchanged int
+	for _, f := range c.Files {
+		fileChanged, err := f.write(ctx)
+		if err != nil {
+			return "", fmt.Errorf("ec2macosinit: error writing file %s: %s", f.Path, err)
+		}
+		if fileChanged {
+			changed++
+			ctx.Logger.Infof("Wrote file [%s]", f.Path)
+		} else {
+			unchanged++
+			ctx.Logger.Infof("File [%s] already up to date", f.Path)
+		}
+	}
+
+	return fmt.Sprintf("successfully processed files [%d changed / %d unchanged]", changed, unchanged), nil
+}
+
+// write writes a single file if its content, mode, or ownership differ from what is configured.
+func (f *WriteFile) write(ctx *ModuleContext) (changed bool, err error) {
+	if !filepath.IsAbs(f.Path) {
+		return false, fmt.Errorf("path must be absolute")
+	}
+
+	content, err := f.content(ctx)
+	if err != nil {
+		return false, err
+	}
+	perm, err := f.fileMode()
+	if err != nil {
+		return false, err
+	}
+	uid, gid, err := f.ownership(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Compare against the existing file, if any
+	if info, err := os.Stat(f.Path); err == nil {
+		existing, err := os.ReadFile(f.Path)
+		if err != nil {
+			return false, err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if ok && bytes.Equal(existing, content) && info.Mode().Perm() == perm && int(st.Uid) == uid && int(st.Gid) == gid {
+			return false, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(f.Path), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = safeWriteFile(f.Path, content, perm, uid, gid)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// content returns the decoded inline content or the content fetched from Source.
+func (f *WriteFile) content(ctx *ModuleContext) (content []byte, err error) {
+	if f.Source != "" {
+		if f.Content != "" {
+			return nil, fmt.Errorf("only one of Content and Source may be set")
+		}
+		return fetchSource(ctx, f.Source)
+	}
+
+	switch f.Encoding {
+	case "", "plain":
+		return []byte(f.Content), nil
+	case "base64", "b64":
+		content, err = base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode base64 content: %s", err)
+		}
+		return content, nil
+	}
+
+	return nil, fmt.Errorf("unsupported encoding %q", f.Encoding)
+}
+
+// fileMode parses the configured octal mode.
+func (f *WriteFile) fileMode() (perm os.FileMode, err error) {
+	if f.Mode == "" {
+		return defaultWriteFileMode, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", f.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// ownership resolves the configured owner and group to a UID and GID.
+func (f *WriteFile) ownership(ctx *ModuleContext) (uid, gid int, err error) {
+	if f.Owner != "" {
+		uid, gid, err = ctx.getUIDandGID(f.Owner)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if f.Group != "" {
+		g, err := user.LookupGroup(f.Group)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unable to look up group %s: %s", f.Group, err)
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid GID for group %s: %s", f.Group, err)
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,59 @@
+package ec2macosinit
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile_write(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "etc", "example.conf")
+	f := WriteFile{
+		Path:     path,
+		Content:  "aGVsbG8sIHdvcmxkIQ==", // printf 'hello, world!' | base64 -w0
+		Encoding: "base64",
+		Owner:    current.Username,
+		Mode:     "0600",
+	}
+
+	changed, err := f.write(&ModuleContext{})
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world!", string(content))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Writing the same file again should not change anything
+	changed, err = f.write(&ModuleContext{})
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestWriteFile_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file WriteFile
+	}{
+		{"RelativePath", WriteFile{Path: "relative/file"}},
+		{"BadMode", WriteFile{Path: "/tmp/file", Mode: "999"}},
+		{"BadEncoding", WriteFile{Path: "/tmp/file", Content: "x", Encoding: "rot13"}},
+		{"ContentAndSource", WriteFile{Path: "/tmp/file", Content: "x", Source: "https://example.com/x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.file.write(&ModuleContext{})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -13,11 +15,11 @@ import (
 
 const (
 	loggingTag = "ec2-macOS-init"
+	// baseDirEnv is the environment variable which overrides the base directory, when --base-dir isn't given.
+	baseDirEnv = "EC2_MACOS_INIT_BASE_DIR"
 )
 
 func main() {
-	const baseDir = paths.DefaultBaseDirectory
-
 	// Set up logging
 	logger, err := ec2macosinit.NewLogger(loggingTag, true, true)
 	if err != nil {
@@ -31,7 +33,22 @@ func main() {
 
 	// Check that this is being run by a user with root permissions
 	if !runningAsRoot() {
-		logger.Fatal(64, "Must be run with root permissions!")
+		logger.Fatal(exitUsage, "Must be run with root permissions!")
+	}
+
+	// Parse global flags, which come before the command. Commands parse their own flags from os.Args[2:], so the global
+	// flags are removed from os.Args.
+	baseDir, args, err := parseGlobalFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(paths.DefaultBaseDirectory)
+		os.Exit(0)
+	}
+	if err != nil {
+		logger.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	os.Args = append(os.Args[:1], args...)
+	if baseDir != paths.DefaultBaseDirectory {
+		logger.Infof("Using base directory %s", baseDir)
 	}
 
 	// Check for no command
@@ -46,14 +63,38 @@ func main() {
 		HistoryPath:     paths.AllInstancesHistory(baseDir),
 		HistoryFilename: paths.HistoryJSON,
 		Log:             logger,
+		FatalCounts:     ec2macosinit.FatalCount{Path: filepath.Join(baseDir, paths.FatalCounts)},
+		StatusFile:      filepath.Join(baseDir, paths.StatusJSON),
 	}
 
 	// Command switch
 	switch command := os.Args[1]; command {
 	case "run":
-		run(baseDir, config)
+		run(baseDir, config, false)
+	case "rerun-failed":
+		run(baseDir, config, true)
 	case "clean":
 		clean(baseDir, config)
+	case "daemon":
+		daemon(baseDir, config)
+	case "config":
+		configCommand(baseDir, config)
+	case "doctor":
+		doctor(baseDir, config)
+	case "install":
+		install(config)
+	case "uninstall":
+		uninstall(config)
+	case "rollback":
+		rollback(baseDir, config)
+	case "history":
+		history(baseDir, config)
+	case "snapshot":
+		snapshot(baseDir, config)
+	case "test-module":
+		testModule(baseDir, config)
+	case "update":
+		update(baseDir, config)
 	case "version":
 		printVersion()
 		os.Exit(0)
@@ -64,13 +105,50 @@ func main() {
 	}
 }
 
+// parseGlobalFlags parses the flags given before the command and returns the base directory along with the command
+// and its arguments. The base directory is taken from --base-dir, then the environment, then the default, so that a
+// staged root, such as an image being built or an integration test, can be used instead of the live system's.
+func parseGlobalFlags(args []string) (baseDir string, rest []string, err error) {
+	baseDir = paths.DefaultBaseDirectory
+	if env := os.Getenv(baseDirEnv); env != "" {
+		baseDir = env
+	}
+
+	globalFlags := flag.NewFlagSet("ec2-macos-init", flag.ContinueOnError)
+	globalFlags.StringVar(&baseDir, "base-dir", baseDir, "Optional; Directory holding init.toml and instance history, overrides "+baseDirEnv+".")
+	err = globalFlags.Parse(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if baseDir == "" {
+		return "", nil, fmt.Errorf("base directory must not be empty")
+	}
+	baseDir, err = filepath.Abs(baseDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid base directory: %s", err)
+	}
+	return baseDir, globalFlags.Args(), nil
+}
+
 // printUsage prints the help text for this program.
 func printUsage(baseDir string) {
-	fmt.Println("Usage: ec2-macos-init <command> <arguments>")
+	fmt.Println("Usage: ec2-macos-init [--base-dir <directory>] <command> <arguments>")
 	fmt.Println("Commands are:")
 	fmt.Println("    run - Run init using configuration located in " + filepath.Join(baseDir, paths.InitTOML))
-	fmt.Println("    clean - Remove instance history from disk")
-	fmt.Println("    version - Print version information")
+	fmt.Println("    rerun-failed - Run only the modules which didn't succeed in the last run")
+	fmt.Println("    daemon - Keep running and run modules with RunEvery set on their interval")
+	fmt.Println("    clean (-dry-run) - Remove instance history and temporary files from disk")
+	fmt.Println("    config get <key> / config set <key> <value> - Read or change a value in init.toml")
+	fmt.Println("    doctor - Check the installation for problems which keep init from running")
+	fmt.Println("    history migrate - Upgrade instance history to the current version, repairing invalid files")
+	fmt.Println("    install (-daemon) - Install and load the launchd jobs which run init")
+	fmt.Println("    uninstall - Unload and remove the launchd jobs which run init")
+	fmt.Println("    rollback <module type> - Restore files changed by the last run of a module type (systemconfig, motd)")
+	fmt.Println("    snapshot list / snapshot revert (-path <path>)... <name> - List snapshots or restore selected paths from one")
+	fmt.Println("    test-module <module file> - Run a single module from a file, without instance history")
+	fmt.Println("    update (-check) - Install the latest build from the configured update source")
+	fmt.Println("    version (-json) - Print version and build information")
+	fmt.Println("The base directory, " + baseDir + ", can also be set with " + baseDirEnv)
 	fmt.Println("For more help: ec2-macos-init <command> -h")
 }
 
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// rollback restores the files modified by the most recent run of a module type, such as systemconfig or motd, from
+// the backups kept under the base directory.
+func rollback(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	rollbackFlags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	rollbackFlags.Usage = func() {
+		fmt.Fprintln(rollbackFlags.Output(), "Usage: ec2-macos-init rollback <module type>")
+		rollbackFlags.PrintDefaults()
+	}
+
+	// Parse flags
+	err := rollbackFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	if rollbackFlags.NArg() != 1 {
+		rollbackFlags.Usage()
+		os.Exit(2)
+	}
+	moduleType := rollbackFlags.Arg(0)
+
+	c.Log.Infof("Rolling back the most recent changes made by %s modules", moduleType)
+	restored, err := ec2macosinit.Rollback(baseDir, moduleType)
+	for _, path := range restored {
+		c.Log.Infof("Restored %s", path)
+	}
+	if err != nil {
+		c.Log.Fatalf(exitCommandFailed, "Unable to roll back %s: %s", moduleType, err)
+	}
+	c.Log.Info("Rollback complete, restart any affected services (such as sshd) to apply the restored configuration")
+}
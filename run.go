@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,25 +15,71 @@ import (
 	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
 )
 
+// defaultLockTimeout is how long a run waits for another run in progress to finish.
+const defaultLockTimeout = 10 * time.Minute
+
 // run is the main runner for ec2-macOS-init.  It handles orchestration of the following major pieces:
-//  1. Setup instance ID - IMDS must be up and provide an instance ID for later parts of run to work.
-//  2. Read init config - Read the init.toml configuration file into the application.
-//  3. Validate init config and identify modules - The config then undergoes basic validation and modules are identified.
-//  4. Prioritize modules - Modules are sorted by priority into a 2D slice of modules to be run in the correct order later.
-//  5. Read instance run history - The history of prior runs is read into the application for comparison of Run type settings.
-//  6. Process each module by priority level - All modules are run in priority groups. Each module in a priority level
-//     is started in its own goroutine and the group waits for everything in that group to finish. If any module in that
-//     group fails and has FatalOnError set, the entire application exits early.
-//  7. Write history file - After any run, a history.json file is written to the instance history directory for future runs.
-func run(baseDir string, c *ec2macosinit.InitConfig) {
+//  0. Lock - Take the run lock so that concurrent invocations can't interleave.
+//  1. Read init config - Read the init.toml configuration file into the application.
+//  2. Validate init config and identify modules - The config then undergoes basic validation and modules are identified.
+//  3. Prioritize modules - Modules are sorted by priority into a 2D slice of modules to be run in the correct order later.
+//  4. Process pre-network modules - Modules in the PreNetwork phase are run by priority level before IMDS is needed.
+//  5. Setup instance ID - IMDS must be up and provide an instance ID for later parts of run to work. Metadata shared by
+//     modules is then prefetched.
+//  6. Read instance run history - The history of prior runs is read into the application for comparison of Run type settings.
+//  7. Process each module by priority level - All remaining modules are run in priority groups. Each module in a
+//     priority level is started in its own goroutine and the group waits for everything in that group to finish. If any
+//     module in that group fails and has FatalOnError set, the entire application exits early.
+//  8. Write history file - After any run, a history.json file is written to the instance history directory for future runs.
+//     It's also written after each priority level, so modules which completed are recorded if the run never finishes.
+//  9. Prune history - History of previous instances outside of the configured retention is removed.
+//  10. Summarize - A summary of the run is logged and, if enabled, metrics are published to CloudWatch and the summary
+//     is recorded for the status server.
+//  11. Mark ready - If every module succeeded, the readiness marker is written for dependent services.
+//
+// When rerunFailed is set, only modules which didn't succeed in the most recent run on the instance are run, modules
+// which succeeded are passed through to history as skipped. Pre-network modules are then run after reading history,
+// rather than before waiting for IMDS, since which of them succeeded is only known from history.
+func run(baseDir string, c *ec2macosinit.InitConfig, rerunFailed bool) {
+	// Define flags
+	command := "run"
+	if rerunFailed {
+		command = "rerun-failed"
+	}
+	runFlags := flag.NewFlagSet(command, flag.ExitOnError)
+	lockTimeout := runFlags.Duration("lock-timeout", defaultLockTimeout, "Optional; How long to wait for another run to finish before giving up.")
+	logFormat := runFlags.String("log-format", "text", "Optional; Format of log output to stdout, either text or json.")
+	imdsMock := runFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
 
-	c.Log.Info("Fetching instance ID from IMDS...")
-	// An instance ID from IMDS is a prerequisite for run() to be able to check instance history
-	err := SetupInstanceID(c)
+	// Parse flags
+	err := runFlags.Parse(os.Args[2:])
 	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 1), "Unable to get instance ID: %s", err)
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		c.Log.JSON = true
+	default:
+		c.Log.Fatalf(exitUsage, "Unknown log format %q, must be text or json", *logFormat)
 	}
-	c.Log.Infof("Running on instance %s", c.IMDS.InstanceID)
+	c.Log.Fields.RunID = ec2macosinit.NewRunID()
+	c.IMDS.MockPath = *imdsMock
+	c.StartUserIDCache()
+
+	// Write milestones and fatal errors to the console so that progress shows up in the EC2 console output
+	c.Log.ConsolePath = ec2macosinit.ConsoleDevice
+	c.Log.Milestonef("Starting EC2 macOS Init")
+
+	// Only one run may be in progress at a time, the lock is released when the process exits
+	lock, err := ec2macosinit.AcquireRunLock(filepath.Join(baseDir, paths.RunLock), *lockTimeout, func(holder string) {
+		c.Log.Warnf("Another run of ec2-macos-init (PID %s) is in progress, waiting up to %s for it to finish...", holder, *lockTimeout)
+	})
+	if err != nil {
+		c.Log.Fatalf(computeExitCode(c, exitLocked), "Unable to start run: %s", err)
+	}
+	// The deferred release also keeps the lock file open for the whole run
+	defer lock.Release()
 
 	// Mark start time
 	startTime := time.Now()
@@ -38,7 +88,7 @@ func run(baseDir string, c *ec2macosinit.InitConfig) {
 	c.Log.Info("Reading init config...")
 	err = c.ReadConfig(filepath.Join(baseDir, paths.InitTOML))
 	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 66), "Error while reading init config file: %s", err)
+		c.Log.Fatalf(computeExitCode(c, exitConfigUnreadable), "Error while reading init config file: %s", err)
 	}
 	c.Log.Info("Successfully read init config")
 
@@ -46,7 +96,7 @@ func run(baseDir string, c *ec2macosinit.InitConfig) {
 	c.Log.Info("Validating config...")
 	err = c.ValidateAndIdentify()
 	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 65), "Error found during init config validation: %s", err)
+		c.Log.Fatalf(computeExitCode(c, exitConfigInvalid), "Error found during init config validation: %s", err)
 	}
 	c.Log.Info("Successfully validated config")
 
@@ -54,15 +104,42 @@ func run(baseDir string, c *ec2macosinit.InitConfig) {
 	c.Log.Info("Prioritizing modules...")
 	err = c.PrioritizeModules()
 	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 1), "Error preparing and identifying modules: %s", err)
+		c.Log.Fatalf(computeExitCode(c, exitInternal), "Error preparing and identifying modules: %s", err)
 	}
 	c.Log.Info("Successfully prioritized modules")
 
+	// Record the run's progress for the status server
+	c.StatusStarted(c.Log.Fields.RunID)
+
+	// Run pre-network modules before waiting for IMDS, so they can set up anything needed to reach it. When rerunning,
+	// they're run once history has been read instead, so that those which succeeded can be skipped.
+	if !rerunFailed {
+		runPreNetworkPhase(baseDir, c, startTime, false)
+	}
+
+	if mock := c.IMDS.MockSource(); mock != "" {
+		c.Log.Warnf("Using IMDS mock %s instead of IMDS", mock)
+	}
+	c.Log.Info("Fetching instance ID from IMDS...")
+	// An instance ID from IMDS is a prerequisite for run() to be able to check instance history
+	err = SetupInstanceID(context.Background(), c)
+	if err != nil {
+		c.Log.Fatalf(computeExitCode(c, exitIMDSUnavailable), "Unable to get instance ID: %s", err)
+	}
+	c.Log.Fields.InstanceID = c.IMDS.InstanceID
+	c.Log.Milestonef("Running on instance %s", c.IMDS.InstanceID)
+
+	// Fetch the IMDS properties shared by modules once, failing to do so shouldn't fail the run as modules retry them
+	err = c.IMDS.Prefetch()
+	if err != nil {
+		c.Log.Warnf("Unable to prefetch instance metadata: %s", err)
+	}
+
 	// Create instance history directories
 	c.Log.Info("Creating instance history directories for current instance...")
 	err = c.CreateDirectories()
 	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 73), "Error creating instance history directories: %s", err)
+		c.Log.Fatalf(computeExitCode(c, exitHistoryWrite), "Error creating instance history directories: %s", err)
 	}
 	c.Log.Info("Successfully created directories")
 
@@ -76,107 +153,286 @@ func run(baseDir string, c *ec2macosinit.InitConfig) {
 		if errors.As(err, &herr) {
 			c.Log.Warn("There was an error getting instance history")
 			c.Log.Info("The history JSON files might be invalid and need to be restored or removed.")
-			c.Log.Info("Run 'sudo ec2-macos-init clean' to remove all history files.")
+			c.Log.Info("Run 'sudo ec2-macos-init history migrate' to repair them, or 'sudo ec2-macos-init clean' to remove all history files.")
 		}
-		c.Log.Fatalf(computeExitCode(c, 1), "Error getting instance history: %s", err)
+		c.Log.Fatalf(computeExitCode(c, exitHistoryRead), "Error getting instance history: %s", err)
 	}
 	c.Log.Info("Successfully gathered instance history")
 
-	// Process each module by priority level
+	// Find the modules to rerun, there's nothing to do if everything succeeded last time
+	if rerunFailed {
+		failed, err := c.FailedInLastRun()
+		if err != nil {
+			c.Log.Fatalf(computeExitCode(c, exitHistoryRead), "Unable to find modules to rerun: %s", err)
+		}
+		if len(failed) == 0 {
+			c.Log.Info("Every module succeeded in the last run, nothing to rerun")
+			return
+		}
+		c.Log.Infof("Rerunning %d module(s) which didn't succeed in the last run: %s", len(failed), strings.Join(failed, ", "))
+		runPreNetworkPhase(baseDir, c, startTime, true)
+	}
+
+	// Remove any readiness marker from an earlier run this boot, it's written again once this run succeeds
+	err = c.ClearReady()
+	if err != nil {
+		c.Log.Warnf("Unable to clear readiness marker: %s", err)
+	}
+
+	// Process each post-network module by priority level
+	aggFatalModuleName := runPhase(baseDir, c, false, rerunFailed)
+	aggregateFatal := aggFatalModuleName != ""
+
+	// Write history file
+	c.Log.Infof("Writing instance history for instance %s...", c.IMDS.InstanceID)
+	err = c.WriteHistoryFile()
+	if err != nil {
+		c.Log.Fatalf(computeExitCode(c, exitHistoryWrite), "Error writing instance history file: %s", err)
+	}
+	c.Log.Info("Successfully wrote instance history")
+
+	// Prune history of previous instances, failing to do so shouldn't fail the run. When a fatal error stopped the run
+	// early, later groups weren't evaluated so their RunOnce results haven't been carried forward yet.
+	if !aggregateFatal {
+		removed, err := c.PruneHistory(time.Now())
+		if err != nil {
+			c.Log.Warnf("Unable to prune instance history: %s", err)
+		}
+		if len(removed) > 0 {
+			c.Log.Infof("Pruned instance history for %d previous instance(s): %s", len(removed), strings.Join(removed, ", "))
+		}
+	}
+
+	// Summarize the run and publish metrics, failing to publish metrics shouldn't fail the run
+	summary := c.Summarize(time.Since(startTime), aggFatalModuleName)
+	c.StatusFinished(summary)
+	err = c.PublishMetrics(summary)
+	if err != nil {
+		c.Log.Warnf("Unable to publish metrics: %s", err)
+	}
+	err = c.WriteTextfileMetrics(summary)
+	if err != nil {
+		c.Log.Warnf("Unable to write metrics: %s", err)
+	}
+
+	// Log every module failure together so that they can be found without searching through the whole run
+	c.Log.Milestonef("%s", summary)
+	for _, f := range summary.Failures {
+		c.Log.Errorf("Module failure: %s", f)
+	}
+
+	// If any module triggered an aggregate fatal, exit with the module failure exit code
+	if aggregateFatal {
+		c.Log.Fatalf(computeExitCode(c, exitModuleFatal), "Exiting after %s due to failure in module [%s] with FatalOnError set (%d module failure(s) in total)", time.Since(startTime).String(), aggFatalModuleName, len(summary.Failures))
+	}
+
+	// Tell dependent services that provisioning is complete, only when nothing failed
+	if summary.Result() == "success" {
+		err = c.MarkReady(summary)
+		if err != nil {
+			c.Log.Warnf("Unable to mark instance as ready: %s", err)
+		} else {
+			c.Log.Infof("Marked instance as ready at %s", c.Readiness.ReadyFile())
+		}
+	} else {
+		c.Log.Warn("Not marking instance as ready due to module failures")
+	}
+
+	// Log completion and total run time
+	c.Log.Infof("EC2 macOS Init completed in %s", time.Since(startTime).String())
+}
+
+// runPreNetworkPhase runs the pre-network modules, if there are any, and exits if one of them fails with FatalOnError
+// set.
+func runPreNetworkPhase(baseDir string, c *ec2macosinit.InitConfig, startTime time.Time, rerunFailed bool) {
+	if !c.HasPreNetworkModules() {
+		return
+	}
+	c.Log.Info("Processing pre-network modules...")
+	fatalModule := runPhase(baseDir, c, true, rerunFailed)
+	if fatalModule == "" {
+		return
+	}
+	summary := c.Summarize(time.Since(startTime), fatalModule)
+	c.StatusFinished(summary)
+	err := c.WriteTextfileMetrics(summary)
+	if err != nil {
+		c.Log.Warnf("Unable to write metrics: %s", err)
+	}
+	c.Log.Milestonef("%s", summary)
+	c.Log.Fatalf(computeExitCode(c, exitModuleFatal), "Exiting after %s due to failure in pre-network module [%s] with FatalOnError set", time.Since(startTime).String(), fatalModule)
+}
+
+// runPhase processes each priority level of modules in the pre-network or post-network phase. Each module in a priority
+// level is started in its own goroutine and the level waits for everything in it to finish. If any module fails which
+// has FatalOnError set, later priority levels aren't processed and the name of that module is returned. When
+// rerunFailed is set, modules which succeeded in the most recent run on the instance are skipped.
+func runPhase(baseDir string, c *ec2macosinit.InitConfig, preNetwork bool, rerunFailed bool) (fatalModule string) {
+	level := "priority level"
+	if preNetwork {
+		level = "pre-network priority level"
+	}
 	var aggregateFatal bool
 	var aggFatalModuleName string
 	for i := 0; i < len(c.ModulesByPriority); i++ {
-		c.Log.Infof("Processing priority level %d (%d modules)...\n", i+1, len(c.ModulesByPriority[i]))
+		// Only modules in this phase are processed, levels without any are passed over
+		var modules int
+		for _, m := range c.ModulesByPriority[i] {
+			if m.PreNetwork() == preNetwork {
+				modules++
+			}
+		}
+		if modules == 0 {
+			continue
+		}
+		c.Log.Infof("Processing %s %d (%d modules)...\n", level, i+1, modules)
 		wg := sync.WaitGroup{}
 		// Start every module within the priority level group
 		for j := 0; j < len(c.ModulesByPriority[i]); j++ {
+			if c.ModulesByPriority[i][j].PreNetwork() != preNetwork {
+				continue
+			}
 			wg.Add(1)
 			go func(m *ec2macosinit.Module, h *[]ec2macosinit.History) {
-				// Run module if it should be run
-				if m.ShouldRun(c.IMDS.InstanceID, *h) {
-					c.Log.Infof("Running module [%s] (type: %s, group: %d)\n", m.Name, m.Type, m.PriorityGroup)
-					ctx := &ec2macosinit.ModuleContext{
-
-						Logger:        c.Log,
-						IMDS:          &c.IMDS,
-						BaseDirectory: baseDir,
-					}
+				// Everything logged for the module includes the module in JSON records
+				moduleLog := c.Log.WithModule(m.Name, m.PriorityGroup)
+				// Run module if it should be run, when rerunning only if it didn't succeed last time
+				shouldRun, skipReason := m.ShouldRun(c.IMDS.InstanceID, *h), "due to Run type setting"
+				if shouldRun && rerunFailed && m.SucceededInLastRun(c.IMDS.InstanceID, *h) {
+					shouldRun, skipReason = false, "since it succeeded in the last run"
+				}
+				if shouldRun {
+					moduleLog.Infof("Running module [%s] (type: %s, group: %d)\n", m.Name, m.Type, m.PriorityGroup)
+					ctx := c.NewModuleContext(moduleLog, baseDir)
 					// Run appropriate module
-					var message string
-					var err error
-					switch t := m.Type; t {
-					case "command":
-						message, err = m.CommandModule.Do(ctx)
-					case "motd":
-						message, err = m.MOTDModule.Do(ctx)
-					case "sshkeys":
-						message, err = m.SSHKeysModule.Do(ctx)
-					case "userdata":
-						message, err = m.UserDataModule.Do(ctx)
-					case "networkcheck":
-						message, err = m.NetworkCheckModule.Do(ctx)
-					case "systemconfig":
-						message, err = m.SystemConfigModule.Do(ctx)
-					case "usermanagement":
-						message, err = m.UserManagementModule.Do(ctx)
-					default:
-						message = "unknown module type"
-						err = fmt.Errorf("unknown module type")
-					}
+					m.StartTime = time.Now()
+					c.ModuleStarted(m.Name)
+					message, err := runModule(ctx, m)
+					c.ModuleFinished(m.Name)
+					m.EndTime = time.Now()
+					// Module results are kept in history, so mask sensitive values there as well as in logs
+					m.Message = c.Log.Redact(message)
 					if err != nil {
-						c.Log.Infof("Error while running module [%s] (type: %s, group: %d) with message: %s and err: %s\n", m.Name, m.Type, m.PriorityGroup, message, err)
+						m.Error = c.Log.Redact(err.Error())
+						moduleLog.Infof("Error while running module [%s] (type: %s, group: %d) with message: %s and err: %s\n", m.Name, m.Type, m.PriorityGroup, message, err)
 						if m.FatalOnError {
 							aggregateFatal = true
 							aggFatalModuleName = m.Name
 						}
+						if m.ContinueOnError {
+							moduleLog.Warnf("Continuing after failure in module [%s] with ContinueOnError set, the run is not marked as failed", m.Name)
+						}
 					} else {
 						// Module was successfully completed
 						m.Success = true
-						c.Log.Infof("Successfully completed module [%s] (type: %s, group: %d) with message: %s\n", m.Name, m.Type, m.PriorityGroup, message)
+						moduleLog.Infof("Successfully completed module [%s] (type: %s, group: %d) with message: %s\n", m.Name, m.Type, m.PriorityGroup, message)
 					}
 				} else {
 					// In the case that we choose not to run a module, it is because the module has already succeeded
 					// in a prior run. For this reason, we need to pass through the success of the module to history.
 					m.Success = true
-					c.Log.Infof("Skipping module [%s] (type: %s, group: %d) due to Run type setting\n", m.Name, m.Type, m.PriorityGroup)
+					m.Skipped = true
+					moduleLog.Infof("Skipping module [%s] (type: %s, group: %d) %s\n", m.Name, m.Type, m.PriorityGroup, skipReason)
 				}
 				wg.Done()
 			}(&c.ModulesByPriority[i][j], &c.InstanceHistory)
 		}
 		wg.Wait()
-		c.Log.Infof("Successfully completed processing of priority level %d\n", i+1)
+		var failed int
+		for _, m := range c.ModulesByPriority[i] {
+			if m.PreNetwork() == preNetwork && !m.Success {
+				failed++
+			}
+		}
+		c.Log.Milestonef("Completed processing of %s %d of %d (%d modules, %d failed)", level, i+1, len(c.ModulesByPriority), modules, failed)
+		// Record the modules completed so far, so that a crash or power loss before the end of the run doesn't lose them.
+		// The instance ID isn't known in the pre-network phase, so those results are first written with the later groups.
+		if !preNetwork {
+			err := c.WriteHistoryFile()
+			if err != nil {
+				c.Log.Warnf("Unable to write instance history after %s %d: %s", level, i+1, err)
+			}
+		}
 		// If any module failed which had FatalOnError set, trigger an aggregate fail
 		if aggregateFatal {
 			break
 		}
 	}
 
-	// Write history file
-	c.Log.Infof("Writing instance history for instance %s...", c.IMDS.InstanceID)
-	err = c.WriteHistoryFile()
-	if err != nil {
-		c.Log.Fatalf(computeExitCode(c, 73), "Error writing instance history file: %s", err)
-	}
-	c.Log.Info("Successfully wrote instance history")
+	return aggFatalModuleName
+}
 
-	// If any module triggered an aggregate fatal, exit 1
-	if aggregateFatal {
-		c.Log.Fatalf(computeExitCode(c, 1), "Exiting after %s due to failure in module [%s] with FatalOnError set", time.Since(startTime).String(), aggFatalModuleName)
+// runModule runs the Do function for the module's type.
+func runModule(ctx *ec2macosinit.ModuleContext, m *ec2macosinit.Module) (message string, err error) {
+	switch t := m.Type; t {
+	case "command":
+		message, err = m.CommandModule.Do(ctx)
+	case "motd":
+		message, err = m.MOTDModule.Do(ctx)
+	case "sshkeys":
+		message, err = m.SSHKeysModule.Do(ctx)
+	case "userdata":
+		message, err = m.UserDataModule.Do(ctx)
+	case "networkcheck":
+		message, err = m.NetworkCheckModule.Do(ctx)
+	case "systemconfig":
+		message, err = m.SystemConfigModule.Do(ctx)
+	case "usermanagement":
+		message, err = m.UserManagementModule.Do(ctx)
+	case "writefiles":
+		message, err = m.WriteFilesModule.Do(ctx)
+	case "lineinfile":
+		message, err = m.LineInFileModule.Do(ctx)
+	case "systemsetup":
+		message, err = m.SystemSetupModule.Do(ctx)
+	case "serviceaccount":
+		message, err = m.ServiceAccountModule.Do(ctx)
+	case "accountlock":
+		message, err = m.AccountLockModule.Do(ctx)
+	case "securetoken":
+		message, err = m.SecureTokenModule.Do(ctx)
+	case "script":
+		message, err = m.ScriptModule.Do(ctx)
+	case "nvram":
+		message, err = m.NVRAMModule.Do(ctx)
+	case "limits":
+		message, err = m.LimitsModule.Do(ctx)
+	case "loginhardening":
+		message, err = m.LoginHardeningModule.Do(ctx)
+	case "setupassistant":
+		message, err = m.SetupAssistantModule.Do(ctx)
+	case "scheduledjobs":
+		message, err = m.ScheduledJobsModule.Do(ctx)
+	case "developermode":
+		message, err = m.DeveloperModeModule.Do(ctx)
+	case "headlessdisplay":
+		message, err = m.HeadlessDisplayModule.Do(ctx)
+	case "snapshot":
+		message, err = m.SnapshotModule.Do(ctx)
+	case "instancefamily":
+		message, err = m.InstanceFamilyModule.Do(ctx)
+	case "s3download":
+		message, err = m.S3DownloadModule.Do(ctx)
+	case "gitclone":
+		message, err = m.GitCloneModule.Do(ctx)
+	case "archive":
+		message, err = m.ArchiveModule.Do(ctx)
+	default:
+		message = "unknown module type"
+		err = fmt.Errorf("unknown module type")
 	}
-
-	// Log completion and total run time
-	c.Log.Infof("EC2 macOS Init completed in %s", time.Since(startTime).String())
+	return message, err
 }
 
 // computeExitCode checks to see if the number of fatal retries has been exceeded. If not, it increments the counter,
-// stored in a temporary file, and returns the requested exit code. If the count is exceeded, it returns 0 to avoid
-// launchd restarting forever due to the KeepAlive setting.
+// stored under the base directory along with the boot time, and returns the requested exit code. If the count is
+// exceeded, it returns 0 to avoid launchd restarting forever due to the KeepAlive setting.
 func computeExitCode(c *ec2macosinit.InitConfig, e int) (exitCode int) {
 	// Check if other runs have happened this boot and return data about them
 	exceeded, err := c.RetriesExceeded()
 	if err != nil {
 		c.Log.Errorf("Error while getting retry information: %s", err)
-		return 1
+		return exitInternal
 	}
 
 	// If the count has exceed the limit, return 0
@@ -187,7 +443,7 @@ func computeExitCode(c *ec2macosinit.InitConfig, e int) (exitCode int) {
 	}
 
 	c.Log.Infof("Fatal [%d/%d] of this boot", c.FatalCounts.Count, ec2macosinit.PerBootFatalLimit)
-	// Increment the counter in the temporary file before returning
+	// Increment the counter in the file before returning
 	err = c.FatalCounts.IncrementFatalCount()
 	if err != nil {
 		c.Log.Errorf("Unable to write fatal counts to file: %s", err)
@@ -1,44 +1,44 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
 )
 
 const (
-	attemptInterval  = 1    // every 1s
-	logInterval      = 10.0 // every 10s
-	setupMaxAttempts = 600  // fail after 10m
+	setupInitialDelay = 250 * time.Millisecond // first retry after 250ms
+	setupMaxDelay     = 5 * time.Second        // back off to every 5s
+	setupMaxWait      = 10 * time.Minute       // fail after 10m
+	logInterval       = 10 * time.Second       // log at most every 10s
 )
 
-// SetupInstanceID is used to setup the instance ID (and IMDSv2 token) the first time.  It retries at a fixed interval
-// up to the maximum number of attempts.  This is expected to fail many times on first boot when this runs before
-// networking is fully up.
-func SetupInstanceID(c *ec2macosinit.InitConfig) (err error) {
-	var attempt int
-	// While instance ID is empty
-	for c.IMDS.InstanceID == "" {
-		// Attempt to get the instance ID
-		err = c.IMDS.UpdateInstanceID()
-		if err != nil {
-			// Fail out if attempts exceeds maximum
-			if attempt > setupMaxAttempts {
-				return fmt.Errorf("error getting instance ID from IMDS: %s\n", err)
-			}
+// SetupInstanceID is used to setup the instance ID (and IMDSv2 token) the first time.  It retries with a backoff, from
+// a short delay so that it finishes soon after the network comes up, for up to the maximum wait or until the context
+// is canceled.  This is expected to fail many times on first boot when this runs before networking is fully up.
+func SetupInstanceID(ctx context.Context, c *ec2macosinit.InitConfig) (err error) {
+	if c.IMDS.InstanceID != "" {
+		return nil
+	}
 
+	var lastLog time.Time
+	err = ec2macosinit.Retry(ctx, ec2macosinit.Backoff{
+		Initial:    setupInitialDelay,
+		Max:        setupMaxDelay,
+		Jitter:     0.2,
+		MaxElapsed: setupMaxWait,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
 			// Log according to the log interval
-			if math.Mod(float64(attempt), logInterval) == 0.0 {
-				c.Log.Warnf("Unable to get instance ID - IMDS may not be available yet...retrying every %ds [%d/%d]", attemptInterval, attempt, setupMaxAttempts)
+			if time.Since(lastLog) >= logInterval {
+				c.Log.Warnf("Unable to get instance ID - IMDS may not be available yet...retrying in %s [attempt %d]", delay.Round(time.Millisecond), attempt)
+				lastLog = time.Now()
 			}
-
-			attempt++ // increment attempts
-
-			// Sleep for attempt interval
-			time.Sleep(attemptInterval * time.Second)
-		}
+		},
+	}, c.IMDS.UpdateInstanceID)
+	if err != nil {
+		return fmt.Errorf("error getting instance ID from IMDS: %s\n", err)
 	}
 
 	return nil
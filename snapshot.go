@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// pathList collects a flag which can be given more than once.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// snapshot manages the snapshots created by Snapshot modules. It has two subcommands:
+// list - List the recorded snapshots and whether they still exist.
+// revert <name> - Restore selected paths, by default the SSH and sudo configuration, from the named snapshot. The
+// rest of the volume isn't rolled back.
+func snapshot(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	snapshotFlags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	snapshotFlags.Usage = func() {
+		fmt.Fprintln(snapshotFlags.Output(), "Usage: ec2-macos-init snapshot list / snapshot revert [-path <path>]... <name>")
+		snapshotFlags.PrintDefaults()
+	}
+	var restorePaths pathList
+	snapshotFlags.Var(&restorePaths, "path", "Optional; A path to restore when reverting, can be given more than once. Default is "+strings.Join(ec2macosinit.DefaultRevertPaths, ", ")+".")
+
+	// Parse flags, which may come after the subcommand
+	args := os.Args[2:]
+	if len(args) == 0 {
+		snapshotFlags.Usage()
+		os.Exit(exitUsage)
+	}
+	subcommand := args[0]
+	err := snapshotFlags.Parse(args[1:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+
+	switch {
+	case subcommand == "list" && snapshotFlags.NArg() == 0:
+		records, exists, err := ec2macosinit.Snapshots(baseDir)
+		if err != nil {
+			c.Log.Fatalf(exitInternal, "Unable to list snapshots: %s", err)
+		}
+		if len(records) == 0 {
+			fmt.Println("No snapshots have been created")
+		}
+		for _, r := range records {
+			state := "available"
+			if !exists[r.Snapshot] {
+				state = "removed by macOS"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", r.Name, r.Snapshot, r.Created.Format("2006-01-02T15:04:05Z07:00"), state)
+		}
+	case subcommand == "revert" && snapshotFlags.NArg() == 1:
+		name := snapshotFlags.Arg(0)
+		c.Log.Infof("Reverting to snapshot %s", name)
+		restored, err := ec2macosinit.RevertSnapshot(baseDir, name, restorePaths)
+		for _, path := range restored {
+			c.Log.Infof("Restored %s", path)
+		}
+		if err != nil {
+			c.Log.Fatalf(exitInternal, "Unable to revert to snapshot %s: %s", name, err)
+		}
+		c.Log.Info("Revert complete, restart any affected services (such as sshd) to apply the restored configuration")
+	default:
+		snapshotFlags.Usage()
+		os.Exit(exitUsage)
+	}
+}
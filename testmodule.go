@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// testModule runs a single module from a TOML file straight away, for trying out a module before adding it to
+// init.toml. The module runs regardless of its Run type, and instance history is neither read nor written. IMDS
+// settings are taken from init.toml when it can be read.
+func testModule(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	testFlags := flag.NewFlagSet("test-module", flag.ExitOnError)
+	testFlags.Usage = func() {
+		fmt.Fprintln(testFlags.Output(), "Usage: ec2-macos-init test-module <module file>")
+		testFlags.PrintDefaults()
+	}
+	logFormat := testFlags.String("log-format", "text", "Optional; Format of log output to stdout, either text or json.")
+	imdsMock := testFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
+
+	// Parse flags
+	err := testFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	if testFlags.NArg() != 1 {
+		testFlags.Usage()
+		os.Exit(2)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		c.Log.JSON = true
+	default:
+		c.Log.Fatalf(exitUsage, "Unknown log format %q, must be text or json", *logFormat)
+	}
+	c.Log.Fields.RunID = ec2macosinit.NewRunID()
+
+	m, err := ec2macosinit.ReadModuleFile(testFlags.Arg(0))
+	if err != nil {
+		c.Log.Fatalf(exitConfigInvalid, "Invalid module: %s", err)
+	}
+
+	// Use the same IMDS as a run would, the modules in init.toml aren't used
+	err = c.ReadConfig(filepath.Join(baseDir, paths.InitTOML))
+	if err != nil {
+		c.Log.Warnf("Using the default IMDS settings, unable to read init config: %s", err)
+		c.IMDS = ec2macosinit.IMDSConfig{}
+	}
+	c.IMDS.MockPath = *imdsMock
+
+	// Modules after the pre-network phase may use instance metadata and write to the instance history directory
+	if !m.PreNetwork() {
+		err = SetupInstanceID(context.Background(), c)
+		if err != nil {
+			c.Log.Fatalf(exitIMDSUnavailable, "Unable to get instance ID: %s", err)
+		}
+		c.Log.Fields.InstanceID = c.IMDS.InstanceID
+		err = c.CreateDirectories()
+		if err != nil {
+			c.Log.Fatalf(exitHistoryWrite, "Error creating instance history directories: %s", err)
+		}
+	}
+
+	moduleLog := c.Log.WithModule(m.Name, m.PriorityGroup)
+	moduleLog.Infof("Running module [%s] (type: %s)", m.Name, m.Type)
+	c.StartUserIDCache()
+	ctx := c.NewModuleContext(moduleLog, baseDir)
+	startTime := time.Now()
+	message, err := runModule(ctx, &m)
+	if err != nil {
+		moduleLog.Errorf("Error while running module [%s] (type: %s) after %s with message: %s and err: %s", m.Name, m.Type, time.Since(startTime), message, err)
+		os.Exit(exitCommandFailed)
+	}
+	moduleLog.Infof("Successfully completed module [%s] (type: %s) in %s with message: %s", m.Name, m.Type, time.Since(startTime), message)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/ec2-macos-init/internal/paths"
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
+
+// update replaces the installed binary with the latest build from the configured update source, when it's newer than
+// the running version. The run lock is held while the binary is replaced so that it isn't swapped during a run. Once
+// replaced, the daemon job is restarted if it's loaded so that it runs the new build, while the boot job picks it up on
+// the next boot.
+func update(baseDir string, c *ec2macosinit.InitConfig) {
+	// Define flags
+	updateFlags := flag.NewFlagSet("update", flag.ExitOnError)
+	check := updateFlags.Bool("check", false, "Optional; Only check for a newer build, without installing it.")
+	force := updateFlags.Bool("force", false, "Optional; Install the latest build even if it isn't newer than the running version.")
+	imdsMock := updateFlags.String("imds-mock", "", "Optional; Serve IMDS from a directory or JSON file, for testing on Macs which aren't EC2 instances.")
+
+	// Parse flags
+	err := updateFlags.Parse(os.Args[2:])
+	if err != nil {
+		c.Log.Fatalf(exitUsage, "Unable to parse arguments: %s", err)
+	}
+	c.IMDS.MockPath = *imdsMock
+
+	err = c.ReadConfig(filepath.Join(baseDir, paths.InitTOML))
+	if err != nil {
+		c.Log.Fatalf(exitConfigUnreadable, "Error while reading init config file: %s", err)
+	}
+
+	c.Log.Infof("Checking %s for updates...", c.Update.Source)
+	release, err := c.LatestRelease()
+	if err != nil {
+		c.Log.Fatalf(exitCommandFailed, "Unable to check for updates: %s", err)
+	}
+	if !ec2macosinit.NewerVersion(Version, release.Version) && !*force {
+		c.Log.Infof("Version %s is up to date, the latest version is %s", Version, release.Version)
+		return
+	}
+	c.Log.Infof("Version %s is available, running version %s", release.Version, Version)
+	if *check {
+		return
+	}
+
+	// Replace the binary itself rather than a symlink to it
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		c.Log.Fatalf(exitInternal, "Unable to find the installed binary: %s", err)
+	}
+
+	lock, err := ec2macosinit.AcquireRunLock(filepath.Join(baseDir, paths.RunLock), defaultLockTimeout, func(holder string) {
+		c.Log.Warnf("Another run of ec2-macos-init (PID %s) is in progress, waiting up to %s for it to finish...", holder, defaultLockTimeout)
+	})
+	if err != nil {
+		c.Log.Fatalf(exitLocked, "Unable to update: %s", err)
+	}
+	defer lock.Release()
+
+	c.Log.Infof("Installing version %s from %s to %s...", release.Version, release.URL, exe)
+	err = c.InstallRelease(release, exe)
+	if err != nil {
+		c.Log.Fatalf(exitCommandFailed, "Unable to install update: %s", err)
+	}
+	c.Log.Infof("Installed version %s, the previous binary was kept as %s.previous", release.Version, exe)
+
+	if ec2macosinit.LaunchdJobLoaded(ec2macosinit.DaemonJobLabel) {
+		err = ec2macosinit.RestartLaunchdJob(ec2macosinit.DaemonJobLabel)
+		if err != nil {
+			c.Log.Fatalf(exitInternal, "Unable to restart the daemon with the new version: %s", err)
+		}
+		c.Log.Infof("Restarted %s", ec2macosinit.DaemonJobLabel)
+	}
+}
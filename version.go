@@ -1,22 +1,78 @@
 package main
 
-import "fmt"
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/aws/ec2-macos-init/lib/ec2macosinit"
+)
 
 var (
 	// CommitDate is the date of the commit used at build time.
 	CommitDate string
+	// CommitSHA is the hash of the commit used at build time.
+	CommitSHA string
 	// Version is the ec2-macos-init release version for this build.
 	Version string = "0.0.0-dev"
 )
 
-// printVersion prints the output for the version command.
+// versionInfo is the build metadata printed by the version command.
+type versionInfo struct {
+	Version             string `json:"version"`
+	CommitSHA           string `json:"commitSHA"`
+	CommitDate          string `json:"commitDate"`
+	GoVersion           string `json:"goVersion"`
+	Platform            string `json:"platform"`
+	ConfigSchemaVersion int    `json:"configSchemaVersion"`
+}
+
+// buildInfo returns the build metadata of the running binary. When the commit wasn't set at build time, it's taken
+// from the version control information embedded by the Go toolchain, if any.
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:             Version,
+		CommitSHA:           CommitSHA,
+		CommitDate:          CommitDate,
+		GoVersion:           runtime.Version(),
+		Platform:            runtime.GOOS + "/" + runtime.GOARCH,
+		ConfigSchemaVersion: ec2macosinit.ConfigSchemaVersion,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.CommitSHA == "" {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.CommitSHA = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// printVersion prints the output for the version command, as JSON when -json is given.
 func printVersion() {
+	versionFlags := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := versionFlags.Bool("json", false, "Optional; Print the version information as JSON.")
+	_ = versionFlags.Parse(os.Args[2:])
+
+	info := buildInfo()
+	if *asJSON {
+		out, _ := json.MarshalIndent(info, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
 	const gitHubLink = "https://github.com/aws/ec2-macos-init"
 
 	fmt.Printf("\nEC2 macOS Init\n"+
 		"Version: %s [%s]\n"+
+		"Commit: %s\n"+
+		"Built with %s for %s\n"+
+		"Config schema version: %d\n"+
 		"%s\n"+
 		"Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.\n\n",
-		Version, CommitDate, gitHubLink,
+		info.Version, info.CommitDate, info.CommitSHA, info.GoVersion, info.Platform, info.ConfigSchemaVersion, gitHubLink,
 	)
 }